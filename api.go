@@ -0,0 +1,627 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// JSON API for scripts and integrations, authenticated with personal API
+// tokens (see apitokens.go) instead of the session cookie. Links and tags
+// use the same JSON shapes as the Link and Tag structs. Errors always come
+// back as {"error": "..."} with a matching status code.
+
+// Page sizes for list endpoints
+const (
+	apiDefaultPerPage = 20
+	apiMaxPerPage     = 100
+)
+
+// Body of POST, PUT and PATCH on links. Fields are pointers so PATCH can
+// tell a missing field from an empty one.
+type apiLinkRequest struct {
+	URL         *string   `json:"url"`
+	Title       *string   `json:"title"`
+	Description *string   `json:"description"`
+	Tags        *[]string `json:"tags"`
+	Visibility  *string   `json:"visibility"`
+	WorkspaceID *int      `json:"workspace_id"` // only when creating
+}
+
+// Body of PATCH on a tag
+type apiTagRequest struct {
+	Name string `json:"name"`
+}
+
+// Body of POST on /tags/merge
+type apiTagMergeRequest struct {
+	TagIDs []int `json:"tag_ids"`
+	Into   int   `json:"into"`
+}
+
+// Responses. openapi.go builds the API spec from these same types, so
+// change them there too when adding fields here.
+type apiLinkList struct {
+	Links      []Link  `json:"links"`
+	Pagination apiPage `json:"pagination"`
+}
+
+type apiTagList struct {
+	Tags []Tag `json:"tags"`
+}
+
+type apiCleanupResponse struct {
+	Deleted int `json:"deleted"` // how many unused tags were deleted
+}
+
+type apiMeResponse struct {
+	ID       int          `json:"id"`
+	Username string       `json:"username"`
+	Email    string       `json:"email"`
+	Token    apiTokenInfo `json:"token"`
+}
+
+type apiTokenInfo struct {
+	Name      string     `json:"name"`
+	Scope     string     `json:"scope"`
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+type apiErrorBody struct {
+	Error string `json:"error"`
+}
+
+// A page of results from a list endpoint
+type apiPage struct {
+	Page       int `json:"page"`
+	PerPage    int `json:"per_page"`
+	Total      int `json:"total"`
+	TotalPages int `json:"total_pages"`
+}
+
+// Read ?page= and ?per_page=, returns false (after sending the error) if
+// they don't make sense
+func apiPagination(c *gin.Context) (page, perPage int, ok bool) {
+	page, perPage = 1, apiDefaultPerPage
+	var err error
+	if value := c.Query("page"); value != "" {
+		if page, err = strconv.Atoi(value); err != nil || page < 1 {
+			apiError(c, http.StatusBadRequest, "page must be a positive number")
+			return 0, 0, false
+		}
+	}
+	if value := c.Query("per_page"); value != "" {
+		if perPage, err = strconv.Atoi(value); err != nil || perPage < 1 || perPage > apiMaxPerPage {
+			apiError(c, http.StatusBadRequest, "per_page must be between 1 and "+strconv.Itoa(apiMaxPerPage))
+			return 0, 0, false
+		}
+	}
+	return page, perPage, true
+}
+
+// Send one page of links
+func apiLinkPage(c *gin.Context, links []Link, page, perPage int) {
+	total := len(links)
+	start := (page - 1) * perPage
+	if start > total {
+		start = total
+	}
+	end := start + perPage
+	if end > total {
+		end = total
+	}
+
+	c.JSON(http.StatusOK, apiLinkList{
+		Links: apiLinks(links[start:end]),
+		Pagination: apiPage{
+			Page:       page,
+			PerPage:    perPage,
+			Total:      total,
+			TotalPages: (total + perPage - 1) / perPage,
+		},
+	})
+}
+
+// Empty lists come back as [] instead of null
+func apiLinks(links []Link) []Link {
+	result := make([]Link, 0, len(links))
+	for _, link := range links {
+		result = append(result, apiLink(link))
+	}
+	return result
+}
+
+func apiLink(link Link) Link {
+	if link.Tags == nil {
+		link.Tags = []string{}
+	}
+	return link
+}
+
+// Load the link named in the URL and check the token's owner has at least
+// the given access to it (see policy.go), returns false (after sending the
+// error) if they don't
+func (app *App) apiAccessibleLink(c *gin.Context, need accessLevel) (Link, bool) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		apiError(c, http.StatusBadRequest, "invalid link ID")
+		return Link{}, false
+	}
+
+	link, err := app.store.GetLinkByID(id)
+	if errors.Is(err, ErrLinkNotFound) {
+		apiError(c, http.StatusNotFound, "link not found")
+		return Link{}, false
+	} else if err != nil {
+		apiError(c, http.StatusInternalServerError, "could not load link")
+		return Link{}, false
+	}
+
+	access, err := app.linkAccess(link, c.GetInt("user_id"))
+	if err != nil {
+		apiError(c, http.StatusInternalServerError, "could not load link")
+		return Link{}, false
+	}
+	if access < need {
+		apiError(c, http.StatusForbidden, "you don't have permission to access this link")
+		return Link{}, false
+	}
+	return link, true
+}
+
+// Who the token belongs to
+func (app *App) apiMe(c *gin.Context) {
+	token := c.MustGet(apiTokenContextKey).(APIToken)
+	user, err := app.store.GetUserByID(token.UserID)
+	if err != nil {
+		apiError(c, http.StatusInternalServerError, "could not load user")
+		return
+	}
+
+	c.JSON(http.StatusOK, apiMeResponse{
+		ID:       user.ID,
+		Username: user.Username,
+		Email:    user.Email,
+		Token: apiTokenInfo{
+			Name:      token.Name,
+			Scope:     token.Scope,
+			ExpiresAt: token.ExpiresAt,
+		},
+	})
+}
+
+// List the user's links, newest first. ?tag= only lists the links with
+// that tag or a tag below it.
+func (app *App) apiListLinks(c *gin.Context) {
+	page, perPage, ok := apiPagination(c)
+	if !ok {
+		return
+	}
+
+	links, err := app.store.GetUserLinks(c.GetInt("user_id"))
+	if err != nil {
+		apiError(c, http.StatusInternalServerError, "could not load links")
+		return
+	}
+	if tag := cleanTagName(c.Query("tag")); tag != "" {
+		links = filterTagged(links, tag)
+	}
+	apiLinkPage(c, links, page, perPage)
+}
+
+// Add a link
+func (app *App) apiCreateLink(c *gin.Context) {
+	var req apiLinkRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		apiError(c, http.StatusBadRequest, "request body must be JSON")
+		return
+	}
+
+	link := Link{UserID: c.GetInt("user_id")}
+	var tags []string
+	applyLinkRequest(&link, &tags, req)
+	if link.URL == "" {
+		apiError(c, http.StatusUnprocessableEntity, "url is required")
+		return
+	}
+	if req.WorkspaceID != nil {
+		link.WorkspaceID = *req.WorkspaceID
+		if ok, err := app.canAddLinks(link.WorkspaceID, link.UserID); err != nil || !ok {
+			apiError(c, http.StatusForbidden, "you can't add links to that workspace")
+			return
+		}
+	}
+	if req.Visibility != nil && !validVisibility(link.Visibility) {
+		apiError(c, http.StatusUnprocessableEntity, "visibility must be private, unlisted or public")
+		return
+	}
+	normalized, err := NormalizeURL(link.URL)
+	if err != nil {
+		apiError(c, http.StatusUnprocessableEntity, "url must be an http or https address")
+		return
+	}
+	link.URL = normalized
+	app.fillLinkMetadata(c.Request.Context(), &link)
+	if link.Title == "" {
+		apiError(c, http.StatusUnprocessableEntity, "title is required, the page doesn't have one")
+		return
+	}
+
+	if err := app.store.CreateLink(&link); err != nil {
+		apiError(c, http.StatusInternalServerError, "could not save link")
+		return
+	}
+	tags, err = app.addAutoTags(link, tags)
+	if err == nil {
+		err = app.store.SetLinkTags(link.ID, tags)
+	}
+	if err != nil {
+		apiError(c, http.StatusInternalServerError, "could not save tags")
+		return
+	}
+	app.archiveInBackground(link)
+
+	created, err := app.store.GetLinkByID(link.ID)
+	if err != nil {
+		apiError(c, http.StatusInternalServerError, "could not load link")
+		return
+	}
+	c.Header("Location", "/api/v1/links/"+strconv.Itoa(created.ID))
+	c.JSON(http.StatusCreated, apiLink(created))
+}
+
+// Get a single link
+func (app *App) apiGetLink(c *gin.Context) {
+	link, ok := app.apiAccessibleLink(c, accessRead)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, apiLink(link))
+}
+
+// Change a link. PUT needs url and title, PATCH only changes the fields
+// that are sent. Tags are only touched when "tags" is in the body. Editors
+// can change everything but the visibility, like on the edit page.
+func (app *App) apiUpdateLink(c *gin.Context) {
+	link, ok := app.apiAccessibleLink(c, accessEdit)
+	if !ok {
+		return
+	}
+
+	var req apiLinkRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		apiError(c, http.StatusBadRequest, "request body must be JSON")
+		return
+	}
+	if c.Request.Method == http.MethodPut && (req.URL == nil || req.Title == nil) {
+		apiError(c, http.StatusUnprocessableEntity, "url and title are required")
+		return
+	}
+	if req.WorkspaceID != nil && *req.WorkspaceID != link.WorkspaceID {
+		apiError(c, http.StatusUnprocessableEntity, "links can't move to another workspace")
+		return
+	}
+	// Only whoever manages the link decides who can see it
+	if req.Visibility != nil && *req.Visibility != link.Visibility {
+		access, err := app.linkAccess(link, c.GetInt("user_id"))
+		if err != nil {
+			apiError(c, http.StatusInternalServerError, "could not load link")
+			return
+		}
+		if access < accessManage {
+			apiError(c, http.StatusForbidden, "you don't have permission to change who can see this link")
+			return
+		}
+	}
+
+	oldURL := link.URL
+	tags := link.Tags
+	applyLinkRequest(&link, &tags, req)
+	if link.URL == "" || link.Title == "" {
+		apiError(c, http.StatusUnprocessableEntity, "url and title can't be empty")
+		return
+	}
+	if req.Visibility != nil && !validVisibility(link.Visibility) {
+		apiError(c, http.StatusUnprocessableEntity, "visibility must be private, unlisted or public")
+		return
+	}
+	if link.URL != oldURL {
+		normalized, err := NormalizeURL(link.URL)
+		if err != nil {
+			apiError(c, http.StatusUnprocessableEntity, "url must be an http or https address")
+			return
+		}
+		link.URL = normalized
+		app.refreshFavicon(c.Request.Context(), &link)
+		link.ReplacedByArchiveID = 0
+	}
+
+	if err := app.store.UpdateLink(&link); err != nil {
+		apiError(c, http.StatusInternalServerError, "could not update link")
+		return
+	}
+	if link.URL != oldURL {
+		app.resetLinkHealth(link)
+	}
+	withRules, err := app.addAutoTags(link, tags)
+	if err != nil {
+		apiError(c, http.StatusInternalServerError, "could not save tags")
+		return
+	}
+	if req.Tags != nil || len(withRules) > len(tags) {
+		if err := app.store.SetLinkTags(link.ID, withRules); err != nil {
+			apiError(c, http.StatusInternalServerError, "could not save tags")
+			return
+		}
+	}
+
+	updated, err := app.store.GetLinkByID(link.ID)
+	if err != nil {
+		apiError(c, http.StatusInternalServerError, "could not load link")
+		return
+	}
+	c.JSON(http.StatusOK, apiLink(updated))
+}
+
+// Copy the fields that were sent into the link
+func applyLinkRequest(link *Link, tags *[]string, req apiLinkRequest) {
+	if req.URL != nil {
+		link.URL = strings.TrimSpace(*req.URL)
+	}
+	if req.Title != nil {
+		link.Title = strings.TrimSpace(*req.Title)
+	}
+	if req.Description != nil {
+		link.Description = *req.Description
+	}
+	if req.Tags != nil {
+		*tags = parseTags(strings.Join(*req.Tags, ","))
+	}
+	if req.Visibility != nil {
+		link.Visibility = *req.Visibility
+	}
+}
+
+// Delete a link
+func (app *App) apiDeleteLink(c *gin.Context) {
+	link, ok := app.apiAccessibleLink(c, accessManage)
+	if !ok {
+		return
+	}
+	if err := app.store.DeleteLink(link.ID); err != nil {
+		apiError(c, http.StatusInternalServerError, "could not delete link")
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// List the user's personal tags with how many links have them
+func (app *App) apiListTags(c *gin.Context) {
+	tags, err := app.store.GetUserTags(c.GetInt("user_id"))
+	if err != nil {
+		apiError(c, http.StatusInternalServerError, "could not load tags")
+		return
+	}
+	if tags == nil {
+		tags = []Tag{}
+	}
+	c.JSON(http.StatusOK, apiTagList{Tags: tags})
+}
+
+// Suggest tags for a link, like the tags field of the add and edit forms
+// does (see suggestions.go)
+func (app *App) apiTagSuggestions(c *gin.Context) {
+	userID := c.GetInt("user_id")
+	workspaceID, _ := strconv.Atoi(c.Query("workspace_id"))
+	linkID, _ := strconv.Atoi(c.Query("link_id"))
+	ownerID, libraryID, problem, err := app.suggestionLibrary(userID, workspaceID, linkID)
+	if err != nil {
+		apiError(c, http.StatusInternalServerError, "could not load tags")
+		return
+	} else if problem != "" {
+		apiError(c, http.StatusForbidden, problem)
+		return
+	}
+
+	suggestions, err := app.suggestTags(ownerID, libraryID, c.Query("q"), strings.TrimSpace(c.Query("url")), linkID)
+	if err != nil {
+		apiError(c, http.StatusInternalServerError, "could not load tags")
+		return
+	}
+	c.JSON(http.StatusOK, suggestions)
+}
+
+// Load the tag named in the URL, or the one with the given ID, and check
+// the token's owner may change it. Returns false (after sending the error)
+// if they can't.
+func (app *App) apiManagedTag(c *gin.Context, id int) (Tag, bool) {
+	tag, err := app.store.GetTag(id)
+	if errors.Is(err, ErrTagNotFound) {
+		apiError(c, http.StatusNotFound, "tag not found")
+		return Tag{}, false
+	} else if err != nil {
+		apiError(c, http.StatusInternalServerError, "could not load tag")
+		return Tag{}, false
+	}
+
+	access, err := app.tagAccess(tag, c.GetInt("user_id"))
+	if err != nil {
+		apiError(c, http.StatusInternalServerError, "could not load tag")
+		return Tag{}, false
+	}
+	if access < accessRead {
+		apiError(c, http.StatusNotFound, "tag not found")
+		return Tag{}, false
+	}
+	if access < accessManage {
+		apiError(c, http.StatusForbidden, "you don't have permission to change this tag")
+		return Tag{}, false
+	}
+	return tag, true
+}
+
+// Read the tag ID from the URL
+func apiTagID(c *gin.Context) (int, bool) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		apiError(c, http.StatusBadRequest, "invalid tag ID")
+		return 0, false
+	}
+	return id, true
+}
+
+// Send a tag again after changing it, with its new name and link count
+func (app *App) apiSendTag(c *gin.Context, id int) {
+	tag, err := app.store.GetTag(id)
+	if err != nil {
+		apiError(c, http.StatusInternalServerError, "could not load tag")
+		return
+	}
+	c.JSON(http.StatusOK, tag)
+}
+
+// Rename a tag. Unlike merging, renaming to the name of another tag is an
+// error.
+func (app *App) apiRenameTag(c *gin.Context) {
+	id, ok := apiTagID(c)
+	if !ok {
+		return
+	}
+	tag, ok := app.apiManagedTag(c, id)
+	if !ok {
+		return
+	}
+	var req apiTagRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		apiError(c, http.StatusBadRequest, "request body must be JSON")
+		return
+	}
+
+	problem, err := app.renameTagTo(tag, req.Name, false)
+	if err != nil {
+		apiError(c, http.StatusInternalServerError, "could not rename tag")
+		return
+	}
+	if problem != "" {
+		apiError(c, http.StatusUnprocessableEntity, problem)
+		return
+	}
+	app.apiSendTag(c, tag.ID)
+}
+
+// Merge tags into another tag of the same library
+func (app *App) apiMergeTags(c *gin.Context) {
+	var req apiTagMergeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		apiError(c, http.StatusBadRequest, "request body must be JSON")
+		return
+	}
+	into, ok := app.apiManagedTag(c, req.Into)
+	if !ok {
+		return
+	}
+	var tags []Tag
+	for _, id := range req.TagIDs {
+		tag, ok := app.apiManagedTag(c, id)
+		if !ok {
+			return
+		}
+		tags = append(tags, tag)
+	}
+
+	for _, tag := range tags {
+		// Merging a tag above this one may have merged it already
+		tag, err := app.store.GetTag(tag.ID)
+		if errors.Is(err, ErrTagNotFound) {
+			continue
+		}
+		problem := ""
+		if err == nil {
+			problem, err = app.mergeTagInto(tag, into)
+		}
+		if err != nil {
+			apiError(c, http.StatusInternalServerError, "could not merge tags")
+			return
+		}
+		if problem != "" {
+			apiError(c, http.StatusUnprocessableEntity, problem)
+			return
+		}
+	}
+	app.apiSendTag(c, into.ID)
+}
+
+// Delete a tag, or with ?reassign_to= merge it into another tag
+func (app *App) apiDeleteTag(c *gin.Context) {
+	id, ok := apiTagID(c)
+	if !ok {
+		return
+	}
+	tag, ok := app.apiManagedTag(c, id)
+	if !ok {
+		return
+	}
+
+	if value := c.Query("reassign_to"); value != "" {
+		intoID, err := strconv.Atoi(value)
+		if err != nil {
+			apiError(c, http.StatusBadRequest, "reassign_to must be a tag ID")
+			return
+		}
+		into, ok := app.apiManagedTag(c, intoID)
+		if !ok {
+			return
+		}
+		problem, err := app.mergeTagInto(tag, into)
+		if err != nil {
+			apiError(c, http.StatusInternalServerError, "could not delete tag")
+			return
+		}
+		if problem != "" {
+			apiError(c, http.StatusUnprocessableEntity, problem)
+			return
+		}
+		c.Status(http.StatusNoContent)
+		return
+	}
+
+	if err := app.removeTag(tag); err != nil {
+		apiError(c, http.StatusInternalServerError, "could not delete tag")
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// Delete the user's personal tags that no link has anymore
+func (app *App) apiCleanUpTags(c *gin.Context) {
+	removed, err := app.removeUnusedTags(c.GetInt("user_id"), 0)
+	if err != nil {
+		apiError(c, http.StatusInternalServerError, "could not delete unused tags")
+		return
+	}
+	c.JSON(http.StatusOK, apiCleanupResponse{Deleted: removed})
+}
+
+// Search the user's links, same matching as the search page
+func (app *App) apiSearch(c *gin.Context) {
+	query := strings.TrimSpace(c.Query("q"))
+	if query == "" {
+		apiError(c, http.StatusBadRequest, "q is required")
+		return
+	}
+	page, perPage, ok := apiPagination(c)
+	if !ok {
+		return
+	}
+
+	links, err := app.store.SearchUserLinks(c.GetInt("user_id"), query)
+	if err != nil {
+		apiError(c, http.StatusInternalServerError, "could not search links")
+		return
+	}
+	apiLinkPage(c, links, page, perPage)
+}
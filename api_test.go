@@ -0,0 +1,169 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Save token for its user, with a made up secret to send as the bearer
+// token. Scope defaults to write.
+func createTestAPIToken(t *testing.T, store Store, token APIToken) string {
+	t.Helper()
+	secret, err := newAPIToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	token.Name = "test"
+	token.Prefix = secret[:apiTokenPrefixLength]
+	token.Hash = hashAPIToken(secret)
+	token.CreatedAt = time.Now()
+	if token.Scope == "" {
+		token.Scope = "write"
+	}
+	if err := store.CreateAPIToken(&token); err != nil {
+		t.Fatal(err)
+	}
+	return secret
+}
+
+// Send an API request with a bearer token and return the status code
+func sendAPI(t *testing.T, server *httptest.Server, method, path, token, body string) int {
+	t.Helper()
+	req, err := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+// Someone a link is shared with for editing can change it, but only its
+// owner can change who sees it or delete it
+func TestAPILinkAccess(t *testing.T) {
+	app, server := newTestApp(t)
+	alice := createTestUser(t, app.store, "alice")
+	bob := createTestUser(t, app.store, "bob")
+	link := createTestLink(t, app.store, Link{URL: "https://go.dev/", Title: "Go", UserID: alice.ID})
+	if err := app.store.SaveShare(&Share{OwnerID: alice.ID, UserID: bob.ID, LinkID: link.ID, Permission: PermissionEdit, CreatedAt: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	bobToken := createTestAPIToken(t, app.store, APIToken{UserID: bob.ID})
+	linkPath := "/api/v1/links/" + strconv.Itoa(link.ID)
+
+	for _, test := range []struct {
+		method, body string
+		want         int
+	}{
+		{http.MethodPatch, `{"title": "The Go Programming Language"}`, http.StatusOK},
+		{http.MethodPatch, `{"title": "Go", "visibility": "private"}`, http.StatusOK}, // unchanged
+		{http.MethodPatch, `{"visibility": "public"}`, http.StatusForbidden},
+		{http.MethodDelete, ``, http.StatusForbidden},
+	} {
+		if got := sendAPI(t, server, test.method, linkPath, bobToken, test.body); got != test.want {
+			t.Errorf("bob: %s %s: %d, want %d", test.method, test.body, got, test.want)
+		}
+	}
+
+	got, err := app.store.GetLinkByID(link.ID)
+	if err != nil || got.Title != "Go" || got.Visibility != VisibilityPrivate {
+		t.Errorf("link after bob's changes = %+v, %v", got, err)
+	}
+
+	aliceToken := createTestAPIToken(t, app.store, APIToken{UserID: alice.ID})
+	if code := sendAPI(t, server, http.MethodPatch, linkPath, aliceToken, `{"visibility": "public"}`); code != http.StatusOK {
+		t.Errorf("alice making her link public: %d", code)
+	}
+	if code := sendAPI(t, server, http.MethodDelete, linkPath, aliceToken, ""); code != http.StatusNoContent {
+		t.Errorf("alice deleting her link: %d", code)
+	}
+}
+
+// Bearer tokens, their scopes, expiry and revoking them
+func TestAPITokenAuth(t *testing.T) {
+	app, server := newTestApp(t)
+	alice := createTestUser(t, app.store, "alice")
+	hourAgo := time.Now().Add(-time.Hour)
+	tomorrow := time.Now().Add(24 * time.Hour)
+	write := createTestAPIToken(t, app.store, APIToken{UserID: alice.ID})
+	read := createTestAPIToken(t, app.store, APIToken{UserID: alice.ID, Scope: "read"})
+	expired := createTestAPIToken(t, app.store, APIToken{UserID: alice.ID, ExpiresAt: &hourAgo})
+	notYet := createTestAPIToken(t, app.store, APIToken{UserID: alice.ID, ExpiresAt: &tomorrow})
+	newLink := `{"url": "https://go.dev/", "title": "Go"}`
+
+	for _, test := range []struct {
+		name, method, path, token, body string
+		want                            int
+	}{
+		{"no token", http.MethodGet, "/api/v1/links", "", "", http.StatusUnauthorized},
+		{"unknown token", http.MethodGet, "/api/v1/links", "lc_nope", "", http.StatusUnauthorized},
+		{"read token reading", http.MethodGet, "/api/v1/links", read, "", http.StatusOK},
+		{"read token writing", http.MethodPost, "/api/v1/links", read, newLink, http.StatusForbidden},
+		{"write token reading", http.MethodGet, "/api/v1/me", write, "", http.StatusOK},
+		{"write token writing", http.MethodPost, "/api/v1/links", write, newLink, http.StatusCreated},
+		{"expired token", http.MethodGet, "/api/v1/links", expired, "", http.StatusUnauthorized},
+		{"token expiring later", http.MethodGet, "/api/v1/links", notYet, "", http.StatusOK},
+	} {
+		if got := sendAPI(t, server, test.method, test.path, test.token, test.body); got != test.want {
+			t.Errorf("%s: %s %s: %d, want %d", test.name, test.method, test.path, got, test.want)
+		}
+	}
+
+	// The session cookie is no use for the API
+	browser := newTestBrowser(t, server)
+	browser.get("/register")
+	browser.post("/register", url.Values{
+		"username": {"bob"}, "password": {"correct horse"}, "email": {"bob@example.com"},
+	})
+	if code, _ := browser.get("/api/v1/links"); code != http.StatusUnauthorized {
+		t.Errorf("API with a session cookie: %d, want 401", code)
+	}
+
+	// A revoked token stops working straight away
+	bob, err := app.store.GetUserByUsername("bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bobToken := createTestAPIToken(t, app.store, APIToken{UserID: bob.ID})
+	tokens, err := app.store.GetUserAPITokens(bob.ID)
+	if err != nil || len(tokens) != 1 {
+		t.Fatalf("bob's tokens = %+v, %v", tokens, err)
+	}
+	if code := sendAPI(t, server, http.MethodGet, "/api/v1/links", bobToken, ""); code != http.StatusOK {
+		t.Fatalf("bob's token before revoking it: %d", code)
+	}
+	browser.get("/settings/tokens")
+	if code, _ := browser.post("/settings/tokens/"+strconv.Itoa(tokens[0].ID)+"/revoke", url.Values{}); code != http.StatusFound {
+		t.Fatalf("revoke: %d", code)
+	}
+	if code := sendAPI(t, server, http.MethodGet, "/api/v1/links", bobToken, ""); code != http.StatusUnauthorized {
+		t.Errorf("revoked token: %d, want 401", code)
+	}
+
+	// Nor can anyone else revoke alice's token
+	aliceToken, err := app.store.GetAPITokenByHash(hashAPIToken(write))
+	if err != nil {
+		t.Fatal(err)
+	}
+	browser.get("/settings/tokens")
+	if code, _ := browser.post("/settings/tokens/"+strconv.Itoa(aliceToken.ID)+"/revoke", url.Values{}); code != http.StatusNotFound {
+		t.Errorf("bob revoking alice's token: %d, want 404", code)
+	}
+	if code := sendAPI(t, server, http.MethodGet, "/api/v1/links", write, ""); code != http.StatusOK {
+		t.Errorf("alice's token after bob tried to revoke it: %d", code)
+	}
+}
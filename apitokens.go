@@ -0,0 +1,230 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+)
+
+// Personal API tokens let scripts use the API without a browser session.
+// A token looks like "lc_" followed by 43 random characters. We only keep
+// its SHA-256 (the token is random enough that a slow hash buys nothing)
+// and the first few characters so people can tell their tokens apart.
+
+// APIToken is a personal access token for the API
+type APIToken struct {
+	ID         int        `json:"id"`
+	UserID     int        `json:"user_id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"` // start of the token, for display
+	Hash       string     `json:"hash"`   // SHA-256 of the whole token
+	Scope      string     `json:"scope"`  // "read" or "write"
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  *time.Time `json:"expires_at"` // nil means never
+	LastUsedAt *time.Time `json:"last_used_at"`
+}
+
+const (
+	apiTokenPrefix       = "lc_"
+	apiTokenPrefixLength = 10 // "lc_" plus 7 characters
+	apiTokenContextKey   = "apiToken"
+)
+
+// Expired tells whether the token can't be used any more
+func (t APIToken) Expired() bool {
+	return t.ExpiresAt != nil && !time.Now().Before(*t.ExpiresAt)
+}
+
+// Allows tells whether the token may be used for something needing scope.
+// Write tokens can read too.
+func (t APIToken) Allows(scope string) bool {
+	return t.Scope == scope || t.Scope == "write"
+}
+
+// Generate a new random token
+func newAPIToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return apiTokenPrefix + base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// What the store uses to look a token up
+func hashAPIToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Send an error to an API client and stop
+func apiError(c *gin.Context, code int, message string) {
+	c.AbortWithStatusJSON(code, apiErrorBody{Error: message})
+}
+
+// API authentication middleware. Expects "Authorization: Bearer <token>"
+// and never looks at the session cookie.
+func (app *App) apiAuthRequired() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		header := c.GetHeader("Authorization")
+		if len(header) < 7 || !strings.EqualFold(header[:7], "Bearer ") {
+			c.Header("WWW-Authenticate", `Bearer realm="linkcollector"`)
+			apiError(c, http.StatusUnauthorized, "missing API token")
+			return
+		}
+
+		token, err := app.store.GetAPITokenByHash(hashAPIToken(strings.TrimSpace(header[7:])))
+		if errors.Is(err, ErrTokenNotFound) {
+			c.Header("WWW-Authenticate", `Bearer realm="linkcollector", error="invalid_token"`)
+			apiError(c, http.StatusUnauthorized, "invalid API token")
+			return
+		} else if err != nil {
+			apiError(c, http.StatusInternalServerError, "could not check API token")
+			return
+		}
+		if token.Expired() {
+			c.Header("WWW-Authenticate", `Bearer realm="linkcollector", error="invalid_token"`)
+			apiError(c, http.StatusUnauthorized, "API token has expired")
+			return
+		}
+
+		// Same as sessions, don't write on every single request
+		now := time.Now()
+		if token.LastUsedAt == nil || now.Sub(*token.LastUsedAt) > lastSeenResolution {
+			if err := app.store.TouchAPIToken(token.ID, now); err != nil {
+				fmt.Println("Could not update API token:", err)
+			}
+		}
+
+		c.Set("user_id", token.UserID)
+		c.Set(apiTokenContextKey, token)
+		c.Next()
+	}
+}
+
+// Only let tokens with the given scope through, has to run after
+// apiAuthRequired
+func requireScope(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token := c.MustGet(apiTokenContextKey).(APIToken)
+		if !token.Allows(scope) {
+			c.Header("WWW-Authenticate", fmt.Sprintf(`Bearer realm="linkcollector", error="insufficient_scope", scope="%s"`, scope))
+			apiError(c, http.StatusForbidden, "this API token needs the "+scope+" scope")
+			return
+		}
+		c.Next()
+	}
+}
+
+// Show the API tokens page, with extra data like errors or a new token
+func (app *App) renderAPITokens(c *gin.Context, code int, data gin.H) {
+	userID := sessions.Default(c).Get("user_id").(int)
+	tokens, err := app.store.GetUserAPITokens(userID)
+	if err != nil {
+		render(c, http.StatusInternalServerError, "error.html", gin.H{
+			"error": "Error loading your API tokens",
+		})
+		return
+	}
+
+	data["title"] = "API Tokens"
+	data["tokens"] = tokens
+	render(c, code, "api_tokens.html", data)
+}
+
+// Show the user's API tokens
+func (app *App) apiTokensPage(c *gin.Context) {
+	app.renderAPITokens(c, http.StatusOK, gin.H{})
+}
+
+// Create a new API token and show it (just this once)
+func (app *App) createAPIToken(c *gin.Context) {
+	userID := sessions.Default(c).Get("user_id").(int)
+
+	name := strings.TrimSpace(c.PostForm("name"))
+	scope := c.PostForm("scope")
+	expiresIn := c.PostForm("expires_in")
+
+	if name == "" {
+		app.renderAPITokens(c, http.StatusBadRequest, gin.H{"error": "Give your token a name"})
+		return
+	}
+	if scope != "read" && scope != "write" {
+		app.renderAPITokens(c, http.StatusBadRequest, gin.H{"error": "Pick read or write access"})
+		return
+	}
+
+	now := time.Now()
+	var expiresAt *time.Time
+	if expiresIn != "never" {
+		days, err := strconv.Atoi(expiresIn)
+		if err != nil || days <= 0 {
+			app.renderAPITokens(c, http.StatusBadRequest, gin.H{"error": "Pick when the token expires"})
+			return
+		}
+		expires := now.AddDate(0, 0, days)
+		expiresAt = &expires
+	}
+
+	secret, err := newAPIToken()
+	if err != nil {
+		render(c, http.StatusInternalServerError, "error.html", gin.H{
+			"error": "Error creating your API token",
+		})
+		return
+	}
+	token := &APIToken{
+		UserID:    userID,
+		Name:      name,
+		Prefix:    secret[:apiTokenPrefixLength],
+		Hash:      hashAPIToken(secret),
+		Scope:     scope,
+		CreatedAt: now,
+		ExpiresAt: expiresAt,
+	}
+	if err := app.store.CreateAPIToken(token); err != nil {
+		render(c, http.StatusInternalServerError, "error.html", gin.H{
+			"error": "Error creating your API token",
+		})
+		return
+	}
+
+	app.renderAPITokens(c, http.StatusOK, gin.H{"newToken": secret, "newTokenName": name})
+}
+
+// Revoke an API token
+func (app *App) revokeAPIToken(c *gin.Context) {
+	userID := sessions.Default(c).Get("user_id").(int)
+
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		render(c, http.StatusBadRequest, "error.html", gin.H{
+			"error": "Invalid token ID",
+		})
+		return
+	}
+	token, err := app.store.GetAPITokenByID(id)
+	if err != nil || token.UserID != userID {
+		render(c, http.StatusNotFound, "error.html", gin.H{
+			"error": "API token not found",
+		})
+		return
+	}
+	if err := app.store.DeleteAPIToken(token.ID); err != nil {
+		render(c, http.StatusInternalServerError, "error.html", gin.H{
+			"error": "Error revoking your API token",
+		})
+		return
+	}
+
+	c.Redirect(http.StatusFound, "/settings/tokens")
+}
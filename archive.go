@@ -0,0 +1,720 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+	"golang.org/x/net/html/charset"
+)
+
+// Archived copies of saved pages, so a link that rots can still be read.
+// Every copy keeps the page three ways:
+//
+//   - readable: only the main text, headings, lists, links and images,
+//     rebuilt from a short list of allowed tags
+//   - text: the plain text of the readable copy
+//   - full page: the whole page as a single file, stylesheets and images
+//     inlined, scripts, frames and event handlers taken out
+//
+// Cleaned up or not, an archived page is still someone else's HTML, so it
+// is only ever served from /archive with archiveCSP (see archiveSandbox).
+
+// ArchivedPage is a copy of a link's page from some point in time
+type ArchivedPage struct {
+	ID        int       `json:"id"`
+	LinkID    int       `json:"link_id"`
+	URL       string    `json:"url"` // where the page was after redirects
+	Title     string    `json:"title"`
+	Readable  string    `json:"readable"`  // cleaned up main content, HTML
+	Text      string    `json:"text"`      // plain text of the readable copy
+	FullPage  string    `json:"full_page"` // whole page with assets inlined, HTML
+	Size      int       `json:"size"`      // bytes of all three together
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// The policy every archived page is served with. The page can't run
+// scripts, load anything that isn't inlined or submit forms, and the
+// sandbox gives it an origin of its own so it can't see our cookies.
+// Links still work, they open in a new tab or replace the page.
+const archiveCSP = "default-src 'none'; img-src data:; style-src 'unsafe-inline'; font-src data:; " +
+	"form-action 'none'; base-uri 'none'; frame-ancestors 'none'; " +
+	"sandbox allow-popups allow-popups-to-escape-sandbox allow-top-navigation-by-user-activation"
+
+const (
+	archiveUserAgent = "LinkCollector/1.0 (+archive)"
+	// The whole archive including all its images, stragglers are left out
+	archiveTimeout = time.Minute
+	// How many pages are archived at the same time, the rest wait
+	archiveWorkers = 2
+)
+
+// Archiver downloads pages and makes archived copies of them
+type Archiver struct {
+	client   *http.Client
+	maxBytes int64 // for everything inlined into one page
+	slots    chan struct{}
+}
+
+// NewArchiver creates an archiver that uses client for all requests (see
+// NewOutboundClient) and inlines at most maxBytes of images, stylesheets
+// and fonts into a page
+func NewArchiver(client *http.Client, maxBytes int64) *Archiver {
+	return &Archiver{
+		client:   client,
+		maxBytes: maxBytes,
+		slots:    make(chan struct{}, archiveWorkers),
+	}
+}
+
+// Archive downloads a page and makes an archived copy of it. The copy
+// doesn't belong to a link yet.
+func (a *Archiver) Archive(ctx context.Context, pageURL string) (*ArchivedPage, error) {
+	u, err := url.Parse(pageURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("%q is not a web address", pageURL)
+	}
+
+	select {
+	case a.slots <- struct{}{}:
+		defer func() { <-a.slots }()
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	ctx, cancel := context.WithTimeout(ctx, archiveTimeout)
+	defer cancel()
+
+	body, contentType, finalURL, err := a.get(ctx, u.String(), "text/html,application/xhtml+xml;q=0.9")
+	if err != nil {
+		return nil, err
+	}
+	if mediaType := mediaTypeOf(contentType, body); mediaType != "text/html" && mediaType != "application/xhtml+xml" {
+		return nil, ErrNotHTML
+	}
+	r, err := charset.NewReader(bytes.NewReader(body), contentType)
+	if err != nil {
+		return nil, err
+	}
+	doc, err := html.Parse(r)
+	if err != nil {
+		return nil, err
+	}
+
+	base := finalURL
+	if baseTag := findElement(doc, "base"); baseTag != nil {
+		if href, err := finalURL.Parse(getAttr(baseTag, "href")); err == nil {
+			base = href
+		}
+	}
+	assets := &assetInliner{
+		archiver:  a,
+		ctx:       ctx,
+		remaining: a.maxBytes,
+		cache:     make(map[string]string),
+	}
+
+	// The readable copy first, making the single file changes the page
+	readable := readableContent(doc, base, assets)
+	var readableHTML strings.Builder
+	for n := readable.FirstChild; n != nil; n = n.NextSibling {
+		if err := html.Render(&readableHTML, n); err != nil {
+			return nil, err
+		}
+	}
+
+	title := ""
+	if titleTag := findElement(doc, "title"); titleTag != nil {
+		title = cleanText(nodeText(titleTag), maxTitleLength)
+	}
+
+	assets.singleFile(doc, base)
+	var fullPage strings.Builder
+	if err := html.Render(&fullPage, doc); err != nil {
+		return nil, err
+	}
+
+	page := &ArchivedPage{
+		URL:      finalURL.String(),
+		Title:    title,
+		Readable: readableHTML.String(),
+		Text:     plainText(readable),
+		FullPage: fullPage.String(),
+	}
+	page.Size = len(page.Readable) + len(page.Text) + len(page.FullPage)
+	return page, nil
+}
+
+// Download something, returns the body, its Content-Type and where it
+// really came from after redirects
+func (a *Archiver) get(ctx context.Context, rawURL, accept string) ([]byte, string, *url.URL, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	req.Header.Set("User-Agent", archiveUserAgent)
+	req.Header.Set("Accept", accept)
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, "", nil, fmt.Errorf("%s returned %s", req.URL.Host, resp.Status)
+	}
+	// The outbound client stops us at FETCH_MAX_BYTES
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	return body, resp.Header.Get("Content-Type"), resp.Request.URL, nil
+}
+
+// The media type from a Content-Type header, or sniffed from the body when
+// the server didn't say
+func mediaTypeOf(contentType string, body []byte) string {
+	if mediaType, _, err := mime.ParseMediaType(contentType); err == nil {
+		return strings.ToLower(mediaType)
+	}
+	mediaType, _, _ := mime.ParseMediaType(http.DetectContentType(body))
+	return mediaType
+}
+
+// Find the first element with the given name, depth first
+func findElement(n *html.Node, name string) *html.Node {
+	if n.Type == html.ElementNode && n.Data == name && n.Namespace == "" {
+		return n
+	}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if found := findElement(c, name); found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+func getAttr(n *html.Node, key string) string {
+	for _, attr := range n.Attr {
+		if attr.Namespace == "" && attr.Key == key {
+			return attr.Val
+		}
+	}
+	return ""
+}
+
+// All the text inside a node
+func nodeText(n *html.Node) string {
+	var b strings.Builder
+	var walk func(*html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.TextNode {
+			b.WriteString(n.Data)
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(n)
+	return b.String()
+}
+
+// Tags the readable copy keeps, with the attributes they keep. Other tags
+// are left out but their contents kept.
+var readableTags = map[string]map[string]bool{
+	"p": nil, "div": nil, "section": nil, "br": nil, "hr": nil,
+	"h1": nil, "h2": nil, "h3": nil, "h4": nil, "h5": nil, "h6": nil,
+	"ul": nil, "ol": nil, "li": nil, "dl": nil, "dt": nil, "dd": nil,
+	"blockquote": nil, "pre": nil, "code": nil, "kbd": nil, "samp": nil,
+	"em": nil, "strong": nil, "b": nil, "i": nil, "u": nil, "s": nil,
+	"sub": nil, "sup": nil, "small": nil, "mark": nil, "abbr": nil,
+	"figure": nil, "figcaption": nil,
+	"table": nil, "caption": nil, "thead": nil, "tbody": nil, "tfoot": nil, "tr": nil,
+	"th":  {"colspan": true, "rowspan": true},
+	"td":  {"colspan": true, "rowspan": true},
+	"a":   {"href": true, "title": true},
+	"img": {"src": true, "alt": true, "title": true, "width": true, "height": true},
+}
+
+// Tags the readable copy leaves out together with their contents
+var readableDropped = map[string]bool{
+	"head": true, "script": true, "style": true, "noscript": true, "template": true,
+	"iframe": true, "frame": true, "frameset": true, "object": true, "embed": true,
+	"form": true, "button": true, "input": true, "select": true, "textarea": true,
+	"nav": true, "aside": true, "footer": true, "dialog": true,
+	"canvas": true, "video": true, "audio": true, "svg": true, "math": true,
+}
+
+// Rebuild the main content of a page from allowed tags only. The result is
+// a <div> holding the content.
+func readableContent(doc *html.Node, base *url.URL, assets *assetInliner) *html.Node {
+	root := findElement(doc, "article")
+	if root == nil {
+		root = findElement(doc, "main")
+	}
+	if root == nil {
+		root = findElement(doc, "body")
+	}
+	if root == nil {
+		root = doc
+	}
+
+	out := &html.Node{Type: html.ElementNode, Data: "div", DataAtom: atom.Div}
+	copyReadable(out, root, base, assets)
+	return out
+}
+
+func copyReadable(dst, src *html.Node, base *url.URL, assets *assetInliner) {
+	for n := src.FirstChild; n != nil; n = n.NextSibling {
+		switch n.Type {
+		case html.TextNode:
+			dst.AppendChild(&html.Node{Type: html.TextNode, Data: n.Data})
+		case html.ElementNode:
+			if n.Namespace != "" || readableDropped[n.Data] {
+				continue
+			}
+			allowedAttrs, allowed := readableTags[n.Data]
+			if !allowed {
+				copyReadable(dst, n, base, assets)
+				continue
+			}
+
+			el := &html.Node{Type: html.ElementNode, Data: n.Data, DataAtom: atom.Lookup([]byte(n.Data))}
+			for _, attr := range n.Attr {
+				if attr.Namespace != "" || !allowedAttrs[attr.Key] {
+					continue
+				}
+				switch attr.Key {
+				case "href":
+					attr.Val = resolveURL(base, attr.Val)
+				case "src":
+					attr.Val = assets.image(base, attr.Val)
+				}
+				if attr.Val != "" {
+					el.Attr = append(el.Attr, html.Attribute{Key: attr.Key, Val: attr.Val})
+				}
+			}
+			copyReadable(el, n, base, assets)
+			dst.AppendChild(el)
+		}
+	}
+}
+
+// Tags that start a new paragraph in the plain text
+var textBlocks = map[string]bool{
+	"p": true, "div": true, "section": true, "blockquote": true, "pre": true,
+	"h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true,
+	"ul": true, "ol": true, "li": true, "dl": true, "dt": true, "dd": true,
+	"figure": true, "figcaption": true, "table": true, "caption": true, "tr": true, "hr": true,
+}
+
+var whitespace = regexp.MustCompile(`\s+`)
+
+// The text of a readable copy, one paragraph per line
+func plainText(n *html.Node) string {
+	var b strings.Builder
+	atLineStart := func() bool {
+		s := b.String()
+		return s == "" || strings.HasSuffix(s, "\n")
+	}
+
+	var walk func(n *html.Node, inPre bool)
+	walk = func(n *html.Node, inPre bool) {
+		switch {
+		case n.Type == html.TextNode && inPre:
+			b.WriteString(n.Data)
+		case n.Type == html.TextNode:
+			text := whitespace.ReplaceAllString(n.Data, " ")
+			if atLineStart() {
+				text = strings.TrimLeft(text, " ")
+			}
+			b.WriteString(text)
+		case n.Type == html.ElementNode && n.Data == "br":
+			b.WriteString("\n")
+		case n.Type == html.ElementNode && textBlocks[n.Data] && !atLineStart():
+			b.WriteString("\n")
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c, inPre || n.Data == "pre")
+		}
+		if n.Type == html.ElementNode && textBlocks[n.Data] {
+			b.WriteString("\n")
+		}
+	}
+	walk(n, false)
+
+	// No trailing spaces and at most one empty line in a row
+	var lines []string
+	for _, line := range strings.Split(b.String(), "\n") {
+		line = strings.TrimRight(line, " \t")
+		if line == "" && (len(lines) == 0 || lines[len(lines)-1] == "") {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return strings.TrimSpace(strings.Join(lines, "\n"))
+}
+
+// Fetches images, stylesheets and fonts for one archived page and turns
+// them into data: URIs, until the page's budget runs out
+type assetInliner struct {
+	archiver  *Archiver
+	ctx       context.Context
+	remaining int64
+	cache     map[string]string // URL -> data: URI, empty if it couldn't be inlined
+}
+
+// An image as a data: URI, empty if it can't be inlined
+func (in *assetInliner) image(base *url.URL, ref string) string {
+	ref = strings.TrimSpace(ref)
+	if strings.HasPrefix(ref, "data:image/") {
+		return ref
+	}
+	if abs := resolveURL(base, ref); abs != "" {
+		return in.inline(abs, "image/")
+	}
+	return ""
+}
+
+// Fetch something and turn it into a data: URI, as long as its media type
+// starts with wantType
+func (in *assetInliner) inline(abs, wantType string) string {
+	if uri, done := in.cache[abs]; done {
+		return uri
+	}
+	in.cache[abs] = ""
+	if in.remaining <= 0 {
+		return ""
+	}
+
+	body, contentType, _, err := in.archiver.get(in.ctx, abs, "*/*")
+	if err != nil {
+		return ""
+	}
+	mediaType := mediaTypeOf(contentType, body)
+	encodedLength := int64(base64.StdEncoding.EncodedLen(len(body)))
+	if !strings.HasPrefix(mediaType, wantType) || encodedLength > in.remaining {
+		return ""
+	}
+	in.remaining -= encodedLength
+
+	uri := "data:" + mediaType + ";base64," + base64.StdEncoding.EncodeToString(body)
+	in.cache[abs] = uri
+	return uri
+}
+
+// Fetch a stylesheet with everything it refers to inlined
+func (in *assetInliner) stylesheet(base *url.URL, ref string) string {
+	abs := resolveURL(base, ref)
+	if abs == "" || in.remaining <= 0 {
+		return ""
+	}
+	body, contentType, cssURL, err := in.archiver.get(in.ctx, abs, "text/css,*/*;q=0.1")
+	if err != nil || mediaTypeOf(contentType, body) != "text/css" || int64(len(body)) > in.remaining {
+		return ""
+	}
+	in.remaining -= int64(len(body))
+	return in.css(string(body), cssURL)
+}
+
+var cssURLPattern = regexp.MustCompile(`url\(\s*(?:"([^"]*)"|'([^']*)'|([^)'"\s]*))\s*\)`)
+
+// Inline the images and fonts CSS refers to. Anything that can't be
+// inlined is at least made absolute, the CSP blocks it either way.
+func (in *assetInliner) css(css string, base *url.URL) string {
+	css = cssURLPattern.ReplaceAllStringFunc(css, func(match string) string {
+		parts := cssURLPattern.FindStringSubmatch(match)
+		ref := strings.TrimSpace(parts[1] + parts[2] + parts[3])
+		if ref == "" || strings.HasPrefix(ref, "#") || strings.HasPrefix(ref, "data:") {
+			return match
+		}
+		abs := resolveURL(base, ref)
+		if uri := in.inline(abs, ""); uri != "" {
+			return `url("` + uri + `")`
+		}
+		return `url("` + abs + `")`
+	})
+	// It ends up in a <style>, which must not get closed early
+	return strings.ReplaceAll(css, "</", `<\/`)
+}
+
+// Elements the single file leaves out
+var singleFileDropped = map[string]bool{
+	"script": true, "noscript": true, "template": true, "base": true,
+	"iframe": true, "frame": true, "frameset": true, "object": true, "embed": true, "applet": true,
+	"video": true, "audio": true, "source": true, "track": true, "portal": true,
+}
+
+// Turn a parsed page into a single file that needs nothing from the
+// network and can't run anything
+func (in *assetInliner) singleFile(doc *html.Node, base *url.URL) {
+	var remove []*html.Node
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		switch n.Type {
+		case html.CommentNode:
+			remove = append(remove, n)
+			return
+		case html.ElementNode:
+			switch {
+			case singleFileDropped[n.Data]:
+				remove = append(remove, n)
+				return
+			case n.Data == "meta" && (getAttr(n, "http-equiv") != "" || getAttr(n, "charset") != ""):
+				// No refreshes or policies of its own, and we send UTF-8
+				remove = append(remove, n)
+				return
+			case n.Data == "link":
+				if !in.inlineLink(n, base) {
+					remove = append(remove, n)
+				}
+				return
+			case n.Data == "style":
+				css := in.css(nodeText(n), base)
+				for n.FirstChild != nil {
+					n.RemoveChild(n.FirstChild)
+				}
+				n.AppendChild(&html.Node{Type: html.TextNode, Data: css})
+			}
+			in.cleanAttrs(n, base)
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(doc)
+	for _, n := range remove {
+		n.Parent.RemoveChild(n)
+	}
+
+	if head := findElement(doc, "head"); head != nil {
+		head.InsertBefore(&html.Node{
+			Type:     html.ElementNode,
+			Data:     "meta",
+			DataAtom: atom.Meta,
+			Attr:     []html.Attribute{{Key: "charset", Val: "utf-8"}},
+		}, head.FirstChild)
+	}
+}
+
+// Turn a stylesheet <link> into a <style> and inline icons. Returns false
+// for links that should go.
+func (in *assetInliner) inlineLink(n *html.Node, base *url.URL) bool {
+	rels := strings.Fields(strings.ToLower(getAttr(n, "rel")))
+	href := getAttr(n, "href")
+	for _, rel := range rels {
+		switch rel {
+		case "stylesheet":
+			css := in.stylesheet(base, href)
+			if css == "" {
+				return false
+			}
+			var attrs []html.Attribute
+			if media := getAttr(n, "media"); media != "" {
+				attrs = append(attrs, html.Attribute{Key: "media", Val: media})
+			}
+			n.Data, n.DataAtom, n.Attr = "style", atom.Style, attrs
+			n.AppendChild(&html.Node{Type: html.TextNode, Data: css})
+			return true
+		case "icon":
+			icon := in.image(base, href)
+			if icon == "" {
+				return false
+			}
+			n.Attr = []html.Attribute{{Key: "rel", Val: "icon"}, {Key: "href", Val: icon}}
+			return true
+		}
+	}
+	return false
+}
+
+// Strip event handlers and anything pointing somewhere we don't want to go,
+// inline images
+func (in *assetInliner) cleanAttrs(n *html.Node, base *url.URL) {
+	attrs := n.Attr[:0]
+	for _, attr := range n.Attr {
+		key := strings.ToLower(attr.Key)
+		switch {
+		case strings.HasPrefix(key, "on"), key == "srcset", key == "integrity", key == "ping",
+			key == "action", key == "formaction", key == "background", key == "poster":
+			continue
+		case key == "href" || key == "src" && n.Data != "img" && n.Data != "input":
+			// Links inside the page keep working
+			if !strings.HasPrefix(strings.TrimSpace(attr.Val), "#") {
+				attr.Val = resolveURL(base, attr.Val)
+			}
+		case key == "src":
+			attr.Val = in.image(base, attr.Val)
+		case key == "style":
+			attr.Val = in.css(attr.Val, base)
+		}
+		if attr.Val != "" || (key != "href" && key != "src") {
+			attrs = append(attrs, attr)
+		}
+	}
+	n.Attr = attrs
+}
+
+// Archive a link's page and keep at most ArchiveMaxSnapshots copies of it
+func (app *App) archiveLink(ctx context.Context, link Link) (*ArchivedPage, error) {
+	page, err := app.archiver.Archive(ctx, link.URL)
+	if err != nil {
+		return nil, err
+	}
+	page.LinkID = link.ID
+	page.CreatedAt = time.Now()
+	if err := app.store.CreateArchivedPage(page); err != nil {
+		return nil, err
+	}
+
+	pages, err := app.store.GetLinkArchivedPages(link.ID)
+	if err != nil {
+		return nil, err
+	}
+	keep := config.ArchiveMaxSnapshots
+	if keep < 1 {
+		keep = 1
+	}
+	for i := keep; i < len(pages); i++ {
+		if err := app.store.DeleteArchivedPage(pages[i].ID); err != nil {
+			return nil, err
+		}
+	}
+	return page, nil
+}
+
+// Archive a newly saved link without making the user wait for it
+func (app *App) archiveInBackground(link Link) {
+	if !config.ArchiveOnSave {
+		return
+	}
+	go func() {
+		if _, err := app.archiveLink(context.Background(), link); err != nil {
+			fmt.Printf("Could not archive %s: %v\n", link.URL, err)
+		}
+	}()
+}
+
+// Archive a link right now, from the "Archive now" button
+func (app *App) archiveLinkNow(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		render(c, http.StatusBadRequest, "error.html", gin.H{
+			"error": "Invalid link ID",
+		})
+		return
+	}
+	link, err := app.store.GetLinkByID(id)
+	if err != nil {
+		render(c, http.StatusNotFound, "error.html", gin.H{
+			"error": "Link not found",
+		})
+		return
+	}
+	userID := sessions.Default(c).Get("user_id").(int)
+	if access, err := app.linkAccess(link, userID); err != nil || access < accessManage {
+		render(c, http.StatusForbidden, "error.html", gin.H{
+			"error": "You don't have permission to archive this link",
+		})
+		return
+	}
+
+	if _, err := app.archiveLink(c.Request.Context(), link); err != nil {
+		message := "Could not archive that page"
+		if errors.Is(err, ErrBlockedDestination) {
+			message = "That address can't be archived"
+		} else if errors.Is(err, ErrNotHTML) {
+			message = "Only web pages can be archived"
+		}
+		render(c, http.StatusBadGateway, "error.html", gin.H{
+			"error": message,
+		})
+		return
+	}
+	c.Redirect(http.StatusFound, fmt.Sprintf("/links/%d", link.ID))
+}
+
+// Headers for everything under /archive, see archiveCSP
+func archiveSandbox() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Header("Content-Security-Policy", archiveCSP)
+		c.Header("X-Content-Type-Options", "nosniff")
+		c.Header("Referrer-Policy", "no-referrer")
+		c.Header("Cross-Origin-Opener-Policy", "same-origin")
+		c.Next()
+	}
+}
+
+// Load the archived page named in the URL, if it's a copy of a link the
+// visitor can see. Nobody has to be logged in, copies of public and unlisted
+// links are as public as the links. Errors are plain text, the CSP would
+// block our stylesheets.
+func (app *App) viewableArchivedPage(c *gin.Context) (ArchivedPage, bool) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.String(http.StatusBadRequest, "Invalid archive ID")
+		return ArchivedPage{}, false
+	}
+	page, err := app.store.GetArchivedPage(id)
+	if err != nil {
+		c.String(http.StatusNotFound, "Archived copy not found")
+		return ArchivedPage{}, false
+	}
+	userID, _ := sessions.Default(c).Get("user_id").(int) // 0 when not logged in
+	link, err := app.store.GetLinkByID(page.LinkID)
+	access := accessNone
+	if err == nil {
+		access, err = app.linkAccess(link, userID)
+	}
+	if err != nil || access < accessRead {
+		c.String(http.StatusNotFound, "Archived copy not found")
+		return ArchivedPage{}, false
+	}
+	return page, true
+}
+
+// Show the readable copy
+func (app *App) viewArchivedPage(c *gin.Context) {
+	page, ok := app.viewableArchivedPage(c)
+	if !ok {
+		return
+	}
+	c.HTML(http.StatusOK, "archive.html", gin.H{
+		"page": page,
+		// Built from allowed tags only, see readableContent
+		"content": template.HTML(page.Readable),
+	})
+}
+
+// Show the whole page
+func (app *App) viewArchivedFullPage(c *gin.Context) {
+	page, ok := app.viewableArchivedPage(c)
+	if !ok {
+		return
+	}
+	c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(page.FullPage))
+}
+
+// Show the plain text
+func (app *App) viewArchivedText(c *gin.Context) {
+	page, ok := app.viewableArchivedPage(c)
+	if !ok {
+		return
+	}
+	c.Data(http.StatusOK, "text/plain; charset=utf-8", []byte(page.Text))
+}
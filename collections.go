@@ -0,0 +1,507 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+)
+
+// Collections are folders for links, next to tags. Unlike tags they have a
+// description and a cover, they can be nested, and the links in them stay
+// in the order they were put in (or dragged to). A link can be in any
+// number of collections, as long as they belong to the same library as the
+// link: the user's personal links or a workspace.
+
+// Collection is a named, hand-ordered group of links
+type Collection struct {
+	ID          int       `json:"id"`
+	UserID      int       `json:"user_id"`      // who made it
+	WorkspaceID int       `json:"workspace_id"` // the workspace it belongs to, 0 for personal collections
+	ParentID    int       `json:"parent_id"`    // the collection it's in, 0 at the top
+	Name        string    `json:"name"`
+	Description string    `json:"description"`
+	Cover       string    `json:"cover"` // address of a cover image
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// Limits for the collection form
+const (
+	maxCollectionNameLength = 100
+	maxCoverLength          = 2048
+)
+
+// Where the collections of a library are listed
+func collectionsPath(workspaceID int) string {
+	if workspaceID != 0 {
+		return fmt.Sprintf("/collections?workspace=%d", workspaceID)
+	}
+	return "/collections"
+}
+
+// A collection with how deep it's nested, for showing the tree as an
+// indented list
+type collectionNode struct {
+	Collection
+	Depth int
+}
+
+// Non-breaking spaces to indent the name with in a select
+func (node collectionNode) Indent() string {
+	return strings.Repeat("\u00a0\u00a0\u00a0", node.Depth)
+}
+
+// Put collections in tree order, every collection right after its parent.
+// Siblings keep the order they came in. The collection skipID and
+// everything in it are left out, that's what can't be its parent.
+func collectionTree(collections []Collection, skipID int) []collectionNode {
+	known := make(map[int]bool, len(collections))
+	for _, collection := range collections {
+		known[collection.ID] = true
+	}
+
+	var nodes []collectionNode
+	var walk func(parentID, depth int)
+	walk = func(parentID, depth int) {
+		for _, collection := range collections {
+			if collection.ID == skipID {
+				continue
+			}
+			// Treat collections with a parent we don't know as top level
+			parent := collection.ParentID
+			if !known[parent] {
+				parent = 0
+			}
+			if parent == parentID {
+				nodes = append(nodes, collectionNode{Collection: collection, Depth: depth})
+				walk(collection.ID, depth+1)
+			}
+		}
+	}
+	walk(0, 0)
+	return nodes
+}
+
+// The collections a collection is in, from the top down
+func collectionPath(collections []Collection, collection Collection) []Collection {
+	byID := make(map[int]Collection, len(collections))
+	for _, c := range collections {
+		byID[c.ID] = c
+	}
+	var path []Collection
+	for parentID := collection.ParentID; parentID != 0 && len(path) < len(collections); {
+		parent, ok := byID[parentID]
+		if !ok {
+			break
+		}
+		path = append([]Collection{parent}, path...)
+		parentID = parent.ParentID
+	}
+	return path
+}
+
+// Read the collection form into collection. library is every collection
+// of the library it's in, to check the parent. problem says what's wrong
+// with the form, if anything.
+func readCollectionForm(c *gin.Context, collection *Collection, library []Collection) (problem string) {
+	name := strings.TrimSpace(c.PostForm("name"))
+	cover := strings.TrimSpace(c.PostForm("cover"))
+	parentID, _ := strconv.Atoi(c.PostForm("parent_id"))
+
+	switch {
+	case name == "":
+		return "Give the collection a name"
+	case len(name) > maxCollectionNameLength:
+		return fmt.Sprintf("Keep the name under %d characters", maxCollectionNameLength)
+	case cover != "" && !validCover(cover):
+		return "The cover has to be the http or https address of an image"
+	}
+	if parentID != 0 {
+		allowed := false
+		for _, node := range collectionTree(library, collection.ID) {
+			if node.ID == parentID {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return "A collection can't go inside itself or a collection somewhere else"
+		}
+	}
+
+	collection.Name = name
+	collection.Description = strings.TrimSpace(c.PostForm("description"))
+	collection.Cover = cover
+	collection.ParentID = parentID
+	return ""
+}
+
+func validCover(cover string) bool {
+	u, err := url.Parse(cover)
+	return err == nil && len(cover) <= maxCoverLength &&
+		(u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// Show the collections of a library, the user's own or a workspace's with
+// ?workspace=
+func (app *App) collectionsPage(c *gin.Context) {
+	workspaceID, _ := strconv.Atoi(c.Query("workspace"))
+	app.renderCollections(c, http.StatusOK, workspaceID, gin.H{})
+}
+
+func (app *App) renderCollections(c *gin.Context, code int, workspaceID int, data gin.H) {
+	userID := sessions.Default(c).Get("user_id").(int)
+	canManage := true
+	if workspaceID != 0 {
+		workspace, err := app.store.GetWorkspace(workspaceID)
+		role := ""
+		if err == nil {
+			role, err = app.workspaceRole(workspaceID, userID)
+		}
+		if err != nil || role == "" {
+			render(c, http.StatusNotFound, "error.html", gin.H{
+				"error": "Workspace not found",
+			})
+			return
+		}
+		data["workspace"] = workspace
+		canManage = roleAtLeast(role, RoleEditor)
+	}
+
+	collections, err := libraryCollections(app.store, userID, workspaceID)
+	if err != nil {
+		render(c, http.StatusInternalServerError, "error.html", gin.H{
+			"error": "Error loading the collections",
+		})
+		return
+	}
+
+	data["title"] = "Collections"
+	data["canManage"] = canManage
+	data["collections"] = collectionTree(collections, 0)
+	render(c, code, "collections.html", data)
+}
+
+// Make a new collection
+func (app *App) createCollection(c *gin.Context) {
+	userID := sessions.Default(c).Get("user_id").(int)
+	workspaceID, _ := strconv.Atoi(c.PostForm("workspace_id"))
+	if ok, err := app.canAddLinks(workspaceID, userID); err != nil || !ok {
+		render(c, http.StatusForbidden, "error.html", gin.H{
+			"error": "You can't add collections to that workspace",
+		})
+		return
+	}
+	library, err := libraryCollections(app.store, userID, workspaceID)
+	if err != nil {
+		render(c, http.StatusInternalServerError, "error.html", gin.H{
+			"error": "Error loading the collections",
+		})
+		return
+	}
+
+	collection := &Collection{UserID: userID, WorkspaceID: workspaceID}
+	if problem := readCollectionForm(c, collection, library); problem != "" {
+		app.renderCollections(c, http.StatusBadRequest, workspaceID, gin.H{"error": problem})
+		return
+	}
+	if err := app.store.CreateCollection(collection); err != nil {
+		render(c, http.StatusInternalServerError, "error.html", gin.H{
+			"error": "Error creating the collection",
+		})
+		return
+	}
+	c.Redirect(http.StatusFound, fmt.Sprintf("/collections/%d", collection.ID))
+}
+
+// Load the collection named in the URL and check the user has at least the
+// given access to it, returns false (after sending the error) if not
+func (app *App) loadCollection(c *gin.Context, need accessLevel) (Collection, accessLevel, bool) {
+	userID := sessions.Default(c).Get("user_id").(int)
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		render(c, http.StatusBadRequest, "error.html", gin.H{
+			"error": "Invalid collection ID",
+		})
+		return Collection{}, accessNone, false
+	}
+
+	collection, err := app.store.GetCollection(id)
+	access := accessNone
+	if err == nil {
+		access, err = app.collectionAccess(collection, userID)
+	}
+	if err != nil || access < accessRead {
+		render(c, http.StatusNotFound, "error.html", gin.H{
+			"error": "Collection not found",
+		})
+		return Collection{}, accessNone, false
+	}
+	if access < need {
+		render(c, http.StatusForbidden, "error.html", gin.H{
+			"error": "You don't have permission to change this collection",
+		})
+		return Collection{}, accessNone, false
+	}
+	return collection, access, true
+}
+
+// The collection's dashboard: its links in order, and what's in it
+func (app *App) collectionPage(c *gin.Context) {
+	collection, access, ok := app.loadCollection(c, accessRead)
+	if !ok {
+		return
+	}
+	app.renderCollection(c, http.StatusOK, collection, access, gin.H{})
+}
+
+func (app *App) renderCollection(c *gin.Context, code int, collection Collection, access accessLevel, data gin.H) {
+	links, err := app.store.GetCollectionLinks(collection.ID)
+	if err != nil {
+		render(c, http.StatusInternalServerError, "error.html", gin.H{
+			"error": "Error loading the collection's links",
+		})
+		return
+	}
+	library, err := libraryCollections(app.store, collection.UserID, collection.WorkspaceID)
+	if err != nil {
+		render(c, http.StatusInternalServerError, "error.html", gin.H{
+			"error": "Error loading the collections",
+		})
+		return
+	}
+	var children []Collection
+	for _, other := range library {
+		if other.ParentID == collection.ID {
+			children = append(children, other)
+		}
+	}
+	if collection.WorkspaceID != 0 {
+		if workspace, err := app.store.GetWorkspace(collection.WorkspaceID); err == nil {
+			data["workspace"] = workspace
+		}
+	}
+
+	data["title"] = collection.Name
+	data["collection"] = collection
+	data["path"] = collectionPath(library, collection)
+	data["children"] = children
+	data["links"] = links
+	data["canManage"] = access >= accessManage
+	data["parents"] = collectionTree(library, collection.ID)
+	data["listPath"] = collectionsPath(collection.WorkspaceID)
+	render(c, code, "collection.html", data)
+}
+
+// Change the name, description, cover or parent of a collection
+func (app *App) updateCollection(c *gin.Context) {
+	collection, access, ok := app.loadCollection(c, accessManage)
+	if !ok {
+		return
+	}
+	library, err := libraryCollections(app.store, collection.UserID, collection.WorkspaceID)
+	if err != nil {
+		render(c, http.StatusInternalServerError, "error.html", gin.H{
+			"error": "Error loading the collections",
+		})
+		return
+	}
+
+	if problem := readCollectionForm(c, &collection, library); problem != "" {
+		app.renderCollection(c, http.StatusBadRequest, collection, access, gin.H{"error": problem})
+		return
+	}
+	if err := app.store.UpdateCollection(&collection); err != nil {
+		render(c, http.StatusInternalServerError, "error.html", gin.H{
+			"error": "Error updating the collection",
+		})
+		return
+	}
+	c.Redirect(http.StatusFound, fmt.Sprintf("/collections/%d", collection.ID))
+}
+
+// Delete a collection. The links in it aren't deleted.
+func (app *App) deleteCollection(c *gin.Context) {
+	collection, _, ok := app.loadCollection(c, accessManage)
+	if !ok {
+		return
+	}
+	if err := app.store.DeleteCollection(collection.ID); err != nil {
+		render(c, http.StatusInternalServerError, "error.html", gin.H{
+			"error": "Error deleting the collection",
+		})
+		return
+	}
+	if collection.ParentID != 0 {
+		c.Redirect(http.StatusFound, fmt.Sprintf("/collections/%d", collection.ParentID))
+		return
+	}
+	c.Redirect(http.StatusFound, collectionsPath(collection.WorkspaceID))
+}
+
+// Whether a link may go in a collection: it has to be in the same library
+func inSameLibrary(collection Collection, link Link) bool {
+	if link.WorkspaceID != collection.WorkspaceID {
+		return false
+	}
+	return link.WorkspaceID != 0 || link.UserID == collection.UserID
+}
+
+// Put a link in a collection, from the link's page
+func (app *App) addToCollection(c *gin.Context) {
+	userID := sessions.Default(c).Get("user_id").(int)
+	collection, _, ok := app.loadCollection(c, accessManage)
+	if !ok {
+		return
+	}
+	linkID, err := strconv.Atoi(c.PostForm("link_id"))
+	if err != nil {
+		render(c, http.StatusBadRequest, "error.html", gin.H{
+			"error": "Invalid link ID",
+		})
+		return
+	}
+	link, err := app.store.GetLinkByID(linkID)
+	access := accessNone
+	if err == nil {
+		access, err = app.linkAccess(link, userID)
+	}
+	if err != nil || access < accessManage {
+		render(c, http.StatusNotFound, "error.html", gin.H{
+			"error": "Link not found",
+		})
+		return
+	}
+	if !inSameLibrary(collection, link) {
+		render(c, http.StatusBadRequest, "error.html", gin.H{
+			"error": "Links can only go in collections of the same workspace",
+		})
+		return
+	}
+
+	if err := app.store.AddLinkToCollection(collection.ID, link.ID); err != nil {
+		render(c, http.StatusInternalServerError, "error.html", gin.H{
+			"error": "Error adding the link to the collection",
+		})
+		return
+	}
+	c.Redirect(http.StatusFound, fmt.Sprintf("/links/%d", link.ID))
+}
+
+// Take a link out of a collection, from the collection's page or the
+// link's
+func (app *App) removeFromCollection(c *gin.Context) {
+	collection, _, ok := app.loadCollection(c, accessManage)
+	if !ok {
+		return
+	}
+	linkID, err := strconv.Atoi(c.Param("link_id"))
+	if err != nil {
+		render(c, http.StatusBadRequest, "error.html", gin.H{
+			"error": "Invalid link ID",
+		})
+		return
+	}
+	err = app.store.RemoveLinkFromCollection(collection.ID, linkID)
+	if err != nil && !errors.Is(err, ErrNotInCollection) {
+		render(c, http.StatusInternalServerError, "error.html", gin.H{
+			"error": "Error removing the link from the collection",
+		})
+		return
+	}
+
+	if c.PostForm("back") == "link" {
+		c.Redirect(http.StatusFound, fmt.Sprintf("/links/%d", linkID))
+		return
+	}
+	c.Redirect(http.StatusFound, fmt.Sprintf("/collections/%d", collection.ID))
+}
+
+// Body of the reorder request
+type collectionOrder struct {
+	LinkIDs []int `json:"link_ids"`
+}
+
+// Save a new order for the links of a collection. The collection page
+// sends this as JSON after a link is dragged somewhere else.
+func (app *App) reorderCollection(c *gin.Context) {
+	userID := sessions.Default(c).Get("user_id").(int)
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid collection ID"})
+		return
+	}
+	collection, err := app.store.GetCollection(id)
+	access := accessNone
+	if err == nil {
+		access, err = app.collectionAccess(collection, userID)
+	}
+	if err != nil || access < accessRead {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Collection not found"})
+		return
+	}
+	if access < accessManage {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You don't have permission to change this collection"})
+		return
+	}
+
+	var order collectionOrder
+	if err := json.NewDecoder(c.Request.Body).Decode(&order); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Send the new order as JSON"})
+		return
+	}
+	err = app.store.ReorderCollection(collection.ID, order.LinkIDs)
+	if errors.Is(err, ErrCollectionOrderStale) {
+		// Someone else added or removed a link in the meantime
+		c.JSON(http.StatusConflict, gin.H{"error": "The collection changed, reload the page and try again"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error saving the order"})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// The collections a link is in that the user can see, and if they manage
+// the link, the ones of its library it could still go in
+func (app *App) linkCollections(link Link, userID int, canManage bool) (in []Collection, available []collectionNode, err error) {
+	collections, err := app.store.GetLinkCollections(link.ID)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, collection := range collections {
+		if access, err := app.collectionAccess(collection, userID); err == nil && access >= accessRead {
+			in = append(in, collection)
+		}
+	}
+	if !canManage {
+		return in, nil, nil
+	}
+
+	library, err := libraryCollections(app.store, link.UserID, link.WorkspaceID)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, node := range collectionTree(library, 0) {
+		if !containsCollection(collections, node.ID) {
+			available = append(available, node)
+		}
+	}
+	return in, available, nil
+}
+
+func containsCollection(collections []Collection, id int) bool {
+	for _, collection := range collections {
+		if collection.ID == id {
+			return true
+		}
+	}
+	return false
+}
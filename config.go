@@ -4,39 +4,123 @@ import (
 	"fmt"
 	"os"
 	"strconv"
+	"time"
 )
 
 // Config holds all the configuration for the application
 type Config struct {
 	// Database settings
+	DBDriver   string // "memory", "mysql" or "sqlite"
+	DBPath     string // database file when using sqlite
 	DBUser     string
 	DBPassword string
 	DBHost     string
 	DBPort     string
 	DBName     string
 	
+	// Apply pending migrations on startup instead of refusing to start
+	DBAutoMigrate bool
+	
+	// Where the in-memory store keeps its snapshot and journal,
+	// empty means nothing is saved
+	DataDir          string
+	SnapshotInterval time.Duration
+	
 	// Server settings
 	ServerPort int
 	
 	// Session settings
-	SessionSecret string
+	SessionSecret       string
+	SessionMaxAge       time.Duration // sessions end this long after login
+	SessionIdleTimeout  time.Duration // or after this long without a request
+	SessionSecureCookie bool          // only send the cookie over HTTPS
+	
+	// Limits for fetching pages people save (titles, favicons, ...)
+	FetchTimeout      time.Duration
+	FetchMaxBytes     int64
+	FetchMaxRedirects int
+	FetchAllow        string // hosts or CIDR ranges that may be fetched even if private, comma separated
+	
+	// Archived copies of saved pages
+	ArchiveOnSave       bool  // archive every new link right away
+	ArchiveMaxSnapshots int   // copies kept per link, the oldest go first
+	ArchiveMaxBytes     int64 // images, styles and fonts inlined into one copy
+	
+	// Checking saved links for rot
+	HealthCheckEnabled   bool
+	HealthCheckInterval  time.Duration // how often each link is checked
+	HealthCheckWorkers   int           // links checked at the same time
+	HealthCheckHostDelay time.Duration // between requests to the same site
+	HealthBrokenAfter    int           // failed checks in a row before a link counts as broken
+	
+	// Check API traffic against the OpenAPI spec. Bad requests get a 400,
+	// bad responses (a bug on our side) a 500.
+	APIValidateRequests  bool
+	APIValidateResponses bool
+	
+	// Password hashing: "bcrypt" or "argon2id". Raising the cost only
+	// affects new hashes, older ones are upgraded when their owner logs in.
+	PasswordHashAlgorithm string
+	BcryptCost            int
+	Argon2Memory          int // KiB
+	Argon2Time            int
+	Argon2Threads         int
 }
 
 // LoadConfig loads configuration from environment variables with fallbacks to default values
 func LoadConfig() Config {
 	config := Config{
 		// Database defaults - CHANGE THESE FOR YOUR STRATO HOSTING
+		DBDriver:   getEnv("DB_DRIVER", "memory"),
+		DBPath:     getEnv("DB_PATH", "linkcollector.db"),
 		DBUser:     getEnv("DB_USER", "dbu4004523"),
 		DBPassword: getEnv("DB_PASSWORD", "Plesk3317_"),
 		DBHost:     getEnv("DB_HOST", "your_db_host"),
 		DBPort:     getEnv("DB_PORT", "3306"),
 		DBName:     getEnv("DB_NAME", "dbs14018482"),
 		
+		DBAutoMigrate: getEnvAsBool("DB_AUTO_MIGRATE", true),
+		
+		DataDir:          getEnv("DATA_DIR", ""),
+		SnapshotInterval: getEnvAsDuration("SNAPSHOT_INTERVAL", 10*time.Minute),
+		
 		// Server defaults
 		ServerPort: getEnvAsInt("SERVER_PORT", 8080),
 		
 		// Session defaults
-		SessionSecret: getEnv("SESSION_SECRET", "change-this-to-something-secure-in-production"),
+		SessionSecret:       getEnv("SESSION_SECRET", "change-this-to-something-secure-in-production"),
+		SessionMaxAge:       getEnvAsDuration("SESSION_MAX_AGE", 30*24*time.Hour),
+		SessionIdleTimeout:  getEnvAsDuration("SESSION_IDLE_TIMEOUT", 7*24*time.Hour),
+		SessionSecureCookie: getEnvAsBool("SESSION_SECURE_COOKIE", false),
+		
+		// Fetching defaults
+		FetchTimeout:      getEnvAsDuration("FETCH_TIMEOUT", 10*time.Second),
+		FetchMaxBytes:     int64(getEnvAsInt("FETCH_MAX_BYTES", 2*1024*1024)),
+		FetchMaxRedirects: getEnvAsInt("FETCH_MAX_REDIRECTS", 5),
+		FetchAllow:        getEnv("FETCH_ALLOW", ""),
+		
+		// Archive defaults
+		ArchiveOnSave:       getEnvAsBool("ARCHIVE_ON_SAVE", true),
+		ArchiveMaxSnapshots: getEnvAsInt("ARCHIVE_MAX_SNAPSHOTS", 10),
+		ArchiveMaxBytes:     int64(getEnvAsInt("ARCHIVE_MAX_BYTES", 10*1024*1024)),
+		
+		// Link check defaults
+		HealthCheckEnabled:   getEnvAsBool("HEALTH_CHECK", true),
+		HealthCheckInterval:  getEnvAsDuration("HEALTH_CHECK_INTERVAL", 24*time.Hour),
+		HealthCheckWorkers:   getEnvAsInt("HEALTH_CHECK_WORKERS", 4),
+		HealthCheckHostDelay: getEnvAsDuration("HEALTH_CHECK_HOST_DELAY", 2*time.Second),
+		HealthBrokenAfter:    getEnvAsInt("HEALTH_BROKEN_AFTER", 2),
+		
+		// API validation defaults, response checks are mostly for development
+		APIValidateRequests:  getEnvAsBool("API_VALIDATE_REQUESTS", true),
+		APIValidateResponses: getEnvAsBool("API_VALIDATE_RESPONSES", false),
+		
+		// Password hashing defaults
+		PasswordHashAlgorithm: getEnv("PASSWORD_HASH_ALGORITHM", "bcrypt"),
+		BcryptCost:            getEnvAsInt("BCRYPT_COST", 12),
+		Argon2Memory:          getEnvAsInt("ARGON2_MEMORY", 64*1024),
+		Argon2Time:            getEnvAsInt("ARGON2_TIME", 3),
+		Argon2Threads:         getEnvAsInt("ARGON2_THREADS", 2),
 	}
 	
 	return config
@@ -44,11 +128,19 @@ func LoadConfig() Config {
 
 // GetDSN returns the database connection string
 func (c *Config) GetDSN() string {
-	// MySQL connection string format: username:password@tcp(host:port)/dbname?parseTime=true
-	return fmt.Sprintf("%s:%s@tcp(%s:%s)/%s?parseTime=true", 
+	// MySQL connection string format: username:password@tcp(host:port)/dbname?parseTime=true&charset=utf8mb4
+	return fmt.Sprintf("%s:%s@tcp(%s:%s)/%s?parseTime=true&charset=utf8mb4", 
 		c.DBUser, c.DBPassword, c.DBHost, c.DBPort, c.DBName)
 }
 
+// GetSQLiteDSN returns the connection string for the SQLite database file
+func (c *Config) GetSQLiteDSN() string {
+	// Foreign keys are off by default in SQLite, and WAL lets readers keep
+	// going while something is being written
+	return fmt.Sprintf("file:%s?_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)",
+		c.DBPath)
+}
+
 // Helper function to get environment variable with a default value
 func getEnv(key, defaultValue string) string {
 	value, exists := os.LookupEnv(key)
@@ -65,4 +157,22 @@ func getEnvAsInt(key string, defaultValue int) int {
 		return value
 	}
 	return defaultValue
-} 
\ No newline at end of file
+}
+
+// Helper function to parse bool environment variables with a default value
+func getEnvAsBool(key string, defaultValue bool) bool {
+	valueStr := getEnv(key, "")
+	if value, err := strconv.ParseBool(valueStr); err == nil {
+		return value
+	}
+	return defaultValue
+}
+
+// Helper function to parse duration environment variables (like "10m") with a default value
+func getEnvAsDuration(key string, defaultValue time.Duration) time.Duration {
+	valueStr := getEnv(key, "")
+	if value, err := time.ParseDuration(valueStr); err == nil && value > 0 {
+		return value
+	}
+	return defaultValue
+}
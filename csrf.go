@@ -0,0 +1,94 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"net/http"
+	"strings"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+)
+
+// Sessions get a random CSRF token the first time a page with a form is
+// rendered for them. Pages put it in a hidden csrf_token field of every form
+// (render adds it to the template data), and any request that can change
+// something has to send it back, either in that field or in an X-CSRF-Token
+// header. Another site can make the browser send our session cookie, but it
+// can't read the token.
+
+const (
+	csrfSessionKey = "csrf_token"
+	csrfFormField  = "csrf_token"
+	csrfHeader     = "X-CSRF-Token"
+	csrfDataKey    = "csrfToken"
+)
+
+// Generate a new random token
+func newCSRFToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// Pages with a form that people see before they log in. Every page of a
+// logged in user gets the token, they have a session anyway, but visitors
+// that only look around shouldn't start one.
+var anonymousFormPages = map[string]bool{
+	"login.html":    true,
+	"register.html": true,
+}
+
+// The session's CSRF token, made and saved the first time it's needed
+func csrfToken(c *gin.Context) (string, error) {
+	session := sessions.Default(c)
+	if token, _ := session.Get(csrfSessionKey).(string); token != "" {
+		return token, nil
+	}
+	token, err := newCSRFToken()
+	if err != nil {
+		return "", err
+	}
+	session.Set(csrfSessionKey, token)
+	if err := session.Save(); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// CSRF middleware, has to run after the session middleware
+func csrfProtection() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// The API only accepts bearer tokens, which a browser never sends
+		// on its own, so there is nothing to forge there
+		if strings.HasPrefix(c.Request.URL.Path, "/api/") {
+			c.Next()
+			return
+		}
+
+		switch c.Request.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			c.Next()
+			return
+		}
+
+		// A session without a token never got a form, so nothing it sends
+		// can be right
+		token, _ := sessions.Default(c).Get(csrfSessionKey).(string)
+		sent := c.GetHeader(csrfHeader)
+		if sent == "" {
+			sent = c.PostForm(csrfFormField)
+		}
+		if token == "" || subtle.ConstantTimeCompare([]byte(sent), []byte(token)) != 1 {
+			c.HTML(http.StatusForbidden, "error.html", gin.H{
+				"error": "Your form has expired or didn't come from this site. Please go back, reload the page and try again.",
+			})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// Links count as duplicates when their URLs have the same DuplicateKey.
+// Only links in the same library are compared: a user's personal links, or
+// the links of a workspace. Two people saving the same page is fine.
+
+// Find the links of a library (see libraryLinks) that point at the same
+// page as rawURL, newest first. exceptID is left out, so a link isn't its
+// own duplicate.
+func findDuplicateLinks(store Store, userID, workspaceID int, rawURL string, exceptID int) ([]Link, error) {
+	links, err := libraryLinks(store, userID, workspaceID)
+	if err != nil {
+		return nil, err
+	}
+	key := DuplicateKey(rawURL)
+	var duplicates []Link
+	for _, link := range links {
+		if link.ID != exceptID && DuplicateKey(link.URL) == key {
+			duplicates = append(duplicates, link)
+		}
+	}
+	return duplicates, nil
+}
+
+// Merge from into into: into gets from's tags, and its description and
+// favicon if it has none. from is deleted afterwards, unless it was never
+// saved (ID 0). into keeps its own URL, title and archived copies; from's
+// archived copies go with it.
+func mergeLinks(store Store, into *Link, from Link) error {
+	changed := false
+	if into.Description == "" && from.Description != "" {
+		into.Description = from.Description
+		changed = true
+	}
+	if into.Favicon == "" && from.Favicon != "" {
+		into.Favicon = from.Favicon
+		changed = true
+	}
+	if changed {
+		if err := store.UpdateLink(into); err != nil {
+			return err
+		}
+	}
+
+	tags := into.Tags
+	for _, tag := range from.Tags {
+		if !containsTag(tags, tag) {
+			tags = append(tags, tag)
+		}
+	}
+	if len(tags) > len(into.Tags) {
+		if err := store.SetLinkTags(into.ID, tags); err != nil {
+			return err
+		}
+		into.Tags = tags
+	}
+
+	if from.ID != 0 {
+		if err := store.DeleteLink(from.ID); err != nil && !errors.Is(err, ErrLinkNotFound) {
+			return err
+		}
+	}
+	return nil
+}
+
+func containsTag(tags []string, tag string) bool {
+	for _, existing := range tags {
+		if existing == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// "linkcollector dedupe [--dry-run]" merges duplicate links that were saved
+// before we looked out for them, in every user's personal links and every
+// workspace. In every group of duplicates the oldest link is kept, gets the
+// tags of the others and its URL cleaned up by NormalizeURL. With --dry-run
+// it only says what it would do. Stop the server first when using the
+// in-memory store with DATA_DIR.
+func runDedupeCommand(config Config, args []string) error {
+	dryRun := false
+	for _, arg := range args {
+		switch arg {
+		case "--dry-run", "-n":
+			dryRun = true
+		default:
+			return fmt.Errorf("unknown dedupe option %q (use --dry-run)", arg)
+		}
+	}
+
+	if (config.DBDriver == "memory" || config.DBDriver == "") && config.DataDir == "" {
+		return fmt.Errorf("nothing to do, the in-memory store only keeps links when DATA_DIR is set")
+	}
+	store, err := openStore(config, NewPasswordHasher(config))
+	if err != nil {
+		return err
+	}
+	users, err := store.ListUsers()
+	if err != nil {
+		return err
+	}
+
+	// Every user's personal links, then every workspace someone is in
+	type library struct {
+		name                string
+		userID, workspaceID int
+	}
+	var libraries []library
+	for _, user := range users {
+		libraries = append(libraries, library{name: user.Username, userID: user.ID})
+	}
+	seen := make(map[int]bool)
+	for _, user := range users {
+		memberships, err := store.GetUserMemberships(user.ID)
+		if err != nil {
+			return err
+		}
+		for _, member := range memberships {
+			if seen[member.WorkspaceID] {
+				continue
+			}
+			seen[member.WorkspaceID] = true
+			workspace, err := store.GetWorkspace(member.WorkspaceID)
+			if err != nil {
+				return err
+			}
+			libraries = append(libraries, library{name: "workspace " + workspace.Name, workspaceID: workspace.ID})
+		}
+	}
+
+	merged := 0
+	for _, lib := range libraries {
+		links, err := libraryLinks(store, lib.userID, lib.workspaceID)
+		if err != nil {
+			return err
+		}
+		n, err := dedupeLinks(store, lib.name, links, dryRun)
+		if err != nil {
+			return err
+		}
+		merged += n
+	}
+
+	switch {
+	case merged == 0:
+		fmt.Println("No duplicate links found")
+	case dryRun:
+		fmt.Printf("Would merge %d duplicate link(s), nothing was changed\n", merged)
+	default:
+		fmt.Printf("Merged %d duplicate link(s)\n", merged)
+	}
+	return nil
+}
+
+// Merge the duplicates among the links of one library, for the dedupe
+// command. Returns how many links were (or would be) merged away.
+func dedupeLinks(store Store, name string, links []Link, dryRun bool) (int, error) {
+	groups := make(map[string][]Link)
+	var keys []string
+	for _, link := range links {
+		key := DuplicateKey(link.URL)
+		if groups[key] == nil {
+			keys = append(keys, key)
+		}
+		groups[key] = append(groups[key], link)
+	}
+
+	merged := 0
+	for _, key := range keys {
+		group := groups[key]
+		if len(group) < 2 {
+			continue
+		}
+		// Keep the oldest, it's the one people have been linking to
+		sort.Slice(group, func(i, j int) bool {
+			if !group[i].CreatedAt.Equal(group[j].CreatedAt) {
+				return group[i].CreatedAt.Before(group[j].CreatedAt)
+			}
+			return group[i].ID < group[j].ID
+		})
+		into := group[0]
+		fmt.Printf("%s: keeping link %d (%s)\n", name, into.ID, into.URL)
+		for _, from := range group[1:] {
+			fmt.Printf("%s:   merging link %d (%s)\n", name, from.ID, from.URL)
+			if !dryRun {
+				if err := mergeLinks(store, &into, from); err != nil {
+					return merged, fmt.Errorf("merging link %d into %d: %w", from.ID, into.ID, err)
+				}
+			}
+			merged++
+		}
+
+		if normalized, err := NormalizeURL(into.URL); err == nil && normalized != into.URL {
+			fmt.Printf("%s:   cleaning up URL to %s\n", name, normalized)
+			if !dryRun {
+				into.URL = normalized
+				if err := store.UpdateLink(&into); err != nil {
+					return merged, err
+				}
+			}
+		}
+	}
+	return merged, nil
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+)
+
+// Saved links rot: pages disappear, sites move, domains expire and end up
+// on parking pages. The health checker goes over all links in the
+// background and remembers what it found, so the dashboard can point out
+// broken links and offer to replace them.
+
+// LinkHealth is what the last check of a link's URL found
+type LinkHealth struct {
+	StatusCode    int        `json:"status_code"`    // 0 if there was no response
+	FinalURL      string     `json:"final_url"`      // where redirects ended up
+	CheckedAt     *time.Time `json:"checked_at"`     // nil if never checked
+	FailureStreak int        `json:"failure_streak"` // failed checks in a row
+	Error         string     `json:"error"`          // what was wrong, empty if nothing
+}
+
+// Broken tells whether the link failed enough checks in a row that it's
+// probably not coming back
+func (h LinkHealth) Broken() bool {
+	return h.FailureStreak >= config.HealthBrokenAfter
+}
+
+// Moved tells whether the link worked the last time but redirected
+// somewhere else
+func (l Link) Moved() bool {
+	return l.Health.Error == "" && l.Health.FinalURL != "" && l.Health.FinalURL != l.URL
+}
+
+const (
+	healthUserAgent = "LinkCollector/1.0 (+link check)"
+	// Links looked at per run, the rest wait for the next one
+	healthBatchSize = 1000
+	// Give the server a moment to start before the first run
+	healthStartDelay = 10 * time.Second
+)
+
+// Where expired domains end up. Redirecting to one of these counts as
+// broken, even though the parking page itself loads fine.
+var parkingHosts = []string{
+	"sedoparking.com", "parkingcrew.net", "bodis.com", "above.com",
+	"dan.com", "afternic.com", "hugedomains.com", "parklogic.com",
+	"domainmarket.com", "undeveloped.com",
+}
+
+// HealthChecker checks links in the background
+type HealthChecker struct {
+	store        Store
+	client       *http.Client
+	workers      int
+	hostDelay    time.Duration // between two requests to the same host
+	recheckAfter time.Duration
+
+	mu       sync.Mutex
+	nextSlot map[string]time.Time // host -> when it may be asked again
+}
+
+// NewHealthChecker creates a checker that uses client for its requests (see
+// NewOutboundClient) and checks each link again after recheckAfter
+func NewHealthChecker(store Store, client *http.Client, workers int, hostDelay, recheckAfter time.Duration) *HealthChecker {
+	if workers < 1 {
+		workers = 1
+	}
+	return &HealthChecker{
+		store:        store,
+		client:       client,
+		workers:      workers,
+		hostDelay:    hostDelay,
+		recheckAfter: recheckAfter,
+		nextSlot:     make(map[string]time.Time),
+	}
+}
+
+// Start checks whatever is due shortly after startup and then once an
+// hour (or more often for short recheck intervals)
+func (h *HealthChecker) Start() {
+	every := time.Hour
+	if h.recheckAfter < every {
+		every = h.recheckAfter
+	}
+	go func() {
+		time.Sleep(healthStartDelay)
+		for {
+			if err := h.RunOnce(context.Background()); err != nil {
+				fmt.Println("Link check failed:", err)
+			}
+			time.Sleep(every)
+		}
+	}()
+}
+
+// RunOnce checks every link that's due, a few at a time
+func (h *HealthChecker) RunOnce(ctx context.Context) error {
+	links, err := h.store.GetLinksToCheck(time.Now().Add(-h.recheckAfter), healthBatchSize)
+	if err != nil {
+		return err
+	}
+	h.forgetIdleHosts()
+
+	jobs := make(chan Link)
+	var wg sync.WaitGroup
+	for i := 0; i < h.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for link := range jobs {
+				health := h.Check(ctx, link)
+				if err := h.store.SaveLinkHealth(link.ID, link.URL, health); err != nil && !errors.Is(err, ErrLinkNotFound) {
+					fmt.Printf("Could not save check of link %d: %v\n", link.ID, err)
+				}
+			}
+		}()
+	}
+	for _, link := range links {
+		jobs <- link
+	}
+	close(jobs)
+	wg.Wait()
+
+	if len(links) > 0 {
+		fmt.Printf("Checked %d link(s)\n", len(links))
+	}
+	return nil
+}
+
+// Check requests a link's URL and works out its new health
+func (h *HealthChecker) Check(ctx context.Context, link Link) LinkHealth {
+	now := time.Now()
+	health := LinkHealth{CheckedAt: &now, FailureStreak: link.Health.FailureStreak}
+
+	// Only web addresses can be checked
+	u, err := url.Parse(link.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		health.FailureStreak = 0
+		return health
+	}
+
+	if err := h.waitForHost(ctx, u.Hostname()); err != nil {
+		health.Error = "not checked"
+		return health
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		health.Error = "invalid URL"
+		health.FailureStreak++
+		return health
+	}
+	req.Header.Set("User-Agent", healthUserAgent)
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		if errors.Is(err, ErrBlockedDestination) {
+			// Not broken, just somewhere we aren't allowed to look
+			health.Error = "private address, not checked"
+			return health
+		}
+		health.Error = describeCheckError(err)
+		health.FailureStreak++
+		return health
+	}
+	// We only care about the status, not the page
+	resp.Body.Close()
+
+	health.StatusCode = resp.StatusCode
+	health.FinalURL = resp.Request.URL.String()
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests:
+		// The site is there, it just doesn't want to talk to us right now
+		health.Error = resp.Status
+		return health
+	case resp.StatusCode >= 400:
+		health.Error = resp.Status
+	case parkedDomain(resp.Request.URL.Hostname()):
+		health.Error = "redirects to a domain parking page"
+	}
+
+	if health.Error != "" {
+		health.FailureStreak++
+	} else {
+		health.FailureStreak = 0
+	}
+	return health
+}
+
+// Wait until host may be asked again, and book the next slot
+func (h *HealthChecker) waitForHost(ctx context.Context, host string) error {
+	h.mu.Lock()
+	now := time.Now()
+	slot := h.nextSlot[host]
+	if slot.Before(now) {
+		slot = now
+	}
+	h.nextSlot[host] = slot.Add(h.hostDelay)
+	h.mu.Unlock()
+
+	select {
+	case <-time.After(time.Until(slot)):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Drop hosts nobody is waiting for, so the map doesn't grow forever
+func (h *HealthChecker) forgetIdleHosts() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	now := time.Now()
+	for host, slot := range h.nextSlot {
+		if slot.Before(now) {
+			delete(h.nextSlot, host)
+		}
+	}
+}
+
+// Whether host belongs to a domain parking service
+func parkedDomain(host string) bool {
+	host = strings.ToLower(host)
+	for _, parking := range parkingHosts {
+		if host == parking || strings.HasSuffix(host, "."+parking) {
+			return true
+		}
+	}
+	return false
+}
+
+// Turn a failed request into something short enough for the dashboard
+func describeCheckError(err error) string {
+	var dnsErr *net.DNSError
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return "timed out"
+	case errors.As(err, &dnsErr) && dnsErr.IsNotFound:
+		return "domain doesn't exist"
+	case errors.As(err, &dnsErr):
+		return "could not look up the domain"
+	case strings.Contains(err.Error(), "redirects"):
+		return "too many redirects"
+	default:
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			return "timed out"
+		}
+		return "could not connect"
+	}
+}
+
+// Forget what earlier checks found, after the URL changed
+func (app *App) resetLinkHealth(link Link) {
+	if err := app.store.SaveLinkHealth(link.ID, link.URL, LinkHealth{}); err != nil {
+		fmt.Printf("Could not reset check of link %d: %v\n", link.ID, err)
+	}
+}
+
+// Replace broken or moved links: moved ones get the URL they redirect to,
+// broken ones can point readers at their latest archived copy instead. The
+// URL stays what it was then, it's still what the link is about.
+func (app *App) replaceBrokenLinks(c *gin.Context) {
+	userID := sessions.Default(c).Get("user_id").(int)
+	action := c.PostForm("action")
+	if action != "redirect" && action != "archive" {
+		render(c, http.StatusBadRequest, "error.html", gin.H{
+			"error": "Pick what to replace the links with",
+		})
+		return
+	}
+
+	replaced, skipped := 0, 0
+	for _, value := range c.PostFormArray("link_id") {
+		id, err := strconv.Atoi(value)
+		if err != nil {
+			skipped++
+			continue
+		}
+		link, err := app.store.GetLinkByID(id)
+		if err != nil {
+			skipped++
+			continue
+		}
+		if access, err := app.linkAccess(link, userID); err != nil || access < accessManage {
+			skipped++
+			continue
+		}
+
+		switch action {
+		case "redirect":
+			if !link.Moved() {
+				skipped++
+				continue
+			}
+			link.URL = link.Health.FinalURL
+			link.ReplacedByArchiveID = 0
+		case "archive":
+			pages, err := app.store.GetLinkArchivedPages(link.ID)
+			if err != nil || len(pages) == 0 {
+				skipped++
+				continue
+			}
+			link.ReplacedByArchiveID = pages[0].ID
+		}
+
+		if err := app.store.UpdateLink(&link); err != nil {
+			render(c, http.StatusInternalServerError, "error.html", gin.H{
+				"error": "Error updating your links",
+			})
+			return
+		}
+		if action == "redirect" {
+			app.resetLinkHealth(link)
+		}
+		replaced++
+	}
+
+	// Back to the dashboard, or the workspace the links were in
+	workspaceID, _ := strconv.Atoi(c.PostForm("workspace_id"))
+	c.Redirect(http.StatusFound, fmt.Sprintf("%s?filter=broken&replaced=%d&skipped=%d",
+		libraryPath(workspaceID), replaced, skipped))
+}
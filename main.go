@@ -3,40 +3,47 @@ package main
 import (
 	"fmt"
 	"net/http"
+	"os"
 	"strconv"
 	"strings"
-	"sync"
 	"time"
 
+	"github.com/getkin/kin-openapi/openapi3"
 	"github.com/gin-contrib/sessions"
-	"github.com/gin-contrib/sessions/cookie"
 	"github.com/gin-gonic/gin"
 )
 
 // Global configuration
 var config Config
 
-// In-memory storage for local testing
-var (
-	users     = make(map[int]*User)
-	links     = make(map[int]*Link)
-	tags      = make(map[int]*Tag)
-	linkTags  = make(map[int][]int) // map[linkID][]tagID
-	userIDSeq = 1
-	linkIDSeq = 1
-	tagIDSeq  = 1
-	mu        sync.RWMutex // Mutex for thread safety
-)
+// App holds everything the handlers depend on
+type App struct {
+	store        Store
+	passwords    *PasswordHasher
+	sessions     *ServerSessionStore
+	openapi      *openapi3.T
+	apiValidator gin.HandlerFunc
+	metadata     *MetadataFetcher
+	archiver     *Archiver
+}
+
+// Name of the session cookie
+const sessionName = "linkcollector"
 
 // Link struct represents a saved link with tags
 type Link struct {
-	ID          int       `json:"id"`
-	URL         string    `json:"url"`
-	Title       string    `json:"title"`
-	Description string    `json:"description"`
-	UserID      int       `json:"user_id"`
-	CreatedAt   time.Time `json:"created_at"`
-	Tags        []string  `json:"tags"`
+	ID                  int        `json:"id"`
+	URL                 string     `json:"url"`
+	Title               string     `json:"title"`
+	Description         string     `json:"description"`
+	Favicon             string     `json:"favicon"`      // icon of the site, fetched when the link is added
+	UserID              int        `json:"user_id"`      // who saved it
+	WorkspaceID         int        `json:"workspace_id"` // the workspace it belongs to, 0 for personal links
+	CreatedAt           time.Time  `json:"created_at"`
+	Tags                []string   `json:"tags"`
+	Visibility          string     `json:"visibility"`             // private, unlisted or public, see visibility.go
+	Health              LinkHealth `json:"health"`                 // filled in by the health checker, see health.go
+	ReplacedByArchiveID int        `json:"replaced_by_archive_id"` // archived copy to read instead when the URL is dead, 0 for none
 }
 
 // User struct for user account info
@@ -47,19 +54,104 @@ type User struct {
 	Email    string `json:"email"`
 }
 
-// Tag struct for link categorization
+// Tag struct for link categorization. Every user has their own tags for
+// their personal links, and every workspace has its own for its links.
 type Tag struct {
-	ID   int    `json:"id"`
-	Name string `json:"name"`
+	ID          int    `json:"id"`
+	Name        string `json:"name"` // the whole path for nested tags, like lang/go
+	ParentID    int    `json:"parent_id"` // the tag above it, 0 for top level tags
+	UserID      int    `json:"user_id"` // whose personal tag it is, 0 for workspace tags
+	WorkspaceID int    `json:"workspace_id"` // the workspace it belongs to, 0 for personal tags
+	LinkCount   int    `json:"link_count"` // how many links have this tag (not counting the tags below it)
 }
 
 func main() {
 	// Load configuration
 	config = LoadConfig()
 	
-	// Initialize in-memory database with some demo data
-	initInMemoryDatabase()
+	// "linkcollector migrate ..." manages the database schema and exits
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := runMigrateCommand(config, os.Args[2:]); err != nil {
+			fmt.Println("Migration failed:", err)
+			os.Exit(1)
+		}
+		return
+	}
+	
+	// "linkcollector dedupe [--dry-run]" merges links saved more than once
+	if len(os.Args) > 1 && os.Args[1] == "dedupe" {
+		if err := runDedupeCommand(config, os.Args[2:]); err != nil {
+			fmt.Println("Dedupe failed:", err)
+			os.Exit(1)
+		}
+		return
+	}
+	
+	// Connect to the database (or set up the in-memory one)
+	passwords := NewPasswordHasher(config)
+	store, err := openStore(config, passwords)
+	if err != nil {
+		fmt.Println("Could not open the database:", err)
+		os.Exit(1)
+	}
+	// Sessions are kept in the same store as everything else
+	sessionStore := NewServerSessionStore(store, []byte(config.SessionSecret),
+		config.SessionMaxAge, config.SessionIdleTimeout, config.SessionSecureCookie)
+	sessionStore.StartCleanup(time.Hour)
+	
+	// The API is described (and checked) by an OpenAPI spec
+	spec, err := buildOpenAPISpec()
+	if err != nil {
+		fmt.Println("Could not build the API spec:", err)
+		os.Exit(1)
+	}
+	apiValidator, err := openAPIValidator(spec, config.APIValidateRequests, config.APIValidateResponses)
+	if err != nil {
+		fmt.Println("Could not set up API validation:", err)
+		os.Exit(1)
+	}
+	
+	// Everything fetched from user supplied URLs goes through this client,
+	// which keeps those requests away from our own network
+	outbound, err := NewOutboundClient(config)
+	if err != nil {
+		fmt.Println("Could not set up outbound requests:", err)
+		os.Exit(1)
+	}
+	
+	app := &App{
+		store:        store,
+		passwords:    passwords,
+		sessions:     sessionStore,
+		openapi:      spec,
+		apiValidator: apiValidator,
+		metadata:     NewMetadataFetcher(outbound, config.FetchMaxBytes),
+		archiver:     NewArchiver(outbound, config.ArchiveMaxBytes),
+	}
+
+	// Check saved links for rot in the background
+	if config.HealthCheckEnabled {
+		NewHealthChecker(store, outbound, config.HealthCheckWorkers,
+			config.HealthCheckHostDelay, config.HealthCheckInterval).Start()
+	}
 
+	router := newRouter(app)
+	
+	// The tests keep the routes and the spec in sync, this is just a
+	// reminder for builds that skipped them
+	if err := checkOpenAPIRoutes(spec, router.Routes()); err != nil {
+		fmt.Println("Warning:", err)
+	}
+
+	// Run the server
+	port := config.ServerPort
+	fmt.Printf("Server running at http://localhost:%d\n", port)
+	router.Run(fmt.Sprintf(":%d", port))
+}
+
+// Build the router with the templates, middleware and routes, also used by
+// the tests
+func newRouter(app *App) *gin.Engine {
 	// Create a gin router with default middleware
 	router := gin.Default()
 	
@@ -73,6 +165,17 @@ func main() {
 		"templates/edit_link.html",
 		"templates/view_link.html",
 		"templates/search.html",
+		"templates/shared.html",
+		"templates/sharing.html",
+		"templates/autotag.html",
+		"templates/workspaces.html",
+		"templates/workspace_members.html",
+		"templates/collections.html",
+		"templates/collection.html",
+		"templates/tags.html",
+		"templates/sessions.html",
+		"templates/api_tokens.html",
+		"templates/archive.html",
 		"templates/error.html",
 		"templates/test.html",
 	)
@@ -81,323 +184,220 @@ func main() {
 	router.Static("/static", "./static")
 	
 	// Set up session middleware
-	store := cookie.NewStore([]byte(config.SessionSecret))
-	router.Use(sessions.Sessions("linkcollector", store))
+	router.Use(sessions.Sessions(sessionName, app.sessions))
+	
+	// Every form post needs the CSRF token from the page it came from
+	router.Use(csrfProtection())
 
 	// Set up routes
-	setupRoutes(router)
+	setupRoutes(router, app)
+	
+	return router
+}
 
-	// Run the server
-	port := config.ServerPort
-	fmt.Printf("Server running at http://localhost:%d\n", port)
-	router.Run(fmt.Sprintf(":%d", port))
+// Pick the storage backend based on the config
+func openStore(config Config, passwords *PasswordHasher) (Store, error) {
+	switch config.DBDriver {
+	case "memory", "":
+		store := NewMemoryStore()
+		restored := false
+		if config.DataDir != "" {
+			var err error
+			restored, err = store.EnablePersistence(config.DataDir)
+			if err != nil {
+				return nil, err
+			}
+			store.StartSnapshots(config.SnapshotInterval)
+			fmt.Printf("Saving in-memory database to %s\n", config.DataDir)
+		}
+		// Initialize in-memory database with some demo data, but only
+		// the very first time so we don't add it again on every restart
+		if !restored {
+			initInMemoryDatabase(store, passwords)
+		}
+		return store, nil
+	case "mysql":
+		db, err := openMigratedSQL(config, "mysql", config.GetDSN())
+		if err != nil {
+			return nil, err
+		}
+		fmt.Printf("Connected to MySQL database %s on %s\n", config.DBName, config.DBHost)
+		return NewSQLStore(db, "mysql"), nil
+	case "sqlite":
+		db, err := openMigratedSQL(config, "sqlite", config.GetSQLiteDSN())
+		if err != nil {
+			return nil, err
+		}
+		fmt.Printf("Using SQLite database %s\n", config.DBPath)
+		return NewSQLStore(db, "sqlite"), nil
+	default:
+		return nil, fmt.Errorf("unknown DB_DRIVER %q", config.DBDriver)
+	}
 }
 
 // Initialize in-memory database with sample data
-func initInMemoryDatabase() {
-	mu.Lock()
-	defer mu.Unlock()
-	
+func initInMemoryDatabase(store Store, passwords *PasswordHasher) {
 	// Create a demo user
+	passwordHash, err := passwords.Hash("demo")
+	if err != nil {
+		fmt.Println("Could not hash demo password:", err)
+		return
+	}
 	user := &User{
-		ID:       userIDSeq,
 		Username: "demo",
-		Password: "demo", // In a real app, this would be hashed
+		Password: passwordHash,
 		Email:    "demo@example.com",
 	}
-	users[user.ID] = user
-	userIDSeq++
-	
-	// Create some sample tags
-	tag1 := createTag("programming")
-	tag2 := createTag("golang")
-	tag3 := createTag("web")
+	if err := store.CreateUser(user); err != nil {
+		fmt.Println("Could not create demo user:", err)
+		return
+	}
 	
 	// Create some sample links
-	link1 := createLink("https://golang.org", "Go Programming Language", "The official Go website", user.ID)
-	link2 := createLink("https://github.com", "GitHub", "Where the world builds software", user.ID)
+	link1 := &Link{URL: "https://golang.org", Title: "Go Programming Language", Description: "The official Go website", UserID: user.ID, Visibility: VisibilityPublic}
+	link2 := &Link{URL: "https://github.com", Title: "GitHub", Description: "Where the world builds software", UserID: user.ID, Visibility: VisibilityPublic}
+	store.CreateLink(link1)
+	store.CreateLink(link2)
 	
 	// Add tags to links
-	addTagToLink(link1.ID, tag1.ID)
-	addTagToLink(link1.ID, tag2.ID)
-	addTagToLink(link2.ID, tag3.ID)
+	store.SetLinkTags(link1.ID, []string{"programming", "golang"})
+	store.SetLinkTags(link2.ID, []string{"web"})
 	
 	fmt.Println("In-memory database initialized with sample data")
 }
 
-// Create a new tag
-func createTag(name string) *Tag {
-	tag := &Tag{
-		ID:   tagIDSeq,
-		Name: name,
-	}
-	tags[tag.ID] = tag
-	tagIDSeq++
-	return tag
-}
-
-// Create a new link
-func createLink(url, title, description string, userID int) *Link {
-	link := &Link{
-		ID:          linkIDSeq,
-		URL:         url,
-		Title:       title,
-		Description: description,
-		UserID:      userID,
-		CreatedAt:   time.Now(),
-		Tags:        []string{},
-	}
-	links[link.ID] = link
-	linkIDSeq++
-	return link
-}
-
-// Add a tag to a link
-func addTagToLink(linkID, tagID int) {
-	if _, exists := linkTags[linkID]; !exists {
-		linkTags[linkID] = []int{}
-	}
-	linkTags[linkID] = append(linkTags[linkID], tagID)
-}
-
-// In-memory database helper functions
-
-// Get user by username
-func getUserByUsername(username string) (User, error) {
-	mu.RLock()
-	defer mu.RUnlock()
-	
-	for _, user := range users {
-		if user.Username == username {
-			return *user, nil
-		}
-	}
-	return User{}, fmt.Errorf("user not found")
-}
-
-// Get all links for a user
-func getUserLinks(userID int) ([]Link, error) {
-	mu.RLock()
-	defer mu.RUnlock()
+func setupRoutes(router *gin.Engine, app *App) {
+	// Public routes
+	router.GET("/", app.homePage)
+	router.GET("/login", showLoginPage)
+	router.POST("/login", app.processLogin)
+	router.GET("/register", showRegisterPage)
+	router.POST("/register", app.processRegistration)
+	router.GET("/test", testPage)
+	// Public and unlisted links can be viewed without logging in,
+	// viewLink checks who may see what
+	router.GET("/links/:id", app.viewLink)
 	
-	var userLinks []Link
-	for _, link := range links {
-		if link.UserID == userID {
-			// Deep copy the link
-			linkCopy := *link
-			// Get tags for this link
-			if tagIDs, exists := linkTags[link.ID]; exists {
-				for _, tagID := range tagIDs {
-					if tag, exists := tags[tagID]; exists {
-						linkCopy.Tags = append(linkCopy.Tags, tag.Name)
-					}
-				}
-			}
-			userLinks = append(userLinks, linkCopy)
-		}
+	// Protected routes (need authentication)
+	authorized := router.Group("/")
+	authorized.Use(authRequired())
+	{
+		authorized.GET("/dashboard", app.dashboardPage)
+		authorized.GET("/links/add", app.showAddLinkPage)
+		authorized.GET("/links/metadata", app.linkMetadata)
+		authorized.POST("/links/add", app.processAddLink)
+		authorized.POST("/links/replace-broken", app.replaceBrokenLinks)
+		authorized.GET("/links/:id/edit", app.showEditLinkPage)
+		authorized.POST("/links/:id/edit", app.processEditLink)
+		authorized.POST("/links/:id/delete", app.deleteLink)
+		authorized.POST("/links/:id/archive", app.archiveLinkNow)
+		authorized.POST("/links/:id/share", app.shareLink)
+		authorized.POST("/shares/:id/revoke", app.revokeShare)
+		authorized.GET("/shared", app.sharedWithMePage)
+		authorized.GET("/search", app.searchLinks)
+		authorized.POST("/logout", logout)
+		authorized.GET("/settings/sessions", app.sessionsPage)
+		authorized.POST("/settings/sessions/:id/revoke", app.revokeSession)
+		authorized.POST("/settings/sessions/revoke-all", app.revokeAllSessions)
+		authorized.GET("/settings/tokens", app.apiTokensPage)
+		authorized.POST("/settings/tokens", app.createAPIToken)
+		authorized.POST("/settings/tokens/:id/revoke", app.revokeAPIToken)
+		authorized.GET("/settings/sharing", app.sharingPage)
+		authorized.POST("/settings/sharing", app.shareTag)
+		authorized.GET("/settings/autotag", app.autoTagPage)
+		authorized.POST("/settings/autotag", app.createAutoTagRule)
+		authorized.POST("/settings/autotag/:id/apply", app.applyAutoTagRule)
+		authorized.POST("/settings/autotag/:id/delete", app.deleteAutoTagRule)
+		authorized.GET("/workspaces", app.workspacesPage)
+		authorized.POST("/workspaces", app.createWorkspace)
+		authorized.GET("/workspaces/:id", app.workspacePage)
+		authorized.GET("/workspaces/:id/search", app.searchWorkspace)
+		authorized.GET("/workspaces/:id/members", app.workspaceMembersPage)
+		authorized.POST("/workspaces/:id/invites", app.inviteToWorkspace)
+		authorized.POST("/workspaces/:id/members/:user_id/role", app.changeMemberRole)
+		authorized.POST("/workspaces/:id/members/:user_id/remove", app.removeMember)
+		authorized.POST("/workspaces/:id/rename", app.renameWorkspace)
+		authorized.POST("/workspaces/:id/delete", app.deleteWorkspace)
+		authorized.POST("/invites/:id/accept", app.acceptInvite)
+		authorized.POST("/invites/:id/decline", app.declineInvite)
+		authorized.GET("/collections", app.collectionsPage)
+		authorized.POST("/collections", app.createCollection)
+		authorized.GET("/collections/:id", app.collectionPage)
+		authorized.POST("/collections/:id/edit", app.updateCollection)
+		authorized.POST("/collections/:id/delete", app.deleteCollection)
+		authorized.POST("/collections/:id/links", app.addToCollection)
+		authorized.POST("/collections/:id/links/:link_id/remove", app.removeFromCollection)
+		authorized.POST("/collections/:id/order", app.reorderCollection)
+		
+		// Tags
+		authorized.GET("/tags", app.tagsPage)
+		authorized.GET("/tags/suggestions", app.tagSuggestions)
+		authorized.POST("/tags/move", app.moveTag)
+		authorized.POST("/tags/merge", app.mergeTags)
+		authorized.POST("/tags/cleanup", app.cleanUpTags)
+		authorized.POST("/tags/:id/rename", app.renameTag)
+		authorized.POST("/tags/:id/delete", app.deleteTag)
 	}
-	return userLinks, nil
-}
-
-// Get public links (for non-logged in users)
-func getPublicLinks(limit int) ([]Link, error) {
-	mu.RLock()
-	defer mu.RUnlock()
 	
-	var publicLinks []Link
-	count := 0
-	for _, link := range links {
-		// Deep copy the link
-		linkCopy := *link
-		// Get tags for this link
-		if tagIDs, exists := linkTags[link.ID]; exists {
-			for _, tagID := range tagIDs {
-				if tag, exists := tags[tagID]; exists {
-					linkCopy.Tags = append(linkCopy.Tags, tag.Name)
-				}
-			}
-		}
-		publicLinks = append(publicLinks, linkCopy)
-		count++
-		if count >= limit {
-			break
-		}
-	}
-	return publicLinks, nil
-}
-
-// Get recent links for a user
-func getRecentLinks(userID int, limit int) ([]Link, error) {
-	links, err := getUserLinks(userID)
-	if err != nil {
-		return nil, err
+	// Archived pages are someone else's HTML, they get a sandbox of their own.
+	// Copies of public and unlisted links can be read without logging in,
+	// viewableArchivedPage checks who may see what.
+	archive := router.Group("/archive")
+	archive.Use(archiveSandbox())
+	{
+		archive.GET("/:id", app.viewArchivedPage)
+		archive.GET("/:id/full", app.viewArchivedFullPage)
+		archive.GET("/:id/text", app.viewArchivedText)
 	}
 	
-	// Sort by created_at (normally would be done with SQL)
-	// For this simple version, just return what we have
-	if len(links) > limit {
-		return links[:limit], nil
-	}
-	return links, nil
-}
-
-// Get a link by ID
-func getLinkByID(id int) (Link, error) {
-	mu.RLock()
-	defer mu.RUnlock()
-	
-	if link, exists := links[id]; exists {
-		// Deep copy the link
-		linkCopy := *link
-		// Get tags for this link
-		if tagIDs, exists := linkTags[link.ID]; exists {
-			for _, tagID := range tagIDs {
-				if tag, exists := tags[tagID]; exists {
-					linkCopy.Tags = append(linkCopy.Tags, tag.Name)
-				}
-			}
-		}
-		return linkCopy, nil
+	// JSON API, authenticated with personal API tokens
+	router.GET(openAPIPath, serveOpenAPISpec(app.openapi))
+	api := router.Group(apiBasePath)
+	api.Use(app.apiAuthRequired(), app.apiValidator)
+	{
+		api.GET("/me", requireScope("read"), app.apiMe)
+		api.GET("/links", requireScope("read"), app.apiListLinks)
+		api.POST("/links", requireScope("write"), app.apiCreateLink)
+		api.GET("/links/:id", requireScope("read"), app.apiGetLink)
+		api.PUT("/links/:id", requireScope("write"), app.apiUpdateLink)
+		api.PATCH("/links/:id", requireScope("write"), app.apiUpdateLink)
+		api.DELETE("/links/:id", requireScope("write"), app.apiDeleteLink)
+		api.GET("/tags", requireScope("read"), app.apiListTags)
+		api.GET("/tags/suggestions", requireScope("read"), app.apiTagSuggestions)
+		api.POST("/tags/merge", requireScope("write"), app.apiMergeTags)
+		api.POST("/tags/cleanup", requireScope("write"), app.apiCleanUpTags)
+		api.PATCH("/tags/:id", requireScope("write"), app.apiRenameTag)
+		api.DELETE("/tags/:id", requireScope("write"), app.apiDeleteTag)
+		api.GET("/search", requireScope("read"), app.apiSearch)
 	}
-	return Link{}, fmt.Errorf("link not found")
-}
-
-// Get all tags for a link
-func getLinkTags(linkID int) ([]string, error) {
-	mu.RLock()
-	defer mu.RUnlock()
 	
-	var tagNames []string
-	if tagIDs, exists := linkTags[linkID]; exists {
-		for _, tagID := range tagIDs {
-			if tag, exists := tags[tagID]; exists {
-				tagNames = append(tagNames, tag.Name)
-			}
+	// API clients want JSON even for routes that don't exist
+	router.NoRoute(func(c *gin.Context) {
+		if strings.HasPrefix(c.Request.URL.Path, "/api/") {
+			apiError(c, http.StatusNotFound, "no such endpoint")
+			return
 		}
-	}
-	return tagNames, nil
+		c.String(http.StatusNotFound, "404 page not found")
+	})
 }
 
-// Add a tag to a link (by name)
-func addTagToLinkByName(linkID int, tagName string) error {
-	mu.Lock()
-	defer mu.Unlock()
-	
-	// Check if tag exists
-	var tagID int
-	var tagExists bool
-	for id, tag := range tags {
-		if tag.Name == tagName {
-			tagID = id
-			tagExists = true
-			break
-		}
-	}
-	
-	// Create tag if it doesn't exist
-	if !tagExists {
-		tag := createTag(tagName)
-		tagID = tag.ID
-	}
-	
-	// Add tag to link
-	if _, exists := linkTags[linkID]; !exists {
-		linkTags[linkID] = []int{}
+// Render a template with the data every page needs (like the CSRF token
+// for its forms) added in
+func render(c *gin.Context, code int, name string, data gin.H) {
+	if data == nil {
+		data = gin.H{}
 	}
-	
-	// Check if link already has this tag
-	for _, id := range linkTags[linkID] {
-		if id == tagID {
-			return nil // Tag already exists for this link
-		}
-	}
-	
-	linkTags[linkID] = append(linkTags[linkID], tagID)
-	return nil
-}
-
-// Search for links by query
-func searchUserLinks(userID int, query string) ([]Link, error) {
-	mu.RLock()
-	defer mu.RUnlock()
-	
-	var results []Link
-	query = strings.ToLower(query)
-	
-	for _, link := range links {
-		if link.UserID != userID {
-			continue
-		}
-		
-		// Check if query matches link title, URL, or description
-		if strings.Contains(strings.ToLower(link.Title), query) ||
-		   strings.Contains(strings.ToLower(link.URL), query) ||
-		   strings.Contains(strings.ToLower(link.Description), query) {
-			// Deep copy the link
-			linkCopy := *link
-			// Get tags for this link
-			if tagIDs, exists := linkTags[link.ID]; exists {
-				for _, tagID := range tagIDs {
-					if tag, exists := tags[tagID]; exists {
-						linkCopy.Tags = append(linkCopy.Tags, tag.Name)
-						// Also check if query matches a tag
-						if strings.Contains(strings.ToLower(tag.Name), query) {
-							linkCopy.Tags = append(linkCopy.Tags, tag.Name)
-						}
-					}
-				}
-			}
-			results = append(results, linkCopy)
-			continue
-		}
-		
-		// Check if query matches any tag
-		if tagIDs, exists := linkTags[link.ID]; exists {
-			for _, tagID := range tagIDs {
-				if tag, exists := tags[tagID]; exists {
-					if strings.Contains(strings.ToLower(tag.Name), query) {
-						// Deep copy the link
-						linkCopy := *link
-						// Get all tags for this link
-						for _, tid := range tagIDs {
-							if t, exists := tags[tid]; exists {
-								linkCopy.Tags = append(linkCopy.Tags, t.Name)
-							}
-						}
-						results = append(results, linkCopy)
-						break
-					}
-				}
-			}
+	if sessions.Default(c).Get("user_id") != nil || anonymousFormPages[name] {
+		token, err := csrfToken(c)
+		if err != nil {
+			c.HTML(http.StatusInternalServerError, "error.html", gin.H{
+				"error": "Could not start your session",
+			})
+			return
 		}
+		data[csrfDataKey] = token
 	}
-	
-	return results, nil
-}
-
-func setupRoutes(router *gin.Engine) {
-	// Public routes
-	router.GET("/", homePage)
-	router.GET("/login", showLoginPage)
-	router.POST("/login", processLogin)
-	router.GET("/register", showRegisterPage)
-	router.POST("/register", processRegistration)
-	router.GET("/test", testPage)
-	
-	// Protected routes (need authentication)
-	authorized := router.Group("/")
-	authorized.Use(authRequired())
-	{
-		authorized.GET("/dashboard", dashboardPage)
-		authorized.GET("/links/add", showAddLinkPage)
-		authorized.POST("/links/add", processAddLink)
-		authorized.GET("/links/:id", viewLink)
-		authorized.GET("/links/:id/edit", showEditLinkPage)
-		authorized.POST("/links/:id/edit", processEditLink)
-		authorized.POST("/links/:id/delete", deleteLink)
-		authorized.GET("/search", searchLinks)
-		authorized.GET("/logout", logout)
-	}
+	c.HTML(code, name, data)
 }
 
 // Authentication middleware
@@ -416,7 +416,7 @@ func authRequired() gin.HandlerFunc {
 }
 
 // Handler for home page
-func homePage(c *gin.Context) {
+func (app *App) homePage(c *gin.Context) {
 	// Get session info to check if user is logged in
 	session := sessions.Default(c)
 	userID := session.Get("user_id")
@@ -427,22 +427,21 @@ func homePage(c *gin.Context) {
 	// If user is logged in, show their most recent links
 	// Otherwise, show public/popular links
 	if userID != nil {
-		recentLinks, err = getRecentLinks(userID.(int), 5)
+		recentLinks, err = app.store.GetRecentLinks(userID.(int), 5)
 	} else {
-		// For now, just show some recent public links
-		// in like any reality you'd probably want to implement some privacy settings
-		recentLinks, err = getPublicLinks(5)
+		// Only links their owners made public
+		recentLinks, err = app.store.GetPublicLinks(5)
 	}
 	
 	if err != nil {
-		c.HTML(http.StatusInternalServerError, "error.html", gin.H{
+		render(c, http.StatusInternalServerError, "error.html", gin.H{
 			"error": "Error loading recent links",
 		})
 		return
 	}
 	
 	// Use standalone homepage template
-	c.HTML(http.StatusOK, "home.html", gin.H{
+	render(c, http.StatusOK, "home.html", gin.H{
 		"title": "LinkCollector - Save and Share Your Links",
 		"userID": userID,
 		"recentLinks": recentLinks,
@@ -451,29 +450,47 @@ func homePage(c *gin.Context) {
 
 // Show login page
 func showLoginPage(c *gin.Context) {
-	c.HTML(http.StatusOK, "login.html", gin.H{
+	render(c, http.StatusOK, "login.html", gin.H{
 		"title": "Login",
 	})
 }
 
 // Process login form
-func processLogin(c *gin.Context) {
+func (app *App) processLogin(c *gin.Context) {
 	username := c.PostForm("username")
-	password := c.PostForm("password") // need to hash and compare this
-	
-	// TODO: Actually implement proper password hashing
-	// This is just a simple example, NOT secure for production please dont use this in production
+	password := c.PostForm("password")
 	
-	user, err := getUserByUsername(username)
-	if err != nil || user.Password != password {
-		c.HTML(http.StatusUnauthorized, "login.html", gin.H{
+	user, err := app.store.GetUserByUsername(username)
+	if err != nil {
+		// Still spend the time hashing so nobody can tell which usernames exist
+		app.passwords.dummyVerify(password)
+	}
+	ok, needsRehash := false, false
+	if err == nil {
+		ok, needsRehash = app.passwords.Verify(user.Password, password)
+	}
+	if !ok {
+		render(c, http.StatusUnauthorized, "login.html", gin.H{
 			"title": "Login",
 			"error": "Invalid username or password",
 		})
 		return
 	}
 	
-	// Set user session
+	// Upgrade plaintext or outdated hashes now that we know the password
+	if needsRehash {
+		if err := app.rehashPassword(user.ID, password); err != nil {
+			fmt.Printf("Could not upgrade password hash for user %d: %v\n", user.ID, err)
+		}
+	}
+	
+	// Start a fresh session so an ID planted before login is useless
+	if err := app.sessions.Regenerate(c.Request, sessionName); err != nil {
+		render(c, http.StatusInternalServerError, "error.html", gin.H{
+			"error": "Could not log you in",
+		})
+		return
+	}
 	session := sessions.Default(c)
 	session.Set("user_id", user.ID)
 	session.Set("username", user.Username)
@@ -482,22 +499,31 @@ func processLogin(c *gin.Context) {
 	c.Redirect(http.StatusFound, "/dashboard")
 }
 
+// Store a fresh hash of the password with the current settings
+func (app *App) rehashPassword(userID int, password string) error {
+	passwordHash, err := app.passwords.Hash(password)
+	if err != nil {
+		return err
+	}
+	return app.store.UpdateUserPassword(userID, passwordHash)
+}
+
 // Show registration page
 func showRegisterPage(c *gin.Context) {
-	c.HTML(http.StatusOK, "register.html", gin.H{
+	render(c, http.StatusOK, "register.html", gin.H{
 		"title": "Register",
 	})
 }
 
 // Process registration form
-func processRegistration(c *gin.Context) {
+func (app *App) processRegistration(c *gin.Context) {
 	username := c.PostForm("username")
 	password := c.PostForm("password")
 	email := c.PostForm("email")
 	
 	// Basic validation - should be much more robust in real app
 	if username == "" || password == "" || email == "" {
-		c.HTML(http.StatusBadRequest, "register.html", gin.H{
+		render(c, http.StatusBadRequest, "register.html", gin.H{
 			"title": "Register",
 			"error": "All fields are required",
 		})
@@ -505,29 +531,45 @@ func processRegistration(c *gin.Context) {
 	}
 	
 	// Check if username already exists
-	_, err := getUserByUsername(username)
+	_, err := app.store.GetUserByUsername(username)
 	if err == nil {
-		c.HTML(http.StatusBadRequest, "register.html", gin.H{
+		render(c, http.StatusBadRequest, "register.html", gin.H{
 			"title": "Register",
 			"error": "Username already exists",
 		})
 		return
 	}
 	
-	// Create new user in memory
-	mu.Lock()
+	// Create new user
+	passwordHash, err := app.passwords.Hash(password)
+	if err != nil {
+		render(c, http.StatusBadRequest, "register.html", gin.H{
+			"title": "Register",
+			"error": "Could not use that password, try a shorter one",
+		})
+		return
+	}
 	newUser := &User{
-		ID:       userIDSeq,
 		Username: username,
-		Password: password, // TODO: should hash this in a real app
+		Password: passwordHash,
 		Email:    email,
 	}
-	users[userIDSeq] = newUser
-	userID := userIDSeq
-	userIDSeq++
-	mu.Unlock()
+	if err := app.store.CreateUser(newUser); err != nil {
+		render(c, http.StatusBadRequest, "register.html", gin.H{
+			"title": "Register",
+			"error": "Could not create your account",
+		})
+		return
+	}
+	userID := newUser.ID
 	
 	// Set user session
+	if err := app.sessions.Regenerate(c.Request, sessionName); err != nil {
+		render(c, http.StatusInternalServerError, "error.html", gin.H{
+			"error": "Could not log you in",
+		})
+		return
+	}
 	session := sessions.Default(c)
 	session.Set("user_id", userID)
 	session.Set("username", username)
@@ -537,36 +579,101 @@ func processRegistration(c *gin.Context) {
 }
 
 // User dashboard page
-func dashboardPage(c *gin.Context) {
+func (app *App) dashboardPage(c *gin.Context) {
 	session := sessions.Default(c)
 	userID := session.Get("user_id").(int)
 	username := session.Get("username").(string)
 	
 	// Get user's links
-	links, err := getUserLinks(userID)
+	links, err := app.store.GetUserLinks(userID)
 	if err != nil {
-		c.HTML(http.StatusInternalServerError, "error.html", gin.H{
+		render(c, http.StatusInternalServerError, "error.html", gin.H{
 			"error": "Error loading your links",
 		})
 		return
 	}
 	
-	c.HTML(http.StatusOK, "dashboard.html", gin.H{
+	tags, err := app.store.GetUserTags(userID)
+	if err != nil {
+		render(c, http.StatusInternalServerError, "error.html", gin.H{
+			"error": "Error loading your tags",
+		})
+		return
+	}
+	
+	app.renderDashboard(c, links, gin.H{
 		"title": "Your Dashboard",
 		"username": username,
-		"links": links,
+		"canManage": true,
+		"basePath": "/dashboard",
+		"tags": tags,
+		"searchPath": "/search",
 	})
 }
 
+// Show a list of links on the dashboard, the user's own or a workspace's
+func (app *App) renderDashboard(c *gin.Context, links []Link, data gin.H) {
+	// Only the links with a tag (or a tag below it) when one is picked
+	tagFilter := cleanTagName(c.Query("tag"))
+	if tagFilter != "" {
+		links = filterTagged(links, tagFilter)
+		data["tagFilter"] = tagFilter
+	}
+	if tags, ok := data["tags"].([]Tag); ok {
+		data["tagTree"] = tagTree(usedTags(tags), tagFilter)
+	}
+	
+	// Links the health checker found problems with
+	var problems []Link
+	for _, link := range links {
+		if link.Health.Broken() || link.Moved() {
+			problems = append(problems, link)
+		}
+	}
+	
+	data["links"] = links
+	data["problemCount"] = len(problems)
+	if c.Query("filter") == "broken" {
+		data["brokenFilter"] = true
+		data["links"] = problems
+		data["replaced"] = c.Query("replaced")
+		data["skipped"] = c.Query("skipped")
+	}
+	render(c, http.StatusOK, "dashboard.html", data)
+}
+
 // Show add link page
-func showAddLinkPage(c *gin.Context) {
-	c.HTML(http.StatusOK, "add_link.html", gin.H{
-		"title": "Add New Link",
+func (app *App) showAddLinkPage(c *gin.Context) {
+	workspaceID, _ := strconv.Atoi(c.Query("workspace"))
+	app.renderAddLink(c, http.StatusOK, gin.H{
+		"link": Link{WorkspaceID: workspaceID},
 	})
 }
 
+// Render the add link form, with the workspaces the link can go to
+func (app *App) renderAddLink(c *gin.Context, code int, data gin.H) {
+	userID := sessions.Default(c).Get("user_id").(int)
+	workspaces, err := app.userWorkspaces(userID)
+	if err != nil {
+		render(c, http.StatusInternalServerError, "error.html", gin.H{
+			"error": "Error loading your workspaces",
+		})
+		return
+	}
+	var writable []membershipView
+	for _, workspace := range workspaces {
+		if roleAtLeast(workspace.Role, RoleEditor) {
+			writable = append(writable, workspace)
+		}
+	}
+	
+	data["title"] = "Add New Link"
+	data["workspaces"] = writable
+	render(c, code, "add_link.html", data)
+}
+
 // Process add link form
-func processAddLink(c *gin.Context) {
+func (app *App) processAddLink(c *gin.Context) {
 	session := sessions.Default(c)
 	userID := session.Get("user_id").(int)
 	
@@ -574,135 +681,267 @@ func processAddLink(c *gin.Context) {
 	title := c.PostForm("title")
 	description := c.PostForm("description")
 	tags := c.PostForm("tags")
+	visibility := c.DefaultPostForm("visibility", VisibilityPrivate)
+	workspaceID, _ := strconv.Atoi(c.PostForm("workspace_id"))
+	
+	// Viewers can't add links to a workspace
+	if ok, err := app.canAddLinks(workspaceID, userID); err != nil || !ok {
+		render(c, http.StatusForbidden, "error.html", gin.H{
+			"error": "You can't add links to that workspace",
+		})
+		return
+	}
 	
 	// Basic validation
-	if url == "" || title == "" {
-		c.HTML(http.StatusBadRequest, "add_link.html", gin.H{
-			"title": "Add New Link",
-			"error": "URL and title are required",
+	if url == "" || !validVisibility(visibility) {
+		errMsg := "URL is required"
+		if url != "" {
+			errMsg = "Pick who can see the link"
+		}
+		app.renderAddLink(c, http.StatusBadRequest, gin.H{
+			"error": errMsg,
 			"link": Link{
 				URL: url,
 				Title: title,
 				Description: description,
+				WorkspaceID: workspaceID,
 			},
+			"tags": tags,
 		})
 		return
 	}
 	
-	// Create the link
-	mu.Lock()
+	url, err := NormalizeURL(url)
+	if err != nil {
+		app.renderAddLink(c, http.StatusBadRequest, gin.H{
+			"error": "That doesn't look like a web address",
+			"link": Link{
+				URL: c.PostForm("url"),
+				Title: title,
+				Description: description,
+				Visibility: visibility,
+				WorkspaceID: workspaceID,
+			},
+			"tags": tags,
+		})
+		return
+	}
+	
+	// Saved this page before? Ask whether to add to that link instead,
+	// unless they already said to keep both
+	choice := c.PostForm("duplicate")
+	if choice != "keep" {
+		duplicates, err := findDuplicateLinks(app.store, userID, workspaceID, url, 0)
+		if err != nil {
+			render(c, http.StatusInternalServerError, "error.html", gin.H{
+				"error": "Error loading your links",
+			})
+			return
+		}
+		if len(duplicates) > 0 && choice == "merge" {
+			// The oldest one is the original
+			into := duplicates[len(duplicates)-1]
+			err := mergeLinks(app.store, &into, Link{Description: description, Tags: parseTags(tags)})
+			if err != nil {
+				render(c, http.StatusInternalServerError, "error.html", gin.H{
+					"error": "Error merging your link",
+				})
+				return
+			}
+			c.Redirect(http.StatusFound, fmt.Sprintf("/links/%d", into.ID))
+			return
+		}
+		if len(duplicates) > 0 {
+			app.renderAddLink(c, http.StatusConflict, gin.H{
+				"duplicates": duplicates,
+				"link": Link{
+					URL: url,
+					Title: title,
+					Description: description,
+					Visibility: visibility,
+					WorkspaceID: workspaceID,
+				},
+				"tags": tags,
+			})
+			return
+		}
+	}
+	
+	// Fill in the title and description from the page if they're empty
 	link := &Link{
-		ID:          linkIDSeq,
 		URL:         url,
 		Title:       title,
 		Description: description,
 		UserID:      userID,
-		CreatedAt:   time.Now(),
-		Tags:        []string{},
-	}
-	links[link.ID] = link
-	linkID := linkIDSeq
-	linkIDSeq++
-	mu.Unlock()
-	
-	// Process tags if provided
-	if tags != "" {
-		tagSlice := strings.Split(tags, ",")
-		for _, tag := range tagSlice {
-			tag = strings.TrimSpace(tag)
-			if tag != "" {
-				addTagToLinkByName(linkID, tag)
-			}
-		}
+		WorkspaceID: workspaceID,
+		Visibility:  visibility,
+	}
+	app.fillLinkMetadata(c.Request.Context(), link)
+	if link.Title == "" {
+		app.renderAddLink(c, http.StatusBadRequest, gin.H{
+			"error": "Couldn't find a title for that page, please enter one",
+			"link": link,
+			"tags": tags,
+		})
+		return
 	}
 	
-	c.Redirect(http.StatusFound, "/dashboard")
+	// Create the link
+	if err := app.store.CreateLink(link); err != nil {
+		render(c, http.StatusInternalServerError, "error.html", gin.H{
+			"error": "Error saving your link",
+		})
+		return
+	}
+	
+	// Process tags if provided, plus the ones auto-tag rules add
+	tagNames, err := app.addAutoTags(*link, parseTags(tags))
+	if err == nil {
+		err = app.store.SetLinkTags(link.ID, tagNames)
+	}
+	if err != nil {
+		render(c, http.StatusInternalServerError, "error.html", gin.H{
+			"error": "Error saving your tags",
+		})
+		return
+	}
+	
+	// Keep a copy of the page in case it disappears
+	app.archiveInBackground(*link)
+	
+	c.Redirect(http.StatusFound, libraryPath(link.WorkspaceID))
 }
 
 // View single link
-func viewLink(c *gin.Context) {
+func (app *App) viewLink(c *gin.Context) {
 	linkID := c.Param("id")
 	id, err := strconv.Atoi(linkID)
 	if err != nil {
-		c.HTML(http.StatusBadRequest, "error.html", gin.H{
+		render(c, http.StatusBadRequest, "error.html", gin.H{
 			"error": "Invalid link ID",
 		})
 		return
 	}
 	
-	link, err := getLinkByID(id)
+	// Links someone else can't see don't exist as far as they know
+	userID, _ := sessions.Default(c).Get("user_id").(int)
+	link, err := app.store.GetLinkByID(id)
 	if err != nil {
-		c.HTML(http.StatusNotFound, "error.html", gin.H{
+		render(c, http.StatusNotFound, "error.html", gin.H{
+			"error": "Link not found",
+		})
+		return
+	}
+	access, err := app.linkAccess(link, userID)
+	if err != nil || access < accessRead {
+		render(c, http.StatusNotFound, "error.html", gin.H{
 			"error": "Link not found",
 		})
 		return
 	}
 	
-	// Get link's tags
-	tags, _ := getLinkTags(id)
-	link.Tags = tags
+	// Archived copies and sharing are for whoever manages the link,
+	// workspace links are shared with the workspace's members instead
+	canManage := access == accessManage
+	canShare := canManage && link.WorkspaceID == 0
+	var archives []ArchivedPage
+	var shares []shareView
+	if canManage {
+		archives, _ = app.store.GetLinkArchivedPages(id)
+	}
+	if canShare {
+		if ownerShares, err := app.store.GetSharesByOwner(userID); err == nil {
+			var linkShares []Share
+			for _, share := range ownerShares {
+				if share.LinkID == link.ID {
+					linkShares = append(linkShares, share)
+				}
+			}
+			shares = app.describeShares(linkShares)
+		}
+	}
+	
+	// Members of the link's workspace get a way back to it
+	var workspace *Workspace
+	if role, err := app.workspaceRole(link.WorkspaceID, userID); err == nil && role != "" {
+		if found, err := app.store.GetWorkspace(link.WorkspaceID); err == nil {
+			workspace = &found
+		}
+	}
+	
+	var collections []Collection
+	var availableCollections []collectionNode
+	if userID != 0 {
+		collections, availableCollections, _ = app.linkCollections(link, userID, canManage)
+	}
 	
-	c.HTML(http.StatusOK, "view_link.html", gin.H{
+	render(c, http.StatusOK, "view_link.html", gin.H{
 		"title": link.Title,
 		"link": link,
+		"userID": userID,
+		"canManage": canManage,
+		"canShare": canShare,
+		"canEdit": access >= accessEdit,
+		"archives": archives,
+		"shares": shares,
+		"workspace": workspace,
+		"collections": collections,
+		"availableCollections": availableCollections,
 	})
 }
 
 // Show edit link page
-func showEditLinkPage(c *gin.Context) {
+func (app *App) showEditLinkPage(c *gin.Context) {
 	linkID := c.Param("id")
 	id, err := strconv.Atoi(linkID)
 	if err != nil {
-		c.HTML(http.StatusBadRequest, "error.html", gin.H{
+		render(c, http.StatusBadRequest, "error.html", gin.H{
 			"error": "Invalid link ID",
 		})
 		return
 	}
 	
-	link, err := getLinkByID(id)
+	link, err := app.store.GetLinkByID(id)
 	if err != nil {
-		c.HTML(http.StatusNotFound, "error.html", gin.H{
+		render(c, http.StatusNotFound, "error.html", gin.H{
 			"error": "Link not found",
 		})
 		return
 	}
 	
-	// Check if user owns this link
-	session := sessions.Default(c)
-	userID := session.Get("user_id").(int)
-	if link.UserID != userID {
-		c.HTML(http.StatusForbidden, "error.html", gin.H{
+	// The owner and people it was shared with for editing may edit it
+	userID := sessions.Default(c).Get("user_id").(int)
+	access, err := app.linkAccess(link, userID)
+	if err != nil || access < accessEdit {
+		render(c, http.StatusForbidden, "error.html", gin.H{
 			"error": "You don't have permission to edit this link",
 		})
 		return
 	}
 	
-	// Get link's tags
-	tags, _ := getLinkTags(id)
-	link.Tags = tags
-	
-	c.HTML(http.StatusOK, "edit_link.html", gin.H{
+	render(c, http.StatusOK, "edit_link.html", gin.H{
 		"title": "Edit Link",
 		"link": link,
-		"tags": strings.Join(tags, ", "),
+		"tags": strings.Join(link.Tags, ", "),
+		"canManage": access == accessManage,
 	})
 }
 
 // Process edit link form
-func processEditLink(c *gin.Context) {
+func (app *App) processEditLink(c *gin.Context) {
 	linkID := c.Param("id")
 	id, err := strconv.Atoi(linkID)
 	if err != nil {
-		c.HTML(http.StatusBadRequest, "error.html", gin.H{
+		render(c, http.StatusBadRequest, "error.html", gin.H{
 			"error": "Invalid link ID",
 		})
 		return
 	}
 	
-	// Check if user owns this link
-	link, err := getLinkByID(id)
+	// The owner and people it was shared with for editing may edit it
+	link, err := app.store.GetLinkByID(id)
 	if err != nil {
-		c.HTML(http.StatusNotFound, "error.html", gin.H{
+		render(c, http.StatusNotFound, "error.html", gin.H{
 			"error": "Link not found",
 		})
 		return
@@ -710,137 +949,229 @@ func processEditLink(c *gin.Context) {
 	
 	session := sessions.Default(c)
 	userID := session.Get("user_id").(int)
-	if link.UserID != userID {
-		c.HTML(http.StatusForbidden, "error.html", gin.H{
+	access, err := app.linkAccess(link, userID)
+	if err != nil || access < accessEdit {
+		render(c, http.StatusForbidden, "error.html", gin.H{
 			"error": "You don't have permission to edit this link",
 		})
 		return
 	}
+	canManage := access == accessManage
 	
-	// Update link information
+	// Update link information, only whoever manages it decides who can see it
 	url := c.PostForm("url")
 	title := c.PostForm("title")
 	description := c.PostForm("description")
 	tagsStr := c.PostForm("tags")
+	visibility := link.Visibility
+	if canManage {
+		visibility = c.DefaultPostForm("visibility", link.Visibility)
+	}
 	
 	// Basic validation
 	if url == "" || title == "" {
-		c.HTML(http.StatusBadRequest, "edit_link.html", gin.H{
+		render(c, http.StatusBadRequest, "edit_link.html", gin.H{
 			"title": "Edit Link",
 			"error": "URL and title are required",
 			"link": link,
+			"tags": tagsStr,
+			"canManage": canManage,
 		})
 		return
 	}
-	
-	// Update link in memory
-	mu.Lock()
-	if existingLink, exists := links[id]; exists {
-		existingLink.URL = url
-		existingLink.Title = title
-		existingLink.Description = description
+	if !validVisibility(visibility) {
+		render(c, http.StatusBadRequest, "edit_link.html", gin.H{
+			"title": "Edit Link",
+			"error": "Pick who can see the link",
+			"link": link,
+			"tags": tagsStr,
+			"canManage": canManage,
+		})
+		return
 	}
-	mu.Unlock()
 	
-	// Update tags - first remove existing tags
-	mu.Lock()
-	if _, exists := linkTags[id]; exists {
-		delete(linkTags, id)
+	// Only clean up the URL when it was changed, older links can have one
+	// that wouldn't be accepted anymore
+	urlChanged := link.URL != url
+	if urlChanged {
+		normalized, err := NormalizeURL(url)
+		if err != nil {
+			render(c, http.StatusBadRequest, "edit_link.html", gin.H{
+				"title": "Edit Link",
+				"error": "That doesn't look like a web address",
+				"link": link,
+				"tags": tagsStr,
+				"canManage": canManage,
+			})
+			return
+		}
+		url = normalized
+		urlChanged = link.URL != url
 	}
-	mu.Unlock()
 	
-	// Add new tags
-	if tagsStr != "" {
-		tagSlice := strings.Split(tagsStr, ",")
-		for _, tag := range tagSlice {
-			tag = strings.TrimSpace(tag)
-			if tag != "" {
-				addTagToLinkByName(id, tag)
+	// Already saved under the new URL? Ask whoever manages the link whether
+	// to merge it into that one, unless they already said to keep both
+	choice := c.PostForm("duplicate")
+	if canManage && urlChanged && choice != "keep" {
+		duplicates, err := findDuplicateLinks(app.store, link.UserID, link.WorkspaceID, url, link.ID)
+		if err != nil {
+			render(c, http.StatusInternalServerError, "error.html", gin.H{
+				"error": "Error loading your links",
+			})
+			return
+		}
+		if len(duplicates) > 0 && choice == "merge" {
+			into := duplicates[len(duplicates)-1]
+			link.Description = description
+			link.Tags = parseTags(tagsStr)
+			if err := mergeLinks(app.store, &into, link); err != nil {
+				render(c, http.StatusInternalServerError, "error.html", gin.H{
+					"error": "Error merging your link",
+				})
+				return
 			}
+			c.Redirect(http.StatusFound, fmt.Sprintf("/links/%d", into.ID))
+			return
 		}
+		if len(duplicates) > 0 {
+			link.URL = url
+			link.Title = title
+			link.Description = description
+			link.Visibility = visibility
+			render(c, http.StatusConflict, "edit_link.html", gin.H{
+				"title": "Edit Link",
+				"duplicates": duplicates,
+				"link": link,
+				"tags": tagsStr,
+				"canManage": canManage,
+			})
+			return
+		}
+	}
+	
+	// Update link, the old favicon (and the archived copy that stood in for
+	// a dead URL) is no good for a different site
+	link.URL = url
+	link.Title = title
+	link.Description = description
+	link.Visibility = visibility
+	if urlChanged {
+		app.refreshFavicon(c.Request.Context(), &link)
+		link.ReplacedByArchiveID = 0
+	}
+	if err := app.store.UpdateLink(&link); err != nil {
+		render(c, http.StatusInternalServerError, "error.html", gin.H{
+			"error": "Error updating your link",
+		})
+		return
+	}
+	if urlChanged {
+		app.resetLinkHealth(link)
+	}
+	
+	// Replace the old tags with the new ones, auto-tag rules get another
+	// look since the link changed
+	tagNames, err := app.addAutoTags(link, parseTags(tagsStr))
+	if err == nil {
+		err = app.store.SetLinkTags(id, tagNames)
+	}
+	if err != nil {
+		render(c, http.StatusInternalServerError, "error.html", gin.H{
+			"error": "Error saving your tags",
+		})
+		return
 	}
 	
 	c.Redirect(http.StatusFound, fmt.Sprintf("/links/%d", id))
 }
 
 // Delete a link
-func deleteLink(c *gin.Context) {
+func (app *App) deleteLink(c *gin.Context) {
 	linkID := c.Param("id")
 	id, err := strconv.Atoi(linkID)
 	if err != nil {
-		c.HTML(http.StatusBadRequest, "error.html", gin.H{
+		render(c, http.StatusBadRequest, "error.html", gin.H{
 			"error": "Invalid link ID",
 		})
 		return
 	}
 	
 	// Check if user owns this link
-	link, err := getLinkByID(id)
+	link, err := app.store.GetLinkByID(id)
 	if err != nil {
-		c.HTML(http.StatusNotFound, "error.html", gin.H{
+		render(c, http.StatusNotFound, "error.html", gin.H{
 			"error": "Link not found",
 		})
 		return
 	}
 	
+	// Only whoever manages it may delete it, editing doesn't include that
 	session := sessions.Default(c)
 	userID := session.Get("user_id").(int)
-	if link.UserID != userID {
-		c.HTML(http.StatusForbidden, "error.html", gin.H{
+	access, err := app.linkAccess(link, userID)
+	if err != nil || access < accessManage {
+		render(c, http.StatusForbidden, "error.html", gin.H{
 			"error": "You don't have permission to delete this link",
 		})
 		return
 	}
 	
 	// Delete the link and its tags
-	mu.Lock()
-	delete(links, id)
-	delete(linkTags, id)
-	mu.Unlock()
+	if err := app.store.DeleteLink(id); err != nil {
+		render(c, http.StatusInternalServerError, "error.html", gin.H{
+			"error": "Error deleting your link",
+		})
+		return
+	}
 	
-	c.Redirect(http.StatusFound, "/dashboard")
+	c.Redirect(http.StatusFound, libraryPath(link.WorkspaceID))
 }
 
 // Search for links
-func searchLinks(c *gin.Context) {
+func (app *App) searchLinks(c *gin.Context) {
 	query := c.Query("q")
 	session := sessions.Default(c)
 	userID := session.Get("user_id").(int)
 	
 	if query == "" {
-		c.HTML(http.StatusOK, "search.html", gin.H{
+		render(c, http.StatusOK, "search.html", gin.H{
 			"title": "Search Links",
+			"searchPath": "/search",
 		})
 		return
 	}
 	
 	// Search in user's links
-	links, err := searchUserLinks(userID, query)
+	links, err := app.store.SearchUserLinks(userID, query)
 	if err != nil {
-		c.HTML(http.StatusInternalServerError, "error.html", gin.H{
+		render(c, http.StatusInternalServerError, "error.html", gin.H{
 			"error": "Error searching links",
 		})
 		return
 	}
 	
-	c.HTML(http.StatusOK, "search.html", gin.H{
+	render(c, http.StatusOK, "search.html", gin.H{
 		"title": "Search Results",
 		"query": query,
 		"links": links,
+		"canManage": true,
+		"searchPath": "/search",
 	})
 }
 
 // Logout user
 func logout(c *gin.Context) {
+	// Delete the session on the server, not just the cookie
 	session := sessions.Default(c)
 	session.Clear()
+	session.Options(sessions.Options{MaxAge: -1})
 	session.Save()
 	c.Redirect(http.StatusFound, "/")
 }
 
 // luh simple test page for debugging
 func testPage(c *gin.Context) {
-	c.HTML(http.StatusOK, "test.html", nil)
+	render(c, http.StatusOK, "test.html", nil)
 } 
 
 
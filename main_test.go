@@ -0,0 +1,279 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The app on an in-memory store with the router main sets up, without the
+// background jobs
+func newTestApp(t *testing.T) (*App, *httptest.Server) {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	gin.DefaultWriter = io.Discard
+	config = LoadConfig()
+	config.ArchiveOnSave = false
+	config.HealthCheckEnabled = false
+	config.FetchAllow = "127.0.0.1"
+	config.FetchTimeout = 5 * time.Second
+
+	store := NewMemoryStore()
+	spec, err := buildOpenAPISpec()
+	if err != nil {
+		t.Fatal(err)
+	}
+	validator, err := openAPIValidator(spec, true, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	outbound, err := NewOutboundClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := &App{
+		store:        store,
+		passwords:    NewPasswordHasher(config),
+		sessions:     NewServerSessionStore(store, []byte("test secret"), time.Hour, time.Hour, false),
+		openapi:      spec,
+		apiValidator: validator,
+		metadata:     NewMetadataFetcher(outbound, config.FetchMaxBytes),
+		archiver:     NewArchiver(outbound, config.ArchiveMaxBytes),
+	}
+	server := httptest.NewServer(newRouter(app))
+	t.Cleanup(server.Close)
+	return app, server
+}
+
+// A browser for the test server: keeps cookies, doesn't follow redirects
+// and knows the CSRF token of the last page it got
+type testBrowser struct {
+	t      *testing.T
+	server *httptest.Server
+	client *http.Client
+	token  string
+}
+
+var csrfFieldPattern = regexp.MustCompile(`name="csrf_token" value="([^"]+)"`)
+
+func newTestBrowser(t *testing.T, server *httptest.Server) *testBrowser {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{
+		Jar: jar,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	return &testBrowser{t: t, server: server, client: client}
+}
+
+// A browser logged in as a new user. Swaps in a cheap password hasher, the
+// real one takes a while on purpose.
+func loginTestUser(t *testing.T, app *App, server *httptest.Server, username string) (*testBrowser, User) {
+	t.Helper()
+	app.passwords = testArgonHasher(1024)
+	user := createTestUser(t, app.store, username)
+	if err := app.store.UpdateUserPassword(user.ID, mustHash(t, app.passwords, "correct horse")); err != nil {
+		t.Fatal(err)
+	}
+	browser := newTestBrowser(t, server)
+	browser.get("/login")
+	if code, _ := browser.post("/login", url.Values{"username": {username}, "password": {"correct horse"}}); code != http.StatusFound {
+		t.Fatalf("logging in as %s: %d", username, code)
+	}
+	return browser, user
+}
+
+func (b *testBrowser) do(req *http.Request) (int, string) {
+	b.t.Helper()
+	resp, err := b.client.Do(req)
+	if err != nil {
+		b.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		b.t.Fatal(err)
+	}
+	if match := csrfFieldPattern.FindStringSubmatch(string(body)); match != nil {
+		b.token = match[1]
+	}
+	return resp.StatusCode, string(body)
+}
+
+func (b *testBrowser) get(path string) (int, string) {
+	b.t.Helper()
+	req, err := http.NewRequest(http.MethodGet, b.server.URL+path, nil)
+	if err != nil {
+		b.t.Fatal(err)
+	}
+	return b.do(req)
+}
+
+// Post a form with the CSRF token of the last page, like the browser would
+func (b *testBrowser) post(path string, form url.Values) (int, string) {
+	b.t.Helper()
+	form.Set("csrf_token", b.token)
+	req, err := http.NewRequest(http.MethodPost, b.server.URL+path, strings.NewReader(form.Encode()))
+	if err != nil {
+		b.t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return b.do(req)
+}
+
+func TestAddAndSearchLinks(t *testing.T) {
+	app, server := newTestApp(t)
+	page := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `<html><head><title>Gophers</title></head><body>hi</body></html>`)
+	}))
+	defer page.Close()
+
+	browser := newTestBrowser(t, server)
+	if code, _ := browser.get("/dashboard"); code != http.StatusFound {
+		t.Fatalf("dashboard without logging in: %d, want a redirect", code)
+	}
+
+	browser.get("/register")
+	code, _ := browser.post("/register", url.Values{
+		"username": {"alice"}, "password": {"correct horse"}, "email": {"alice@example.com"},
+	})
+	if code != http.StatusFound {
+		t.Fatalf("register: %d", code)
+	}
+
+	browser.get("/links/add")
+	code, _ = browser.post("/links/add", url.Values{
+		"url": {page.URL}, "title": {""}, "description": {"All about gophers"}, "tags": {"animals, go"},
+	})
+	if code != http.StatusFound {
+		t.Fatalf("add link: %d", code)
+	}
+
+	alice, err := app.store.GetUserByUsername("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	links, err := app.store.GetUserLinks(alice.ID)
+	if err != nil || len(links) != 1 {
+		t.Fatalf("alice's links = %+v, %v", links, err)
+	}
+	if links[0].Title != "Gophers" || len(links[0].Tags) != 2 {
+		t.Errorf("saved link = %+v, want the page's title and two tags", links[0])
+	}
+
+	if _, body := browser.get("/dashboard"); !strings.Contains(body, "Gophers") {
+		t.Error("the dashboard doesn't list the new link")
+	}
+	if _, body := browser.get("/search?q=gophers"); !strings.Contains(body, page.URL) {
+		t.Error("searching for gophers doesn't find the new link")
+	}
+	if _, body := browser.get("/search?q=cats"); strings.Contains(body, page.URL) {
+		t.Error("searching for cats finds the new link")
+	}
+}
+
+func TestCSRFTokenOnlyForForms(t *testing.T) {
+	_, server := newTestApp(t)
+
+	// Looking around doesn't start a session, the login form does
+	for path, wantCookie := range map[string]bool{"/": false, "/login": true} {
+		resp, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if got := len(resp.Cookies()) > 0; got != wantCookie {
+			t.Errorf("GET %s sets a cookie: %v, want %v", path, got, wantCookie)
+		}
+	}
+
+	browser := newTestBrowser(t, server)
+	browser.get("/register")
+	browser.post("/register", url.Values{
+		"username": {"alice"}, "password": {"correct horse"}, "email": {"alice@example.com"},
+	})
+	if code, _ := browser.get("/logout"); code != http.StatusNotFound {
+		t.Errorf("GET /logout: %d, want 404", code)
+	}
+	_, body := browser.get("/dashboard")
+	if !strings.Contains(body, `action="/logout"`) {
+		t.Fatal("the dashboard has no logout form")
+	}
+	token := browser.token
+	browser.token = "forged"
+	if code, _ := browser.post("/logout", url.Values{}); code != http.StatusForbidden {
+		t.Errorf("logout with a wrong token: %d, want 403", code)
+	}
+	browser.token = token
+	if code, _ := browser.post("/logout", url.Values{}); code != http.StatusFound {
+		t.Errorf("logout: %d, want a redirect", code)
+	}
+	if code, _ := browser.get("/dashboard"); code != http.StatusFound {
+		t.Errorf("dashboard after logging out: %d, want a redirect to the login page", code)
+	}
+}
+
+// Logging in starts a new session with a new form token, so neither can be
+// planted beforehand
+func TestLoginRegeneratesSession(t *testing.T) {
+	app, server := newTestApp(t)
+	app.passwords = testArgonHasher(1024)
+	alice := createTestUser(t, app.store, "alice")
+	if err := app.store.UpdateUserPassword(alice.ID, mustHash(t, app.passwords, "correct horse")); err != nil {
+		t.Fatal(err)
+	}
+
+	browser := newTestBrowser(t, server)
+	browser.get("/login")
+	serverURL, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := browser.client.Jar.Cookies(serverURL)
+	tokenBefore := browser.token
+	if len(before) == 0 || tokenBefore == "" {
+		t.Fatal("the login form didn't start a session")
+	}
+
+	if code, _ := browser.post("/login", url.Values{"username": {"alice"}, "password": {"correct horse"}}); code != http.StatusFound {
+		t.Fatalf("login: %d", code)
+	}
+	if code, _ := browser.get("/dashboard"); code != http.StatusOK {
+		t.Fatalf("dashboard after logging in: %d", code)
+	}
+	if browser.token == tokenBefore {
+		t.Error("the CSRF token from before login still works after it")
+	}
+	if after := browser.client.Jar.Cookies(serverURL); len(after) == 0 || after[0].Value == before[0].Value {
+		t.Error("the session cookie didn't change on login")
+	}
+
+	// Someone holding the old cookie isn't logged in as alice
+	planted := newTestBrowser(t, server)
+	planted.client.Jar.SetCookies(serverURL, before)
+	if code, _ := planted.get("/dashboard"); code != http.StatusFound {
+		t.Errorf("dashboard with the session cookie from before login: %d, want a redirect to the login page", code)
+	}
+}
+
+// Every API route has to be in the spec and the other way around
+func TestOpenAPIRoutes(t *testing.T) {
+	app, _ := newTestApp(t)
+	router := gin.New()
+	setupRoutes(router, app)
+	if err := checkOpenAPIRoutes(app.openapi, router.Routes()); err != nil {
+		t.Fatal(err)
+	}
+}
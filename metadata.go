@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/charset"
+)
+
+// Fetches a page and reads its title, description, canonical URL and
+// favicon from the <head>, so people don't have to type them in. OpenGraph
+// and Twitter card tags win over <title> and the plain description, they
+// are usually written for exactly this.
+
+// PageMetadata is what we could find out about a page. Fields are empty
+// when the page doesn't say.
+type PageMetadata struct {
+	Title        string `json:"title"`
+	Description  string `json:"description"`
+	CanonicalURL string `json:"canonical_url"`
+	FaviconURL   string `json:"favicon_url"`
+}
+
+// ErrNotHTML means the URL points at something that isn't a web page
+var ErrNotHTML = errors.New("not an HTML page")
+
+// Don't store novels in the title column
+const (
+	maxTitleLength       = 300
+	maxDescriptionLength = 1000
+)
+
+const metadataUserAgent = "LinkCollector/1.0 (+link preview)"
+
+// MetadataFetcher downloads pages and reads their metadata
+type MetadataFetcher struct {
+	client   *http.Client
+	maxBytes int64
+}
+
+// NewMetadataFetcher creates a fetcher that uses client for the requests
+// (which should have a timeout) and reads at most maxBytes of each page
+func NewMetadataFetcher(client *http.Client, maxBytes int64) *MetadataFetcher {
+	return &MetadataFetcher{client: client, maxBytes: maxBytes}
+}
+
+// Fetch downloads a page and reads its metadata
+func (f *MetadataFetcher) Fetch(ctx context.Context, pageURL string) (PageMetadata, error) {
+	u, err := url.Parse(pageURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return PageMetadata{}, fmt.Errorf("%q is not a web address", pageURL)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return PageMetadata{}, err
+	}
+	req.Header.Set("User-Agent", metadataUserAgent)
+	req.Header.Set("Accept", "text/html,application/xhtml+xml;q=0.9,*/*;q=0.5")
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return PageMetadata{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return PageMetadata{}, fmt.Errorf("%s returned %s", u.Host, resp.Status)
+	}
+	contentType := resp.Header.Get("Content-Type")
+	if contentType != "" {
+		mediaType, _, err := mime.ParseMediaType(contentType)
+		if err != nil || (mediaType != "text/html" && mediaType != "application/xhtml+xml") {
+			return PageMetadata{}, ErrNotHTML
+		}
+	}
+
+	// Decode to UTF-8 using the Content-Type header, a BOM or the page's own
+	// <meta charset>, whichever is there
+	body, err := charset.NewReader(io.LimitReader(resp.Body, f.maxBytes), contentType)
+	if err != nil {
+		return PageMetadata{}, err
+	}
+
+	// Relative links are relative to wherever the redirects ended up
+	return parseMetadata(body, resp.Request.URL), nil
+}
+
+// Read the metadata from the <head> of a page
+func parseMetadata(r io.Reader, pageURL *url.URL) PageMetadata {
+	base := pageURL
+	var title, canonical, icon, touchIcon string
+	meta := make(map[string]string)
+
+	z := html.NewTokenizer(r)
+	inTitle := false
+	var titleText strings.Builder
+parse:
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			// End of the page, or of as much as we were willing to read
+			break parse
+		case html.TextToken:
+			if inTitle {
+				titleText.Write(z.Text())
+			}
+		case html.EndTagToken:
+			name, _ := z.TagName()
+			switch string(name) {
+			case "title":
+				inTitle = false
+				if title == "" {
+					title = titleText.String()
+				}
+			case "head":
+				break parse
+			}
+		case html.StartTagToken, html.SelfClosingTagToken:
+			name, hasAttr := z.TagName()
+			attrs := make(map[string]string)
+			for hasAttr {
+				var key, value []byte
+				key, value, hasAttr = z.TagAttr()
+				attrs[string(key)] = string(value)
+			}
+
+			switch string(name) {
+			case "title":
+				inTitle = true
+			case "body":
+				// Everything we care about is in the <head>
+				break parse
+			case "base":
+				if href, err := base.Parse(attrs["href"]); err == nil && attrs["href"] != "" {
+					base = href
+				}
+			case "meta":
+				key := attrs["property"]
+				if key == "" {
+					key = attrs["name"]
+				}
+				key = strings.ToLower(key)
+				if _, seen := meta[key]; key != "" && !seen {
+					meta[key] = attrs["content"]
+				}
+			case "link":
+				for _, rel := range strings.Fields(strings.ToLower(attrs["rel"])) {
+					switch {
+					case rel == "canonical" && canonical == "":
+						canonical = attrs["href"]
+					case rel == "icon" && icon == "":
+						icon = attrs["href"]
+					case rel == "apple-touch-icon" && touchIcon == "":
+						touchIcon = attrs["href"]
+					}
+				}
+			}
+		}
+	}
+	if inTitle && title == "" {
+		title = titleText.String()
+	}
+
+	metadata := PageMetadata{
+		Title:       cleanText(firstNonEmpty(meta["og:title"], meta["twitter:title"], title), maxTitleLength),
+		Description: cleanText(firstNonEmpty(meta["og:description"], meta["twitter:description"], meta["description"]), maxDescriptionLength),
+	}
+	if canonical == "" {
+		canonical = meta["og:url"]
+	}
+	metadata.CanonicalURL = resolveURL(base, canonical)
+	// Browsers look for /favicon.ico on the page's own site when it doesn't
+	// name an icon
+	if icon = firstNonEmpty(icon, touchIcon); icon != "" {
+		metadata.FaviconURL = resolveURL(base, icon)
+	} else {
+		metadata.FaviconURL = resolveURL(pageURL, "/favicon.ico")
+	}
+	return metadata
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if strings.TrimSpace(value) != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// Squash whitespace and cut the text to at most max characters
+func cleanText(text string, max int) string {
+	text = strings.Join(strings.Fields(text), " ")
+	if runes := []rune(text); len(runes) > max {
+		text = strings.TrimSpace(string(runes[:max-1])) + "…"
+	}
+	return text
+}
+
+// Make a link from the page absolute, only http(s) links are kept
+func resolveURL(base *url.URL, ref string) string {
+	ref = strings.TrimSpace(ref)
+	if ref == "" {
+		return ""
+	}
+	u, err := base.Parse(ref)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return ""
+	}
+	return u.String()
+}
+
+// Fill in whatever the user left empty from the page itself. Failing to
+// fetch the page isn't an error, the user just has to type more.
+func (app *App) fillLinkMetadata(ctx context.Context, link *Link) {
+	if link.Title != "" && link.Description != "" && link.Favicon != "" {
+		return
+	}
+	metadata, err := app.metadata.Fetch(ctx, link.URL)
+	if err != nil {
+		fmt.Printf("Could not fetch metadata for %s: %v\n", link.URL, err)
+		return
+	}
+	if link.Title == "" {
+		link.Title = metadata.Title
+	}
+	if link.Description == "" {
+		link.Description = metadata.Description
+	}
+	if link.Favicon == "" {
+		link.Favicon = metadata.FaviconURL
+	}
+}
+
+// Get the new site's icon after a link's URL changed
+func (app *App) refreshFavicon(ctx context.Context, link *Link) {
+	link.Favicon = ""
+	metadata, err := app.metadata.Fetch(ctx, link.URL)
+	if err != nil {
+		fmt.Printf("Could not fetch metadata for %s: %v\n", link.URL, err)
+		return
+	}
+	link.Favicon = metadata.FaviconURL
+}
+
+// Metadata for the add link form, which fills in the empty fields with it
+func (app *App) linkMetadata(c *gin.Context) {
+	pageURL := strings.TrimSpace(c.Query("url"))
+	if pageURL == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "url is required"})
+		return
+	}
+
+	metadata, err := app.metadata.Fetch(c.Request.Context(), pageURL)
+	if errors.Is(err, ErrBlockedDestination) {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "That address can't be fetched"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Could not read that page"})
+		return
+	}
+	c.JSON(http.StatusOK, metadata)
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A fetcher on the same restricted client main uses, allowed to reach the
+// test servers on 127.0.0.1 unless allow says otherwise
+func newTestFetcher(t *testing.T, allow string, timeout time.Duration, maxBytes int64) *MetadataFetcher {
+	t.Helper()
+	config := LoadConfig()
+	config.FetchAllow = allow
+	config.FetchTimeout = timeout
+	config.FetchMaxBytes = maxBytes
+	client, err := NewOutboundClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewMetadataFetcher(client, maxBytes)
+}
+
+// A server with one page on it
+func servePage(t *testing.T, page string) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		io.WriteString(w, page)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestFetchMetadata(t *testing.T) {
+	fetcher := newTestFetcher(t, "127.0.0.1", 5*time.Second, 1<<20)
+
+	for _, test := range []struct {
+		name string
+		page string
+		want PageMetadata
+	}{
+		{
+			name: "title and description",
+			page: `<html><head><title> Gophers
+				and more </title><meta name="description" content="All about gophers"></head></html>`,
+			want: PageMetadata{Title: "Gophers and more", Description: "All about gophers"},
+		},
+		{
+			name: "OpenGraph wins",
+			page: `<head><title>Plain</title><meta name="description" content="plain">
+				<meta property="og:title" content="Open Graph"><meta property="og:description" content="og">
+				<meta property="og:url" content="/canonical"><link rel="icon" href="/icons/go.png"></head>`,
+			want: PageMetadata{Title: "Open Graph", Description: "og", CanonicalURL: "/canonical", FaviconURL: "/icons/go.png"},
+		},
+		{
+			name: "only the head counts",
+			page: `<head><title>Head</title></head><body><title>Body</title><meta name="description" content="body"></body>`,
+			want: PageMetadata{Title: "Head"},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			server := servePage(t, test.page)
+			got, err := fetcher.Fetch(context.Background(), server.URL+"/page")
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Links on the page are relative to the server
+			want := test.want
+			if want.CanonicalURL != "" {
+				want.CanonicalURL = server.URL + want.CanonicalURL
+			}
+			if want.FaviconURL == "" {
+				want.FaviconURL = "/favicon.ico"
+			}
+			want.FaviconURL = server.URL + want.FaviconURL
+			if got != want {
+				t.Errorf("got %+v\nwant %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestFetchMetadataLimits(t *testing.T) {
+	t.Run("size cap", func(t *testing.T) {
+		// The title is past the part we are willing to read
+		page := "<head>" + strings.Repeat("<!-- padding -->", 200) + "<title>Too far</title></head>"
+		server := servePage(t, page)
+		got, err := newTestFetcher(t, "127.0.0.1", 5*time.Second, 1024).Fetch(context.Background(), server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Title != "" {
+			t.Errorf("read the title %q from beyond the size cap", got.Title)
+		}
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			select {
+			case <-r.Context().Done():
+			case <-time.After(5 * time.Second):
+			}
+		}))
+		defer server.Close()
+
+		start := time.Now()
+		_, err := newTestFetcher(t, "127.0.0.1", 100*time.Millisecond, 1<<20).Fetch(context.Background(), server.URL)
+		if err == nil {
+			t.Fatal("a page that never answers didn't fail")
+		}
+		if elapsed := time.Since(start); elapsed > 2*time.Second {
+			t.Errorf("gave up after %v, the timeout is 100ms", elapsed)
+		}
+	})
+
+	t.Run("private address", func(t *testing.T) {
+		server := servePage(t, "<title>Internal</title>")
+		_, err := newTestFetcher(t, "", 5*time.Second, 1<<20).Fetch(context.Background(), server.URL)
+		if !errors.Is(err, ErrBlockedDestination) {
+			t.Errorf("fetching 127.0.0.1: got %v, want ErrBlockedDestination", err)
+		}
+	})
+
+	t.Run("not a page", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/pdf")
+			io.WriteString(w, "%PDF-1.4")
+		}))
+		defer server.Close()
+		if _, err := newTestFetcher(t, "127.0.0.1", 5*time.Second, 1<<20).Fetch(context.Background(), server.URL); !errors.Is(err, ErrNotHTML) {
+			t.Errorf("got %v, want ErrNotHTML", err)
+		}
+	})
+}
@@ -0,0 +1,1037 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// A migration moves the schema one version forward (Up) or back (Down).
+// Statements are kept per driver because MySQL and SQLite don't agree on
+// much DDL. Never edit a migration that has been released, add a new one.
+type migration struct {
+	Version int
+	Name    string
+	Up      map[string][]string
+	Down    map[string][]string
+}
+
+// All migrations, oldest first. Versions must keep going up.
+var migrations = []migration{
+	{
+		Version: 1,
+		Name:    "create users, links and tags",
+		// IF NOT EXISTS so databases created before migrations existed are
+		// picked up as version 1. link_tags has its own id so tags come back
+		// in the order they were added, and MySQL names use a binary
+		// collation so they are case sensitive, same as the in-memory store.
+		Up: map[string][]string{
+			"mysql": {
+				`CREATE TABLE IF NOT EXISTS users (
+					id INT AUTO_INCREMENT PRIMARY KEY,
+					username VARCHAR(255) COLLATE utf8mb4_bin NOT NULL UNIQUE,
+					password VARCHAR(255) NOT NULL,
+					email VARCHAR(255) NOT NULL
+				) DEFAULT CHARSET=utf8mb4`,
+				`CREATE TABLE IF NOT EXISTS links (
+					id INT AUTO_INCREMENT PRIMARY KEY,
+					url TEXT NOT NULL,
+					title VARCHAR(1024) NOT NULL,
+					description TEXT NOT NULL,
+					user_id INT NOT NULL,
+					created_at DATETIME NOT NULL,
+					INDEX idx_links_user (user_id),
+					FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+				) DEFAULT CHARSET=utf8mb4`,
+				`CREATE TABLE IF NOT EXISTS tags (
+					id INT AUTO_INCREMENT PRIMARY KEY,
+					name VARCHAR(255) COLLATE utf8mb4_bin NOT NULL UNIQUE
+				) DEFAULT CHARSET=utf8mb4`,
+				`CREATE TABLE IF NOT EXISTS link_tags (
+					id INT AUTO_INCREMENT PRIMARY KEY,
+					link_id INT NOT NULL,
+					tag_id INT NOT NULL,
+					UNIQUE KEY uniq_link_tag (link_id, tag_id),
+					FOREIGN KEY (link_id) REFERENCES links(id) ON DELETE CASCADE,
+					FOREIGN KEY (tag_id) REFERENCES tags(id) ON DELETE CASCADE
+				) DEFAULT CHARSET=utf8mb4`,
+			},
+			"sqlite": {
+				`CREATE TABLE IF NOT EXISTS users (
+					id INTEGER PRIMARY KEY AUTOINCREMENT,
+					username TEXT NOT NULL UNIQUE,
+					password TEXT NOT NULL,
+					email TEXT NOT NULL
+				)`,
+				`CREATE TABLE IF NOT EXISTS links (
+					id INTEGER PRIMARY KEY AUTOINCREMENT,
+					url TEXT NOT NULL,
+					title TEXT NOT NULL,
+					description TEXT NOT NULL,
+					user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+					created_at DATETIME NOT NULL
+				)`,
+				`CREATE INDEX IF NOT EXISTS idx_links_user ON links (user_id)`,
+				`CREATE TABLE IF NOT EXISTS tags (
+					id INTEGER PRIMARY KEY AUTOINCREMENT,
+					name TEXT NOT NULL UNIQUE
+				)`,
+				`CREATE TABLE IF NOT EXISTS link_tags (
+					id INTEGER PRIMARY KEY AUTOINCREMENT,
+					link_id INTEGER NOT NULL REFERENCES links(id) ON DELETE CASCADE,
+					tag_id INTEGER NOT NULL REFERENCES tags(id) ON DELETE CASCADE,
+					UNIQUE (link_id, tag_id)
+				)`,
+			},
+		},
+		Down: map[string][]string{
+			"mysql": {
+				`DROP TABLE IF EXISTS link_tags`,
+				`DROP TABLE IF EXISTS tags`,
+				`DROP TABLE IF EXISTS links`,
+				`DROP TABLE IF EXISTS users`,
+			},
+			"sqlite": {
+				`DROP TABLE IF EXISTS link_tags`,
+				`DROP TABLE IF EXISTS tags`,
+				`DROP TABLE IF EXISTS links`,
+				`DROP TABLE IF EXISTS users`,
+			},
+		},
+	},
+	{
+		Version: 2,
+		Name:    "add server-side sessions",
+		Up: map[string][]string{
+			"mysql": {
+				`CREATE TABLE sessions (
+					id CHAR(64) NOT NULL PRIMARY KEY,
+					user_id INT NOT NULL DEFAULT 0,
+					data BLOB NOT NULL,
+					created_at DATETIME NOT NULL,
+					last_seen DATETIME NOT NULL,
+					expires_at DATETIME NOT NULL,
+					user_agent VARCHAR(512) NOT NULL DEFAULT '',
+					ip VARCHAR(64) NOT NULL DEFAULT '',
+					INDEX idx_sessions_user (user_id),
+					INDEX idx_sessions_expires (expires_at)
+				) DEFAULT CHARSET=utf8mb4`,
+			},
+			"sqlite": {
+				`CREATE TABLE sessions (
+					id TEXT NOT NULL PRIMARY KEY,
+					user_id INTEGER NOT NULL DEFAULT 0,
+					data BLOB NOT NULL,
+					created_at DATETIME NOT NULL,
+					last_seen DATETIME NOT NULL,
+					expires_at DATETIME NOT NULL,
+					user_agent TEXT NOT NULL DEFAULT '',
+					ip TEXT NOT NULL DEFAULT ''
+				)`,
+				`CREATE INDEX idx_sessions_user ON sessions (user_id)`,
+				`CREATE INDEX idx_sessions_expires ON sessions (expires_at)`,
+			},
+		},
+		Down: map[string][]string{
+			"mysql":  {`DROP TABLE sessions`},
+			"sqlite": {`DROP TABLE sessions`},
+		},
+	},
+	{
+		Version: 3,
+		Name:    "add personal API tokens",
+		Up: map[string][]string{
+			"mysql": {
+				`CREATE TABLE api_tokens (
+					id INT AUTO_INCREMENT PRIMARY KEY,
+					user_id INT NOT NULL,
+					name VARCHAR(255) NOT NULL,
+					prefix VARCHAR(16) NOT NULL,
+					hash CHAR(64) NOT NULL UNIQUE,
+					scope VARCHAR(16) NOT NULL,
+					created_at DATETIME NOT NULL,
+					expires_at DATETIME NULL,
+					last_used_at DATETIME NULL,
+					INDEX idx_api_tokens_user (user_id),
+					FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+				) DEFAULT CHARSET=utf8mb4`,
+			},
+			"sqlite": {
+				`CREATE TABLE api_tokens (
+					id INTEGER PRIMARY KEY AUTOINCREMENT,
+					user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+					name TEXT NOT NULL,
+					prefix TEXT NOT NULL,
+					hash TEXT NOT NULL UNIQUE,
+					scope TEXT NOT NULL,
+					created_at DATETIME NOT NULL,
+					expires_at DATETIME,
+					last_used_at DATETIME
+				)`,
+				`CREATE INDEX idx_api_tokens_user ON api_tokens (user_id)`,
+			},
+		},
+		Down: map[string][]string{
+			"mysql":  {`DROP TABLE api_tokens`},
+			"sqlite": {`DROP TABLE api_tokens`},
+		},
+	},
+	{
+		Version: 4,
+		Name:    "add link favicons",
+		Up: map[string][]string{
+			"mysql":  {`ALTER TABLE links ADD COLUMN favicon VARCHAR(2048) NOT NULL DEFAULT ''`},
+			"sqlite": {`ALTER TABLE links ADD COLUMN favicon TEXT NOT NULL DEFAULT ''`},
+		},
+		Down: map[string][]string{
+			"mysql":  {`ALTER TABLE links DROP COLUMN favicon`},
+			"sqlite": {`ALTER TABLE links DROP COLUMN favicon`},
+		},
+	},
+	{
+		Version: 5,
+		Name:    "add archived pages",
+		// A full page with its images inlined can get big, hence LONGTEXT
+		Up: map[string][]string{
+			"mysql": {
+				`CREATE TABLE archived_pages (
+					id INT AUTO_INCREMENT PRIMARY KEY,
+					link_id INT NOT NULL,
+					url TEXT NOT NULL,
+					title VARCHAR(1024) NOT NULL,
+					readable MEDIUMTEXT NOT NULL,
+					text_content MEDIUMTEXT NOT NULL,
+					full_page LONGTEXT NOT NULL,
+					size INT NOT NULL,
+					created_at DATETIME NOT NULL,
+					INDEX idx_archived_pages_link (link_id),
+					FOREIGN KEY (link_id) REFERENCES links(id) ON DELETE CASCADE
+				) DEFAULT CHARSET=utf8mb4`,
+			},
+			"sqlite": {
+				`CREATE TABLE archived_pages (
+					id INTEGER PRIMARY KEY AUTOINCREMENT,
+					link_id INTEGER NOT NULL REFERENCES links(id) ON DELETE CASCADE,
+					url TEXT NOT NULL,
+					title TEXT NOT NULL,
+					readable TEXT NOT NULL,
+					text_content TEXT NOT NULL,
+					full_page TEXT NOT NULL,
+					size INTEGER NOT NULL,
+					created_at DATETIME NOT NULL
+				)`,
+				`CREATE INDEX idx_archived_pages_link ON archived_pages (link_id)`,
+			},
+		},
+		Down: map[string][]string{
+			"mysql":  {`DROP TABLE archived_pages`},
+			"sqlite": {`DROP TABLE archived_pages`},
+		},
+	},
+	{
+		Version: 6,
+		Name:    "add link health checks",
+		Up: map[string][]string{
+			"mysql": {
+				`ALTER TABLE links
+					ADD COLUMN status_code INT NOT NULL DEFAULT 0,
+					ADD COLUMN final_url VARCHAR(2048) NOT NULL DEFAULT '',
+					ADD COLUMN checked_at DATETIME NULL,
+					ADD COLUMN failure_streak INT NOT NULL DEFAULT 0,
+					ADD COLUMN check_error VARCHAR(255) NOT NULL DEFAULT ''`,
+				`CREATE INDEX idx_links_checked ON links (checked_at)`,
+			},
+			// SQLite only adds one column at a time
+			"sqlite": {
+				`ALTER TABLE links ADD COLUMN status_code INTEGER NOT NULL DEFAULT 0`,
+				`ALTER TABLE links ADD COLUMN final_url TEXT NOT NULL DEFAULT ''`,
+				`ALTER TABLE links ADD COLUMN checked_at DATETIME`,
+				`ALTER TABLE links ADD COLUMN failure_streak INTEGER NOT NULL DEFAULT 0`,
+				`ALTER TABLE links ADD COLUMN check_error TEXT NOT NULL DEFAULT ''`,
+				`CREATE INDEX idx_links_checked ON links (checked_at)`,
+			},
+		},
+		Down: map[string][]string{
+			"mysql": {
+				`DROP INDEX idx_links_checked ON links`,
+				`ALTER TABLE links
+					DROP COLUMN status_code,
+					DROP COLUMN final_url,
+					DROP COLUMN checked_at,
+					DROP COLUMN failure_streak,
+					DROP COLUMN check_error`,
+			},
+			"sqlite": {
+				`DROP INDEX idx_links_checked`,
+				`ALTER TABLE links DROP COLUMN status_code`,
+				`ALTER TABLE links DROP COLUMN final_url`,
+				`ALTER TABLE links DROP COLUMN checked_at`,
+				`ALTER TABLE links DROP COLUMN failure_streak`,
+				`ALTER TABLE links DROP COLUMN check_error`,
+			},
+		},
+	},
+	{
+		// Links saved before this were visible to everyone, but nobody
+		// chose that, so they start out private
+		Version: 7,
+		Name:    "add link visibility",
+		Up: map[string][]string{
+			"mysql": {
+				`ALTER TABLE links ADD COLUMN visibility VARCHAR(10) NOT NULL DEFAULT 'private'`,
+				`CREATE INDEX idx_links_visibility ON links (visibility, created_at)`,
+			},
+			"sqlite": {
+				`ALTER TABLE links ADD COLUMN visibility TEXT NOT NULL DEFAULT 'private'`,
+				`CREATE INDEX idx_links_visibility ON links (visibility, created_at)`,
+			},
+		},
+		Down: map[string][]string{
+			"mysql": {
+				`DROP INDEX idx_links_visibility ON links`,
+				`ALTER TABLE links DROP COLUMN visibility`,
+			},
+			"sqlite": {
+				`DROP INDEX idx_links_visibility`,
+				`ALTER TABLE links DROP COLUMN visibility`,
+			},
+		},
+	},
+	{
+		// A share is either for a single link (link_id) or for all of the
+		// owner's links with a tag (tag)
+		Version: 8,
+		Name:    "add shares",
+		Up: map[string][]string{
+			"mysql": {
+				`CREATE TABLE shares (
+					id INT AUTO_INCREMENT PRIMARY KEY,
+					owner_id INT NOT NULL,
+					user_id INT NOT NULL,
+					link_id INT NULL,
+					tag VARCHAR(255) COLLATE utf8mb4_bin NOT NULL DEFAULT '',
+					permission VARCHAR(10) NOT NULL,
+					created_at DATETIME NOT NULL,
+					INDEX idx_shares_owner (owner_id),
+					INDEX idx_shares_user (user_id),
+					FOREIGN KEY (owner_id) REFERENCES users(id) ON DELETE CASCADE,
+					FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+					FOREIGN KEY (link_id) REFERENCES links(id) ON DELETE CASCADE
+				) DEFAULT CHARSET=utf8mb4`,
+			},
+			"sqlite": {
+				`CREATE TABLE shares (
+					id INTEGER PRIMARY KEY AUTOINCREMENT,
+					owner_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+					user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+					link_id INTEGER REFERENCES links(id) ON DELETE CASCADE,
+					tag TEXT NOT NULL DEFAULT '',
+					permission TEXT NOT NULL,
+					created_at DATETIME NOT NULL
+				)`,
+				`CREATE INDEX idx_shares_owner ON shares (owner_id)`,
+				`CREATE INDEX idx_shares_user ON shares (user_id)`,
+			},
+		},
+		Down: map[string][]string{
+			"mysql":  {`DROP TABLE shares`},
+			"sqlite": {`DROP TABLE shares`},
+		},
+	},
+	{
+		// No foreign key on links.workspace_id in SQLite, it can't drop a
+		// column that has one. Rolling back hands workspace links to whoever
+		// saved them.
+		Version: 9,
+		Name:    "add workspaces",
+		Up: map[string][]string{
+			"mysql": {
+				`CREATE TABLE workspaces (
+					id INT AUTO_INCREMENT PRIMARY KEY,
+					name VARCHAR(255) NOT NULL,
+					created_at DATETIME NOT NULL
+				) DEFAULT CHARSET=utf8mb4`,
+				`CREATE TABLE workspace_members (
+					workspace_id INT NOT NULL,
+					user_id INT NOT NULL,
+					role VARCHAR(10) NOT NULL,
+					created_at DATETIME NOT NULL,
+					PRIMARY KEY (workspace_id, user_id),
+					INDEX idx_workspace_members_user (user_id),
+					FOREIGN KEY (workspace_id) REFERENCES workspaces(id) ON DELETE CASCADE,
+					FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+				) DEFAULT CHARSET=utf8mb4`,
+				`CREATE TABLE workspace_invites (
+					id INT AUTO_INCREMENT PRIMARY KEY,
+					workspace_id INT NOT NULL,
+					user_id INT NOT NULL,
+					invited_by INT NOT NULL,
+					role VARCHAR(10) NOT NULL,
+					created_at DATETIME NOT NULL,
+					UNIQUE KEY idx_workspace_invites_user (workspace_id, user_id),
+					INDEX idx_workspace_invites_invitee (user_id),
+					FOREIGN KEY (workspace_id) REFERENCES workspaces(id) ON DELETE CASCADE,
+					FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+					FOREIGN KEY (invited_by) REFERENCES users(id) ON DELETE CASCADE
+				) DEFAULT CHARSET=utf8mb4`,
+				`ALTER TABLE links
+					ADD COLUMN workspace_id INT NULL,
+					ADD INDEX idx_links_workspace (workspace_id),
+					ADD CONSTRAINT fk_links_workspace FOREIGN KEY (workspace_id) REFERENCES workspaces(id) ON DELETE CASCADE`,
+			},
+			"sqlite": {
+				`CREATE TABLE workspaces (
+					id INTEGER PRIMARY KEY AUTOINCREMENT,
+					name TEXT NOT NULL,
+					created_at DATETIME NOT NULL
+				)`,
+				`CREATE TABLE workspace_members (
+					workspace_id INTEGER NOT NULL REFERENCES workspaces(id) ON DELETE CASCADE,
+					user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+					role TEXT NOT NULL,
+					created_at DATETIME NOT NULL,
+					PRIMARY KEY (workspace_id, user_id)
+				)`,
+				`CREATE INDEX idx_workspace_members_user ON workspace_members (user_id)`,
+				`CREATE TABLE workspace_invites (
+					id INTEGER PRIMARY KEY AUTOINCREMENT,
+					workspace_id INTEGER NOT NULL REFERENCES workspaces(id) ON DELETE CASCADE,
+					user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+					invited_by INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+					role TEXT NOT NULL,
+					created_at DATETIME NOT NULL,
+					UNIQUE (workspace_id, user_id)
+				)`,
+				`CREATE INDEX idx_workspace_invites_invitee ON workspace_invites (user_id)`,
+				`ALTER TABLE links ADD COLUMN workspace_id INTEGER`,
+				`CREATE INDEX idx_links_workspace ON links (workspace_id)`,
+			},
+		},
+		Down: map[string][]string{
+			"mysql": {
+				`ALTER TABLE links DROP FOREIGN KEY fk_links_workspace`,
+				`UPDATE links SET workspace_id = NULL`,
+				`DROP INDEX idx_links_workspace ON links`,
+				`ALTER TABLE links DROP COLUMN workspace_id`,
+				`DROP TABLE workspace_invites`,
+				`DROP TABLE workspace_members`,
+				`DROP TABLE workspaces`,
+			},
+			"sqlite": {
+				`UPDATE links SET workspace_id = NULL`,
+				`DROP INDEX idx_links_workspace`,
+				`ALTER TABLE links DROP COLUMN workspace_id`,
+				`DROP TABLE workspace_invites`,
+				`DROP TABLE workspace_members`,
+				`DROP TABLE workspaces`,
+			},
+		},
+	},
+	{
+		Version: 10,
+		Name:    "add collections",
+		Up: map[string][]string{
+			"mysql": {
+				`CREATE TABLE collections (
+					id INT AUTO_INCREMENT PRIMARY KEY,
+					user_id INT NOT NULL,
+					workspace_id INT NULL,
+					parent_id INT NULL,
+					name VARCHAR(255) NOT NULL,
+					description TEXT NOT NULL,
+					cover VARCHAR(2048) NOT NULL DEFAULT '',
+					created_at DATETIME NOT NULL,
+					INDEX idx_collections_user (user_id),
+					INDEX idx_collections_workspace (workspace_id),
+					FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+					FOREIGN KEY (workspace_id) REFERENCES workspaces(id) ON DELETE CASCADE,
+					FOREIGN KEY (parent_id) REFERENCES collections(id)
+				) DEFAULT CHARSET=utf8mb4`,
+				`CREATE TABLE collection_links (
+					collection_id INT NOT NULL,
+					link_id INT NOT NULL,
+					position INT NOT NULL,
+					PRIMARY KEY (collection_id, link_id),
+					INDEX idx_collection_links_link (link_id),
+					FOREIGN KEY (collection_id) REFERENCES collections(id) ON DELETE CASCADE,
+					FOREIGN KEY (link_id) REFERENCES links(id) ON DELETE CASCADE
+				) DEFAULT CHARSET=utf8mb4`,
+			},
+			"sqlite": {
+				`CREATE TABLE collections (
+					id INTEGER PRIMARY KEY AUTOINCREMENT,
+					user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+					workspace_id INTEGER REFERENCES workspaces(id) ON DELETE CASCADE,
+					parent_id INTEGER REFERENCES collections(id),
+					name TEXT NOT NULL,
+					description TEXT NOT NULL DEFAULT '',
+					cover TEXT NOT NULL DEFAULT '',
+					created_at DATETIME NOT NULL
+				)`,
+				`CREATE INDEX idx_collections_user ON collections (user_id)`,
+				`CREATE INDEX idx_collections_workspace ON collections (workspace_id)`,
+				`CREATE TABLE collection_links (
+					collection_id INTEGER NOT NULL REFERENCES collections(id) ON DELETE CASCADE,
+					link_id INTEGER NOT NULL REFERENCES links(id) ON DELETE CASCADE,
+					position INTEGER NOT NULL,
+					PRIMARY KEY (collection_id, link_id)
+				)`,
+				`CREATE INDEX idx_collection_links_link ON collection_links (link_id)`,
+			},
+		},
+		Down: map[string][]string{
+			"mysql":  {`DROP TABLE collection_links`, `DROP TABLE collections`},
+			"sqlite": {`DROP TABLE collection_links`, `DROP TABLE collections`},
+		},
+	},
+	{
+		// Existing tags like a/b get a as their parent if there is a tag a,
+		// the others get theirs the next time they're used. Again no foreign
+		// key in SQLite so the column can be dropped.
+		Version: 11,
+		Name:    "add tag parents",
+		Up: map[string][]string{
+			"mysql": {
+				`ALTER TABLE tags
+					ADD COLUMN parent_id INT NULL,
+					ADD CONSTRAINT fk_tags_parent FOREIGN KEY (parent_id) REFERENCES tags(id) ON DELETE SET NULL`,
+				`UPDATE tags t
+					JOIN tags p ON p.name = LEFT(t.name, CHAR_LENGTH(t.name) - CHAR_LENGTH(SUBSTRING_INDEX(t.name, '/', -1)) - 1)
+					SET t.parent_id = p.id
+					WHERE t.name LIKE '%/%'`,
+			},
+			"sqlite": {
+				`ALTER TABLE tags ADD COLUMN parent_id INTEGER`,
+				// rtrim with all the other characters of the name strips
+				// everything after the last slash
+				`UPDATE tags SET parent_id = (
+					SELECT p.id FROM tags p
+					WHERE p.name = substr(tags.name, 1, length(rtrim(tags.name, replace(tags.name, '/', ''))) - 1)
+				) WHERE name LIKE '%/%'`,
+			},
+		},
+		Down: map[string][]string{
+			"mysql": {
+				`ALTER TABLE tags DROP FOREIGN KEY fk_tags_parent`,
+				`ALTER TABLE tags DROP COLUMN parent_id`,
+			},
+			"sqlite": {`ALTER TABLE tags DROP COLUMN parent_id`},
+		},
+	},
+	{
+		// Every library gets its own copies of the tags its links have, and
+		// of the tags above them, then the global tags go. SQLite can't
+		// drop the UNIQUE on name, so the tags table is rebuilt, and
+		// link_tags with it to point at the new one. Rolling back merges the
+		// tags with the same name again.
+		Version: 12,
+		Name:    "scope tags per user",
+		Up: map[string][]string{
+			"mysql": {
+				`ALTER TABLE tags
+					ADD COLUMN user_id INT NULL,
+					ADD COLUMN workspace_id INT NULL,
+					DROP INDEX name,
+					ADD UNIQUE KEY uniq_tags_user (user_id, name),
+					ADD UNIQUE KEY uniq_tags_workspace (workspace_id, name),
+					ADD CONSTRAINT fk_tags_user FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+					ADD CONSTRAINT fk_tags_workspace FOREIGN KEY (workspace_id) REFERENCES workspaces(id) ON DELETE CASCADE`,
+				`INSERT INTO tags (name, user_id, workspace_id)
+					WITH RECURSIVE names (name, user_id, workspace_id) AS (
+						SELECT t.name, CASE WHEN l.workspace_id IS NULL THEN l.user_id END, l.workspace_id
+						FROM link_tags lt
+						JOIN links l ON l.id = lt.link_id
+						JOIN tags t ON t.id = lt.tag_id
+						UNION
+						SELECT LEFT(name, CHAR_LENGTH(name) - CHAR_LENGTH(SUBSTRING_INDEX(name, '/', -1)) - 1), user_id, workspace_id
+						FROM names WHERE name LIKE '%/%'
+					)
+					SELECT DISTINCT name, user_id, workspace_id FROM names`,
+				`UPDATE link_tags lt
+					JOIN links l ON l.id = lt.link_id
+					JOIN tags g ON g.id = lt.tag_id
+					JOIN tags t ON t.name = g.name
+						AND ((l.workspace_id IS NULL AND t.user_id = l.user_id) OR t.workspace_id = l.workspace_id)
+					SET lt.tag_id = t.id`,
+				`UPDATE tags t
+					JOIN tags p ON p.name = LEFT(t.name, CHAR_LENGTH(t.name) - CHAR_LENGTH(SUBSTRING_INDEX(t.name, '/', -1)) - 1)
+						AND (p.user_id = t.user_id OR p.workspace_id = t.workspace_id)
+					SET t.parent_id = p.id
+					WHERE t.name LIKE '%/%'`,
+				`UPDATE tags SET parent_id = NULL WHERE COALESCE(user_id, workspace_id) IS NULL`,
+				`DELETE FROM tags WHERE COALESCE(user_id, workspace_id) IS NULL`,
+			},
+			"sqlite": {
+				`ALTER TABLE tags RENAME TO global_tags`,
+				`CREATE TABLE tags (
+					id INTEGER PRIMARY KEY AUTOINCREMENT,
+					name TEXT NOT NULL,
+					parent_id INTEGER REFERENCES tags(id) ON DELETE SET NULL,
+					user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+					workspace_id INTEGER REFERENCES workspaces(id) ON DELETE CASCADE,
+					UNIQUE (user_id, name),
+					UNIQUE (workspace_id, name)
+				)`,
+				`INSERT INTO tags (name, user_id, workspace_id)
+					WITH RECURSIVE names (name, user_id, workspace_id) AS (
+						SELECT t.name, CASE WHEN l.workspace_id IS NULL THEN l.user_id END, l.workspace_id
+						FROM link_tags lt
+						JOIN links l ON l.id = lt.link_id
+						JOIN global_tags t ON t.id = lt.tag_id
+						UNION
+						SELECT substr(name, 1, length(rtrim(name, replace(name, '/', ''))) - 1), user_id, workspace_id
+						FROM names WHERE name LIKE '%/%'
+					)
+					SELECT DISTINCT name, user_id, workspace_id FROM names`,
+				`CREATE TABLE scoped_link_tags (
+					id INTEGER PRIMARY KEY AUTOINCREMENT,
+					link_id INTEGER NOT NULL REFERENCES links(id) ON DELETE CASCADE,
+					tag_id INTEGER NOT NULL REFERENCES tags(id) ON DELETE CASCADE,
+					UNIQUE (link_id, tag_id)
+				)`,
+				`INSERT INTO scoped_link_tags (id, link_id, tag_id)
+					SELECT lt.id, lt.link_id, t.id FROM link_tags lt
+					JOIN links l ON l.id = lt.link_id
+					JOIN global_tags g ON g.id = lt.tag_id
+					JOIN tags t ON t.name = g.name
+						AND ((l.workspace_id IS NULL AND t.user_id = l.user_id) OR t.workspace_id = l.workspace_id)`,
+				`DROP TABLE link_tags`,
+				`ALTER TABLE scoped_link_tags RENAME TO link_tags`,
+				`DROP TABLE global_tags`,
+				`UPDATE tags SET parent_id = (
+					SELECT p.id FROM tags p
+					WHERE p.name = substr(tags.name, 1, length(rtrim(tags.name, replace(tags.name, '/', ''))) - 1)
+						AND (p.user_id = tags.user_id OR p.workspace_id = tags.workspace_id)
+				) WHERE name LIKE '%/%'`,
+			},
+		},
+		Down: map[string][]string{
+			"mysql": {
+				`INSERT INTO tags (name) SELECT DISTINCT name FROM tags`,
+				`UPDATE link_tags lt
+					JOIN tags t ON t.id = lt.tag_id
+					JOIN tags g ON g.name = t.name AND g.user_id IS NULL AND g.workspace_id IS NULL
+					SET lt.tag_id = g.id`,
+				`UPDATE tags SET parent_id = NULL`,
+				`DELETE FROM tags WHERE user_id IS NOT NULL OR workspace_id IS NOT NULL`,
+				`UPDATE tags t
+					JOIN tags p ON p.name = LEFT(t.name, CHAR_LENGTH(t.name) - CHAR_LENGTH(SUBSTRING_INDEX(t.name, '/', -1)) - 1)
+					SET t.parent_id = p.id
+					WHERE t.name LIKE '%/%'`,
+				`ALTER TABLE tags DROP FOREIGN KEY fk_tags_user, DROP FOREIGN KEY fk_tags_workspace`,
+				`ALTER TABLE tags
+					DROP INDEX uniq_tags_user,
+					DROP INDEX uniq_tags_workspace,
+					DROP COLUMN user_id,
+					DROP COLUMN workspace_id,
+					ADD UNIQUE KEY name (name)`,
+			},
+			"sqlite": {
+				`ALTER TABLE tags RENAME TO scoped_tags`,
+				`CREATE TABLE tags (
+					id INTEGER PRIMARY KEY AUTOINCREMENT,
+					name TEXT NOT NULL UNIQUE,
+					parent_id INTEGER
+				)`,
+				`INSERT INTO tags (name) SELECT DISTINCT name FROM scoped_tags`,
+				`CREATE TABLE global_link_tags (
+					id INTEGER PRIMARY KEY AUTOINCREMENT,
+					link_id INTEGER NOT NULL REFERENCES links(id) ON DELETE CASCADE,
+					tag_id INTEGER NOT NULL REFERENCES tags(id) ON DELETE CASCADE,
+					UNIQUE (link_id, tag_id)
+				)`,
+				`INSERT INTO global_link_tags (id, link_id, tag_id)
+					SELECT lt.id, lt.link_id, g.id FROM link_tags lt
+					JOIN scoped_tags t ON t.id = lt.tag_id
+					JOIN tags g ON g.name = t.name`,
+				`DROP TABLE link_tags`,
+				`ALTER TABLE global_link_tags RENAME TO link_tags`,
+				`DROP TABLE scoped_tags`,
+				`UPDATE tags SET parent_id = (
+					SELECT p.id FROM tags p
+					WHERE p.name = substr(tags.name, 1, length(rtrim(tags.name, replace(tags.name, '/', ''))) - 1)
+				) WHERE name LIKE '%/%'`,
+			},
+		},
+	},
+	{
+		Version: 13,
+		Name:    "add auto-tag rules",
+		Up: map[string][]string{
+			"mysql": {
+				`CREATE TABLE auto_tag_rules (
+					id INT AUTO_INCREMENT PRIMARY KEY,
+					user_id INT NOT NULL,
+					kind VARCHAR(10) NOT NULL,
+					pattern VARCHAR(255) COLLATE utf8mb4_bin NOT NULL,
+					tag VARCHAR(255) COLLATE utf8mb4_bin NOT NULL,
+					created_at DATETIME NOT NULL,
+					INDEX idx_auto_tag_rules_user (user_id),
+					FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+				) DEFAULT CHARSET=utf8mb4`,
+			},
+			"sqlite": {
+				`CREATE TABLE auto_tag_rules (
+					id INTEGER PRIMARY KEY AUTOINCREMENT,
+					user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+					kind TEXT NOT NULL,
+					pattern TEXT NOT NULL,
+					tag TEXT NOT NULL,
+					created_at DATETIME NOT NULL
+				)`,
+				`CREATE INDEX idx_auto_tag_rules_user ON auto_tag_rules (user_id)`,
+			},
+		},
+		Down: map[string][]string{
+			"mysql":  {`DROP TABLE auto_tag_rules`},
+			"sqlite": {`DROP TABLE auto_tag_rules`},
+		},
+	},
+	{
+		Version: 14,
+		Name:    "add archived copy replacements",
+		// No foreign key, SQLite can't drop a column that has one.
+		// DeleteArchivedPage clears it instead.
+		Up: map[string][]string{
+			"mysql":  {`ALTER TABLE links ADD COLUMN replaced_by_archive_id INT NOT NULL DEFAULT 0`},
+			"sqlite": {`ALTER TABLE links ADD COLUMN replaced_by_archive_id INTEGER NOT NULL DEFAULT 0`},
+		},
+		Down: map[string][]string{
+			"mysql":  {`ALTER TABLE links DROP COLUMN replaced_by_archive_id`},
+			"sqlite": {`ALTER TABLE links DROP COLUMN replaced_by_archive_id`},
+		},
+	},
+}
+
+// ErrSchemaTooNew means the database was migrated by a newer version of the
+// app. Running an old binary against it could corrupt data.
+var ErrSchemaTooNew = errors.New("database schema is newer than this version of linkcollector")
+
+// Latest schema version this binary knows about
+func latestSchemaVersion() int {
+	if len(migrations) == 0 {
+		return 0
+	}
+	return migrations[len(migrations)-1].Version
+}
+
+// Migrator applies and rolls back migrations, remembering what it did in
+// the schema_migrations table
+type Migrator struct {
+	db     *sql.DB
+	driver string
+}
+
+// MigrationStatus is one line of "migrate status"
+type MigrationStatus struct {
+	Version   int
+	Name      string
+	AppliedAt *time.Time
+}
+
+// NewMigrator creates a migrator for an open database
+func NewMigrator(db *sql.DB, driver string) *Migrator {
+	return &Migrator{db: db, driver: driver}
+}
+
+// Make sure the bookkeeping table is there
+func (m *Migrator) ensureTable() error {
+	_, err := m.db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER NOT NULL PRIMARY KEY,
+		name VARCHAR(255) NOT NULL,
+		applied_at DATETIME NOT NULL
+	)`)
+	return err
+}
+
+// Get all versions that have been applied, with when they were applied
+func (m *Migrator) applied() (map[int]time.Time, error) {
+	if err := m.ensureTable(); err != nil {
+		return nil, err
+	}
+	rows, err := m.db.Query("SELECT version, applied_at FROM schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := make(map[int]time.Time)
+	for rows.Next() {
+		var version int
+		var appliedAt time.Time
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, err
+		}
+		applied[version] = appliedAt
+	}
+	return applied, rows.Err()
+}
+
+// CurrentVersion returns the highest applied version, 0 for an empty database
+func (m *Migrator) CurrentVersion() (int, error) {
+	applied, err := m.applied()
+	if err != nil {
+		return 0, err
+	}
+	current := 0
+	for version := range applied {
+		if version > current {
+			current = version
+		}
+	}
+	return current, nil
+}
+
+// Check refuses databases that were migrated by a newer binary
+func (m *Migrator) Check() error {
+	current, err := m.CurrentVersion()
+	if err != nil {
+		return err
+	}
+	if current > latestSchemaVersion() {
+		return fmt.Errorf("%w (database is at version %d, this binary only knows up to %d)",
+			ErrSchemaTooNew, current, latestSchemaVersion())
+	}
+	return nil
+}
+
+// Pending returns the migrations that haven't been applied yet
+func (m *Migrator) Pending() ([]migration, error) {
+	applied, err := m.applied()
+	if err != nil {
+		return nil, err
+	}
+	var pending []migration
+	for _, mig := range migrations {
+		if _, done := applied[mig.Version]; !done {
+			pending = append(pending, mig)
+		}
+	}
+	return pending, nil
+}
+
+// Up applies every pending migration in order
+func (m *Migrator) Up() ([]migration, error) {
+	if err := m.Check(); err != nil {
+		return nil, err
+	}
+	pending, err := m.Pending()
+	if err != nil {
+		return nil, err
+	}
+
+	var done []migration
+	for _, mig := range pending {
+		if err := m.run(mig, mig.Up[m.driver], true); err != nil {
+			return done, fmt.Errorf("migration %d (%s) failed: %w", mig.Version, mig.Name, err)
+		}
+		done = append(done, mig)
+	}
+	return done, nil
+}
+
+// Down rolls back the last few applied migrations, newest first
+func (m *Migrator) Down(steps int) ([]migration, error) {
+	if err := m.Check(); err != nil {
+		return nil, err
+	}
+	applied, err := m.applied()
+	if err != nil {
+		return nil, err
+	}
+
+	var versions []int
+	for version := range applied {
+		versions = append(versions, version)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(versions)))
+
+	var done []migration
+	for _, version := range versions {
+		if len(done) >= steps {
+			break
+		}
+		mig, ok := findMigration(version)
+		if !ok {
+			return done, fmt.Errorf("don't know how to roll back version %d", version)
+		}
+		if err := m.run(mig, mig.Down[m.driver], false); err != nil {
+			return done, fmt.Errorf("rolling back migration %d (%s) failed: %w", mig.Version, mig.Name, err)
+		}
+		done = append(done, mig)
+	}
+	return done, nil
+}
+
+// Status lists every known migration and whether it has been applied
+func (m *Migrator) Status() ([]MigrationStatus, error) {
+	applied, err := m.applied()
+	if err != nil {
+		return nil, err
+	}
+	var statuses []MigrationStatus
+	for _, mig := range migrations {
+		status := MigrationStatus{Version: mig.Version, Name: mig.Name}
+		if appliedAt, done := applied[mig.Version]; done {
+			status.AppliedAt = &appliedAt
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+// Run the statements of one migration and record it. MySQL commits DDL on
+// its own so the transaction mostly helps SQLite, but it keeps the
+// bookkeeping row in sync either way.
+func (m *Migrator) run(mig migration, statements []string, up bool) error {
+	if statements == nil {
+		return fmt.Errorf("no statements for driver %q", m.driver)
+	}
+
+	tx, err := m.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, stmt := range statements {
+		if _, err := tx.Exec(stmt); err != nil {
+			return err
+		}
+	}
+
+	if up {
+		_, err = tx.Exec("INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?)",
+			mig.Version, mig.Name, time.Now().UTC().Truncate(time.Second))
+	} else {
+		_, err = tx.Exec("DELETE FROM schema_migrations WHERE version = ?", mig.Version)
+	}
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Find a migration by version
+func findMigration(version int) (migration, bool) {
+	for _, mig := range migrations {
+		if mig.Version == version {
+			return mig, true
+		}
+	}
+	return migration{}, false
+}
+
+// Open the configured database and bring its schema up to date, or just
+// check it when auto-migration is turned off
+func openMigratedSQL(config Config, driver, dsn string) (*sql.DB, error) {
+	db, err := openSQL(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	migrator := NewMigrator(db, driver)
+	if err := migrator.Check(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	if config.DBAutoMigrate {
+		done, err := migrator.Up()
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+		for _, mig := range done {
+			fmt.Printf("Applied migration %d: %s\n", mig.Version, mig.Name)
+		}
+		return db, nil
+	}
+
+	pending, err := migrator.Pending()
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	if len(pending) > 0 {
+		db.Close()
+		return nil, fmt.Errorf("%d pending migration(s), run \"linkcollector migrate up\" first", len(pending))
+	}
+	return db, nil
+}
+
+// Handle "linkcollector migrate <up|down [steps]|status>"
+func runMigrateCommand(config Config, args []string) error {
+	var driver, dsn string
+	switch config.DBDriver {
+	case "mysql":
+		driver, dsn = "mysql", config.GetDSN()
+	case "sqlite":
+		driver, dsn = "sqlite", config.GetSQLiteDSN()
+	default:
+		return fmt.Errorf("migrations only work with DB_DRIVER=mysql or DB_DRIVER=sqlite")
+	}
+
+	db, err := openSQL(driver, dsn)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	migrator := NewMigrator(db, driver)
+
+	command := "status"
+	if len(args) > 0 {
+		command = args[0]
+	}
+
+	switch command {
+	case "up":
+		done, err := migrator.Up()
+		for _, mig := range done {
+			fmt.Printf("Applied migration %d: %s\n", mig.Version, mig.Name)
+		}
+		if err != nil {
+			return err
+		}
+		if len(done) == 0 {
+			fmt.Println("Database is already up to date")
+		}
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			if steps, err = strconv.Atoi(args[1]); err != nil || steps < 1 {
+				return fmt.Errorf("invalid number of steps %q", args[1])
+			}
+		}
+		done, err := migrator.Down(steps)
+		for _, mig := range done {
+			fmt.Printf("Rolled back migration %d: %s\n", mig.Version, mig.Name)
+		}
+		if err != nil {
+			return err
+		}
+	case "status":
+		statuses, err := migrator.Status()
+		if err != nil {
+			return err
+		}
+		current, _ := migrator.CurrentVersion()
+		fmt.Printf("Database version %d, latest known version %d\n", current, latestSchemaVersion())
+		for _, status := range statuses {
+			applied := "pending"
+			if status.AppliedAt != nil {
+				applied = "applied " + status.AppliedAt.Format("2006-01-02 15:04:05")
+			}
+			fmt.Printf("  %4d  %-40s %s\n", status.Version, status.Name, applied)
+		}
+		if current > latestSchemaVersion() {
+			return ErrSchemaTooNew
+		}
+	default:
+		return fmt.Errorf("unknown migrate command %q (use up, down [steps] or status)", command)
+	}
+	return nil
+}
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/getkin/kin-openapi/openapi3filter"
+	"github.com/getkin/kin-openapi/openapi3gen"
+	"github.com/getkin/kin-openapi/routers/gorillamux"
+	"github.com/gin-gonic/gin"
+)
+
+// OpenAPI 3 description of the JSON API. The schemas are generated from the
+// same structs the handlers send back (see api.go), the paths are listed
+// here by hand. At startup checkOpenAPIRoutes makes sure this list and the
+// routes in setupRoutes agree, so a new endpoint can't ship undocumented.
+
+// Where the spec is served, public so tools can fetch it without a token
+const openAPIPath = "/api/v1/openapi.json"
+
+// Prefix of every route described by the spec
+const apiBasePath = "/api/v1"
+
+// Build the spec and make sure it is valid
+func buildOpenAPISpec() (*openapi3.T, error) {
+	schemas := openapi3.Schemas{}
+	generate := func(name string, value interface{}) (*openapi3.Schema, error) {
+		ref, err := openapi3gen.NewSchemaRefForValue(value, nil)
+		if err != nil {
+			return nil, fmt.Errorf("schema %s: %w", name, err)
+		}
+		schemas[name] = ref
+		return ref.Value, nil
+	}
+	ref := func(name string) *openapi3.SchemaRef {
+		return openapi3.NewSchemaRef("#/components/schemas/"+name, schemas[name].Value)
+	}
+
+	link, err := generate("Link", Link{})
+	if err != nil {
+		return nil, err
+	}
+	visibilityEnum := make([]interface{}, len(visibilities))
+	for i, v := range visibilities {
+		visibilityEnum[i] = v
+	}
+	// A schema of its own, the generator shares one between all the string
+	// fields and the enum would end up on those too
+	link.Properties["visibility"] = openapi3.NewStringSchema().WithEnum(visibilityEnum...).NewRef()
+	if _, err := generate("Tag", Tag{}); err != nil {
+		return nil, err
+	}
+	user, err := generate("User", User{})
+	if err != nil {
+		return nil, err
+	}
+	delete(user.Properties, "password") // never sent by the API
+	if _, err := generate("CurrentUser", apiMeResponse{}); err != nil {
+		return nil, err
+	}
+	if _, err := generate("Pagination", apiPage{}); err != nil {
+		return nil, err
+	}
+	if _, err := generate("TagCleanup", apiCleanupResponse{}); err != nil {
+		return nil, err
+	}
+	if _, err := generate("TagSuggestions", TagSuggestions{}); err != nil {
+		return nil, err
+	}
+	apiErr, err := generate("Error", apiErrorBody{})
+	if err != nil {
+		return nil, err
+	}
+	apiErr.Required = []string{"error"}
+
+	// Lists point at the schemas above instead of repeating them
+	arrayOf := func(name string) *openapi3.SchemaRef {
+		array := openapi3.NewArraySchema()
+		array.Items = ref(name)
+		return array.NewRef()
+	}
+	schemas["LinkList"] = openapi3.NewObjectSchema().
+		WithPropertyRef("links", arrayOf("Link")).
+		WithPropertyRef("pagination", ref("Pagination")).NewRef()
+	schemas["TagList"] = openapi3.NewObjectSchema().
+		WithPropertyRef("tags", arrayOf("Tag")).NewRef()
+
+	// Request bodies are written by hand since every field is optional in
+	// apiLinkRequest. They are strict, so typos in field names are caught.
+	linkRequest := func(required ...string) *openapi3.SchemaRef {
+		schema := openapi3.NewObjectSchema().
+			WithProperty("url", openapi3.NewStringSchema().WithMinLength(1)).
+			WithProperty("title", openapi3.NewStringSchema().WithMinLength(1)).
+			WithProperty("description", openapi3.NewStringSchema()).
+			WithProperty("tags", openapi3.NewArraySchema().WithItems(openapi3.NewStringSchema())).
+			WithProperty("visibility", openapi3.NewStringSchema().WithEnum(visibilityEnum...)).
+			WithoutAdditionalProperties()
+		schema.Required = required
+		return schema.NewRef()
+	}
+	schemas["NewLink"] = linkRequest("url")
+	// Links can only be put in a workspace when they're created
+	workspaceID := openapi3.NewIntegerSchema()
+	workspaceID.Description = "Workspace to save the link to, leave it out for a personal link"
+	schemas["NewLink"].Value.WithProperty("workspace_id", workspaceID)
+	schemas["LinkInput"] = linkRequest("url", "title")
+	schemas["LinkPatch"] = linkRequest()
+	tagRename := openapi3.NewObjectSchema().
+		WithProperty("name", openapi3.NewStringSchema().WithMinLength(1)).
+		WithoutAdditionalProperties()
+	tagRename.Required = []string{"name"}
+	schemas["TagRename"] = tagRename.NewRef()
+	tagMerge := openapi3.NewObjectSchema().
+		WithProperty("tag_ids", openapi3.NewArraySchema().WithItems(openapi3.NewIntegerSchema()).WithMinItems(1)).
+		WithProperty("into", openapi3.NewIntegerSchema()).
+		WithoutAdditionalProperties()
+	tagMerge.Required = []string{"tag_ids", "into"}
+	schemas["TagMerge"] = tagMerge.NewRef()
+
+	// Parameters and responses used by several operations
+	linkID := &openapi3.ParameterRef{Value: openapi3.NewPathParameter("id").
+		WithSchema(openapi3.NewIntegerSchema()).WithDescription("Link ID")}
+	page := &openapi3.ParameterRef{Value: openapi3.NewQueryParameter("page").
+		WithSchema(openapi3.NewIntegerSchema().WithMin(1)).WithDescription("Page number, starting at 1")}
+	perPage := &openapi3.ParameterRef{Value: openapi3.NewQueryParameter("per_page").
+		WithSchema(openapi3.NewIntegerSchema().WithMin(1).WithMax(apiMaxPerPage)).
+		WithDescription(fmt.Sprintf("Results per page, %d by default", apiDefaultPerPage))}
+	tagID := &openapi3.ParameterRef{Value: openapi3.NewPathParameter("id").
+		WithSchema(openapi3.NewIntegerSchema()).WithDescription("Tag ID")}
+	reassignTo := &openapi3.ParameterRef{Value: openapi3.NewQueryParameter("reassign_to").
+		WithSchema(openapi3.NewIntegerSchema()).WithDescription("Give the tag's links this tag instead, which merges the two")}
+	query := &openapi3.ParameterRef{Value: openapi3.NewQueryParameter("q").
+		WithSchema(openapi3.NewStringSchema()).WithRequired(true).WithDescription("What to search for")}
+	typed := &openapi3.ParameterRef{Value: openapi3.NewQueryParameter("q").
+		WithSchema(openapi3.NewStringSchema()).WithDescription("What's typed so far, leave it out for the most used tags")}
+	suggestFor := []*openapi3.ParameterRef{
+		typed,
+		{Value: openapi3.NewQueryParameter("url").
+			WithSchema(openapi3.NewStringSchema()).WithDescription("Address of the link, for the tags of other links from its site")},
+		{Value: openapi3.NewQueryParameter("workspace_id").
+			WithSchema(openapi3.NewIntegerSchema()).WithDescription("Workspace a new link goes to, leave it out for a personal link")},
+		{Value: openapi3.NewQueryParameter("link_id").
+			WithSchema(openapi3.NewIntegerSchema()).WithDescription("Link being edited, instead of workspace_id. Its own tags don't count")},
+	}
+	tag := &openapi3.ParameterRef{Value: openapi3.NewQueryParameter("tag").
+		WithSchema(openapi3.NewStringSchema()).WithDescription("Only links with this tag or a tag below it, lang also finds lang/go")}
+	body := func(schema string) *openapi3.RequestBodyRef {
+		return &openapi3.RequestBodyRef{Value: openapi3.NewRequestBody().WithRequired(true).
+			WithContent(openapi3.NewContentWithJSONSchemaRef(ref(schema)))}
+	}
+	jsonResponse := func(status int, description, schema string) *openapi3.Responses {
+		responses := openapi3.NewResponses(openapi3.WithName("default",
+			openapi3.NewResponse().WithDescription("Error").WithJSONSchemaRef(ref("Error"))))
+		response := openapi3.NewResponse().WithDescription(description)
+		if schema != "" {
+			response = response.WithJSONSchemaRef(ref(schema))
+		}
+		responses.Set(fmt.Sprint(status), &openapi3.ResponseRef{Value: response})
+		return responses
+	}
+	operation := func(id, summary, scope string, responses *openapi3.Responses, params ...*openapi3.ParameterRef) *openapi3.Operation {
+		return &openapi3.Operation{
+			OperationID: id,
+			Summary:     summary,
+			Description: "Needs a token with the " + scope + " scope.",
+			Parameters:  params,
+			Responses:   responses,
+		}
+	}
+	withBody := func(op *openapi3.Operation, schema string) *openapi3.Operation {
+		op.RequestBody = body(schema)
+		return op
+	}
+
+	spec := &openapi3.T{
+		OpenAPI: "3.0.3",
+		Info: &openapi3.Info{
+			Title:       "LinkCollector API",
+			Version:     "1",
+			Description: "Save, tag and search links. Authenticate with a personal API token from Settings, sent as `Authorization: Bearer <token>`.",
+		},
+		Servers: openapi3.Servers{{URL: apiBasePath}},
+		Components: &openapi3.Components{
+			Schemas: schemas,
+			SecuritySchemes: openapi3.SecuritySchemes{
+				"bearerAuth": &openapi3.SecuritySchemeRef{Value: openapi3.NewSecurityScheme().WithType("http").WithScheme("bearer")},
+			},
+		},
+		Security: openapi3.SecurityRequirements{{"bearerAuth": []string{}}},
+		Paths: openapi3.NewPaths(
+			openapi3.WithPath("/me", &openapi3.PathItem{
+				Get: operation("getCurrentUser", "Who the token belongs to", "read",
+					jsonResponse(http.StatusOK, "The token's owner", "CurrentUser")),
+			}),
+			openapi3.WithPath("/links", &openapi3.PathItem{
+				Get: operation("listLinks", "List your personal links, newest first", "read",
+					jsonResponse(http.StatusOK, "A page of links", "LinkList"), page, perPage, tag),
+				Post: withBody(operation("createLink", "Add a link, an empty title or description is filled in from the page", "write",
+					jsonResponse(http.StatusCreated, "The new link", "Link")), "NewLink"),
+			}),
+			openapi3.WithPath("/links/{id}", &openapi3.PathItem{
+				Get: operation("getLink", "Get a link", "read",
+					jsonResponse(http.StatusOK, "The link", "Link"), linkID),
+				Put: withBody(operation("replaceLink", "Replace a link", "write",
+					jsonResponse(http.StatusOK, "The updated link", "Link"), linkID), "LinkInput"),
+				Patch: withBody(operation("updateLink", "Change some fields of a link", "write",
+					jsonResponse(http.StatusOK, "The updated link", "Link"), linkID), "LinkPatch"),
+				Delete: operation("deleteLink", "Delete a link", "write",
+					jsonResponse(http.StatusNoContent, "The link was deleted", ""), linkID),
+			}),
+			openapi3.WithPath("/tags", &openapi3.PathItem{
+				Get: operation("listTags", "List your personal tags with how many links have them", "read",
+					jsonResponse(http.StatusOK, "Tags sorted by name", "TagList")),
+			}),
+			openapi3.WithPath("/tags/suggestions", &openapi3.PathItem{
+				Get: operation("suggestTags", "Suggest tags for a link, the ones you use most and lately first", "read",
+					jsonResponse(http.StatusOK, "Tags matching q and tags of other links from the same site", "TagSuggestions"), suggestFor...),
+			}),
+			openapi3.WithPath("/tags/{id}", &openapi3.PathItem{
+				Patch: withBody(operation("renameTag", "Rename a tag and the tags below it", "write",
+					jsonResponse(http.StatusOK, "The renamed tag", "Tag"), tagID), "TagRename"),
+				Delete: operation("deleteTag", "Delete a tag, the tags below it move up a level", "write",
+					jsonResponse(http.StatusNoContent, "The tag was deleted", ""), tagID, reassignTo),
+			}),
+			openapi3.WithPath("/tags/merge", &openapi3.PathItem{
+				Post: withBody(operation("mergeTags", "Merge tags into another tag", "write",
+					jsonResponse(http.StatusOK, "The tag they were merged into", "Tag")), "TagMerge"),
+			}),
+			openapi3.WithPath("/tags/cleanup", &openapi3.PathItem{
+				Post: operation("cleanUpTags", "Delete your personal tags that no link has", "write",
+					jsonResponse(http.StatusOK, "How many tags were deleted", "TagCleanup")),
+			}),
+			openapi3.WithPath("/search", &openapi3.PathItem{
+				Get: operation("searchLinks", "Search your links", "read",
+					jsonResponse(http.StatusOK, "A page of matching links", "LinkList"), query, page, perPage),
+			}),
+		),
+	}
+
+	if err := spec.Validate(context.Background()); err != nil {
+		return nil, fmt.Errorf("invalid OpenAPI spec: %w", err)
+	}
+	return spec, nil
+}
+
+// Make sure every API route in the router is in the spec and the other
+// way around
+func checkOpenAPIRoutes(spec *openapi3.T, routes gin.RoutesInfo) error {
+	registered := make(map[string]bool)
+	var problems []string
+	for _, route := range routes {
+		if !strings.HasPrefix(route.Path, apiBasePath+"/") || route.Path == openAPIPath {
+			continue
+		}
+		// gin writes /links/:id, OpenAPI writes /links/{id}
+		parts := strings.Split(strings.TrimPrefix(route.Path, apiBasePath), "/")
+		for i, part := range parts {
+			if strings.HasPrefix(part, ":") {
+				parts[i] = "{" + part[1:] + "}"
+			}
+		}
+		path := strings.Join(parts, "/")
+		registered[route.Method+" "+path] = true
+
+		item := spec.Paths.Value(path)
+		if item == nil || item.GetOperation(route.Method) == nil {
+			problems = append(problems, route.Method+" "+route.Path+" is not in the spec")
+		}
+	}
+
+	for path, item := range spec.Paths.Map() {
+		for method := range item.Operations() {
+			if !registered[method+" "+path] {
+				problems = append(problems, method+" "+apiBasePath+path+" is in the spec but has no route")
+			}
+		}
+	}
+
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return fmt.Errorf("API routes and OpenAPI spec don't match:\n  %s", strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+// Serve the spec
+func serveOpenAPISpec(spec *openapi3.T) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, spec)
+	}
+}
+
+// Captures a response so it can be checked before it is sent
+type bufferedResponseWriter struct {
+	gin.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *bufferedResponseWriter) WriteHeader(code int)              { w.status = code }
+func (w *bufferedResponseWriter) WriteHeaderNow()                   {}
+func (w *bufferedResponseWriter) Write(b []byte) (int, error)       { return w.body.Write(b) }
+func (w *bufferedResponseWriter) WriteString(s string) (int, error) { return w.body.WriteString(s) }
+func (w *bufferedResponseWriter) Status() int                       { return w.status }
+func (w *bufferedResponseWriter) Size() int                         { return w.body.Len() }
+func (w *bufferedResponseWriter) Written() bool                     { return w.body.Len() > 0 }
+
+// Middleware that rejects requests that don't match the spec and, when
+// checkResponses is set, refuses to send responses that don't match it
+// either (that is a bug in the handler, so it turns into a 500). Has to run
+// after apiAuthRequired, authentication is not its job.
+func openAPIValidator(spec *openapi3.T, checkRequests, checkResponses bool) (gin.HandlerFunc, error) {
+	router, err := gorillamux.NewRouter(spec)
+	if err != nil {
+		return nil, err
+	}
+	// Errors go back to API clients, they don't need the whole schema
+	openapi3.SchemaErrorDetailsDisabled = true
+	options := &openapi3filter.Options{
+		AuthenticationFunc: openapi3filter.NoopAuthenticationFunc,
+	}
+
+	return func(c *gin.Context) {
+		if !checkRequests && !checkResponses {
+			c.Next()
+			return
+		}
+		route, pathParams, err := router.FindRoute(c.Request)
+		if err != nil {
+			// checkOpenAPIRoutes makes sure this doesn't happen
+			c.Next()
+			return
+		}
+
+		input := &openapi3filter.RequestValidationInput{
+			Request:    c.Request,
+			PathParams: pathParams,
+			Route:      route,
+			Options:    options,
+		}
+		if checkRequests {
+			if err := openapi3filter.ValidateRequest(c.Request.Context(), input); err != nil {
+				apiError(c, http.StatusBadRequest, "request doesn't match the API spec: "+err.Error())
+				return
+			}
+		}
+		if !checkResponses {
+			c.Next()
+			return
+		}
+
+		original := c.Writer
+		buffered := &bufferedResponseWriter{ResponseWriter: original, status: http.StatusOK}
+		c.Writer = buffered
+		c.Next()
+		c.Writer = original
+
+		responseInput := &openapi3filter.ResponseValidationInput{
+			RequestValidationInput: input,
+			Status:                 buffered.status,
+			Header:                 original.Header(),
+			Options:                options,
+		}
+		responseInput.SetBodyBytes(buffered.body.Bytes())
+		if err := openapi3filter.ValidateResponse(c.Request.Context(), responseInput); err != nil {
+			fmt.Printf("Response for %s %s doesn't match the API spec: %v\n", c.Request.Method, c.Request.URL.Path, err)
+			original.Header().Del("Location")
+			original.Header().Set("Content-Type", "application/json; charset=utf-8")
+			original.WriteHeader(http.StatusInternalServerError)
+			original.WriteString(`{"error":"response doesn't match the API spec"}`)
+			return
+		}
+
+		original.WriteHeader(buffered.status)
+		original.Write(buffered.body.Bytes())
+	}, nil
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"time"
+)
+
+// Every request the server makes to a URL someone typed in (page titles,
+// archives, health checks) has to go through NewOutboundClient. Otherwise
+// a link to http://127.0.0.1:3306 or http://169.254.169.254/ would have us
+// poke at our own database or the cloud provider's metadata service.
+//
+// The client resolves host names itself, checks every address it is about
+// to connect to and then connects to exactly that address, so a DNS record
+// that changes between the check and the connection (DNS rebinding) doesn't
+// get around it. Redirects open new connections and are checked the same
+// way.
+
+// ErrBlockedDestination means a URL pointed at a private or otherwise
+// off-limits address
+var ErrBlockedDestination = errors.New("destination not allowed")
+
+// ErrResponseTooLarge means a response body was bigger than allowed
+var ErrResponseTooLarge = errors.New("response too large")
+
+// Address ranges nobody outside should be able to make us talk to. Loopback,
+// private, link-local and multicast are checked with the netip methods, these
+// are the special ranges those don't cover.
+var blockedPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),       // "this network"
+	netip.MustParsePrefix("100.64.0.0/10"),   // carrier-grade NAT
+	netip.MustParsePrefix("192.0.0.0/24"),    // IETF protocol assignments
+	netip.MustParsePrefix("192.0.2.0/24"),    // documentation
+	netip.MustParsePrefix("198.18.0.0/15"),   // benchmarking
+	netip.MustParsePrefix("198.51.100.0/24"), // documentation
+	netip.MustParsePrefix("203.0.113.0/24"),  // documentation
+	netip.MustParsePrefix("240.0.0.0/4"),     // reserved, and broadcast
+	netip.MustParsePrefix("64:ff9b::/96"),    // NAT64, can reach private IPv4
+	netip.MustParsePrefix("64:ff9b:1::/48"),  // local NAT64
+	netip.MustParsePrefix("100::/64"),        // discard
+	netip.MustParsePrefix("2001::/23"),       // IETF protocol assignments
+	netip.MustParsePrefix("2001:db8::/32"),   // documentation
+	netip.MustParsePrefix("2002::/16"),       // 6to4, can reach private IPv4
+}
+
+// OutboundPolicy decides which addresses outbound requests may go to
+type OutboundPolicy struct {
+	allowedHosts    map[string]bool
+	allowedPrefixes []netip.Prefix
+}
+
+// NewOutboundPolicy builds a policy from the FETCH_ALLOW list. Entries can
+// be host names ("intranet.example.com"), addresses or CIDR ranges
+// ("10.1.0.0/16"); those are reachable even though they'd normally be
+// blocked.
+func NewOutboundPolicy(allow []string) (*OutboundPolicy, error) {
+	policy := &OutboundPolicy{allowedHosts: make(map[string]bool)}
+	for _, entry := range allow {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		switch {
+		case entry == "":
+		case strings.Contains(entry, "/"):
+			prefix, err := netip.ParsePrefix(entry)
+			if err != nil {
+				return nil, fmt.Errorf("invalid FETCH_ALLOW entry %q: %w", entry, err)
+			}
+			policy.allowedPrefixes = append(policy.allowedPrefixes, prefix.Masked())
+		default:
+			if addr, err := netip.ParseAddr(entry); err == nil {
+				policy.allowedPrefixes = append(policy.allowedPrefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			} else {
+				policy.allowedHosts[strings.TrimSuffix(entry, ".")] = true
+			}
+		}
+	}
+	return policy, nil
+}
+
+// Allowed tells whether we may connect to addr, which host resolved to
+func (p *OutboundPolicy) Allowed(host string, addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if p.allowedHosts[strings.TrimSuffix(strings.ToLower(host), ".")] {
+		return true
+	}
+	for _, prefix := range p.allowedPrefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return publicAddress(addr)
+}
+
+// Whether an address is on the public internet
+func publicAddress(addr netip.Addr) bool {
+	if !addr.IsValid() || addr.IsUnspecified() || addr.IsLoopback() || addr.IsPrivate() ||
+		addr.IsLinkLocalUnicast() || addr.IsLinkLocalMulticast() || addr.IsInterfaceLocalMulticast() ||
+		addr.IsMulticast() {
+		return false
+	}
+	for _, prefix := range blockedPrefixes {
+		if prefix.Contains(addr) {
+			return false
+		}
+	}
+	return true
+}
+
+// Resolves and checks addresses before connecting to them
+type safeDialer struct {
+	policy *OutboundPolicy
+	dialer *net.Dialer
+}
+
+func (d *safeDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return nil, err
+	}
+
+	lastErr := fmt.Errorf("%w: %s", ErrBlockedDestination, host)
+	for _, addr := range addrs {
+		if !d.policy.Allowed(host, addr) {
+			continue
+		}
+		conn, err := d.dialer.DialContext(ctx, network, net.JoinHostPort(addr.Unmap().String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+// Turns away anything but http(s) and caps response bodies
+type outboundTransport struct {
+	base     http.RoundTripper
+	maxBytes int64
+}
+
+func (t *outboundTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+		return nil, fmt.Errorf("%w: %s URLs can't be fetched", ErrBlockedDestination, req.URL.Scheme)
+	}
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = &limitedBody{ReadCloser: resp.Body, remaining: t.maxBytes}
+	return resp, nil
+}
+
+// A response body that fails once more than the limit has been read. Callers
+// that only want the start of a body can stop reading before that.
+type limitedBody struct {
+	io.ReadCloser
+	remaining int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.remaining < 0 {
+		return 0, ErrResponseTooLarge
+	}
+	// Read one byte more than allowed to notice bodies that are too long
+	if int64(len(p)) > b.remaining+1 {
+		p = p[:b.remaining+1]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.remaining -= int64(n)
+	if b.remaining < 0 {
+		return n + int(b.remaining), ErrResponseTooLarge
+	}
+	return n, err
+}
+
+// NewOutboundClient creates the HTTP client for fetching user supplied
+// URLs. Requests time out after config.FetchTimeout, follow at most
+// config.FetchMaxRedirects redirects and read at most config.FetchMaxBytes
+// of the body.
+func NewOutboundClient(config Config) (*http.Client, error) {
+	policy, err := NewOutboundPolicy(strings.Split(config.FetchAllow, ","))
+	if err != nil {
+		return nil, err
+	}
+
+	dialer := &safeDialer{
+		policy: policy,
+		dialer: &net.Dialer{Timeout: 5 * time.Second},
+	}
+	transport := &http.Transport{
+		// Never through a proxy, the proxy would do the connecting and the
+		// checks above would be checking the proxy
+		Proxy:                 nil,
+		DialContext:           dialer.DialContext,
+		TLSHandshakeTimeout:   5 * time.Second,
+		ResponseHeaderTimeout: config.FetchTimeout,
+		MaxIdleConns:          20,
+		IdleConnTimeout:       30 * time.Second,
+	}
+
+	return &http.Client{
+		Timeout:   config.FetchTimeout,
+		Transport: &outboundTransport{base: transport, maxBytes: config.FetchMaxBytes},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) > config.FetchMaxRedirects {
+				return fmt.Errorf("stopped after %d redirects", config.FetchMaxRedirects)
+			}
+			if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+				return fmt.Errorf("%w: redirect to a %s URL", ErrBlockedDestination, req.URL.Scheme)
+			}
+			return nil
+		},
+	}, nil
+}
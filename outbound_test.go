@@ -0,0 +1,175 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOutboundPolicy(t *testing.T) {
+	blocked, err := NewOutboundPolicy(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for addr, allowed := range map[string]bool{
+		"93.184.216.34":            true,
+		"2606:4700:4700::1111":     true,
+		"10.1.2.3":                 false,
+		"172.16.0.1":               false,
+		"192.168.1.1":              false,
+		"127.0.0.1":                false,
+		"169.254.169.254":          false, // cloud metadata
+		"0.0.0.0":                  false,
+		"0.1.2.3":                  false,
+		"100.64.0.1":               false, // carrier-grade NAT
+		"100.127.255.254":          false,
+		"100.128.0.1":              true, // just past it
+		"224.0.0.1":                false,
+		"255.255.255.255":          false,
+		"::":                       false,
+		"::1":                      false,
+		"fc00::1":                  false,
+		"fd12:3456::1":             false,
+		"fe80::1":                  false,
+		"ff02::1":                  false,
+		"::ffff:10.1.2.3":          false, // IPv4-mapped
+		"::ffff:127.0.0.1":         false,
+		"::ffff:169.254.169.254":   false,
+		"::ffff:93.184.216.34":     true,
+		"64:ff9b::a01:203":         false, // NAT64 of 10.1.2.3
+		"2002:a01:203::1":          false, // 6to4 of 10.1.2.3
+		"2001:db8::1":              false,
+		"fdaa:bbbb:cccc:dddd::abc": false,
+	} {
+		if got := blocked.Allowed("example.com", netip.MustParseAddr(addr)); got != allowed {
+			t.Errorf("Allowed(%s) = %v, want %v", addr, got, allowed)
+		}
+	}
+
+	// FETCH_ALLOW opens up exactly what it lists
+	policy, err := NewOutboundPolicy(strings.Split("10.1.0.0/16, 192.168.1.5,Intranet.Example.com.,::1", ","))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		host, addr string
+		allowed    bool
+	}{
+		{"a.example", "10.1.200.3", true},
+		{"a.example", "::ffff:10.1.200.3", true},
+		{"a.example", "10.2.0.1", false},
+		{"a.example", "192.168.1.5", true},
+		{"a.example", "192.168.1.6", false},
+		{"a.example", "::1", true},
+		{"a.example", "127.0.0.1", false},
+		{"intranet.example.com", "172.16.0.9", true},
+		{"INTRANET.example.com.", "172.16.0.9", true},
+		{"other.example.com", "172.16.0.9", false},
+		{"a.example", "93.184.216.34", true},
+	} {
+		if got := policy.Allowed(test.host, netip.MustParseAddr(test.addr)); got != test.allowed {
+			t.Errorf("with FETCH_ALLOW, Allowed(%s, %s) = %v, want %v", test.host, test.addr, got, test.allowed)
+		}
+	}
+
+	for _, entry := range []string{"10.0.0.0/33", "not a range/8"} {
+		if _, err := NewOutboundPolicy([]string{entry}); err == nil {
+			t.Errorf("FETCH_ALLOW entry %q was accepted", entry)
+		}
+	}
+}
+
+// A client like main's, with the test servers on 127.0.0.1 allowed
+func newTestOutboundClient(t *testing.T, allow string, maxRedirects int) *http.Client {
+	t.Helper()
+	config := LoadConfig()
+	config.FetchAllow = allow
+	config.FetchTimeout = 5 * time.Second
+	config.FetchMaxRedirects = maxRedirects
+	client, err := NewOutboundClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+func TestOutboundClient(t *testing.T) {
+	// /hops/3 redirects to /hops/2 and so on down to the page at /hops/0,
+	// /to?url= redirects anywhere
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/to" {
+			http.Redirect(w, r, r.URL.Query().Get("url"), http.StatusFound)
+			return
+		}
+		hops, _ := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/hops/"))
+		if hops > 0 {
+			http.Redirect(w, r, fmt.Sprintf("/hops/%d", hops-1), http.StatusFound)
+			return
+		}
+		io.WriteString(w, "arrived")
+	}))
+	defer server.Close()
+	port := server.URL[strings.LastIndex(server.URL, ":")+1:]
+
+	get := func(client *http.Client, url string) error {
+		t.Helper()
+		resp, err := client.Get(url)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		return nil
+	}
+
+	t.Run("FETCH_ALLOW", func(t *testing.T) {
+		for allow, reachable := range map[string]bool{
+			"":             false,
+			"127.0.0.1":    true,
+			"127.0.0.0/8":  true,
+			"10.0.0.0/8":   false,
+			"localhost":    true, // by name, for http://localhost
+			"intranet.com": false,
+		} {
+			err := get(newTestOutboundClient(t, allow, 5), "http://localhost:"+port+"/hops/0")
+			if got := err == nil; got != reachable {
+				t.Errorf("FETCH_ALLOW=%q: localhost reachable %v, want %v (%v)", allow, got, reachable, err)
+			} else if !reachable && !errors.Is(err, ErrBlockedDestination) {
+				t.Errorf("FETCH_ALLOW=%q: got %v, want ErrBlockedDestination", allow, err)
+			}
+		}
+	})
+
+	t.Run("redirect to a private address", func(t *testing.T) {
+		client := newTestOutboundClient(t, "127.0.0.1", 5)
+		for _, target := range []string{
+			"http://169.254.169.254/latest/meta-data/",
+			"http://10.0.0.1/",
+			"http://[::1]:" + port + "/hops/0",
+			"http://0.0.0.0:" + port + "/hops/0",
+		} {
+			if err := get(client, server.URL+"/to?url="+target); !errors.Is(err, ErrBlockedDestination) {
+				t.Errorf("redirect to %s: got %v, want ErrBlockedDestination", target, err)
+			}
+		}
+		if err := get(client, server.URL+"/to?url=file:///etc/passwd"); !errors.Is(err, ErrBlockedDestination) {
+			t.Errorf("redirect to a file URL: got %v, want ErrBlockedDestination", err)
+		}
+	})
+
+	t.Run("redirect limit", func(t *testing.T) {
+		client := newTestOutboundClient(t, "127.0.0.1", 3)
+		if err := get(client, server.URL+"/hops/3"); err != nil {
+			t.Errorf("3 redirects with a limit of 3: %v", err)
+		}
+		if err := get(client, server.URL+"/hops/4"); err == nil || !strings.Contains(err.Error(), "stopped after 3 redirects") {
+			t.Errorf("4 redirects with a limit of 3: got %v", err)
+		}
+	})
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// PasswordHasher hashes and checks passwords. Hashes are stored in the
+// usual self-describing formats ("$2a$12$..." for bcrypt, PHC strings like
+// "$argon2id$v=19$m=65536,t=3,p=2$salt$hash" for argon2id), so changing the
+// algorithm or cost in the config only affects new hashes. Old ones are
+// upgraded the next time their owner logs in.
+type PasswordHasher struct {
+	Algorithm    string // "bcrypt" or "argon2id"
+	BcryptCost   int
+	ArgonMemory  uint32 // KiB
+	ArgonTime    uint32
+	ArgonThreads uint8
+
+	dummyOnce sync.Once
+	dummyHash string
+}
+
+// Cost parameters read back from an argon2id hash
+type argon2Params struct {
+	Memory  uint32
+	Time    uint32
+	Threads uint8
+}
+
+const (
+	argonSaltLength = 16
+	argonKeyLength  = 32
+)
+
+// NewPasswordHasher creates a hasher from the config
+func NewPasswordHasher(config Config) *PasswordHasher {
+	return &PasswordHasher{
+		Algorithm:    config.PasswordHashAlgorithm,
+		BcryptCost:   config.BcryptCost,
+		ArgonMemory:  uint32(config.Argon2Memory),
+		ArgonTime:    uint32(config.Argon2Time),
+		ArgonThreads: uint8(config.Argon2Threads),
+	}
+}
+
+// Hash a password with the configured algorithm
+func (h *PasswordHasher) Hash(password string) (string, error) {
+	switch h.Algorithm {
+	case "argon2id":
+		salt := make([]byte, argonSaltLength)
+		if _, err := rand.Read(salt); err != nil {
+			return "", err
+		}
+		key := argon2.IDKey([]byte(password), salt, h.ArgonTime, h.ArgonMemory, h.ArgonThreads, argonKeyLength)
+		return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+			argon2.Version, h.ArgonMemory, h.ArgonTime, h.ArgonThreads,
+			base64.RawStdEncoding.EncodeToString(salt),
+			base64.RawStdEncoding.EncodeToString(key)), nil
+	case "bcrypt", "":
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), h.BcryptCost)
+		return string(hash), err
+	default:
+		return "", fmt.Errorf("unknown password hash algorithm %q", h.Algorithm)
+	}
+}
+
+// Verify checks a password against a stored hash. needsRehash is true when
+// the password was right but the hash is plaintext, uses another algorithm
+// or is weaker than what is configured now.
+func (h *PasswordHasher) Verify(stored, password string) (ok bool, needsRehash bool) {
+	switch {
+	case strings.HasPrefix(stored, "$2a$") || strings.HasPrefix(stored, "$2b$") || strings.HasPrefix(stored, "$2y$"):
+		if bcrypt.CompareHashAndPassword([]byte(stored), []byte(password)) != nil {
+			return false, false
+		}
+		cost, err := bcrypt.Cost([]byte(stored))
+		return true, h.Algorithm != "bcrypt" || err != nil || cost < h.BcryptCost
+
+	case strings.HasPrefix(stored, "$argon2id$"):
+		params, salt, key, err := parseArgon2Hash(stored)
+		if err != nil {
+			return false, false
+		}
+		candidate := argon2.IDKey([]byte(password), salt, params.Time, params.Memory, params.Threads, uint32(len(key)))
+		if subtle.ConstantTimeCompare(candidate, key) != 1 {
+			return false, false
+		}
+		weaker := params.Memory < h.ArgonMemory || params.Time < h.ArgonTime || params.Threads < h.ArgonThreads
+		return true, h.Algorithm != "argon2id" || weaker
+
+	default:
+		// Accounts created before passwords were hashed. Compare digests so
+		// the comparison doesn't leak the length of the password.
+		storedSum := sha256.Sum256([]byte(stored))
+		passwordSum := sha256.Sum256([]byte(password))
+		if stored == "" || subtle.ConstantTimeCompare(storedSum[:], passwordSum[:]) != 1 {
+			return false, false
+		}
+		return true, true
+	}
+}
+
+// Take about as long as a real check, so a login for a user that doesn't
+// exist can't be told apart by timing
+func (h *PasswordHasher) dummyVerify(password string) {
+	h.dummyOnce.Do(func() {
+		h.dummyHash, _ = h.Hash("not the password")
+	})
+	h.Verify(h.dummyHash, password)
+}
+
+// Split "$argon2id$v=19$m=65536,t=3,p=2$salt$hash" into its parts
+func parseArgon2Hash(encoded string) (argon2Params, []byte, []byte, error) {
+	var params argon2Params
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 {
+		return params, nil, nil, fmt.Errorf("invalid argon2id hash")
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return params, nil, nil, fmt.Errorf("unsupported argon2 version")
+	}
+	var threads uint32
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Time, &threads); err != nil {
+		return params, nil, nil, fmt.Errorf("invalid argon2id parameters")
+	}
+	if threads == 0 || threads > 255 {
+		return params, nil, nil, fmt.Errorf("invalid argon2id parameters")
+	}
+	params.Threads = uint8(threads)
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return params, nil, nil, err
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return params, nil, nil, fmt.Errorf("invalid argon2id key")
+	}
+	return params, salt, key, nil
+}
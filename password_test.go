@@ -0,0 +1,94 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Hashers with the lowest costs, the real ones take a while on purpose
+func testBcryptHasher(cost int) *PasswordHasher {
+	return &PasswordHasher{Algorithm: "bcrypt", BcryptCost: cost}
+}
+
+func testArgonHasher(memory uint32) *PasswordHasher {
+	return &PasswordHasher{Algorithm: "argon2id", BcryptCost: bcrypt.MinCost, ArgonMemory: memory, ArgonTime: 1, ArgonThreads: 1}
+}
+
+func mustHash(t *testing.T, h *PasswordHasher, password string) string {
+	t.Helper()
+	hash, err := h.Hash(password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hash
+}
+
+func TestPasswordVerify(t *testing.T) {
+	const password = "correct horse"
+	current := testArgonHasher(1024)
+
+	for _, test := range []struct {
+		name        string
+		stored      string
+		password    string
+		ok, rehash  bool
+		checkedWith *PasswordHasher
+	}{
+		{"argon2id", mustHash(t, current, password), password, true, false, current},
+		{"argon2id, wrong password", mustHash(t, current, password), "wrong", false, false, current},
+		{"weaker argon2id", mustHash(t, testArgonHasher(512), password), password, true, true, current},
+		{"bcrypt when argon2id is configured", mustHash(t, testBcryptHasher(bcrypt.MinCost), password), password, true, true, current},
+		{"bcrypt", mustHash(t, testBcryptHasher(bcrypt.MinCost), password), password, true, false, testBcryptHasher(bcrypt.MinCost)},
+		{"cheaper bcrypt", mustHash(t, testBcryptHasher(bcrypt.MinCost), password), password, true, true, testBcryptHasher(bcrypt.MinCost + 1)},
+		{"bcrypt, wrong password", mustHash(t, testBcryptHasher(bcrypt.MinCost), password), "wrong", false, false, current},
+		{"argon2id when bcrypt is configured", mustHash(t, current, password), password, true, true, testBcryptHasher(bcrypt.MinCost)},
+		{"plaintext", password, password, true, true, current},
+		{"plaintext, wrong password", password, "wrong", false, false, current},
+		{"empty", "", "", false, false, current},
+		{"broken argon2id", "$argon2id$v=19$m=1024,t=1,p=0$c2FsdA$a2V5", password, false, false, current},
+	} {
+		ok, rehash := test.checkedWith.Verify(test.stored, test.password)
+		if ok != test.ok || rehash != test.rehash {
+			t.Errorf("%s: Verify = %v, %v, want %v, %v", test.name, ok, rehash, test.ok, test.rehash)
+		}
+	}
+}
+
+// Logging in upgrades plaintext and outdated hashes to the configured one
+func TestLoginRehashesPassword(t *testing.T) {
+	app, server := newTestApp(t)
+	app.passwords = testArgonHasher(1024)
+	const password = "correct horse"
+
+	for name, stored := range map[string]string{
+		"plain":  password,
+		"bcrypt": mustHash(t, testBcryptHasher(bcrypt.MinCost), password),
+		"argon":  mustHash(t, testArgonHasher(512), password),
+	} {
+		user := createTestUser(t, app.store, name)
+		if err := app.store.UpdateUserPassword(user.ID, stored); err != nil {
+			t.Fatal(err)
+		}
+
+		browser := newTestBrowser(t, server)
+		browser.get("/login")
+		if code, _ := browser.post("/login", url.Values{"username": {name}, "password": {password}}); code != http.StatusFound {
+			t.Fatalf("%s: login: %d", name, code)
+		}
+
+		saved, err := app.store.GetUserByID(user.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(saved.Password, "$argon2id$v=19$m=1024,") {
+			t.Errorf("%s: stored hash after login is %q", name, saved.Password)
+		}
+		if ok, rehash := app.passwords.Verify(saved.Password, password); !ok || rehash {
+			t.Errorf("%s: new hash Verify = %v, %v", name, ok, rehash)
+		}
+	}
+}
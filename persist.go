@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// The in-memory store can be made durable with two files in a data
+// directory:
+//
+//   snapshot.json  the whole store at some point in time
+//   journal.log    every change made since that snapshot
+//
+// On startup the snapshot is loaded and the journal replayed on top of it.
+// Every journal record is fsynced before the change is applied in memory,
+// so a crash never loses a change the user was told about. Both files carry
+// CRC32 checksums so a damaged file is noticed instead of silently loaded.
+
+const (
+	snapshotFile   = "snapshot.json"
+	journalFile    = "journal.log"
+	snapshotHeader = "linkcollector-snapshot v1"
+	// Records bigger than this can only come from a damaged length field
+	maxJournalRecord = 64 << 20
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// ErrCorruptData means a snapshot or journal failed its checksum
+var ErrCorruptData = errors.New("persisted data is corrupt")
+
+// journalOp is one change to the store. Data holds the JSON of whatever the
+// op needs, see MemoryStore.apply for what each type carries.
+type journalOp struct {
+	Seq  uint64          `json:"seq"`
+	Type string          `json:"op"`
+	Data json.RawMessage `json:"data"`
+}
+
+// Journal is an append-only log of journalOps.
+// Each record is [length uint32][crc32 uint32][JSON].
+type Journal struct {
+	file *os.File
+	dir  string
+}
+
+// OpenJournal opens (or creates) the journal in dir
+func OpenJournal(dir string) (*Journal, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(filepath.Join(dir, journalFile), os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	return &Journal{file: file, dir: dir}, nil
+}
+
+// Replay reads every record from the start of the journal. A record cut off
+// at the very end (we crashed while writing it) is dropped and the file
+// truncated; a bad record with more data after it is reported as corruption.
+// The journal is left positioned for appending.
+func (j *Journal) Replay(fn func(op journalOp) error) error {
+	if _, err := j.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	reader := bufio.NewReader(j.file)
+
+	var offset int64
+	for {
+		op, size, err := readJournalRecord(reader)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// Anything left after the bad record means it isn't just a torn write
+			if _, peekErr := reader.Peek(1); peekErr == nil {
+				return fmt.Errorf("%w: journal record at byte %d: %v", ErrCorruptData, offset, err)
+			}
+			fmt.Printf("Dropping incomplete journal record at byte %d: %v\n", offset, err)
+			if err := j.file.Truncate(offset); err != nil {
+				return err
+			}
+			break
+		}
+		if err := fn(op); err != nil {
+			return fmt.Errorf("replaying journal record %d: %w", op.Seq, err)
+		}
+		offset += size
+	}
+
+	_, err := j.file.Seek(offset, io.SeekStart)
+	return err
+}
+
+// Read one record, returning how many bytes it took up
+func readJournalRecord(reader *bufio.Reader) (journalOp, int64, error) {
+	var header [8]byte
+	n, err := io.ReadFull(reader, header[:])
+	if err == io.EOF {
+		return journalOp{}, 0, io.EOF
+	}
+	if err != nil {
+		return journalOp{}, 0, fmt.Errorf("short header (%d bytes)", n)
+	}
+
+	length := binary.LittleEndian.Uint32(header[0:4])
+	checksum := binary.LittleEndian.Uint32(header[4:8])
+	if length > maxJournalRecord {
+		return journalOp{}, 0, fmt.Errorf("record length %d is too big", length)
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return journalOp{}, 0, fmt.Errorf("short record")
+	}
+	if crc32.Checksum(payload, crcTable) != checksum {
+		return journalOp{}, 0, fmt.Errorf("checksum mismatch")
+	}
+
+	var op journalOp
+	if err := json.Unmarshal(payload, &op); err != nil {
+		return journalOp{}, 0, err
+	}
+	return op, int64(len(header)) + int64(length), nil
+}
+
+// Append writes a record and waits until it is on disk
+func (j *Journal) Append(op journalOp) error {
+	payload, err := json.Marshal(op)
+	if err != nil {
+		return err
+	}
+
+	record := make([]byte, 8+len(payload))
+	binary.LittleEndian.PutUint32(record[0:4], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(record[4:8], crc32.Checksum(payload, crcTable))
+	copy(record[8:], payload)
+
+	if _, err := j.file.Write(record); err != nil {
+		return err
+	}
+	return j.file.Sync()
+}
+
+// Reset empties the journal once a snapshot has everything in it
+func (j *Journal) Reset() error {
+	if err := j.file.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := j.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	return j.file.Sync()
+}
+
+// Close the journal file
+func (j *Journal) Close() error {
+	return j.file.Close()
+}
+
+// Write a snapshot atomically: write a temp file, fsync it, rename it over
+// the old one and fsync the directory so the rename sticks
+func writeSnapshot(dir string, state interface{}) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	tmpPath := filepath.Join(dir, snapshotFile+".tmp")
+	file, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	header := fmt.Sprintf("%s crc32=%08x len=%d\n", snapshotHeader, crc32.Checksum(data, crcTable), len(data))
+	if _, err := file.WriteString(header); err != nil {
+		file.Close()
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmpPath, filepath.Join(dir, snapshotFile)); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// Read the snapshot into state. Returns false if there is no snapshot yet.
+func readSnapshot(dir string, state interface{}) (bool, error) {
+	data, err := os.ReadFile(filepath.Join(dir, snapshotFile))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	newline := strings.IndexByte(string(data), '\n')
+	if newline < 0 {
+		return false, fmt.Errorf("%w: snapshot has no header", ErrCorruptData)
+	}
+	var checksum uint32
+	var length int
+	_, err = fmt.Sscanf(string(data[:newline]), snapshotHeader+" crc32=%08x len=%d", &checksum, &length)
+	if err != nil {
+		return false, fmt.Errorf("%w: bad snapshot header: %v", ErrCorruptData, err)
+	}
+
+	body := data[newline+1:]
+	if len(body) != length || crc32.Checksum(body, crcTable) != checksum {
+		return false, fmt.Errorf("%w: snapshot checksum mismatch", ErrCorruptData)
+	}
+	if err := json.Unmarshal(body, state); err != nil {
+		return false, fmt.Errorf("%w: %v", ErrCorruptData, err)
+	}
+	return true, nil
+}
+
+// fsync a directory so renames inside it survive a crash
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,143 @@
+package main
+
+import "errors"
+
+// Who may do what with a link. Personal links belong to the user who saved
+// them. Workspace links belong to the workspace: its owners and editors
+// manage them like their own links, viewers can only look at them. On top
+// of that links can be unlisted or public (visibility.go), and personal
+// links can be shared with other users (sharing.go). Collections and tags
+// follow the same ownership, but are never shared or public themselves.
+
+// What a user may do with a link, each level includes the ones before it
+type accessLevel int
+
+const (
+	accessNone accessLevel = iota
+	accessRead
+	accessEdit   // change the URL, title, description and tags
+	accessManage // also delete it, pick its visibility, share and archive it
+)
+
+// Work out what a user may do with a link. userID is 0 for visitors who
+// aren't logged in. The link needs its tags filled in.
+func (app *App) linkAccess(link Link, userID int) (accessLevel, error) {
+	access := accessNone
+	if link.VisibleTo(userID) {
+		access = accessRead
+	}
+	if userID == 0 {
+		return access, nil
+	}
+
+	if link.WorkspaceID != 0 {
+		member, err := app.workspaceAccess(link.WorkspaceID, userID)
+		if member > access {
+			access = member
+		}
+		return access, err
+	}
+
+	if link.UserID == userID {
+		return accessManage, nil
+	}
+	shares, err := app.store.GetSharesWithUser(userID)
+	if err != nil {
+		return accessNone, err
+	}
+	for _, share := range shares {
+		if share.OwnerID != link.UserID {
+			continue
+		}
+		if share.LinkID != link.ID && (share.Tag == "" || !taggedWith(link.Tags, share.Tag)) {
+			continue
+		}
+		if share.Permission == PermissionEdit {
+			return accessEdit, nil
+		}
+		access = accessRead
+	}
+	return access, nil
+}
+
+// Work out what a user may do with a collection
+func (app *App) collectionAccess(collection Collection, userID int) (accessLevel, error) {
+	if collection.WorkspaceID != 0 {
+		return app.workspaceAccess(collection.WorkspaceID, userID)
+	}
+	if userID != 0 && collection.UserID == userID {
+		return accessManage, nil
+	}
+	return accessNone, nil
+}
+
+// Work out what a user may do with a tag, same as with a collection
+func (app *App) tagAccess(tag Tag, userID int) (accessLevel, error) {
+	if tag.WorkspaceID != 0 {
+		return app.workspaceAccess(tag.WorkspaceID, userID)
+	}
+	if userID != 0 && tag.UserID == userID {
+		return accessManage, nil
+	}
+	return accessNone, nil
+}
+
+// What the user's role lets them do with the things in a workspace
+func (app *App) workspaceAccess(workspaceID, userID int) (accessLevel, error) {
+	role, err := app.workspaceRole(workspaceID, userID)
+	switch {
+	case err != nil:
+		return accessNone, err
+	case roleAtLeast(role, RoleEditor):
+		return accessManage, nil
+	case role == RoleViewer:
+		return accessRead, nil
+	}
+	return accessNone, nil
+}
+
+// The user's role in a workspace, "" if they aren't a member
+func (app *App) workspaceRole(workspaceID, userID int) (string, error) {
+	member, err := app.store.GetWorkspaceMember(workspaceID, userID)
+	if errors.Is(err, ErrNotMember) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	return member.Role, nil
+}
+
+// Whether the user may save links to a workspace, or to their personal
+// links for workspaceID 0
+func (app *App) canAddLinks(workspaceID, userID int) (bool, error) {
+	if workspaceID == 0 {
+		return true, nil
+	}
+	role, err := app.workspaceRole(workspaceID, userID)
+	return roleAtLeast(role, RoleEditor), err
+}
+
+// The links of a library: a workspace's links, or the user's personal ones
+// for workspaceID 0
+func libraryLinks(store Store, userID, workspaceID int) ([]Link, error) {
+	if workspaceID != 0 {
+		return store.GetWorkspaceLinks(workspaceID)
+	}
+	return store.GetUserLinks(userID)
+}
+
+// The collections of a library, like libraryLinks
+func libraryCollections(store Store, userID, workspaceID int) ([]Collection, error) {
+	if workspaceID != 0 {
+		return store.GetWorkspaceCollections(workspaceID)
+	}
+	return store.GetUserCollections(userID)
+}
+
+// The tags of a library, like libraryLinks
+func libraryTags(store Store, userID, workspaceID int) ([]Tag, error) {
+	if workspaceID != 0 {
+		return store.GetWorkspaceTags(workspaceID)
+	}
+	return store.GetUserTags(userID)
+}
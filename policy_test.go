@@ -0,0 +1,212 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// A workspace owned by owner with the others as members in the given roles
+func createTestWorkspace(t *testing.T, store Store, name string, owner User, roles map[int]string) Workspace {
+	t.Helper()
+	workspace := &Workspace{Name: name, CreatedAt: time.Now()}
+	if err := store.CreateWorkspace(workspace, owner.ID); err != nil {
+		t.Fatal(err)
+	}
+	for userID, role := range roles {
+		if err := store.SaveWorkspaceMember(&WorkspaceMember{WorkspaceID: workspace.ID, UserID: userID, Role: role, CreatedAt: time.Now()}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return *workspace
+}
+
+func TestLinkAccess(t *testing.T) {
+	app, _ := newTestApp(t)
+	alice := createTestUser(t, app.store, "alice")
+	editor := createTestUser(t, app.store, "editor")
+	viewer := createTestUser(t, app.store, "viewer")
+	reader := createTestUser(t, app.store, "reader")
+	outsider := createTestUser(t, app.store, "outsider")
+	const anonymous = 0
+
+	workspace := createTestWorkspace(t, app.store, "Team", alice, map[int]string{editor.ID: RoleEditor, viewer.ID: RoleViewer})
+	private := createTestLink(t, app.store, Link{URL: "https://a.example/", UserID: alice.ID})
+	public := createTestLink(t, app.store, Link{URL: "https://b.example/", UserID: alice.ID, Visibility: VisibilityPublic})
+	unlisted := createTestLink(t, app.store, Link{URL: "https://c.example/", UserID: alice.ID, Visibility: VisibilityUnlisted})
+	tagged := createTestLink(t, app.store, Link{URL: "https://d.example/", UserID: alice.ID}, "shared")
+	team := createTestLink(t, app.store, Link{URL: "https://e.example/", UserID: alice.ID, WorkspaceID: workspace.ID})
+	publicTeam := createTestLink(t, app.store, Link{URL: "https://f.example/", UserID: editor.ID, WorkspaceID: workspace.ID, Visibility: VisibilityPublic})
+
+	// Shares only reach personal links, editor gets to edit private
+	for _, share := range []Share{
+		{OwnerID: alice.ID, UserID: editor.ID, LinkID: private.ID, Permission: PermissionEdit},
+		{OwnerID: alice.ID, UserID: reader.ID, Tag: "shared", Permission: PermissionRead},
+		{OwnerID: alice.ID, UserID: reader.ID, LinkID: team.ID, Permission: PermissionEdit},
+	} {
+		share.CreatedAt = time.Now()
+		if err := app.store.SaveShare(&share); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, test := range []struct {
+		link   Link
+		userID int
+		want   accessLevel
+	}{
+		{private, alice.ID, accessManage},
+		{private, editor.ID, accessEdit},
+		{private, viewer.ID, accessNone},
+		{private, anonymous, accessNone},
+		{public, outsider.ID, accessRead},
+		{public, anonymous, accessRead},
+		{public, alice.ID, accessManage},
+		{unlisted, anonymous, accessRead},
+		{tagged, reader.ID, accessRead},
+		{tagged, editor.ID, accessNone},
+		{team, alice.ID, accessManage}, // owner
+		{team, editor.ID, accessManage},
+		{team, viewer.ID, accessRead},
+		{team, outsider.ID, accessNone},
+		{team, reader.ID, accessNone}, // sharing a workspace link does nothing
+		{team, anonymous, accessNone},
+		{publicTeam, alice.ID, accessManage}, // saved by someone else in the workspace
+		{publicTeam, viewer.ID, accessRead},
+		{publicTeam, outsider.ID, accessRead},
+		{publicTeam, anonymous, accessRead},
+	} {
+		got, err := app.linkAccess(test.link, test.userID)
+		if err != nil || got != test.want {
+			t.Errorf("linkAccess(%s, user %d) = %v, %v, want %v", test.link.URL, test.userID, got, err, test.want)
+		}
+	}
+}
+
+func TestWorkspaceAccess(t *testing.T) {
+	app, _ := newTestApp(t)
+	owner := createTestUser(t, app.store, "owner")
+	editor := createTestUser(t, app.store, "editor")
+	viewer := createTestUser(t, app.store, "viewer")
+	outsider := createTestUser(t, app.store, "outsider")
+	workspace := createTestWorkspace(t, app.store, "Team", owner, map[int]string{editor.ID: RoleEditor, viewer.ID: RoleViewer})
+	other := createTestWorkspace(t, app.store, "Other", outsider, nil)
+
+	for _, test := range []struct {
+		workspaceID, userID int
+		want                accessLevel
+		canAdd              bool
+	}{
+		{workspace.ID, owner.ID, accessManage, true},
+		{workspace.ID, editor.ID, accessManage, true},
+		{workspace.ID, viewer.ID, accessRead, false},
+		{workspace.ID, outsider.ID, accessNone, false},
+		{workspace.ID, 0, accessNone, false},
+		{other.ID, owner.ID, accessNone, false},
+		{0, viewer.ID, accessNone, true}, // personal links
+	} {
+		got, err := app.workspaceAccess(test.workspaceID, test.userID)
+		if test.workspaceID != 0 && (err != nil || got != test.want) {
+			t.Errorf("workspaceAccess(%d, user %d) = %v, %v, want %v", test.workspaceID, test.userID, got, err, test.want)
+		}
+		canAdd, err := app.canAddLinks(test.workspaceID, test.userID)
+		if err != nil || canAdd != test.canAdd {
+			t.Errorf("canAddLinks(%d, user %d) = %v, %v, want %v", test.workspaceID, test.userID, canAdd, err, test.canAdd)
+		}
+	}
+
+	// Tags and collections of the workspace follow the roles
+	createTestLink(t, app.store, Link{URL: "https://go.dev/", UserID: editor.ID, WorkspaceID: workspace.ID}, "team")
+	tags, err := app.store.GetWorkspaceTags(workspace.ID)
+	if err != nil || len(tags) != 1 {
+		t.Fatalf("workspace tags = %+v, %v", tags, err)
+	}
+	tag := tags[0]
+	for userID, want := range map[int]accessLevel{owner.ID: accessManage, editor.ID: accessManage, viewer.ID: accessRead, outsider.ID: accessNone} {
+		if got, err := app.tagAccess(tag, userID); err != nil || got != want {
+			t.Errorf("tagAccess(user %d) = %v, %v, want %v", userID, got, err, want)
+		}
+		collection := Collection{WorkspaceID: workspace.ID, UserID: owner.ID}
+		if got, err := app.collectionAccess(collection, userID); err != nil || got != want {
+			t.Errorf("collectionAccess(user %d) = %v, %v, want %v", userID, got, err, want)
+		}
+	}
+}
+
+// The roles hold up on the web pages and in the API alike
+func TestWorkspaceLinkRoles(t *testing.T) {
+	app, server := newTestApp(t)
+	owner, ownerUser := loginTestUser(t, app, server, "owner")
+	editor, editorUser := loginTestUser(t, app, server, "editor")
+	viewer, viewerUser := loginTestUser(t, app, server, "viewer")
+	outsider, outsiderUser := loginTestUser(t, app, server, "outsider")
+	workspace := createTestWorkspace(t, app.store, "Team", ownerUser, map[int]string{editorUser.ID: RoleEditor, viewerUser.ID: RoleViewer})
+
+	browsers := map[string]*testBrowser{"owner": owner, "editor": editor, "viewer": viewer, "outsider": outsider}
+	tokens := map[string]string{}
+	for name, user := range map[string]User{"owner": ownerUser, "editor": editorUser, "viewer": viewerUser, "outsider": outsiderUser} {
+		tokens[name] = createTestAPIToken(t, app.store, APIToken{UserID: user.ID})
+	}
+
+	for _, role := range []struct {
+		name                        string
+		view, edit, deletion        int // web
+		apiGet, apiPatch, apiDelete int
+	}{
+		{"outsider", http.StatusNotFound, http.StatusForbidden, http.StatusForbidden, http.StatusForbidden, http.StatusForbidden, http.StatusForbidden},
+		{"viewer", http.StatusOK, http.StatusForbidden, http.StatusForbidden, http.StatusOK, http.StatusForbidden, http.StatusForbidden},
+		{"editor", http.StatusOK, http.StatusFound, http.StatusFound, http.StatusOK, http.StatusOK, http.StatusNoContent},
+		{"owner", http.StatusOK, http.StatusFound, http.StatusFound, http.StatusOK, http.StatusOK, http.StatusNoContent},
+	} {
+		// One link for the web and one for the API, each gets deleted
+		web := createTestLink(t, app.store, Link{URL: "https://go.dev/web", Title: "Go", UserID: ownerUser.ID, WorkspaceID: workspace.ID})
+		api := createTestLink(t, app.store, Link{URL: "https://go.dev/api", Title: "Go", UserID: ownerUser.ID, WorkspaceID: workspace.ID})
+		webPath := "/links/" + strconv.Itoa(web.ID)
+		apiPath := "/api/v1/links/" + strconv.Itoa(api.ID)
+		browser := browsers[role.name]
+
+		if code, _ := browser.get(webPath); code != role.view {
+			t.Errorf("%s: GET %s: %d, want %d", role.name, webPath, code, role.view)
+		}
+		browser.get("/dashboard")
+		form := url.Values{"url": {"https://go.dev/web"}, "title": {"Edited by " + role.name}, "description": {""}, "tags": {""}}
+		if code, _ := browser.post(webPath+"/edit", form); code != role.edit {
+			t.Errorf("%s: editing on the web: %d, want %d", role.name, code, role.edit)
+		}
+		browser.get("/dashboard")
+		if code, _ := browser.post(webPath+"/delete", url.Values{}); code != role.deletion {
+			t.Errorf("%s: deleting on the web: %d, want %d", role.name, code, role.deletion)
+		}
+
+		token := tokens[role.name]
+		if code := sendAPI(t, server, http.MethodGet, apiPath, token, ""); code != role.apiGet {
+			t.Errorf("%s: API GET: %d, want %d", role.name, code, role.apiGet)
+		}
+		if code := sendAPI(t, server, http.MethodPatch, apiPath, token, `{"title": "Edited"}`); code != role.apiPatch {
+			t.Errorf("%s: API PATCH: %d, want %d", role.name, code, role.apiPatch)
+		}
+		if code := sendAPI(t, server, http.MethodDelete, apiPath, token, ""); code != role.apiDelete {
+			t.Errorf("%s: API DELETE: %d, want %d", role.name, code, role.apiDelete)
+		}
+
+		// Whatever was refused really didn't happen
+		if role.deletion != http.StatusFound {
+			if got, err := app.store.GetLinkByID(web.ID); err != nil || got.Title != "Go" {
+				t.Errorf("%s: the web link is now %+v, %v", role.name, got, err)
+			}
+			if got, err := app.store.GetLinkByID(api.ID); err != nil || got.Title != "Go" {
+				t.Errorf("%s: the API link is now %+v, %v", role.name, got, err)
+			}
+		}
+	}
+
+	// Only editors and owners can add links to the workspace
+	for name, want := range map[string]int{"viewer": http.StatusForbidden, "editor": http.StatusCreated} {
+		body := `{"url": "https://example.com/` + name + `", "title": "New", "workspace_id": ` + strconv.Itoa(workspace.ID) + `}`
+		if code := sendAPI(t, server, http.MethodPost, "/api/v1/links", tokens[name], body); code != want {
+			t.Errorf("%s: API adding a link to the workspace: %d, want %d", name, code, want)
+		}
+	}
+}
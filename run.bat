@@ -13,6 +13,7 @@ go mod download
 
 REM Set MySQL connection variables if needed
 REM Uncomment and modify these lines with your Strato MySQL credentials
+REM SET DB_DRIVER=mysql
 REM SET DB_USER=your_strato_db_user
 REM SET DB_PASSWORD=your_strato_db_password
 REM SET DB_HOST=your_strato_db_host
@@ -21,6 +22,6 @@ REM SET DB_NAME=your_strato_db_name
 REM SET SESSION_SECRET=your-secure-session-key
 
 ECHO Running LinkCollector on http://localhost:8080
-go run main.go config.go
+go run .
 
 PAUSE 
\ No newline at end of file
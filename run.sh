@@ -16,6 +16,7 @@ go mod download
 
 # Set MySQL connection variables if needed
 # Uncomment and modify these lines with your Strato MySQL credentials
+# export DB_DRIVER=mysql
 # export DB_USER=your_strato_db_user
 # export DB_PASSWORD=your_strato_db_password
 # export DB_HOST=your_strato_db_host
@@ -25,4 +26,4 @@ go mod download
 
 # Run the application
 echo "Running LinkCollector on http://localhost:8080"
-go run main.go config.go 
\ No newline at end of file
+go run . 
\ No newline at end of file
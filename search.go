@@ -0,0 +1,471 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"strings"
+)
+
+// The search index of the in-memory store. Every library (see
+// libraryLinks) has an inverted index of its own: for every word, the links
+// that have it and how often in each field. Searching only looks at the
+// links that have the words searched for and ranks them with BM25, so a
+// search takes as long as there are links with those words, however many
+// links there are. The store keeps it up to date as links, tags and
+// archived copies change (see MemoryStore.apply).
+
+// The parts of a link that are searched
+type searchField int
+
+const (
+	fieldTitle searchField = iota
+	fieldTags
+	fieldDescription
+	fieldURL
+	fieldArchive // the text of the newest archived copy
+	searchFields
+)
+
+// How much a word counts in each field, a word in the title says more
+// about a link than one somewhere in its archived page
+var searchFieldWeights = [searchFields]float64{3, 2.5, 1.5, 1, 0.5}
+
+// BM25 parameters, the usual ones: how fast more of the same word stops
+// mattering, and how much long fields are held against a link
+const (
+	bm25K1 = 1.2
+	bm25B  = 0.75
+)
+
+// Words too common to search for, and the bits of every URL
+var stopWords = map[string]bool{
+	"a": true, "an": true, "and": true, "are": true, "as": true, "at": true,
+	"be": true, "by": true, "for": true, "from": true, "in": true, "is": true,
+	"it": true, "of": true, "on": true, "or": true, "that": true, "the": true,
+	"this": true, "to": true, "was": true, "with": true,
+	"http": true, "https": true, "www": true,
+}
+
+// Longer "words" are base64 and the like, nobody searches for those
+const maxWordLength = 40
+
+// Split text into the words the index is made of: lowercase, stemmed and
+// without stop words
+func searchTerms(text string) []string {
+	var terms []string
+	for _, word := range words(text) {
+		if stopWords[word] || len(word) > maxWordLength {
+			continue
+		}
+		terms = append(terms, stem(word))
+	}
+	return terms
+}
+
+// Which library a link is in, see libraryLinks
+type libraryKey struct {
+	UserID      int // 0 for workspace links
+	WorkspaceID int
+}
+
+func linkLibrary(link *Link) libraryKey {
+	if link.WorkspaceID != 0 {
+		return libraryKey{WorkspaceID: link.WorkspaceID}
+	}
+	return libraryKey{UserID: link.UserID}
+}
+
+// How often a word shows up in each field of a link
+type fieldCounts [searchFields]int32
+
+// A link in the index
+type searchDoc struct {
+	library libraryKey
+	lengths [searchFields]int      // words in each field
+	terms   [searchFields][]string // the different words of each field
+}
+
+// The index of one library
+type librarySearch struct {
+	postings map[string]map[int]*fieldCounts // word -> link ID -> counts
+	docs     map[int]*searchDoc
+	lengths  [searchFields]int // words in each field of all links together
+}
+
+type searchIndex struct {
+	libraries map[libraryKey]*librarySearch
+	docs      map[int]*searchDoc
+}
+
+func newSearchIndex() *searchIndex {
+	return &searchIndex{
+		libraries: make(map[libraryKey]*librarySearch),
+		docs:      make(map[int]*searchDoc),
+	}
+}
+
+// Replace the text of one field of a link. Links stay in the library they
+// were first indexed in.
+func (idx *searchIndex) setField(linkID int, library libraryKey, field searchField, text string) {
+	doc := idx.docs[linkID]
+	if doc == nil {
+		doc = &searchDoc{library: library}
+		idx.docs[linkID] = doc
+	}
+	lib := idx.libraries[doc.library]
+	if lib == nil {
+		lib = &librarySearch{
+			postings: make(map[string]map[int]*fieldCounts),
+			docs:     make(map[int]*searchDoc),
+		}
+		idx.libraries[doc.library] = lib
+	}
+	lib.docs[linkID] = doc
+	lib.clearField(linkID, doc, field)
+
+	terms := searchTerms(text)
+	counts := make(map[string]int32)
+	for _, term := range terms {
+		counts[term]++
+	}
+	doc.terms[field] = make([]string, 0, len(counts))
+	for term, count := range counts {
+		postings := lib.postings[term]
+		if postings == nil {
+			postings = make(map[int]*fieldCounts)
+			lib.postings[term] = postings
+		}
+		if postings[linkID] == nil {
+			postings[linkID] = &fieldCounts{}
+		}
+		postings[linkID][field] = count
+		doc.terms[field] = append(doc.terms[field], term)
+	}
+	doc.lengths[field] = len(terms)
+	lib.lengths[field] += len(terms)
+}
+
+// Take the words of a field of a link out of the postings
+func (lib *librarySearch) clearField(linkID int, doc *searchDoc, field searchField) {
+	for _, term := range doc.terms[field] {
+		postings := lib.postings[term]
+		counts := postings[linkID]
+		if counts == nil {
+			continue
+		}
+		counts[field] = 0
+		if *counts == (fieldCounts{}) {
+			delete(postings, linkID)
+		}
+		if len(postings) == 0 {
+			delete(lib.postings, term)
+		}
+	}
+	lib.lengths[field] -= doc.lengths[field]
+	doc.terms[field] = nil
+	doc.lengths[field] = 0
+}
+
+// Take a link out of the index
+func (idx *searchIndex) remove(linkID int) {
+	doc := idx.docs[linkID]
+	if doc == nil {
+		return
+	}
+	lib := idx.libraries[doc.library]
+	for field := searchField(0); field < searchFields; field++ {
+		lib.clearField(linkID, doc, field)
+	}
+	delete(lib.docs, linkID)
+	if len(lib.docs) == 0 {
+		delete(idx.libraries, doc.library)
+	}
+	delete(idx.docs, linkID)
+}
+
+// The IDs of the links in a library
+func (idx *searchIndex) libraryDocs(library libraryKey) []int {
+	lib := idx.libraries[library]
+	if lib == nil {
+		return nil
+	}
+	ids := make([]int, 0, len(lib.docs))
+	for id := range lib.docs {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// Find the links of a library that have all the words of query, with how
+// well each one matches (higher is better). The last word also matches the
+// words it's the start of, so "git" finds github.com and results show up
+// while the last word is still being typed.
+func (idx *searchIndex) search(library libraryKey, query string) map[int]float64 {
+	lib := idx.libraries[library]
+	terms := searchTerms(query)
+	if lib == nil || len(terms) == 0 {
+		return nil
+	}
+	stats := lib.stats()
+
+	// Every word once, the one with the fewest links first so we check as
+	// few links as possible against the others
+	var matches []termMatches
+	seen := make(map[string]bool)
+	for i, term := range terms {
+		prefix := i == len(terms)-1 && len(term) >= minPrefixLength
+		key := term
+		if prefix {
+			key += "*"
+		}
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+
+		match := termMatches{postings: lib.postings[term]}
+		if prefix {
+			match = lib.prefixMatches(term, stats)
+		}
+		if match.size() == 0 {
+			return nil
+		}
+		matches = append(matches, match)
+	}
+	sort.Slice(matches, func(i, j int) bool { return matches[i].size() < matches[j].size() })
+
+	scores := make(map[int]float64)
+next:
+	for _, linkID := range matches[0].linkIDs() {
+		score := 0.0
+		for _, match := range matches {
+			termScore, found := match.score(lib, linkID, stats)
+			if !found {
+				continue next
+			}
+			score += termScore
+		}
+		scores[linkID] = score
+	}
+	return scores
+}
+
+// A last word shorter than this only matches itself, as the start of
+// words it would match most of them
+const minPrefixLength = 3
+
+// What BM25 needs to know about the whole library
+type bm25Stats struct {
+	total    float64               // links
+	averages [searchFields]float64 // words in each field of a link
+}
+
+func (lib *librarySearch) stats() bm25Stats {
+	stats := bm25Stats{total: float64(len(lib.docs))}
+	for field, length := range lib.lengths {
+		stats.averages[field] = float64(length) / stats.total
+	}
+	return stats
+}
+
+// The links one word searched for matches. A plain word has the postings
+// of that word. The start of a word can match lots of words, so their links
+// are scored up front and each keeps the score of its best word.
+type termMatches struct {
+	postings map[int]*fieldCounts
+	scores   map[int]float64
+}
+
+// The words of the library that start with prefix
+func (lib *librarySearch) prefixMatches(prefix string, stats bm25Stats) termMatches {
+	scores := make(map[int]float64)
+	for word, postings := range lib.postings {
+		if !strings.HasPrefix(word, prefix) {
+			continue
+		}
+		for linkID, counts := range postings {
+			score := bm25Score(counts, lib.docs[linkID], len(postings), stats)
+			if best, found := scores[linkID]; !found || score > best {
+				scores[linkID] = score
+			}
+		}
+	}
+	return termMatches{scores: scores}
+}
+
+func (m termMatches) size() int {
+	if m.scores != nil {
+		return len(m.scores)
+	}
+	return len(m.postings)
+}
+
+func (m termMatches) linkIDs() []int {
+	ids := make([]int, 0, m.size())
+	if m.scores != nil {
+		for id := range m.scores {
+			ids = append(ids, id)
+		}
+		return ids
+	}
+	for id := range m.postings {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// How well the word matches a link, and whether it does at all
+func (m termMatches) score(lib *librarySearch, linkID int, stats bm25Stats) (float64, bool) {
+	if m.scores != nil {
+		score, found := m.scores[linkID]
+		return score, found
+	}
+	counts := m.postings[linkID]
+	if counts == nil {
+		return 0, false
+	}
+	return bm25Score(counts, lib.docs[linkID], len(m.postings), stats), true
+}
+
+// BM25F score of one word for a link: weigh and normalize each field, then
+// saturate once. found is how many links of the library have the word.
+func bm25Score(counts *fieldCounts, doc *searchDoc, found int, stats bm25Stats) float64 {
+	tf := 0.0
+	for field, count := range counts {
+		if count == 0 {
+			continue
+		}
+		norm := 1.0
+		if stats.averages[field] > 0 {
+			norm = 1 - bm25B + bm25B*float64(doc.lengths[field])/stats.averages[field]
+		}
+		tf += searchFieldWeights[field] * float64(count) / norm
+	}
+	idf := math.Log(1 + (stats.total-float64(found)+0.5)/(float64(found)+0.5))
+	return idf * tf * (bm25K1 + 1) / (bm25K1 + tf)
+}
+
+// A light English stemmer, the first and last steps of Porter's algorithm:
+// it takes off plurals, -ed and -ing and a silent e, so "searches",
+// "searched" and "searching" all find "search". Words that aren't plain a
+// to z are left alone.
+func stem(word string) string {
+	if len(word) <= 2 {
+		return word
+	}
+	for i := 0; i < len(word); i++ {
+		if word[i] < 'a' || word[i] > 'z' {
+			return word
+		}
+	}
+
+	// Step 1a: plurals
+	switch {
+	case strings.HasSuffix(word, "sses"):
+		word = word[:len(word)-2]
+	case strings.HasSuffix(word, "ies"):
+		word = word[:len(word)-2]
+	case strings.HasSuffix(word, "ss"):
+	case strings.HasSuffix(word, "s"):
+		word = word[:len(word)-1]
+	}
+
+	// Step 1b: -eed, -ed and -ing
+	if strings.HasSuffix(word, "eed") {
+		if measure(word[:len(word)-3]) > 0 {
+			word = word[:len(word)-1]
+		}
+	} else if base, ok := trimSuffix(word, "ed", "ing"); ok && hasVowel(base) {
+		word = base
+		switch {
+		case strings.HasSuffix(word, "at"), strings.HasSuffix(word, "bl"), strings.HasSuffix(word, "iz"):
+			word += "e"
+		case endsWithDoubleConsonant(word) && !strings.HasSuffix(word, "l") &&
+			!strings.HasSuffix(word, "s") && !strings.HasSuffix(word, "z"):
+			word = word[:len(word)-1]
+		case measure(word) == 1 && endsCVC(word):
+			word += "e"
+		}
+	}
+
+	// Step 1c: y after a vowel somewhere becomes i, so "happy" and
+	// "happiness" meet halfway
+	if strings.HasSuffix(word, "y") && hasVowel(word[:len(word)-1]) {
+		word = word[:len(word)-1] + "i"
+	}
+
+	// Step 5: a silent e at the end goes, and double l becomes one, so
+	// "searche" from step 1 becomes "search"
+	if base, ok := trimSuffix(word, "e"); ok {
+		if m := measure(base); m > 1 || (m == 1 && !endsCVC(base)) {
+			word = base
+		}
+	}
+	if strings.HasSuffix(word, "ll") && measure(word) > 1 {
+		word = word[:len(word)-1]
+	}
+	return word
+}
+
+func trimSuffix(word string, suffixes ...string) (string, bool) {
+	for _, suffix := range suffixes {
+		if strings.HasSuffix(word, suffix) {
+			return word[:len(word)-len(suffix)], true
+		}
+	}
+	return word, false
+}
+
+// Whether word[i] is a consonant the way Porter counts them: y is one at
+// the start and after a vowel
+func isConsonant(word string, i int) bool {
+	switch word[i] {
+	case 'a', 'e', 'i', 'o', 'u':
+		return false
+	case 'y':
+		return i == 0 || !isConsonant(word, i-1)
+	}
+	return true
+}
+
+// How many vowels-then-consonants sequences the word has
+func measure(word string) int {
+	m := 0
+	vowel := false
+	for i := range word {
+		if isConsonant(word, i) {
+			if vowel {
+				m++
+			}
+			vowel = false
+		} else {
+			vowel = true
+		}
+	}
+	return m
+}
+
+func hasVowel(word string) bool {
+	for i := range word {
+		if !isConsonant(word, i) {
+			return true
+		}
+	}
+	return false
+}
+
+func endsWithDoubleConsonant(word string) bool {
+	n := len(word)
+	return n >= 2 && word[n-1] == word[n-2] && isConsonant(word, n-1)
+}
+
+// Consonant, vowel, consonant at the end, the last one not w, x or y
+// (hop, but not snow)
+func endsCVC(word string) bool {
+	n := len(word)
+	if n < 3 || !isConsonant(word, n-1) || isConsonant(word, n-2) || !isConsonant(word, n-3) {
+		return false
+	}
+	last := word[n-1]
+	return last != 'w' && last != 'x' && last != 'y'
+}
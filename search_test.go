@@ -0,0 +1,277 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSearchTerms(t *testing.T) {
+	for text, want := range map[string][]string{
+		"The Go Programming Language":            {"go", "program", "languag"},
+		"https://www.rust-lang.org/learn?page=1": {"rust", "lang", "org", "learn", "page", "1"},
+		"Searching, SEARCHED and searches":       {"search", "search", "search"},
+		"a " + strings.Repeat("x", 41) + " b":    {"b"},
+		"":                                       nil,
+	} {
+		if got := searchTerms(text); !reflect.DeepEqual(got, want) {
+			t.Errorf("searchTerms(%q) = %q, want %q", text, got, want)
+		}
+	}
+}
+
+func TestStem(t *testing.T) {
+	for word, want := range map[string]string{
+		"caresses":  "caress",
+		"ponies":    "poni",
+		"cats":      "cat",
+		"feed":      "feed",
+		"agreed":    "agre",
+		"hopping":   "hop",
+		"tanned":    "tan",
+		"falling":   "fall",
+		"filing":    "file",
+		"hoped":     "hope",
+		"motoring":  "motor",
+		"searches":  "search",
+		"searched":  "search",
+		"searching": "search",
+		"happy":     "happi",
+		"sky":       "sky",
+		"go":        "go",
+		"über":      "über", // only a to z is stemmed
+		"c3pos":     "c3pos",
+	} {
+		if got := stem(word); got != want {
+			t.Errorf("stem(%q) = %q, want %q", word, got, want)
+		}
+	}
+}
+
+// A store with alice in it, and a way to search her links
+func newSearchTestStore(t *testing.T) (*MemoryStore, User, func(query string) []string) {
+	store := NewMemoryStore()
+	alice := createTestUser(t, store, "alice")
+	search := func(query string) []string {
+		t.Helper()
+		links, err := store.SearchUserLinks(alice.ID, query)
+		if err != nil {
+			t.Fatalf("SearchUserLinks(%q): %v", query, err)
+		}
+		return linkTitles(links)
+	}
+	return store, alice, search
+}
+
+func TestSearchRanking(t *testing.T) {
+	store, alice, search := newSearchTestStore(t)
+	day := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	// Newest first, so the order below isn't just the order they were added
+	archived := createTestLink(t, store, Link{URL: "https://a.example/", Title: "Archived", UserID: alice.ID, CreatedAt: day.Add(4 * time.Hour)})
+	if err := store.CreateArchivedPage(&ArchivedPage{LinkID: archived.ID, Text: "all about gophers"}); err != nil {
+		t.Fatal(err)
+	}
+	createTestLink(t, store, Link{URL: "https://b.example/", Title: "Described", Description: "Gophers and more", UserID: alice.ID, CreatedAt: day.Add(3 * time.Hour)})
+	createTestLink(t, store, Link{URL: "https://c.example/", Title: "Tagged", UserID: alice.ID, CreatedAt: day.Add(2 * time.Hour)}, "gophers")
+	createTestLink(t, store, Link{URL: "https://d.example/", Title: "Gophers", UserID: alice.ID, CreatedAt: day.Add(time.Hour)})
+	createTestLink(t, store, Link{URL: "https://e.example/", Title: "Unrelated", UserID: alice.ID, CreatedAt: day})
+
+	want := []string{"Gophers", "Tagged", "Described", "Archived"}
+	if got := search("gopher"); !reflect.DeepEqual(got, want) {
+		t.Errorf("search gopher = %v, want %v (title, tags, description, archived copy)", got, want)
+	}
+
+	// A rare word counts for more than a common one
+	createTestLink(t, store, Link{URL: "https://f.example/", Title: "Gophers in the wild", Description: "A burrow", UserID: alice.ID, CreatedAt: day})
+	if got := search("gopher burrow"); !reflect.DeepEqual(got, []string{"Gophers in the wild"}) {
+		t.Errorf("search gopher burrow = %v", got)
+	}
+	if got := search("burrow gopher")[0]; got != "Gophers in the wild" {
+		t.Errorf("search burrow gopher starts with %q", got)
+	}
+}
+
+func TestSearchPrefix(t *testing.T) {
+	store, alice, search := newSearchTestStore(t)
+	createTestLink(t, store, Link{URL: "https://github.com/octocat", Title: "Source code", UserID: alice.ID})
+
+	for query, found := range map[string]bool{
+		"git":         true,
+		"gi":          false, // too short to be the start of a word
+		"GitH":        true,
+		"source git":  true,
+		"git source":  false, // only the last word can be the start of one
+		"sourcecode":  false,
+		"code gitlab": false,
+	} {
+		if got := len(search(query)) == 1; got != found {
+			t.Errorf("search %q found the link: %v, want %v", query, got, found)
+		}
+	}
+}
+
+func TestSearchIndexUpdates(t *testing.T) {
+	store, alice, search := newSearchTestStore(t)
+	link := createTestLink(t, store, Link{URL: "https://go.dev/", Title: "Gophers", UserID: alice.ID}, "animals")
+
+	expect := func(query string, found bool) {
+		t.Helper()
+		if got := len(search(query)) == 1; got != found {
+			t.Errorf("search %q found the link: %v, want %v", query, got, found)
+		}
+	}
+	expect("gophers", true)
+
+	link.Title = "Rustaceans"
+	if err := store.UpdateLink(&link); err != nil {
+		t.Fatal(err)
+	}
+	expect("gophers", false)
+	expect("rustaceans", true)
+
+	if err := store.SetLinkTags(link.ID, []string{"crabs"}); err != nil {
+		t.Fatal(err)
+	}
+	expect("animals", false)
+	expect("crabs", true)
+	if err := store.RenameTag(mustTagID(t, store, alice.ID, "crabs"), "ferris"); err != nil {
+		t.Fatal(err)
+	}
+	expect("crabs", false)
+	expect("ferris", true)
+
+	page := &ArchivedPage{LinkID: link.ID, Text: "the borrow checker"}
+	if err := store.CreateArchivedPage(page); err != nil {
+		t.Fatal(err)
+	}
+	expect("borrow", true)
+	if err := store.DeleteArchivedPage(page.ID); err != nil {
+		t.Fatal(err)
+	}
+	expect("borrow", false)
+
+	if err := store.DeleteLink(link.ID); err != nil {
+		t.Fatal(err)
+	}
+	expect("rustaceans", false)
+	if len(store.search.docs) != 0 || len(store.search.libraries) != 0 {
+		t.Errorf("the index still has %d links in %d libraries", len(store.search.docs), len(store.search.libraries))
+	}
+}
+
+// Searching a store of made up links, against a plain scan of every link
+// like search used to do. go test -bench Search -benchtime 1x for a quick
+// look.
+func BenchmarkSearch(b *testing.B) {
+	store := NewMemoryStore()
+	user := &User{Username: "bench", Password: "-", Email: "bench@example.com"}
+	if err := store.CreateUser(user); err != nil {
+		b.Fatal(err)
+	}
+
+	// Words used more or less like in real text: a few very often and most
+	// of them rarely. Names are on 5 links each whatever the size, like the
+	// name of a project you saved a few links about.
+	random := rand.New(rand.NewSource(1))
+	vocabulary := benchWords(5000)
+	zipf := rand.NewZipf(random, 1.1, 1, uint64(len(vocabulary)-1))
+	text := func(n int) string {
+		picked := make([]string, n)
+		for i := range picked {
+			picked[i] = vocabulary[zipf.Uint64()]
+		}
+		return strings.Join(picked, " ")
+	}
+	name := func(i int) string { return "proj" + strconv.Itoa(i/5) }
+
+	queries := []struct{ name, query string }{
+		{"name", name(0)},
+		{"rare", vocabulary[2000]},
+		{"common", vocabulary[200]},
+		{"very common", vocabulary[5]},
+		{"two words", vocabulary[10] + " " + vocabulary[300]},
+		{"prefix", vocabulary[300][:3]},
+	}
+
+	added := 0
+	for _, size := range []int{1000, 10000, 100000} {
+		for ; added < size; added++ {
+			link := &Link{
+				URL:         fmt.Sprintf("https://site%d.example/%s/%s", added%500, name(added), vocabulary[zipf.Uint64()]),
+				Title:       name(added) + " " + text(5),
+				Description: text(20),
+				UserID:      user.ID,
+			}
+			if err := store.CreateLink(link); err != nil {
+				b.Fatal(err)
+			}
+			tags := []string{"topic/" + vocabulary[random.Intn(100)], vocabulary[random.Intn(50)]}
+			if err := store.SetLinkTags(link.ID, tags); err != nil {
+				b.Fatal(err)
+			}
+			if added%10 == 0 {
+				if err := store.CreateArchivedPage(&ArchivedPage{LinkID: link.ID, Text: text(300)}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+		links, err := store.GetUserLinks(user.ID)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		for _, query := range queries {
+			b.Run(fmt.Sprintf("links=%d/%s/index", size, query.name), func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					store.SearchUserLinks(user.ID, query.query)
+				}
+			})
+			b.Run(fmt.Sprintf("links=%d/%s/scan", size, query.name), func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					scanSearch(links, query.query)
+				}
+			})
+		}
+	}
+}
+
+// Made up words that look like words
+func benchWords(n int) []string {
+	syllables := []string{"ka", "lo", "mi", "ne", "ru", "ta", "vo", "pe", "si", "da", "gu", "fo"}
+	var made []string
+	for i := 0; len(made) < n; i++ {
+		word := ""
+		for j := i; ; j /= len(syllables) {
+			word += syllables[j%len(syllables)]
+			if j < len(syllables) {
+				break
+			}
+		}
+		made = append(made, word)
+	}
+	return made
+}
+
+// Search by looking at every link, the way the in-memory store did before
+// the index
+func scanSearch(links []Link, query string) []Link {
+	query = strings.ToLower(query)
+	var results []Link
+	for _, link := range links {
+		found := strings.Contains(strings.ToLower(link.Title), query) ||
+			strings.Contains(strings.ToLower(link.URL), query) ||
+			strings.Contains(strings.ToLower(link.Description), query)
+		for _, tag := range link.Tags {
+			found = found || strings.Contains(strings.ToLower(tag), query)
+		}
+		if found {
+			results = append(results, link)
+		}
+	}
+	return results
+}
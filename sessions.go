@@ -0,0 +1,400 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/securecookie"
+	gsessions "github.com/gorilla/sessions"
+)
+
+// Sessions live on the server so they can be listed and revoked. The cookie
+// only holds a random token (signed with SESSION_SECRET); the store keys
+// sessions by the SHA-256 of that token, so someone reading the database
+// still can't take over a session.
+
+// ErrSessionNotFound is returned when a session doesn't exist (any more)
+var ErrSessionNotFound = errors.New("session not found")
+
+// SessionRecord is a session as kept by the storage backend
+type SessionRecord struct {
+	ID        string    `json:"id"`      // SHA-256 of the cookie token
+	UserID    int       `json:"user_id"` // 0 until someone logs in
+	Data      []byte    `json:"data"`    // gob encoded session values
+	CreatedAt time.Time `json:"created_at"`
+	LastSeen  time.Time `json:"last_seen"`
+	ExpiresAt time.Time `json:"expires_at"`
+	UserAgent string    `json:"user_agent"`
+	IP        string    `json:"ip"`
+}
+
+// SessionBackend stores sessions, implemented by the memory and SQL stores
+type SessionBackend interface {
+	GetSession(id string) (SessionRecord, error)
+	SaveSession(record SessionRecord) error
+	DeleteSession(id string) error
+	ListUserSessions(userID int) ([]SessionRecord, error)
+	// DeleteUserSessions removes all sessions of a user except keepID
+	DeleteUserSessions(userID int, keepID string) error
+	// DeleteExpiredSessions removes sessions past their expiry or unused
+	// for longer than idleTimeout
+	DeleteExpiredSessions(now time.Time, idleTimeout time.Duration) error
+}
+
+// Don't write to the store on every request just to bump LastSeen
+const lastSeenResolution = time.Minute
+
+// ServerSessionStore plugs the backend into gin-contrib/sessions, so
+// handlers keep using sessions.Default(c) like before
+type ServerSessionStore struct {
+	backend     SessionBackend
+	codecs      []securecookie.Codec
+	options     *gsessions.Options
+	maxAge      time.Duration
+	idleTimeout time.Duration
+}
+
+// NewServerSessionStore creates a session store. Sessions end maxAge after
+// login no matter what, or after idleTimeout without any requests.
+func NewServerSessionStore(backend SessionBackend, secret []byte, maxAge, idleTimeout time.Duration, secure bool) *ServerSessionStore {
+	return &ServerSessionStore{
+		backend: backend,
+		codecs:  securecookie.CodecsFromPairs(secret),
+		options: &gsessions.Options{
+			Path:     "/",
+			MaxAge:   int(maxAge.Seconds()),
+			Secure:   secure,
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		},
+		maxAge:      maxAge,
+		idleTimeout: idleTimeout,
+	}
+}
+
+// Options sets the cookie options (part of the gin sessions.Store interface)
+func (s *ServerSessionStore) Options(options sessions.Options) {
+	s.options = options.ToGorillaOptions()
+}
+
+// Get returns the session for this request, loading it only once
+func (s *ServerSessionStore) Get(r *http.Request, name string) (*gsessions.Session, error) {
+	return gsessions.GetRegistry(r).Get(s, name)
+}
+
+// New loads the session named in the cookie, or starts an empty one
+func (s *ServerSessionStore) New(r *http.Request, name string) (*gsessions.Session, error) {
+	session := gsessions.NewSession(s, name)
+	options := *s.options
+	session.Options = &options
+	session.IsNew = true
+
+	cookie, err := r.Cookie(name)
+	if err != nil {
+		return session, nil
+	}
+	var token string
+	if err := securecookie.DecodeMulti(name, cookie.Value, &token, s.codecs...); err != nil {
+		return session, nil
+	}
+
+	record, err := s.backend.GetSession(hashSessionToken(token))
+	if err != nil {
+		return session, nil
+	}
+	now := time.Now()
+	if now.After(record.ExpiresAt) || now.Sub(record.LastSeen) > s.idleTimeout {
+		s.backend.DeleteSession(record.ID)
+		return session, nil
+	}
+	values, err := decodeSessionValues(record.Data)
+	if err != nil {
+		return session, nil
+	}
+
+	session.ID = token
+	session.Values = values
+	session.IsNew = false
+
+	if now.Sub(record.LastSeen) > lastSeenResolution {
+		record.LastSeen = now
+		record.IP = requestIP(r)
+		record.UserAgent = r.UserAgent()
+		if err := s.backend.SaveSession(record); err != nil {
+			fmt.Println("Could not update session:", err)
+		}
+	}
+	return session, nil
+}
+
+// Save writes the session to the backend and sets the cookie. A negative
+// MaxAge deletes the session instead.
+func (s *ServerSessionStore) Save(r *http.Request, w http.ResponseWriter, session *gsessions.Session) error {
+	if session.Options.MaxAge < 0 {
+		if session.ID != "" {
+			if err := s.backend.DeleteSession(hashSessionToken(session.ID)); err != nil {
+				return err
+			}
+		}
+		http.SetCookie(w, gsessions.NewCookie(session.Name(), "", session.Options))
+		return nil
+	}
+
+	now := time.Now()
+	var record SessionRecord
+	if session.ID != "" {
+		existing, err := s.backend.GetSession(hashSessionToken(session.ID))
+		if err == nil {
+			record = existing
+		} else {
+			// Revoked while this request was running, don't bring it back
+			session.ID = ""
+		}
+	}
+	if session.ID == "" {
+		token, err := newSessionToken()
+		if err != nil {
+			return err
+		}
+		session.ID = token
+		record = SessionRecord{
+			ID:        hashSessionToken(token),
+			CreatedAt: now,
+			ExpiresAt: now.Add(s.maxAge),
+		}
+	}
+
+	data, err := encodeSessionValues(session.Values)
+	if err != nil {
+		return err
+	}
+	record.Data = data
+	record.UserID, _ = session.Values["user_id"].(int)
+	record.LastSeen = now
+	record.IP = requestIP(r)
+	record.UserAgent = r.UserAgent()
+	if err := s.backend.SaveSession(record); err != nil {
+		return err
+	}
+
+	encoded, err := securecookie.EncodeMulti(session.Name(), session.ID, s.codecs...)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, gsessions.NewCookie(session.Name(), encoded, session.Options))
+	return nil
+}
+
+// Regenerate throws away the current session ID and everything stored in it,
+// so the next Save issues a new ID and the form token is made again. Call
+// this on login so a session ID or CSRF token planted before login is
+// worthless afterwards.
+func (s *ServerSessionStore) Regenerate(r *http.Request, name string) error {
+	session, err := s.Get(r, name)
+	if err != nil {
+		return err
+	}
+	if session.ID != "" {
+		if err := s.backend.DeleteSession(hashSessionToken(session.ID)); err != nil {
+			return err
+		}
+		session.ID = ""
+	}
+	for key := range session.Values {
+		delete(session.Values, key)
+	}
+	return nil
+}
+
+// StartCleanup removes expired sessions every interval in the background
+func (s *ServerSessionStore) StartCleanup(interval time.Duration) {
+	go func() {
+		for range time.Tick(interval) {
+			if err := s.backend.DeleteExpiredSessions(time.Now(), s.idleTimeout); err != nil {
+				fmt.Println("Could not clean up sessions:", err)
+			}
+		}
+	}()
+}
+
+// Random token for the cookie
+func newSessionToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// What the backend uses as the session ID
+func hashSessionToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func encodeSessionValues(values map[interface{}]interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(values); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeSessionValues(data []byte) (map[interface{}]interface{}, error) {
+	values := make(map[interface{}]interface{})
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&values); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+// The address the request came from, without the port
+func requestIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// Turn a User-Agent header into something like "Firefox on Linux"
+func describeUserAgent(ua string) string {
+	browser := "Unknown browser"
+	switch {
+	case strings.Contains(ua, "Edg/"):
+		browser = "Edge"
+	case strings.Contains(ua, "OPR/"):
+		browser = "Opera"
+	case strings.Contains(ua, "Firefox/"):
+		browser = "Firefox"
+	case strings.Contains(ua, "Chrome/"):
+		browser = "Chrome"
+	case strings.Contains(ua, "Safari/"):
+		browser = "Safari"
+	case strings.HasPrefix(ua, "curl/"):
+		browser = "curl"
+	}
+
+	system := ""
+	switch {
+	case strings.Contains(ua, "Android"):
+		system = "Android"
+	case strings.Contains(ua, "iPhone"), strings.Contains(ua, "iPad"):
+		system = "iOS"
+	case strings.Contains(ua, "Windows"):
+		system = "Windows"
+	case strings.Contains(ua, "Mac OS X"):
+		system = "macOS"
+	case strings.Contains(ua, "Linux"):
+		system = "Linux"
+	}
+
+	if system == "" {
+		return browser
+	}
+	return browser + " on " + system
+}
+
+// One row of the active sessions page
+type sessionView struct {
+	ID        string
+	Device    string
+	IP        string
+	CreatedAt time.Time
+	LastSeen  time.Time
+	Current   bool
+}
+
+// Show the user's active sessions
+func (app *App) sessionsPage(c *gin.Context) {
+	session := sessions.Default(c)
+	userID := session.Get("user_id").(int)
+	currentID := hashSessionToken(session.ID())
+
+	records, err := app.store.ListUserSessions(userID)
+	if err != nil {
+		render(c, http.StatusInternalServerError, "error.html", gin.H{
+			"error": "Error loading your sessions",
+		})
+		return
+	}
+
+	var views []sessionView
+	for _, record := range records {
+		views = append(views, sessionView{
+			ID:        record.ID,
+			Device:    describeUserAgent(record.UserAgent),
+			IP:        record.IP,
+			CreatedAt: record.CreatedAt,
+			LastSeen:  record.LastSeen,
+			Current:   record.ID == currentID,
+		})
+	}
+
+	render(c, http.StatusOK, "sessions.html", gin.H{
+		"title":    "Active Sessions",
+		"sessions": views,
+	})
+}
+
+// Log out a single session
+func (app *App) revokeSession(c *gin.Context) {
+	session := sessions.Default(c)
+	userID := session.Get("user_id").(int)
+
+	record, err := app.store.GetSession(c.Param("id"))
+	if err != nil || record.UserID != userID {
+		render(c, http.StatusNotFound, "error.html", gin.H{
+			"error": "Session not found",
+		})
+		return
+	}
+	if err := app.store.DeleteSession(record.ID); err != nil {
+		render(c, http.StatusInternalServerError, "error.html", gin.H{
+			"error": "Error logging out that session",
+		})
+		return
+	}
+
+	// Revoking the session we're using is just a logout
+	if record.ID == hashSessionToken(session.ID()) {
+		c.Redirect(http.StatusFound, "/login")
+		return
+	}
+	c.Redirect(http.StatusFound, "/settings/sessions")
+}
+
+// Log out everywhere, or everywhere but here when keep_current is set
+func (app *App) revokeAllSessions(c *gin.Context) {
+	session := sessions.Default(c)
+	userID := session.Get("user_id").(int)
+
+	keepID := ""
+	if c.PostForm("keep_current") != "" {
+		keepID = hashSessionToken(session.ID())
+	}
+	if err := app.store.DeleteUserSessions(userID, keepID); err != nil {
+		render(c, http.StatusInternalServerError, "error.html", gin.H{
+			"error": "Error logging out your sessions",
+		})
+		return
+	}
+
+	if keepID == "" {
+		c.Redirect(http.StatusFound, "/login")
+		return
+	}
+	c.Redirect(http.StatusFound, "/settings/sessions")
+}
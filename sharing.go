@@ -0,0 +1,277 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+)
+
+// Links can be shared with other users one at a time, or as a collection:
+// everything the owner tagged with a certain tag or a tag below it,
+// including links tagged later on. People they're shared with can look at them, or also edit them
+// with the edit permission. Deleting and sharing stay with the owner.
+// Workspace links aren't shared this way, the workspace has members for
+// that. linkAccess in policy.go puts it all together.
+
+// Share gives another user access to a link or to all links with a tag
+type Share struct {
+	ID         int       `json:"id"`
+	OwnerID    int       `json:"owner_id"`
+	UserID     int       `json:"user_id"`    // who it's shared with
+	LinkID     int       `json:"link_id"`    // the shared link, or 0 for a tag
+	Tag        string    `json:"tag"`        // the shared tag, or "" for a link
+	Permission string    `json:"permission"` // read or edit
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+const (
+	PermissionRead = "read"
+	PermissionEdit = "edit"
+)
+
+// Look up the user to share with from a form and check the permission.
+// problem says what's wrong with the form, if anything.
+func (app *App) shareRecipient(c *gin.Context, ownerID int) (user User, permission string, problem string) {
+	permission = c.PostForm("permission")
+	if permission != PermissionRead && permission != PermissionEdit {
+		return User{}, "", "Pick whether they can only view or also edit"
+	}
+	user, err := app.store.GetUserByUsername(strings.TrimSpace(c.PostForm("username")))
+	if err != nil {
+		return User{}, "", "There's no user with that name"
+	}
+	if user.ID == ownerID {
+		return User{}, "", "That's you, no need to share with yourself"
+	}
+	return user, permission, ""
+}
+
+// Share a single link
+func (app *App) shareLink(c *gin.Context) {
+	userID := sessions.Default(c).Get("user_id").(int)
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		render(c, http.StatusBadRequest, "error.html", gin.H{
+			"error": "Invalid link ID",
+		})
+		return
+	}
+	link, err := app.store.GetLinkByID(id)
+	access := accessNone
+	if err == nil {
+		access, err = app.linkAccess(link, userID)
+	}
+	if err != nil || access < accessManage {
+		render(c, http.StatusNotFound, "error.html", gin.H{
+			"error": "Link not found",
+		})
+		return
+	}
+	if link.WorkspaceID != 0 {
+		render(c, http.StatusBadRequest, "error.html", gin.H{
+			"error": "Workspace links are shared with the members of the workspace",
+		})
+		return
+	}
+
+	recipient, permission, problem := app.shareRecipient(c, userID)
+	if problem != "" {
+		render(c, http.StatusBadRequest, "error.html", gin.H{
+			"error": problem,
+		})
+		return
+	}
+	share := &Share{
+		OwnerID:    userID,
+		UserID:     recipient.ID,
+		LinkID:     link.ID,
+		Permission: permission,
+		CreatedAt:  time.Now(),
+	}
+	if err := app.store.SaveShare(share); err != nil {
+		render(c, http.StatusInternalServerError, "error.html", gin.H{
+			"error": "Error sharing your link",
+		})
+		return
+	}
+
+	c.Redirect(http.StatusFound, fmt.Sprintf("/links/%d", link.ID))
+}
+
+// A share with the names that go with it, for showing on a page
+type shareView struct {
+	Share
+	OwnerName string
+	Username  string
+	LinkTitle string
+	Links     []Link // the links it gives access to, only on the shared with me page
+}
+
+// Fill in user names and link titles for a list of shares
+func (app *App) describeShares(shares []Share) []shareView {
+	names := make(map[int]string)
+	name := func(id int) string {
+		if _, ok := names[id]; !ok {
+			if user, err := app.store.GetUserByID(id); err == nil {
+				names[id] = user.Username
+			}
+		}
+		return names[id]
+	}
+
+	views := make([]shareView, 0, len(shares))
+	for _, share := range shares {
+		view := shareView{Share: share, OwnerName: name(share.OwnerID), Username: name(share.UserID)}
+		if share.LinkID != 0 {
+			if link, err := app.store.GetLinkByID(share.LinkID); err == nil {
+				view.LinkTitle = link.Title
+			}
+		}
+		views = append(views, view)
+	}
+	return views
+}
+
+// Show what the user shared, with a form to share a tag
+func (app *App) sharingPage(c *gin.Context) {
+	app.renderSharing(c, http.StatusOK, gin.H{})
+}
+
+func (app *App) renderSharing(c *gin.Context, code int, data gin.H) {
+	userID := sessions.Default(c).Get("user_id").(int)
+	shares, err := app.store.GetSharesByOwner(userID)
+	if err != nil {
+		render(c, http.StatusInternalServerError, "error.html", gin.H{
+			"error": "Error loading your shares",
+		})
+		return
+	}
+	tags, err := app.store.GetUserTags(userID)
+	if err != nil {
+		render(c, http.StatusInternalServerError, "error.html", gin.H{
+			"error": "Error loading your tags",
+		})
+		return
+	}
+
+	data["title"] = "Sharing"
+	data["shares"] = app.describeShares(shares)
+	data["tags"] = tags
+	render(c, code, "sharing.html", data)
+}
+
+// Share everything with a tag
+func (app *App) shareTag(c *gin.Context) {
+	userID := sessions.Default(c).Get("user_id").(int)
+	tag := strings.TrimSpace(c.PostForm("tag"))
+	if tag == "" {
+		app.renderSharing(c, http.StatusBadRequest, gin.H{"error": "Pick a tag to share"})
+		return
+	}
+	recipient, permission, problem := app.shareRecipient(c, userID)
+	if problem != "" {
+		app.renderSharing(c, http.StatusBadRequest, gin.H{"error": problem})
+		return
+	}
+
+	share := &Share{
+		OwnerID:    userID,
+		UserID:     recipient.ID,
+		Tag:        tag,
+		Permission: permission,
+		CreatedAt:  time.Now(),
+	}
+	if err := app.store.SaveShare(share); err != nil {
+		render(c, http.StatusInternalServerError, "error.html", gin.H{
+			"error": "Error sharing your tag",
+		})
+		return
+	}
+
+	c.Redirect(http.StatusFound, "/settings/sharing")
+}
+
+// Stop sharing. The owner can revoke a share, and the person it was
+// shared with can drop it from their list.
+func (app *App) revokeShare(c *gin.Context) {
+	userID := sessions.Default(c).Get("user_id").(int)
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		render(c, http.StatusBadRequest, "error.html", gin.H{
+			"error": "Invalid share ID",
+		})
+		return
+	}
+	share, err := app.store.GetShare(id)
+	if err != nil || (share.OwnerID != userID && share.UserID != userID) {
+		render(c, http.StatusNotFound, "error.html", gin.H{
+			"error": "Share not found",
+		})
+		return
+	}
+	if err := app.store.DeleteShare(share.ID); err != nil {
+		render(c, http.StatusInternalServerError, "error.html", gin.H{
+			"error": "Error removing the share",
+		})
+		return
+	}
+
+	// Back to wherever the button was
+	switch {
+	case share.UserID == userID:
+		c.Redirect(http.StatusFound, "/shared")
+	case c.PostForm("back") == "link" && share.LinkID != 0:
+		c.Redirect(http.StatusFound, fmt.Sprintf("/links/%d", share.LinkID))
+	default:
+		c.Redirect(http.StatusFound, "/settings/sharing")
+	}
+}
+
+// Show the links others shared with the user
+func (app *App) sharedWithMePage(c *gin.Context) {
+	userID := sessions.Default(c).Get("user_id").(int)
+	shares, err := app.store.GetSharesWithUser(userID)
+	if err != nil {
+		render(c, http.StatusInternalServerError, "error.html", gin.H{
+			"error": "Error loading shared links",
+		})
+		return
+	}
+
+	// Tag shares need all of the owner's links, load them once per owner
+	ownerLinks := make(map[int][]Link)
+	views := app.describeShares(shares)
+	for i, share := range views {
+		if share.LinkID != 0 {
+			if link, err := app.store.GetLinkByID(share.LinkID); err == nil {
+				views[i].Links = []Link{link}
+			}
+			continue
+		}
+		links, ok := ownerLinks[share.OwnerID]
+		if !ok {
+			if links, err = app.store.GetUserLinks(share.OwnerID); err != nil {
+				render(c, http.StatusInternalServerError, "error.html", gin.H{
+					"error": "Error loading shared links",
+				})
+				return
+			}
+			ownerLinks[share.OwnerID] = links
+		}
+		for _, link := range links {
+			if taggedWith(link.Tags, share.Tag) {
+				views[i].Links = append(views[i].Links, link)
+			}
+		}
+	}
+
+	render(c, http.StatusOK, "shared.html", gin.H{
+		"title":  "Shared with Me",
+		"shares": views,
+	})
+}
@@ -44,9 +44,200 @@ document.addEventListener('DOMContentLoaded', function() {
         });
     }
     
-    // TODO: add auto-fill title from URL (would need backend API support)
-    // Maybe in a future update!
+    // Auto-fill title and description from the page (add form only)
+    if (urlInput && urlInput.hasAttribute('data-fetch-metadata')) {
+        const titleInput = document.getElementById('title');
+        const descriptionInput = document.getElementById('description');
+        const status = document.getElementById('metadata-status');
+        let lastFetched = '';
+
+        urlInput.addEventListener('blur', function() {
+            const url = this.value.trim();
+            // Nothing to do if the user already typed everything
+            if (!url || url === lastFetched || (titleInput.value && descriptionInput.value)) {
+                return;
+            }
+            lastFetched = url;
+            status.textContent = 'Looking up the page...';
+
+            fetch('/links/metadata?url=' + encodeURIComponent(url))
+                .then(response => response.ok ? response.json() : Promise.reject(response.status))
+                .then(metadata => {
+                    // Never overwrite something the user typed
+                    if (!titleInput.value && metadata.title) {
+                        titleInput.value = metadata.title;
+                    }
+                    if (!descriptionInput.value && metadata.description) {
+                        descriptionInput.value = metadata.description;
+                    }
+                    status.textContent = '';
+                })
+                .catch(() => {
+                    status.textContent = "Couldn't read that page, please fill in the title yourself.";
+                });
+        });
+    }
     
+    // Suggest tags while typing, and the tags of other links from the same site
+    const tagsInput = document.querySelector('input[data-suggest-tags]');
+    if (tagsInput) {
+        const matchingBox = document.getElementById('tag-suggestions');
+        const siteBox = document.getElementById('site-tag-suggestions');
+        const workspaceSelect = document.getElementById('workspace_id');
+        let typingTimer = null;
+
+        // The tags in the field, the last one is the one being typed
+        const typedTags = () => tagsInput.value.split(',').map(tag => tag.trim());
+
+        const fetchSuggestions = params => {
+            // Suggestions come from the tags of the library the link is in
+            if (tagsInput.dataset.linkId) {
+                params.set('link_id', tagsInput.dataset.linkId);
+            } else if (workspaceSelect) {
+                params.set('workspace_id', workspaceSelect.value);
+            }
+            return fetch('/tags/suggestions?' + params.toString())
+                .then(response => response.ok ? response.json() : Promise.reject(response.status));
+        };
+
+        // Show tags as buttons, leaving out the ones already in the field
+        const showTags = (box, label, suggestions, taken, pick) => {
+            box.replaceChildren();
+            suggestions = suggestions.filter(suggestion => !taken.includes(suggestion.name));
+            if (suggestions.length === 0) {
+                return;
+            }
+            if (label) {
+                box.append(label + ' ');
+            }
+            suggestions.forEach(suggestion => {
+                const button = document.createElement('button');
+                button.type = 'button';
+                button.className = 'btn btn-sm btn-outline-secondary me-1 mb-1';
+                button.textContent = suggestion.name;
+                button.title = suggestion.count === 1 ? 'On 1 link' : 'On ' + suggestion.count + ' links';
+                button.addEventListener('click', () => {
+                    pick(suggestion.name, button);
+                    tagsInput.focus();
+                });
+                box.append(button);
+            });
+        };
+
+        tagsInput.addEventListener('input', function() {
+            clearTimeout(typingTimer);
+            // Wait until the user stops typing for a moment
+            typingTimer = setTimeout(() => {
+                const typed = typedTags().pop();
+                if (!typed) {
+                    matchingBox.replaceChildren();
+                    return;
+                }
+                fetchSuggestions(new URLSearchParams({ q: typed }))
+                    .then(suggestions => {
+                        // Too late, the user kept typing
+                        if (typedTags().pop() !== typed) {
+                            return;
+                        }
+                        showTags(matchingBox, '', suggestions.matching, typedTags().slice(0, -1), name => {
+                            const tags = typedTags().slice(0, -1).filter(tag => tag);
+                            tags.push(name);
+                            tagsInput.value = tags.join(', ') + ', ';
+                            matchingBox.replaceChildren();
+                        });
+                    })
+                    .catch(() => matchingBox.replaceChildren());
+            }, 200);
+        });
+
+        const suggestFromSite = () => {
+            const url = urlInput ? urlInput.value.trim() : '';
+            if (!url) {
+                siteBox.replaceChildren();
+                return;
+            }
+            fetchSuggestions(new URLSearchParams({ url: url }))
+                .then(suggestions => {
+                    const label = 'Your other links from ' + suggestions.site + ' have:';
+                    showTags(siteBox, label, suggestions.from_site, typedTags(), (name, button) => {
+                        const tags = typedTags().filter(tag => tag);
+                        tags.push(name);
+                        tagsInput.value = tags.join(', ') + ', ';
+                        button.remove();
+                        if (!siteBox.querySelector('button')) {
+                            siteBox.replaceChildren();
+                        }
+                    });
+                })
+                .catch(() => siteBox.replaceChildren());
+        };
+        if (urlInput) {
+            urlInput.addEventListener('blur', suggestFromSite);
+        }
+        if (workspaceSelect) {
+            workspaceSelect.addEventListener('change', suggestFromSite);
+        }
+        suggestFromSite();
+    }
+
+    // Drag and drop to put the links of a collection in order
+    const reorderBody = document.querySelector('tbody[data-reorder-url]');
+    if (reorderBody) {
+        const reorderStatus = document.getElementById('reorder-status');
+        let dragged = null;
+
+        reorderBody.addEventListener('dragstart', function(event) {
+            dragged = event.target.closest('tr');
+            event.dataTransfer.effectAllowed = 'move';
+        });
+
+        reorderBody.addEventListener('dragover', function(event) {
+            const row = event.target.closest('tr');
+            if (!dragged || !row || row === dragged) {
+                return;
+            }
+            event.preventDefault();
+            // Drop below the row when we're on its bottom half
+            const box = row.getBoundingClientRect();
+            if (event.clientY > box.top + box.height / 2) {
+                row.after(dragged);
+            } else {
+                row.before(dragged);
+            }
+        });
+
+        reorderBody.addEventListener('drop', function(event) {
+            event.preventDefault();
+        });
+
+        reorderBody.addEventListener('dragend', function() {
+            dragged = null;
+            const linkIDs = Array.from(reorderBody.querySelectorAll('tr[data-link-id]'))
+                .map(row => parseInt(row.dataset.linkId, 10));
+
+            fetch(reorderBody.dataset.reorderUrl, {
+                method: 'POST',
+                headers: {
+                    'Content-Type': 'application/json',
+                    'X-CSRF-Token': reorderBody.dataset.csrfToken
+                },
+                body: JSON.stringify({ link_ids: linkIDs })
+            })
+                .then(response => {
+                    // Someone else changed the collection, show what it looks like now
+                    if (response.status === 409) {
+                        window.location.reload();
+                    } else if (!response.ok) {
+                        return Promise.reject(response.status);
+                    }
+                })
+                .catch(() => {
+                    reorderStatus.textContent = "Couldn't save the new order, please try again.";
+                    reorderStatus.classList.remove('d-none');
+                });
+        });
+    }
+
     // This code is far from production quality, would need proper error handling and more
     // But it's a starting point!
 });
@@ -62,7 +253,6 @@ function refreshLinks() {
 
 /* 
   Potential future improvements:
-  - Auto-suggest tags as user types
   - Link previews
   - Share links with other users
   - Import/export link collections
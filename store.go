@@ -0,0 +1,294 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Errors returned by the stores when something can't be found
+var (
+	ErrUserNotFound  = errors.New("user not found")
+	ErrLinkNotFound  = errors.New("link not found")
+	ErrUsernameTaken = errors.New("username already exists")
+	ErrTokenNotFound = errors.New("API token not found")
+	ErrPageNotFound  = errors.New("archived page not found")
+	ErrShareNotFound = errors.New("share not found")
+
+	ErrWorkspaceNotFound = errors.New("workspace not found")
+	ErrNotMember         = errors.New("not a member of the workspace")
+	ErrInviteNotFound    = errors.New("invitation not found")
+
+	ErrCollectionNotFound   = errors.New("collection not found")
+	ErrNotInCollection      = errors.New("link is not in the collection")
+	ErrCollectionOrderStale = errors.New("order doesn't list the links of the collection")
+	ErrCollectionCycle      = errors.New("collection can't go inside itself")
+
+	ErrTagNotFound = errors.New("tag not found")
+
+	ErrRuleNotFound = errors.New("auto-tag rule not found")
+)
+
+// UserStore handles user accounts
+type UserStore interface {
+	GetUserByID(id int) (User, error)
+	GetUserByUsername(username string) (User, error)
+	// ListUsers returns all users, oldest first
+	ListUsers() ([]User, error)
+	// CreateUser saves a new user and fills in its ID
+	CreateUser(user *User) error
+	// UpdateUserPassword replaces the stored password hash
+	UpdateUserPassword(userID int, passwordHash string) error
+}
+
+// LinkStore handles saved links. Links returned by the store always have
+// their tag names filled in. "User links" are a user's personal links, the
+// links they saved to a workspace belong to the workspace.
+type LinkStore interface {
+	GetUserLinks(userID int) ([]Link, error)
+	GetWorkspaceLinks(workspaceID int) ([]Link, error)
+	// GetPublicLinks returns the newest links of all users that are
+	// visible to everyone
+	GetPublicLinks(limit int) ([]Link, error)
+	GetRecentLinks(userID int, limit int) ([]Link, error)
+	GetLinkByID(id int) (Link, error)
+	// SearchUserLinks and SearchWorkspaceLinks find the links that have
+	// every word of query in their title, description, URL or tags,
+	// ignoring case. The last word also matches the words it's the start
+	// of. Beyond that the stores differ: the memory store also searches the
+	// newest archived copy, matches other endings of a word, needs three
+	// letters before the last word matches longer words and puts the best
+	// matches first (search.go). The SQL store matches every word as any
+	// part of a word, without other endings or archived copies, newest
+	// first.
+	SearchUserLinks(userID int, query string) ([]Link, error)
+	SearchWorkspaceLinks(workspaceID int, query string) ([]Link, error)
+	// CreateLink saves a new link and fills in its ID and CreatedAt
+	CreateLink(link *Link) error
+	// UpdateLink saves the URL, title, description, favicon and visibility
+	// of an existing link. Links can't move to another workspace.
+	UpdateLink(link *Link) error
+	// DeleteLink removes a link together with its tags, archived copies,
+	// shares and places in collections
+	DeleteLink(id int) error
+	// GetLinksToCheck returns up to limit links of all users that haven't
+	// been checked since before, least recently checked first
+	GetLinksToCheck(before time.Time, limit int) ([]Link, error)
+	// SaveLinkHealth records what checking checkedURL found, unless the
+	// link has a different URL by now
+	SaveLinkHealth(linkID int, checkedURL string, health LinkHealth) error
+}
+
+// TagStore handles tags and which links they are attached to. Tags belong
+// to a library like links do: a user's personal links have the user's tags,
+// a workspace's links the workspace's. Nested tags like lang/go have a
+// parent, see tags.go. Tags returned by the store have their LinkCount
+// filled in.
+type TagStore interface {
+	GetLinkTags(linkID int) ([]string, error)
+	// GetUserTags returns a user's personal tags, also the ones no link
+	// has anymore, sorted by name
+	GetUserTags(userID int) ([]Tag, error)
+	// GetWorkspaceTags returns a workspace's tags, sorted by name
+	GetWorkspaceTags(workspaceID int) ([]Tag, error)
+	GetTag(id int) (Tag, error)
+	// AddTagToLinkByName attaches a tag of the link's library to a link,
+	// creating the tag (and the tags above it) if needed
+	AddTagToLinkByName(linkID int, tagName string) error
+	// SetLinkTags replaces all tags of a link
+	SetLinkTags(linkID int, tagNames []string) error
+	// RenameTag renames a tag and the tags below it, so renaming lang/go to
+	// code/go turns lang/go/generics into code/go/generics. Tags that end
+	// up with the name of another tag of the library are merged into it.
+	// name can't be below the tag itself.
+	RenameTag(id int, name string) error
+	// DeleteTag takes a tag off its links and deletes it, the tags below
+	// it move up a level
+	DeleteTag(id int) error
+}
+
+// APITokenStore handles personal API tokens. Tokens are looked up by the
+// SHA-256 of the secret, the secret itself is never stored.
+type APITokenStore interface {
+	// CreateAPIToken saves a new token and fills in its ID
+	CreateAPIToken(token *APIToken) error
+	GetAPITokenByID(id int) (APIToken, error)
+	GetAPITokenByHash(hash string) (APIToken, error)
+	GetUserAPITokens(userID int) ([]APIToken, error)
+	// TouchAPIToken records when a token was last used
+	TouchAPIToken(id int, usedAt time.Time) error
+	DeleteAPIToken(id int) error
+}
+
+// ArchiveStore handles archived copies of links' pages
+type ArchiveStore interface {
+	// CreateArchivedPage saves a new copy and fills in its ID
+	CreateArchivedPage(page *ArchivedPage) error
+	// GetArchivedPage returns a copy with all of its contents
+	GetArchivedPage(id int) (ArchivedPage, error)
+	// GetLinkArchivedPages returns the copies of a link, newest first.
+	// Only the ID, URL, title, size and date are filled in.
+	GetLinkArchivedPages(linkID int) ([]ArchivedPage, error)
+	DeleteArchivedPage(id int) error
+}
+
+// ShareStore handles links and tags shared with other users
+type ShareStore interface {
+	// SaveShare shares a link or a tag and fills in the ID. Sharing the
+	// same link or tag with the same user again only changes the
+	// permission.
+	SaveShare(share *Share) error
+	GetShare(id int) (Share, error)
+	// GetSharesByOwner returns what a user shared with others, newest first
+	GetSharesByOwner(ownerID int) ([]Share, error)
+	// GetSharesWithUser returns what others shared with a user, newest first
+	GetSharesWithUser(userID int) ([]Share, error)
+	DeleteShare(id int) error
+}
+
+// WorkspaceStore handles workspaces, their members and invitations
+type WorkspaceStore interface {
+	// CreateWorkspace saves a new workspace and fills in its ID and
+	// CreatedAt. ownerID becomes its first member, as an owner.
+	CreateWorkspace(workspace *Workspace, ownerID int) error
+	GetWorkspace(id int) (Workspace, error)
+	RenameWorkspace(id int, name string) error
+	// DeleteWorkspace removes a workspace together with its links,
+	// collections, members and invitations
+	DeleteWorkspace(id int) error
+
+	// GetWorkspaceMember returns ErrNotMember if the user isn't in the
+	// workspace
+	GetWorkspaceMember(workspaceID, userID int) (WorkspaceMember, error)
+	// GetWorkspaceMembers returns the members of a workspace, oldest first
+	GetWorkspaceMembers(workspaceID int) ([]WorkspaceMember, error)
+	// GetUserMemberships returns the workspaces a user is in, oldest first
+	GetUserMemberships(userID int) ([]WorkspaceMember, error)
+	// SaveWorkspaceMember adds a member, or changes the role of one
+	SaveWorkspaceMember(member *WorkspaceMember) error
+	RemoveWorkspaceMember(workspaceID, userID int) error
+
+	// SaveWorkspaceInvite invites a user and fills in the ID. Inviting the
+	// same user to the same workspace again only changes the role.
+	SaveWorkspaceInvite(invite *WorkspaceInvite) error
+	GetWorkspaceInvite(id int) (WorkspaceInvite, error)
+	// GetWorkspaceInvites returns the open invitations of a workspace,
+	// newest first
+	GetWorkspaceInvites(workspaceID int) ([]WorkspaceInvite, error)
+	// GetUserWorkspaceInvites returns the invitations a user hasn't
+	// answered yet, newest first
+	GetUserWorkspaceInvites(userID int) ([]WorkspaceInvite, error)
+	DeleteWorkspaceInvite(id int) error
+}
+
+// CollectionStore handles collections and the order of the links in them.
+// Like links, collections are personal or belong to a workspace.
+type CollectionStore interface {
+	// CreateCollection saves a new collection and fills in its ID and
+	// CreatedAt
+	CreateCollection(collection *Collection) error
+	GetCollection(id int) (Collection, error)
+	// GetUserCollections returns a user's personal collections, sorted by
+	// name
+	GetUserCollections(userID int) ([]Collection, error)
+	// GetWorkspaceCollections returns a workspace's collections, sorted by
+	// name
+	GetWorkspaceCollections(workspaceID int) ([]Collection, error)
+	// UpdateCollection saves the name, description, cover and parent of an
+	// existing collection. It returns ErrCollectionCycle if the new parent
+	// is the collection itself or one of its sub-collections.
+	UpdateCollection(collection *Collection) error
+	// DeleteCollection removes a collection. Its links stay, its
+	// sub-collections move up to its parent.
+	DeleteCollection(id int) error
+
+	// GetCollectionLinks returns the links in a collection, in their order
+	GetCollectionLinks(collectionID int) ([]Link, error)
+	// GetLinkCollections returns the collections a link is in, sorted by
+	// name
+	GetLinkCollections(linkID int) ([]Collection, error)
+	// AddLinkToCollection puts a link at the end of a collection, links
+	// that are already in it stay where they are
+	AddLinkToCollection(collectionID, linkID int) error
+	// RemoveLinkFromCollection returns ErrNotInCollection if the link
+	// isn't in the collection
+	RemoveLinkFromCollection(collectionID, linkID int) error
+	// ReorderCollection puts the links of a collection in the given order.
+	// linkIDs has to list every link in the collection exactly once,
+	// otherwise it returns ErrCollectionOrderStale.
+	ReorderCollection(collectionID int, linkIDs []int) error
+}
+
+// AutoTagRuleStore handles the rules that tag a user's links automatically,
+// see autotag.go
+type AutoTagRuleStore interface {
+	// CreateAutoTagRule saves a new rule and fills in its ID and CreatedAt
+	CreateAutoTagRule(rule *AutoTagRule) error
+	GetAutoTagRule(id int) (AutoTagRule, error)
+	// GetUserAutoTagRules returns a user's rules, oldest first
+	GetUserAutoTagRules(userID int) ([]AutoTagRule, error)
+	DeleteAutoTagRule(id int) error
+}
+
+// Store is everything the handlers need to read and write data
+type Store interface {
+	UserStore
+	LinkStore
+	TagStore
+	APITokenStore
+	ArchiveStore
+	ShareStore
+	WorkspaceStore
+	CollectionStore
+	AutoTagRuleStore
+	SessionBackend
+}
+
+// Turn the comma separated tags from a form into a clean list
+func parseTags(tagsStr string) []string {
+	var tagNames []string
+	for _, tag := range strings.Split(tagsStr, ",") {
+		tag = cleanTagName(tag)
+		if tag != "" {
+			tagNames = append(tagNames, tag)
+		}
+	}
+	return tagNames
+}
+
+// Sort collections by name, ignoring case
+func sortCollections(collections []Collection) {
+	sort.Slice(collections, func(i, j int) bool {
+		a, b := strings.ToLower(collections[i].Name), strings.ToLower(collections[j].Name)
+		if a != b {
+			return a < b
+		}
+		return collections[i].ID < collections[j].ID
+	})
+}
+
+// Position of id in ids, -1 if it's not there
+func indexOf(ids []int, id int) int {
+	for i, other := range ids {
+		if other == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// Whether both lists have the same IDs, each of them once
+func sameLinkIDs(current, order []int) bool {
+	if len(current) != len(order) {
+		return false
+	}
+	seen := make(map[int]bool, len(order))
+	for _, id := range order {
+		if seen[id] || indexOf(current, id) < 0 {
+			return false
+		}
+		seen[id] = true
+	}
+	return true
+}
@@ -0,0 +1,2125 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryStore keeps everything in maps, good for local testing.
+// Everything is lost when the server restarts unless persistence is
+// enabled, see persist.go.
+//
+// Every change goes through commit, which writes it to the journal (if
+// there is one) and then applies it, so replaying the journal after a
+// restart rebuilds exactly the same maps.
+type MemoryStore struct {
+	mu         sync.RWMutex // Mutex for thread safety
+	users      map[int]*User
+	links      map[int]*Link
+	tags       map[int]*Tag
+	linkTags   map[int][]int // map[linkID][]tagID
+	apiTokens  map[int]*APIToken
+	archives   map[int]*ArchivedPage
+	shares     map[int]*Share
+	workspaces map[int]*Workspace
+	members    map[memberKey]*WorkspaceMember
+	invites    map[int]*WorkspaceInvite
+	sessions   map[string]*SessionRecord
+
+	collections     map[int]*Collection
+	collectionLinks map[int][]int // map[collectionID][]linkID, in order
+	autoTagRules    map[int]*AutoTagRule
+
+	search *searchIndex // built from the maps, never saved, see search.go
+
+	userIDSeq  int
+	linkIDSeq  int
+	tagIDSeq   int
+	tokenIDSeq int
+	pageIDSeq  int
+	shareIDSeq int
+
+	workspaceIDSeq  int
+	inviteIDSeq     int
+	collectionIDSeq int
+	ruleIDSeq       int
+
+	journal     *Journal
+	dataDir     string
+	seq         uint64 // last applied journal op
+	snapshotSeq uint64 // last op included in the snapshot on disk
+}
+
+// Everything in the store, as written to a snapshot
+type memoryState struct {
+	Seq        uint64           `json:"seq"`
+	UserIDSeq  int              `json:"user_id_seq"`
+	LinkIDSeq  int              `json:"link_id_seq"`
+	TagIDSeq   int              `json:"tag_id_seq"`
+	Users      []*User          `json:"users"`
+	Links      []*Link          `json:"links"`
+	Tags       []*Tag           `json:"tags"`
+	LinkTags   map[int][]int    `json:"link_tags"`
+	Sessions   []*SessionRecord `json:"sessions"`
+	APITokens  []*APIToken      `json:"api_tokens"`
+	TokenIDSeq int              `json:"token_id_seq"`
+	Archives   []*ArchivedPage  `json:"archives"`
+	PageIDSeq  int              `json:"page_id_seq"`
+	Shares     []*Share         `json:"shares"`
+	ShareIDSeq int              `json:"share_id_seq"`
+
+	Workspaces     []*Workspace       `json:"workspaces"`
+	WorkspaceIDSeq int                `json:"workspace_id_seq"`
+	Members        []*WorkspaceMember `json:"workspace_members"`
+	Invites        []*WorkspaceInvite `json:"workspace_invites"`
+	InviteIDSeq    int                `json:"invite_id_seq"`
+
+	Collections     []*Collection `json:"collections"`
+	CollectionIDSeq int           `json:"collection_id_seq"`
+	CollectionLinks map[int][]int `json:"collection_links"`
+
+	AutoTagRules []*AutoTagRule `json:"auto_tag_rules"`
+	RuleIDSeq    int            `json:"rule_id_seq"`
+}
+
+// Workspace members are looked up by workspace and user
+type memberKey struct {
+	WorkspaceID int
+	UserID      int
+}
+
+// Journal payloads that aren't just a User or Link
+type linkIDOp struct {
+	LinkID int `json:"link_id"`
+}
+
+type linkTagsOp struct {
+	LinkID int      `json:"link_id"`
+	Tags   []string `json:"tags"`
+}
+
+type tagRenameOp struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+}
+
+type tagIDOp struct {
+	ID int `json:"id"`
+}
+
+type linkHealthOp struct {
+	LinkID int        `json:"link_id"`
+	Health LinkHealth `json:"health"`
+}
+
+type tokenIDOp struct {
+	ID int `json:"id"`
+}
+
+type touchTokenOp struct {
+	ID     int       `json:"id"`
+	UsedAt time.Time `json:"used_at"`
+}
+
+type pageIDOp struct {
+	ID int `json:"id"`
+}
+
+type shareIDOp struct {
+	ID int `json:"id"`
+}
+
+type createWorkspaceOp struct {
+	Workspace Workspace       `json:"workspace"`
+	Owner     WorkspaceMember `json:"owner"`
+}
+
+type workspaceIDOp struct {
+	ID int `json:"id"`
+}
+
+type inviteIDOp struct {
+	ID int `json:"id"`
+}
+
+type collectionIDOp struct {
+	ID int `json:"id"`
+}
+
+type collectionLinkOp struct {
+	CollectionID int `json:"collection_id"`
+	LinkID       int `json:"link_id"`
+}
+
+type collectionOrderOp struct {
+	CollectionID int   `json:"collection_id"`
+	LinkIDs      []int `json:"link_ids"`
+}
+
+type ruleIDOp struct {
+	ID int `json:"id"`
+}
+
+type sessionIDOp struct {
+	ID string `json:"id"`
+}
+
+type userSessionsOp struct {
+	UserID int    `json:"user_id"`
+	KeepID string `json:"keep_id"`
+}
+
+type expireSessionsOp struct {
+	Now         time.Time     `json:"now"`
+	IdleTimeout time.Duration `json:"idle_timeout"`
+}
+
+// NewMemoryStore creates an empty in-memory store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		users:      make(map[int]*User),
+		links:      make(map[int]*Link),
+		tags:       make(map[int]*Tag),
+		linkTags:   make(map[int][]int),
+		apiTokens:  make(map[int]*APIToken),
+		archives:   make(map[int]*ArchivedPage),
+		shares:     make(map[int]*Share),
+		workspaces: make(map[int]*Workspace),
+		members:    make(map[memberKey]*WorkspaceMember),
+		invites:    make(map[int]*WorkspaceInvite),
+		sessions:   make(map[string]*SessionRecord),
+
+		collections:     make(map[int]*Collection),
+		collectionLinks: make(map[int][]int),
+		autoTagRules:    make(map[int]*AutoTagRule),
+
+		search: newSearchIndex(),
+
+		userIDSeq:  1,
+		linkIDSeq:  1,
+		tagIDSeq:   1,
+		tokenIDSeq: 1,
+		pageIDSeq:  1,
+		shareIDSeq: 1,
+
+		workspaceIDSeq:  1,
+		inviteIDSeq:     1,
+		collectionIDSeq: 1,
+		ruleIDSeq:       1,
+	}
+}
+
+// Create a new tag in a library, caller must hold the lock
+func (s *MemoryStore) createTag(userID, workspaceID int, name string) *Tag {
+	tag := &Tag{
+		ID:          s.tagIDSeq,
+		Name:        name,
+		WorkspaceID: workspaceID,
+	}
+	if workspaceID == 0 {
+		tag.UserID = userID
+	}
+	s.tags[tag.ID] = tag
+	s.tagIDSeq++
+	return tag
+}
+
+// Copy a link and fill in its tag names, caller must hold the lock
+func (s *MemoryStore) copyLink(link *Link) Link {
+	linkCopy := *link
+	linkCopy.Tags = s.tagNames(link.ID)
+	return linkCopy
+}
+
+// Get tag names for a link, caller must hold the lock
+func (s *MemoryStore) tagNames(linkID int) []string {
+	var tagNames []string
+	for _, tagID := range s.linkTags[linkID] {
+		if tag, exists := s.tags[tagID]; exists {
+			tagNames = append(tagNames, tag.Name)
+		}
+	}
+	return tagNames
+}
+
+// Newest links first, same order the database would give us
+func sortLinksNewestFirst(links []Link) {
+	sort.Slice(links, func(i, j int) bool {
+		if links[i].CreatedAt.Equal(links[j].CreatedAt) {
+			return links[i].ID > links[j].ID
+		}
+		return links[i].CreatedAt.After(links[j].CreatedAt)
+	})
+}
+
+// Get user by ID
+func (s *MemoryStore) GetUserByID(id int) (User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if user, exists := s.users[id]; exists {
+		return *user, nil
+	}
+	return User{}, ErrUserNotFound
+}
+
+// Get user by username
+func (s *MemoryStore) GetUserByUsername(username string) (User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, user := range s.users {
+		if user.Username == username {
+			return *user, nil
+		}
+	}
+	return User{}, ErrUserNotFound
+}
+
+// List all users
+func (s *MemoryStore) ListUsers() ([]User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	users := make([]User, 0, len(s.users))
+	for _, user := range s.users {
+		users = append(users, *user)
+	}
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].ID < users[j].ID
+	})
+	return users, nil
+}
+
+// Create a new user
+func (s *MemoryStore) CreateUser(user *User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, existing := range s.users {
+		if existing.Username == user.Username {
+			return ErrUsernameTaken
+		}
+	}
+
+	user.ID = s.userIDSeq
+	return s.commit("create_user", user)
+}
+
+// Replace a user's password hash
+func (s *MemoryStore) UpdateUserPassword(userID int, passwordHash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.users[userID]; !exists {
+		return ErrUserNotFound
+	}
+	return s.commit("update_password", User{ID: userID, Password: passwordHash})
+}
+
+// Get all personal links of a user
+func (s *MemoryStore) GetUserLinks(userID int) ([]Link, error) {
+	return s.findLinks(func(link *Link) bool {
+		return link.UserID == userID && link.WorkspaceID == 0
+	}), nil
+}
+
+// Get all links of a workspace
+func (s *MemoryStore) GetWorkspaceLinks(workspaceID int) ([]Link, error) {
+	return s.findLinks(func(link *Link) bool {
+		return link.WorkspaceID == workspaceID
+	}), nil
+}
+
+// Links that match, newest first
+func (s *MemoryStore) findLinks(match func(*Link) bool) []Link {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var links []Link
+	for _, link := range s.links {
+		if match(link) {
+			links = append(links, s.copyLink(link))
+		}
+	}
+	sortLinksNewestFirst(links)
+	return links
+}
+
+// Get public links (for non-logged in users)
+func (s *MemoryStore) GetPublicLinks(limit int) ([]Link, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var publicLinks []Link
+	for _, link := range s.links {
+		if link.Visibility == VisibilityPublic {
+			publicLinks = append(publicLinks, s.copyLink(link))
+		}
+	}
+	sortLinksNewestFirst(publicLinks)
+	if len(publicLinks) > limit {
+		publicLinks = publicLinks[:limit]
+	}
+	return publicLinks, nil
+}
+
+// Get recent links for a user
+func (s *MemoryStore) GetRecentLinks(userID int, limit int) ([]Link, error) {
+	links, err := s.GetUserLinks(userID)
+	if err != nil {
+		return nil, err
+	}
+	if len(links) > limit {
+		return links[:limit], nil
+	}
+	return links, nil
+}
+
+// Get a link by ID
+func (s *MemoryStore) GetLinkByID(id int) (Link, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if link, exists := s.links[id]; exists {
+		return s.copyLink(link), nil
+	}
+	return Link{}, ErrLinkNotFound
+}
+
+// Search for a user's personal links by query, best matches first
+func (s *MemoryStore) SearchUserLinks(userID int, query string) ([]Link, error) {
+	return s.searchLinks(libraryKey{UserID: userID}, query), nil
+}
+
+// Search for a workspace's links by query
+func (s *MemoryStore) SearchWorkspaceLinks(workspaceID int, query string) ([]Link, error) {
+	return s.searchLinks(libraryKey{WorkspaceID: workspaceID}, query), nil
+}
+
+// Search the links of a library in the index, best matches first and
+// newest first among equally good ones
+func (s *MemoryStore) searchLinks(library libraryKey, query string) []Link {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	// Sort the links themselves rather than copies, moving copies around
+	// is most of the work with thousands of results
+	type match struct {
+		link  *Link
+		score float64
+	}
+	scores := s.search.search(library, query)
+	found := make([]match, 0, len(scores))
+	for linkID, score := range scores {
+		if link, exists := s.links[linkID]; exists {
+			found = append(found, match{link, score})
+		}
+	}
+	sort.Slice(found, func(i, j int) bool {
+		a, b := found[i], found[j]
+		switch {
+		case a.score != b.score:
+			return a.score > b.score
+		case !a.link.CreatedAt.Equal(b.link.CreatedAt):
+			return a.link.CreatedAt.After(b.link.CreatedAt)
+		}
+		return a.link.ID > b.link.ID
+	})
+
+	if len(found) == 0 {
+		return nil
+	}
+	results := make([]Link, 0, len(found))
+	for _, match := range found {
+		results = append(results, s.copyLink(match.link))
+	}
+	return results
+}
+
+// Create a new link
+func (s *MemoryStore) CreateLink(link *Link) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	link.ID = s.linkIDSeq
+	if link.CreatedAt.IsZero() {
+		link.CreatedAt = time.Now()
+	}
+	if link.Visibility == "" {
+		link.Visibility = VisibilityPrivate
+	}
+	link.Tags = []string{}
+	return s.commit("create_link", link)
+}
+
+// Update an existing link
+func (s *MemoryStore) UpdateLink(link *Link) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.links[link.ID]; !exists {
+		return ErrLinkNotFound
+	}
+	if link.Visibility == "" {
+		link.Visibility = VisibilityPrivate
+	}
+	return s.commit("update_link", link)
+}
+
+// Delete a link and its tags
+func (s *MemoryStore) DeleteLink(id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.links[id]; !exists {
+		return ErrLinkNotFound
+	}
+	return s.commit("delete_link", linkIDOp{LinkID: id})
+}
+
+// Get links that haven't been checked since before, least recently
+// checked first
+func (s *MemoryStore) GetLinksToCheck(before time.Time, limit int) ([]Link, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var due []Link
+	for _, link := range s.links {
+		if link.Health.CheckedAt == nil || link.Health.CheckedAt.Before(before) {
+			due = append(due, s.copyLink(link))
+		}
+	}
+	// Never checked first, same as NULLs in the database
+	sort.Slice(due, func(i, j int) bool {
+		a, b := due[i].Health.CheckedAt, due[j].Health.CheckedAt
+		switch {
+		case a == nil && b == nil:
+			return due[i].ID < due[j].ID
+		case a == nil || b == nil:
+			return a == nil
+		case a.Equal(*b):
+			return due[i].ID < due[j].ID
+		}
+		return a.Before(*b)
+	})
+	if len(due) > limit {
+		due = due[:limit]
+	}
+	return due, nil
+}
+
+// Record what checking a link found
+func (s *MemoryStore) SaveLinkHealth(linkID int, checkedURL string, health LinkHealth) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	link, exists := s.links[linkID]
+	if !exists {
+		return ErrLinkNotFound
+	}
+	// The URL was edited while it was being checked, the result is about
+	// the old one
+	if link.URL != checkedURL {
+		return nil
+	}
+	return s.commit("save_link_health", linkHealthOp{LinkID: linkID, Health: health})
+}
+
+// Get all tags for a link
+func (s *MemoryStore) GetLinkTags(linkID int) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.tagNames(linkID), nil
+}
+
+// Get a user's personal tags
+func (s *MemoryStore) GetUserTags(userID int) ([]Tag, error) {
+	return s.findTags(userID, 0), nil
+}
+
+// Get a workspace's tags
+func (s *MemoryStore) GetWorkspaceTags(workspaceID int) ([]Tag, error) {
+	return s.findTags(0, workspaceID), nil
+}
+
+// The tags of a library with their link counts, sorted by name
+func (s *MemoryStore) findTags(userID, workspaceID int) []Tag {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	counts := s.tagLinkCounts()
+	var tags []Tag
+	for _, tag := range s.tags {
+		if tag.inLibrary(userID, workspaceID) {
+			found := *tag
+			found.LinkCount = counts[tag.ID]
+			tags = append(tags, found)
+		}
+	}
+	sort.Slice(tags, func(i, j int) bool {
+		return tags[i].Name < tags[j].Name
+	})
+	return tags
+}
+
+// How many links have each tag, caller must hold the lock
+func (s *MemoryStore) tagLinkCounts() map[int]int {
+	counts := make(map[int]int)
+	for linkID, tagIDs := range s.linkTags {
+		if _, exists := s.links[linkID]; !exists {
+			continue
+		}
+		for _, tagID := range tagIDs {
+			counts[tagID]++
+		}
+	}
+	return counts
+}
+
+// Get a tag by ID
+func (s *MemoryStore) GetTag(id int) (Tag, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	tag, exists := s.tags[id]
+	if !exists {
+		return Tag{}, ErrTagNotFound
+	}
+	found := *tag
+	found.LinkCount = s.tagLinkCounts()[id]
+	return found, nil
+}
+
+// Add a tag to a link (by name)
+func (s *MemoryStore) AddTagToLinkByName(linkID int, tagName string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.links[linkID]; !exists {
+		return ErrLinkNotFound
+	}
+	return s.commit("add_tag", linkTagsOp{LinkID: linkID, Tags: []string{tagName}})
+}
+
+// Same as AddTagToLinkByName without journaling, caller must hold the lock
+func (s *MemoryStore) addTagToLinkByName(linkID int, tagName string) {
+	link, exists := s.links[linkID]
+	if !exists {
+		return
+	}
+	tagID := s.findOrCreateTag(link.UserID, link.WorkspaceID, tagName).ID
+
+	// Check if link already has this tag
+	for _, id := range s.linkTags[linkID] {
+		if id == tagID {
+			return
+		}
+	}
+
+	s.linkTags[linkID] = append(s.linkTags[linkID], tagID)
+}
+
+// Replace all tags of a link
+func (s *MemoryStore) SetLinkTags(linkID int, tagNames []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.links[linkID]; !exists {
+		return ErrLinkNotFound
+	}
+	return s.commit("set_tags", linkTagsOp{LinkID: linkID, Tags: tagNames})
+}
+
+// Rename a tag and the tags below it
+func (s *MemoryStore) RenameTag(id int, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.tags[id]; !exists {
+		return ErrTagNotFound
+	}
+	return s.commit("rename_tag", tagRenameOp{ID: id, Name: name})
+}
+
+// Delete a tag, the tags below it move up a level
+func (s *MemoryStore) DeleteTag(id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.tags[id]; !exists {
+		return ErrTagNotFound
+	}
+	return s.commit("delete_tag", tagIDOp{ID: id})
+}
+
+// Find a tag of a library by name, nil if there is none. Caller must hold
+// the lock.
+func (s *MemoryStore) tagByName(userID, workspaceID int, name string) *Tag {
+	for _, tag := range s.tags {
+		if tag.Name == name && tag.inLibrary(userID, workspaceID) {
+			return tag
+		}
+	}
+	return nil
+}
+
+// Find a tag of a library, or create it and the tags above it, caller must
+// hold the lock
+func (s *MemoryStore) findOrCreateTag(userID, workspaceID int, name string) *Tag {
+	tag := s.tagByName(userID, workspaceID, name)
+	if tag == nil {
+		tag = s.createTag(userID, workspaceID, name)
+	}
+	// Tags from before tags had parents get theirs the next time they're used
+	if parent := parentTagName(name); parent != "" && tag.ParentID == 0 {
+		tag.ParentID = s.findOrCreateTag(userID, workspaceID, parent).ID
+	}
+	return tag
+}
+
+// Rename the tags of a library that are from or below it, see RenameTag.
+// Caller must hold the lock.
+func (s *MemoryStore) renameTags(userID, workspaceID int, from, to string) {
+	var moving []*Tag
+	for _, tag := range s.tags {
+		if tag.inLibrary(userID, workspaceID) && tagUnder(tag.Name, from) {
+			moving = append(moving, tag)
+		}
+	}
+	// Tags above first, so their new names are taken before the tags below
+	// look for their parents. The names make it the same order every time
+	// the journal is replayed.
+	sort.Slice(moving, func(i, j int) bool {
+		return tagsAboveFirst(moving[i].Name, moving[j].Name)
+	})
+
+	for _, tag := range moving {
+		name := movedTagName(tag.Name, from, to)
+		if existing := s.tagByName(userID, workspaceID, name); existing != nil && existing != tag {
+			s.retag(tag.ID, existing.ID)
+			s.removeTag(tag.ID)
+			continue
+		}
+		tag.Name = name
+		tag.ParentID = 0
+		if parent := parentTagName(name); parent != "" {
+			tag.ParentID = s.findOrCreateTag(userID, workspaceID, parent).ID
+		}
+	}
+}
+
+// Take a tag off every link that has it, and put replacement on instead
+// unless it's 0 or the link has it already. Caller must hold the lock.
+func (s *MemoryStore) retag(tagID, replacement int) {
+	for linkID, tagIDs := range s.linkTags {
+		var kept []int
+		for _, id := range tagIDs {
+			switch {
+			case id != tagID:
+				kept = append(kept, id)
+			case replacement != 0 && indexOf(tagIDs, replacement) < 0:
+				kept = append(kept, replacement)
+			}
+		}
+		s.linkTags[linkID] = kept
+	}
+}
+
+// Delete a tag that no link has anymore, caller must hold the lock
+func (s *MemoryStore) removeTag(tagID int) {
+	delete(s.tags, tagID)
+	for _, tag := range s.tags {
+		if tag.ParentID == tagID {
+			tag.ParentID = 0
+		}
+	}
+}
+
+// Create a new API token
+func (s *MemoryStore) CreateAPIToken(token *APIToken) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	token.ID = s.tokenIDSeq
+	return s.commit("create_api_token", token)
+}
+
+// Get an API token by ID
+func (s *MemoryStore) GetAPITokenByID(id int) (APIToken, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if token, exists := s.apiTokens[id]; exists {
+		return *token, nil
+	}
+	return APIToken{}, ErrTokenNotFound
+}
+
+// Get an API token by the hash of its secret
+func (s *MemoryStore) GetAPITokenByHash(hash string) (APIToken, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, token := range s.apiTokens {
+		if token.Hash == hash {
+			return *token, nil
+		}
+	}
+	return APIToken{}, ErrTokenNotFound
+}
+
+// Get all API tokens of a user, newest first
+func (s *MemoryStore) GetUserAPITokens(userID int) ([]APIToken, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var tokens []APIToken
+	for _, token := range s.apiTokens {
+		if token.UserID == userID {
+			tokens = append(tokens, *token)
+		}
+	}
+	sort.Slice(tokens, func(i, j int) bool {
+		return tokens[i].ID > tokens[j].ID
+	})
+	return tokens, nil
+}
+
+// Record when an API token was last used
+func (s *MemoryStore) TouchAPIToken(id int, usedAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.apiTokens[id]; !exists {
+		return ErrTokenNotFound
+	}
+	return s.commit("touch_api_token", touchTokenOp{ID: id, UsedAt: usedAt})
+}
+
+// Delete an API token
+func (s *MemoryStore) DeleteAPIToken(id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.apiTokens[id]; !exists {
+		return ErrTokenNotFound
+	}
+	return s.commit("delete_api_token", tokenIDOp{ID: id})
+}
+
+// Save an archived copy of a link's page
+func (s *MemoryStore) CreateArchivedPage(page *ArchivedPage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// The link may have been deleted while its page was being archived
+	if _, exists := s.links[page.LinkID]; !exists {
+		return ErrLinkNotFound
+	}
+	page.ID = s.pageIDSeq
+	return s.commit("create_archived_page", page)
+}
+
+// Get an archived page with its contents
+func (s *MemoryStore) GetArchivedPage(id int) (ArchivedPage, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if page, exists := s.archives[id]; exists {
+		return *page, nil
+	}
+	return ArchivedPage{}, ErrPageNotFound
+}
+
+// Get the archived copies of a link without their contents, newest first
+func (s *MemoryStore) GetLinkArchivedPages(linkID int) ([]ArchivedPage, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var pages []ArchivedPage
+	for _, page := range s.archives {
+		if page.LinkID == linkID {
+			pageCopy := *page
+			pageCopy.Readable, pageCopy.Text, pageCopy.FullPage = "", "", ""
+			pages = append(pages, pageCopy)
+		}
+	}
+	sort.Slice(pages, func(i, j int) bool {
+		return pages[i].ID > pages[j].ID
+	})
+	return pages, nil
+}
+
+// Delete an archived page
+func (s *MemoryStore) DeleteArchivedPage(id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.archives[id]; !exists {
+		return ErrPageNotFound
+	}
+	return s.commit("delete_archived_page", pageIDOp{ID: id})
+}
+
+// Share a link or tag, or change the permission of an existing share
+func (s *MemoryStore) SaveShare(share *Share) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if share.LinkID != 0 {
+		if _, exists := s.links[share.LinkID]; !exists {
+			return ErrLinkNotFound
+		}
+	}
+	share.ID = s.shareIDSeq
+	for _, existing := range s.shares {
+		if existing.OwnerID == share.OwnerID && existing.UserID == share.UserID &&
+			existing.LinkID == share.LinkID && existing.Tag == share.Tag {
+			share.ID = existing.ID
+			share.CreatedAt = existing.CreatedAt
+			break
+		}
+	}
+	return s.commit("save_share", share)
+}
+
+// Get a share by ID
+func (s *MemoryStore) GetShare(id int) (Share, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if share, exists := s.shares[id]; exists {
+		return *share, nil
+	}
+	return Share{}, ErrShareNotFound
+}
+
+// Get what a user shared with others, newest first
+func (s *MemoryStore) GetSharesByOwner(ownerID int) ([]Share, error) {
+	return s.findShares(func(share *Share) bool { return share.OwnerID == ownerID }), nil
+}
+
+// Get what others shared with a user, newest first
+func (s *MemoryStore) GetSharesWithUser(userID int) ([]Share, error) {
+	return s.findShares(func(share *Share) bool { return share.UserID == userID }), nil
+}
+
+func (s *MemoryStore) findShares(match func(*Share) bool) []Share {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var shares []Share
+	for _, share := range s.shares {
+		if match(share) {
+			shares = append(shares, *share)
+		}
+	}
+	sort.Slice(shares, func(i, j int) bool {
+		return shares[i].ID > shares[j].ID
+	})
+	return shares
+}
+
+// Stop sharing
+func (s *MemoryStore) DeleteShare(id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.shares[id]; !exists {
+		return ErrShareNotFound
+	}
+	return s.commit("delete_share", shareIDOp{ID: id})
+}
+
+// Create a workspace with its first owner
+func (s *MemoryStore) CreateWorkspace(workspace *Workspace, ownerID int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	workspace.ID = s.workspaceIDSeq
+	if workspace.CreatedAt.IsZero() {
+		workspace.CreatedAt = time.Now()
+	}
+	return s.commit("create_workspace", createWorkspaceOp{
+		Workspace: *workspace,
+		Owner: WorkspaceMember{
+			WorkspaceID: workspace.ID,
+			UserID:      ownerID,
+			Role:        RoleOwner,
+			CreatedAt:   workspace.CreatedAt,
+		},
+	})
+}
+
+// Get a workspace by ID
+func (s *MemoryStore) GetWorkspace(id int) (Workspace, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if workspace, exists := s.workspaces[id]; exists {
+		return *workspace, nil
+	}
+	return Workspace{}, ErrWorkspaceNotFound
+}
+
+// Give a workspace a new name
+func (s *MemoryStore) RenameWorkspace(id int, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.workspaces[id]; !exists {
+		return ErrWorkspaceNotFound
+	}
+	return s.commit("rename_workspace", Workspace{ID: id, Name: name})
+}
+
+// Delete a workspace with its links, members and invitations
+func (s *MemoryStore) DeleteWorkspace(id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.workspaces[id]; !exists {
+		return ErrWorkspaceNotFound
+	}
+	return s.commit("delete_workspace", workspaceIDOp{ID: id})
+}
+
+// Get a user's membership of a workspace
+func (s *MemoryStore) GetWorkspaceMember(workspaceID, userID int) (WorkspaceMember, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if member, exists := s.members[memberKey{workspaceID, userID}]; exists {
+		return *member, nil
+	}
+	return WorkspaceMember{}, ErrNotMember
+}
+
+// Get the members of a workspace, oldest first
+func (s *MemoryStore) GetWorkspaceMembers(workspaceID int) ([]WorkspaceMember, error) {
+	return s.findMembers(func(member *WorkspaceMember) bool { return member.WorkspaceID == workspaceID }), nil
+}
+
+// Get the workspaces a user is in, oldest first
+func (s *MemoryStore) GetUserMemberships(userID int) ([]WorkspaceMember, error) {
+	return s.findMembers(func(member *WorkspaceMember) bool { return member.UserID == userID }), nil
+}
+
+func (s *MemoryStore) findMembers(match func(*WorkspaceMember) bool) []WorkspaceMember {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var members []WorkspaceMember
+	for _, member := range s.members {
+		if match(member) {
+			members = append(members, *member)
+		}
+	}
+	sort.Slice(members, func(i, j int) bool {
+		if !members[i].CreatedAt.Equal(members[j].CreatedAt) {
+			return members[i].CreatedAt.Before(members[j].CreatedAt)
+		}
+		if members[i].WorkspaceID != members[j].WorkspaceID {
+			return members[i].WorkspaceID < members[j].WorkspaceID
+		}
+		return members[i].UserID < members[j].UserID
+	})
+	return members
+}
+
+// Add a member to a workspace, or change their role
+func (s *MemoryStore) SaveWorkspaceMember(member *WorkspaceMember) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.workspaces[member.WorkspaceID]; !exists {
+		return ErrWorkspaceNotFound
+	}
+	if existing, exists := s.members[memberKey{member.WorkspaceID, member.UserID}]; exists {
+		member.CreatedAt = existing.CreatedAt
+	} else if member.CreatedAt.IsZero() {
+		member.CreatedAt = time.Now()
+	}
+	return s.commit("save_workspace_member", member)
+}
+
+// Remove a member from a workspace
+func (s *MemoryStore) RemoveWorkspaceMember(workspaceID, userID int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.members[memberKey{workspaceID, userID}]; !exists {
+		return ErrNotMember
+	}
+	return s.commit("remove_workspace_member", WorkspaceMember{WorkspaceID: workspaceID, UserID: userID})
+}
+
+// Invite a user to a workspace, or change the role they're invited as
+func (s *MemoryStore) SaveWorkspaceInvite(invite *WorkspaceInvite) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.workspaces[invite.WorkspaceID]; !exists {
+		return ErrWorkspaceNotFound
+	}
+	invite.ID = s.inviteIDSeq
+	for _, existing := range s.invites {
+		if existing.WorkspaceID == invite.WorkspaceID && existing.UserID == invite.UserID {
+			invite.ID = existing.ID
+			break
+		}
+	}
+	return s.commit("save_workspace_invite", invite)
+}
+
+// Get an invitation by ID
+func (s *MemoryStore) GetWorkspaceInvite(id int) (WorkspaceInvite, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if invite, exists := s.invites[id]; exists {
+		return *invite, nil
+	}
+	return WorkspaceInvite{}, ErrInviteNotFound
+}
+
+// Get the open invitations of a workspace, newest first
+func (s *MemoryStore) GetWorkspaceInvites(workspaceID int) ([]WorkspaceInvite, error) {
+	return s.findInvites(func(invite *WorkspaceInvite) bool { return invite.WorkspaceID == workspaceID }), nil
+}
+
+// Get the invitations a user hasn't answered yet, newest first
+func (s *MemoryStore) GetUserWorkspaceInvites(userID int) ([]WorkspaceInvite, error) {
+	return s.findInvites(func(invite *WorkspaceInvite) bool { return invite.UserID == userID }), nil
+}
+
+func (s *MemoryStore) findInvites(match func(*WorkspaceInvite) bool) []WorkspaceInvite {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var invites []WorkspaceInvite
+	for _, invite := range s.invites {
+		if match(invite) {
+			invites = append(invites, *invite)
+		}
+	}
+	sort.Slice(invites, func(i, j int) bool {
+		return invites[i].ID > invites[j].ID
+	})
+	return invites
+}
+
+// Delete an invitation
+func (s *MemoryStore) DeleteWorkspaceInvite(id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.invites[id]; !exists {
+		return ErrInviteNotFound
+	}
+	return s.commit("delete_workspace_invite", inviteIDOp{ID: id})
+}
+
+// Create a new collection
+func (s *MemoryStore) CreateCollection(collection *Collection) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	collection.ID = s.collectionIDSeq
+	if collection.CreatedAt.IsZero() {
+		collection.CreatedAt = time.Now()
+	}
+	return s.commit("create_collection", collection)
+}
+
+// Get a collection by ID
+func (s *MemoryStore) GetCollection(id int) (Collection, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if collection, exists := s.collections[id]; exists {
+		return *collection, nil
+	}
+	return Collection{}, ErrCollectionNotFound
+}
+
+// Get a user's personal collections, sorted by name
+func (s *MemoryStore) GetUserCollections(userID int) ([]Collection, error) {
+	return s.findCollections(func(collection *Collection) bool {
+		return collection.UserID == userID && collection.WorkspaceID == 0
+	}), nil
+}
+
+// Get a workspace's collections, sorted by name
+func (s *MemoryStore) GetWorkspaceCollections(workspaceID int) ([]Collection, error) {
+	return s.findCollections(func(collection *Collection) bool {
+		return collection.WorkspaceID == workspaceID
+	}), nil
+}
+
+func (s *MemoryStore) findCollections(match func(*Collection) bool) []Collection {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var collections []Collection
+	for _, collection := range s.collections {
+		if match(collection) {
+			collections = append(collections, *collection)
+		}
+	}
+	sortCollections(collections)
+	return collections
+}
+
+// Update a collection
+func (s *MemoryStore) UpdateCollection(collection *Collection) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.collections[collection.ID]; !exists {
+		return ErrCollectionNotFound
+	}
+	for parentID, steps := collection.ParentID, 0; parentID != 0 && steps <= len(s.collections); steps++ {
+		if parentID == collection.ID {
+			return ErrCollectionCycle
+		}
+		parent, exists := s.collections[parentID]
+		if !exists {
+			break
+		}
+		parentID = parent.ParentID
+	}
+	return s.commit("update_collection", collection)
+}
+
+// Delete a collection, its sub-collections move up to its parent
+func (s *MemoryStore) DeleteCollection(id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.collections[id]; !exists {
+		return ErrCollectionNotFound
+	}
+	return s.commit("delete_collection", collectionIDOp{ID: id})
+}
+
+// Get the links in a collection, in their order
+func (s *MemoryStore) GetCollectionLinks(collectionID int) ([]Link, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if _, exists := s.collections[collectionID]; !exists {
+		return nil, ErrCollectionNotFound
+	}
+	var links []Link
+	for _, linkID := range s.collectionLinks[collectionID] {
+		if link, exists := s.links[linkID]; exists {
+			links = append(links, s.copyLink(link))
+		}
+	}
+	return links, nil
+}
+
+// Get the collections a link is in, sorted by name
+func (s *MemoryStore) GetLinkCollections(linkID int) ([]Collection, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var collections []Collection
+	for collectionID, linkIDs := range s.collectionLinks {
+		if indexOf(linkIDs, linkID) >= 0 {
+			collections = append(collections, *s.collections[collectionID])
+		}
+	}
+	sortCollections(collections)
+	return collections, nil
+}
+
+// Put a link at the end of a collection
+func (s *MemoryStore) AddLinkToCollection(collectionID, linkID int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.collections[collectionID]; !exists {
+		return ErrCollectionNotFound
+	}
+	if _, exists := s.links[linkID]; !exists {
+		return ErrLinkNotFound
+	}
+	if indexOf(s.collectionLinks[collectionID], linkID) >= 0 {
+		return nil
+	}
+	return s.commit("add_collection_link", collectionLinkOp{CollectionID: collectionID, LinkID: linkID})
+}
+
+// Take a link out of a collection
+func (s *MemoryStore) RemoveLinkFromCollection(collectionID, linkID int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if indexOf(s.collectionLinks[collectionID], linkID) < 0 {
+		return ErrNotInCollection
+	}
+	return s.commit("remove_collection_link", collectionLinkOp{CollectionID: collectionID, LinkID: linkID})
+}
+
+// Put the links of a collection in a new order
+func (s *MemoryStore) ReorderCollection(collectionID int, linkIDs []int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.collections[collectionID]; !exists {
+		return ErrCollectionNotFound
+	}
+	if !sameLinkIDs(s.collectionLinks[collectionID], linkIDs) {
+		return ErrCollectionOrderStale
+	}
+	return s.commit("reorder_collection", collectionOrderOp{CollectionID: collectionID, LinkIDs: linkIDs})
+}
+
+// Get a session by ID
+func (s *MemoryStore) GetSession(id string) (SessionRecord, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if record, exists := s.sessions[id]; exists {
+		return *record, nil
+	}
+	return SessionRecord{}, ErrSessionNotFound
+}
+
+// Create a new auto-tag rule
+func (s *MemoryStore) CreateAutoTagRule(rule *AutoTagRule) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rule.ID = s.ruleIDSeq
+	if rule.CreatedAt.IsZero() {
+		rule.CreatedAt = time.Now()
+	}
+	return s.commit("create_auto_tag_rule", rule)
+}
+
+// Get an auto-tag rule by ID
+func (s *MemoryStore) GetAutoTagRule(id int) (AutoTagRule, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if rule, exists := s.autoTagRules[id]; exists {
+		return *rule, nil
+	}
+	return AutoTagRule{}, ErrRuleNotFound
+}
+
+// Get a user's auto-tag rules, oldest first
+func (s *MemoryStore) GetUserAutoTagRules(userID int) ([]AutoTagRule, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var rules []AutoTagRule
+	for _, rule := range s.autoTagRules {
+		if rule.UserID == userID {
+			rules = append(rules, *rule)
+		}
+	}
+	sort.Slice(rules, func(i, j int) bool {
+		return rules[i].ID < rules[j].ID
+	})
+	return rules, nil
+}
+
+// Delete an auto-tag rule, the tags it added stay
+func (s *MemoryStore) DeleteAutoTagRule(id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.autoTagRules[id]; !exists {
+		return ErrRuleNotFound
+	}
+	return s.commit("delete_auto_tag_rule", ruleIDOp{ID: id})
+}
+
+// Create or update a session
+func (s *MemoryStore) SaveSession(record SessionRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.commit("save_session", record)
+}
+
+// Delete a session
+func (s *MemoryStore) DeleteSession(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.sessions[id]; !exists {
+		return nil
+	}
+	return s.commit("delete_session", sessionIDOp{ID: id})
+}
+
+// Get all sessions of a user, most recently used first
+func (s *MemoryStore) ListUserSessions(userID int) ([]SessionRecord, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var records []SessionRecord
+	for _, record := range s.sessions {
+		if record.UserID == userID {
+			records = append(records, *record)
+		}
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].LastSeen.After(records[j].LastSeen)
+	})
+	return records, nil
+}
+
+// Delete all sessions of a user except keepID
+func (s *MemoryStore) DeleteUserSessions(userID int, keepID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.commit("delete_user_sessions", userSessionsOp{UserID: userID, KeepID: keepID})
+}
+
+// Delete sessions that have expired or have been idle too long
+func (s *MemoryStore) DeleteExpiredSessions(now time.Time, idleTimeout time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	expired := false
+	for _, record := range s.sessions {
+		if sessionExpired(record, now, idleTimeout) {
+			expired = true
+			break
+		}
+	}
+	if !expired {
+		return nil
+	}
+	return s.commit("expire_sessions", expireSessionsOp{Now: now, IdleTimeout: idleTimeout})
+}
+
+// Whether a session should be cleaned up
+func sessionExpired(record *SessionRecord, now time.Time, idleTimeout time.Duration) bool {
+	return !now.Before(record.ExpiresAt) || now.Sub(record.LastSeen) > idleTimeout
+}
+
+// Write a change to the journal and apply it, caller must hold the lock
+func (s *MemoryStore) commit(opType string, data interface{}) error {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	op := journalOp{Seq: s.seq + 1, Type: opType, Data: raw}
+	if s.journal != nil {
+		if err := s.journal.Append(op); err != nil {
+			return fmt.Errorf("could not write journal: %w", err)
+		}
+	}
+	return s.apply(op)
+}
+
+// Apply a change to the maps, caller must hold the lock. This is used both
+// for new changes and when replaying the journal, so it must not depend on
+// anything but the op and the current maps.
+func (s *MemoryStore) apply(op journalOp) error {
+	switch op.Type {
+	case "create_user":
+		var user User
+		if err := json.Unmarshal(op.Data, &user); err != nil {
+			return err
+		}
+		s.users[user.ID] = &user
+		if user.ID >= s.userIDSeq {
+			s.userIDSeq = user.ID + 1
+		}
+	case "update_password":
+		var user User
+		if err := json.Unmarshal(op.Data, &user); err != nil {
+			return err
+		}
+		if existingUser, exists := s.users[user.ID]; exists {
+			existingUser.Password = user.Password
+		}
+	case "create_link":
+		var link Link
+		if err := json.Unmarshal(op.Data, &link); err != nil {
+			return err
+		}
+		link.Tags = []string{}
+		// Links from before visibility existed are private
+		if link.Visibility == "" {
+			link.Visibility = VisibilityPrivate
+		}
+		s.links[link.ID] = &link
+		if link.ID >= s.linkIDSeq {
+			s.linkIDSeq = link.ID + 1
+		}
+		s.indexLink(link.ID)
+	case "update_link":
+		var link Link
+		if err := json.Unmarshal(op.Data, &link); err != nil {
+			return err
+		}
+		if existingLink, exists := s.links[link.ID]; exists {
+			existingLink.URL = link.URL
+			existingLink.Title = link.Title
+			existingLink.Description = link.Description
+			existingLink.Favicon = link.Favicon
+			existingLink.ReplacedByArchiveID = link.ReplacedByArchiveID
+			if link.Visibility != "" {
+				existingLink.Visibility = link.Visibility
+			}
+			s.indexLink(link.ID)
+		}
+	case "save_link_health":
+		var data linkHealthOp
+		if err := json.Unmarshal(op.Data, &data); err != nil {
+			return err
+		}
+		if link, exists := s.links[data.LinkID]; exists {
+			link.Health = data.Health
+		}
+	case "delete_link":
+		var data linkIDOp
+		if err := json.Unmarshal(op.Data, &data); err != nil {
+			return err
+		}
+		s.removeLink(data.LinkID)
+	case "add_tag", "set_tags":
+		var data linkTagsOp
+		if err := json.Unmarshal(op.Data, &data); err != nil {
+			return err
+		}
+		if op.Type == "set_tags" {
+			delete(s.linkTags, data.LinkID)
+		}
+		for _, tagName := range data.Tags {
+			s.addTagToLinkByName(data.LinkID, tagName)
+		}
+		s.indexTags(data.LinkID)
+	case "rename_tag":
+		var data tagRenameOp
+		if err := json.Unmarshal(op.Data, &data); err != nil {
+			return err
+		}
+		if tag, exists := s.tags[data.ID]; exists {
+			s.renameTags(tag.UserID, tag.WorkspaceID, tag.Name, data.Name)
+			s.indexLibraryTags(tag.UserID, tag.WorkspaceID)
+		}
+	case "delete_tag":
+		var data tagIDOp
+		if err := json.Unmarshal(op.Data, &data); err != nil {
+			return err
+		}
+		tag, exists := s.tags[data.ID]
+		if !exists {
+			break
+		}
+		s.retag(tag.ID, 0)
+		s.removeTag(tag.ID)
+		var below []string
+		for _, other := range s.tags {
+			if other.inLibrary(tag.UserID, tag.WorkspaceID) {
+				below = append(below, other.Name)
+			}
+		}
+		for _, child := range childTagNames(below, tag.Name) {
+			s.renameTags(tag.UserID, tag.WorkspaceID, child, movedUpTagName(child, tag.Name))
+		}
+		s.indexLibraryTags(tag.UserID, tag.WorkspaceID)
+	case "create_api_token":
+		var token APIToken
+		if err := json.Unmarshal(op.Data, &token); err != nil {
+			return err
+		}
+		s.apiTokens[token.ID] = &token
+		if token.ID >= s.tokenIDSeq {
+			s.tokenIDSeq = token.ID + 1
+		}
+	case "touch_api_token":
+		var data touchTokenOp
+		if err := json.Unmarshal(op.Data, &data); err != nil {
+			return err
+		}
+		if token, exists := s.apiTokens[data.ID]; exists {
+			usedAt := data.UsedAt
+			token.LastUsedAt = &usedAt
+		}
+	case "delete_api_token":
+		var data tokenIDOp
+		if err := json.Unmarshal(op.Data, &data); err != nil {
+			return err
+		}
+		delete(s.apiTokens, data.ID)
+	case "create_archived_page":
+		var page ArchivedPage
+		if err := json.Unmarshal(op.Data, &page); err != nil {
+			return err
+		}
+		s.archives[page.ID] = &page
+		if page.ID >= s.pageIDSeq {
+			s.pageIDSeq = page.ID + 1
+		}
+		// The newest copy is the one that's searched
+		if link, exists := s.links[page.LinkID]; exists {
+			s.search.setField(link.ID, linkLibrary(link), fieldArchive, page.Text)
+		}
+	case "delete_archived_page":
+		var data pageIDOp
+		if err := json.Unmarshal(op.Data, &data); err != nil {
+			return err
+		}
+		if page, exists := s.archives[data.ID]; exists {
+			delete(s.archives, data.ID)
+			s.indexArchive(page.LinkID)
+			if link, exists := s.links[page.LinkID]; exists && link.ReplacedByArchiveID == data.ID {
+				link.ReplacedByArchiveID = 0
+			}
+		}
+	case "save_share":
+		var share Share
+		if err := json.Unmarshal(op.Data, &share); err != nil {
+			return err
+		}
+		s.shares[share.ID] = &share
+		if share.ID >= s.shareIDSeq {
+			s.shareIDSeq = share.ID + 1
+		}
+	case "delete_share":
+		var data shareIDOp
+		if err := json.Unmarshal(op.Data, &data); err != nil {
+			return err
+		}
+		delete(s.shares, data.ID)
+	case "create_workspace":
+		var data createWorkspaceOp
+		if err := json.Unmarshal(op.Data, &data); err != nil {
+			return err
+		}
+		workspace, owner := data.Workspace, data.Owner
+		s.workspaces[workspace.ID] = &workspace
+		s.members[memberKey{owner.WorkspaceID, owner.UserID}] = &owner
+		if workspace.ID >= s.workspaceIDSeq {
+			s.workspaceIDSeq = workspace.ID + 1
+		}
+	case "rename_workspace":
+		var workspace Workspace
+		if err := json.Unmarshal(op.Data, &workspace); err != nil {
+			return err
+		}
+		if existing, exists := s.workspaces[workspace.ID]; exists {
+			existing.Name = workspace.Name
+		}
+	case "delete_workspace":
+		var data workspaceIDOp
+		if err := json.Unmarshal(op.Data, &data); err != nil {
+			return err
+		}
+		for id, link := range s.links {
+			if link.WorkspaceID == data.ID {
+				s.removeLink(id)
+			}
+		}
+		for id, collection := range s.collections {
+			if collection.WorkspaceID == data.ID {
+				delete(s.collections, id)
+				delete(s.collectionLinks, id)
+			}
+		}
+		for id, tag := range s.tags {
+			if tag.WorkspaceID == data.ID {
+				delete(s.tags, id)
+			}
+		}
+		for key := range s.members {
+			if key.WorkspaceID == data.ID {
+				delete(s.members, key)
+			}
+		}
+		for id, invite := range s.invites {
+			if invite.WorkspaceID == data.ID {
+				delete(s.invites, id)
+			}
+		}
+		delete(s.workspaces, data.ID)
+	case "save_workspace_member":
+		var member WorkspaceMember
+		if err := json.Unmarshal(op.Data, &member); err != nil {
+			return err
+		}
+		s.members[memberKey{member.WorkspaceID, member.UserID}] = &member
+	case "remove_workspace_member":
+		var member WorkspaceMember
+		if err := json.Unmarshal(op.Data, &member); err != nil {
+			return err
+		}
+		delete(s.members, memberKey{member.WorkspaceID, member.UserID})
+	case "save_workspace_invite":
+		var invite WorkspaceInvite
+		if err := json.Unmarshal(op.Data, &invite); err != nil {
+			return err
+		}
+		s.invites[invite.ID] = &invite
+		if invite.ID >= s.inviteIDSeq {
+			s.inviteIDSeq = invite.ID + 1
+		}
+	case "delete_workspace_invite":
+		var data inviteIDOp
+		if err := json.Unmarshal(op.Data, &data); err != nil {
+			return err
+		}
+		delete(s.invites, data.ID)
+	case "create_collection":
+		var collection Collection
+		if err := json.Unmarshal(op.Data, &collection); err != nil {
+			return err
+		}
+		s.collections[collection.ID] = &collection
+		if collection.ID >= s.collectionIDSeq {
+			s.collectionIDSeq = collection.ID + 1
+		}
+	case "update_collection":
+		var collection Collection
+		if err := json.Unmarshal(op.Data, &collection); err != nil {
+			return err
+		}
+		if existing, exists := s.collections[collection.ID]; exists {
+			existing.Name = collection.Name
+			existing.Description = collection.Description
+			existing.Cover = collection.Cover
+			existing.ParentID = collection.ParentID
+		}
+	case "delete_collection":
+		var data collectionIDOp
+		if err := json.Unmarshal(op.Data, &data); err != nil {
+			return err
+		}
+		deleted, exists := s.collections[data.ID]
+		if !exists {
+			break
+		}
+		for _, collection := range s.collections {
+			if collection.ParentID == data.ID {
+				collection.ParentID = deleted.ParentID
+			}
+		}
+		delete(s.collections, data.ID)
+		delete(s.collectionLinks, data.ID)
+	case "add_collection_link":
+		var data collectionLinkOp
+		if err := json.Unmarshal(op.Data, &data); err != nil {
+			return err
+		}
+		s.collectionLinks[data.CollectionID] = append(s.collectionLinks[data.CollectionID], data.LinkID)
+	case "remove_collection_link":
+		var data collectionLinkOp
+		if err := json.Unmarshal(op.Data, &data); err != nil {
+			return err
+		}
+		s.removeFromCollection(data.CollectionID, data.LinkID)
+	case "reorder_collection":
+		var data collectionOrderOp
+		if err := json.Unmarshal(op.Data, &data); err != nil {
+			return err
+		}
+		s.collectionLinks[data.CollectionID] = data.LinkIDs
+	case "create_auto_tag_rule":
+		var rule AutoTagRule
+		if err := json.Unmarshal(op.Data, &rule); err != nil {
+			return err
+		}
+		s.autoTagRules[rule.ID] = &rule
+		if rule.ID >= s.ruleIDSeq {
+			s.ruleIDSeq = rule.ID + 1
+		}
+	case "delete_auto_tag_rule":
+		var data ruleIDOp
+		if err := json.Unmarshal(op.Data, &data); err != nil {
+			return err
+		}
+		delete(s.autoTagRules, data.ID)
+	case "save_session":
+		var record SessionRecord
+		if err := json.Unmarshal(op.Data, &record); err != nil {
+			return err
+		}
+		s.sessions[record.ID] = &record
+	case "delete_session":
+		var data sessionIDOp
+		if err := json.Unmarshal(op.Data, &data); err != nil {
+			return err
+		}
+		delete(s.sessions, data.ID)
+	case "delete_user_sessions":
+		var data userSessionsOp
+		if err := json.Unmarshal(op.Data, &data); err != nil {
+			return err
+		}
+		for id, record := range s.sessions {
+			if record.UserID == data.UserID && id != data.KeepID {
+				delete(s.sessions, id)
+			}
+		}
+	case "expire_sessions":
+		var data expireSessionsOp
+		if err := json.Unmarshal(op.Data, &data); err != nil {
+			return err
+		}
+		for id, record := range s.sessions {
+			if sessionExpired(record, data.Now, data.IdleTimeout) {
+				delete(s.sessions, id)
+			}
+		}
+	default:
+		return fmt.Errorf("unknown journal op %q", op.Type)
+	}
+	s.seq = op.Seq
+	return nil
+}
+
+// Remove a link with its tags, archived copies, shares and places in
+// collections, caller must hold the lock
+func (s *MemoryStore) removeLink(linkID int) {
+	for collectionID := range s.collectionLinks {
+		s.removeFromCollection(collectionID, linkID)
+	}
+	delete(s.links, linkID)
+	delete(s.linkTags, linkID)
+	s.search.remove(linkID)
+	for id, page := range s.archives {
+		if page.LinkID == linkID {
+			delete(s.archives, id)
+		}
+	}
+	for id, share := range s.shares {
+		if share.LinkID == linkID {
+			delete(s.shares, id)
+		}
+	}
+}
+
+// Put a link's title, description, URL and tags in the search index,
+// caller must hold the lock
+func (s *MemoryStore) indexLink(linkID int) {
+	link, exists := s.links[linkID]
+	if !exists {
+		return
+	}
+	library := linkLibrary(link)
+	s.search.setField(linkID, library, fieldTitle, link.Title)
+	s.search.setField(linkID, library, fieldDescription, link.Description)
+	s.search.setField(linkID, library, fieldURL, link.URL)
+	s.indexTags(linkID)
+}
+
+// Update the tags of a link in the search index, caller must hold the lock
+func (s *MemoryStore) indexTags(linkID int) {
+	if link, exists := s.links[linkID]; exists {
+		s.search.setField(linkID, linkLibrary(link), fieldTags, strings.Join(s.tagNames(linkID), " "))
+	}
+}
+
+// Update the tags of every link of a library in the search index, after
+// tags were renamed or deleted. Caller must hold the lock.
+func (s *MemoryStore) indexLibraryTags(userID, workspaceID int) {
+	for _, linkID := range s.search.libraryDocs(libraryKey{UserID: userID, WorkspaceID: workspaceID}) {
+		s.indexTags(linkID)
+	}
+}
+
+// Put the text of a link's newest archived copy in the search index,
+// caller must hold the lock
+func (s *MemoryStore) indexArchive(linkID int) {
+	link, exists := s.links[linkID]
+	if !exists {
+		return
+	}
+	var newest *ArchivedPage
+	for _, page := range s.archives {
+		if page.LinkID == linkID && (newest == nil || page.ID > newest.ID) {
+			newest = page
+		}
+	}
+	text := ""
+	if newest != nil {
+		text = newest.Text
+	}
+	s.search.setField(linkID, linkLibrary(link), fieldArchive, text)
+}
+
+// Build the search index from scratch, caller must hold the lock
+func (s *MemoryStore) reindex() {
+	s.search = newSearchIndex()
+	newest := make(map[int]*ArchivedPage)
+	for _, page := range s.archives {
+		if newest[page.LinkID] == nil || page.ID > newest[page.LinkID].ID {
+			newest[page.LinkID] = page
+		}
+	}
+	for linkID, link := range s.links {
+		s.indexLink(linkID)
+		if page := newest[linkID]; page != nil {
+			s.search.setField(linkID, linkLibrary(link), fieldArchive, page.Text)
+		}
+	}
+}
+
+// Take a link out of a collection, caller must hold the lock
+func (s *MemoryStore) removeFromCollection(collectionID, linkID int) {
+	linkIDs := s.collectionLinks[collectionID]
+	if i := indexOf(linkIDs, linkID); i >= 0 {
+		s.collectionLinks[collectionID] = append(linkIDs[:i:i], linkIDs[i+1:]...)
+	}
+}
+
+// EnablePersistence loads whatever was saved in dir and journals every
+// change from now on. Returns true if there was saved data to load.
+func (s *MemoryStore) EnablePersistence(dir string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return false, err
+	}
+
+	var state memoryState
+	restored, err := readSnapshot(dir, &state)
+	if err != nil {
+		return false, err
+	}
+	if restored {
+		s.loadState(state)
+	}
+
+	journal, err := OpenJournal(dir)
+	if err != nil {
+		return false, err
+	}
+	replayed := 0
+	err = journal.Replay(func(op journalOp) error {
+		// Left over from a crash between writing a snapshot and resetting
+		// the journal, the snapshot already has these
+		if op.Seq <= s.seq {
+			return nil
+		}
+		replayed++
+		return s.apply(op)
+	})
+	if err != nil {
+		journal.Close()
+		return false, err
+	}
+
+	s.journal = journal
+	s.dataDir = dir
+	if replayed > 0 {
+		fmt.Printf("Replayed %d change(s) from the journal\n", replayed)
+	}
+	return restored || replayed > 0, nil
+}
+
+// Snapshot writes the whole store to disk and empties the journal
+func (s *MemoryStore) Snapshot() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.journal == nil || s.seq == s.snapshotSeq {
+		return nil
+	}
+	if err := writeSnapshot(s.dataDir, s.state()); err != nil {
+		return err
+	}
+	s.snapshotSeq = s.seq
+	return s.journal.Reset()
+}
+
+// StartSnapshots takes a snapshot every interval in the background
+func (s *MemoryStore) StartSnapshots(interval time.Duration) {
+	go func() {
+		for range time.Tick(interval) {
+			if err := s.Snapshot(); err != nil {
+				fmt.Println("Could not write snapshot:", err)
+			}
+		}
+	}()
+}
+
+// Copy the maps into a memoryState, caller must hold the lock
+func (s *MemoryStore) state() memoryState {
+	state := memoryState{
+		Seq:        s.seq,
+		UserIDSeq:  s.userIDSeq,
+		LinkIDSeq:  s.linkIDSeq,
+		TagIDSeq:   s.tagIDSeq,
+		LinkTags:   s.linkTags,
+		TokenIDSeq: s.tokenIDSeq,
+		PageIDSeq:  s.pageIDSeq,
+		ShareIDSeq: s.shareIDSeq,
+
+		WorkspaceIDSeq: s.workspaceIDSeq,
+		InviteIDSeq:    s.inviteIDSeq,
+
+		CollectionIDSeq: s.collectionIDSeq,
+		CollectionLinks: s.collectionLinks,
+
+		RuleIDSeq: s.ruleIDSeq,
+	}
+	for _, user := range s.users {
+		state.Users = append(state.Users, user)
+	}
+	for _, link := range s.links {
+		state.Links = append(state.Links, link)
+	}
+	for _, tag := range s.tags {
+		state.Tags = append(state.Tags, tag)
+	}
+	for _, token := range s.apiTokens {
+		state.APITokens = append(state.APITokens, token)
+	}
+	for _, page := range s.archives {
+		state.Archives = append(state.Archives, page)
+	}
+	for _, share := range s.shares {
+		state.Shares = append(state.Shares, share)
+	}
+	for _, workspace := range s.workspaces {
+		state.Workspaces = append(state.Workspaces, workspace)
+	}
+	for _, member := range s.members {
+		state.Members = append(state.Members, member)
+	}
+	for _, invite := range s.invites {
+		state.Invites = append(state.Invites, invite)
+	}
+	for _, collection := range s.collections {
+		state.Collections = append(state.Collections, collection)
+	}
+	for _, rule := range s.autoTagRules {
+		state.AutoTagRules = append(state.AutoTagRules, rule)
+	}
+	for _, record := range s.sessions {
+		state.Sessions = append(state.Sessions, record)
+	}
+	return state
+}
+
+// Snapshots from before tags belonged to a library have one set of tags
+// for everybody. Give every library its own copies of the tags its links
+// have, and the tags above them, like migration 12 does. Caller must hold
+// the lock.
+func (s *MemoryStore) scopeGlobalTags() {
+	global := false
+	for _, tag := range s.tags {
+		if tag.UserID == 0 && tag.WorkspaceID == 0 {
+			global = true
+			break
+		}
+	}
+	if !global {
+		return
+	}
+
+	linkIDs := make([]int, 0, len(s.linkTags))
+	names := make(map[int][]string, len(s.linkTags))
+	for linkID := range s.linkTags {
+		linkIDs = append(linkIDs, linkID)
+		names[linkID] = s.tagNames(linkID)
+	}
+	sort.Ints(linkIDs)
+	s.tags = make(map[int]*Tag)
+	s.linkTags = make(map[int][]int)
+	for _, linkID := range linkIDs {
+		for _, name := range names[linkID] {
+			s.addTagToLinkByName(linkID, name)
+		}
+	}
+}
+
+// Replace the maps with a loaded snapshot, caller must hold the lock
+func (s *MemoryStore) loadState(state memoryState) {
+	s.seq = state.Seq
+	s.snapshotSeq = state.Seq
+	s.userIDSeq = state.UserIDSeq
+	s.linkIDSeq = state.LinkIDSeq
+	s.tagIDSeq = state.TagIDSeq
+	for _, user := range state.Users {
+		s.users[user.ID] = user
+	}
+	for _, link := range state.Links {
+		link.Tags = []string{}
+		if link.Visibility == "" {
+			link.Visibility = VisibilityPrivate
+		}
+		s.links[link.ID] = link
+	}
+	for _, tag := range state.Tags {
+		s.tags[tag.ID] = tag
+	}
+	if state.LinkTags != nil {
+		s.linkTags = state.LinkTags
+	}
+	s.scopeGlobalTags()
+	// Snapshots from before API tokens existed don't have a sequence
+	if state.TokenIDSeq > 0 {
+		s.tokenIDSeq = state.TokenIDSeq
+	}
+	for _, token := range state.APITokens {
+		s.apiTokens[token.ID] = token
+	}
+	if state.PageIDSeq > 0 {
+		s.pageIDSeq = state.PageIDSeq
+	}
+	for _, page := range state.Archives {
+		s.archives[page.ID] = page
+	}
+	if state.ShareIDSeq > 0 {
+		s.shareIDSeq = state.ShareIDSeq
+	}
+	for _, share := range state.Shares {
+		s.shares[share.ID] = share
+	}
+	if state.WorkspaceIDSeq > 0 {
+		s.workspaceIDSeq = state.WorkspaceIDSeq
+	}
+	for _, workspace := range state.Workspaces {
+		s.workspaces[workspace.ID] = workspace
+	}
+	for _, member := range state.Members {
+		s.members[memberKey{member.WorkspaceID, member.UserID}] = member
+	}
+	if state.InviteIDSeq > 0 {
+		s.inviteIDSeq = state.InviteIDSeq
+	}
+	for _, invite := range state.Invites {
+		s.invites[invite.ID] = invite
+	}
+	if state.CollectionIDSeq > 0 {
+		s.collectionIDSeq = state.CollectionIDSeq
+	}
+	for _, collection := range state.Collections {
+		s.collections[collection.ID] = collection
+	}
+	if state.CollectionLinks != nil {
+		s.collectionLinks = state.CollectionLinks
+	}
+	if state.RuleIDSeq > 0 {
+		s.ruleIDSeq = state.RuleIDSeq
+	}
+	for _, rule := range state.AutoTagRules {
+		s.autoTagRules[rule.ID] = rule
+	}
+	for _, record := range state.Sessions {
+		s.sessions[record.ID] = record
+	}
+	s.reindex()
+}
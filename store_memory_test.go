@@ -0,0 +1,184 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestMemoryStore(t *testing.T) {
+	testStore(t, func(t *testing.T) Store { return NewMemoryStore() })
+}
+
+// What memory search does differently from the SQL store, the other side of
+// TestSQLStoreSearch
+func TestMemoryStoreSearch(t *testing.T) {
+	search := searchDifferencesStore(t, NewMemoryStore())
+
+	for query, want := range map[string][]string{
+		"programming": {"Programming in Go", "Searches and more"}, // the title counts for more
+		"ogramm":      {},                                         // only the start of a word
+		"gram go":     {},                                         // and only for the last word
+		"pr":          {},                                         // of three letters or more
+		"pro":         {"Programming in Go", "Searches and more"},
+		"searching":   {"Searches and more"}, // other endings
+		"kubernetes":  {"Searches and more"}, // the archived copy
+	} {
+		if got := search(query); !reflect.DeepEqual(got, want) {
+			t.Errorf("search %q = %v, want %v", query, got, want)
+		}
+	}
+}
+
+// A store with persistence in dir, like main opens it
+func openTestMemoryStore(t *testing.T, dir string) (*MemoryStore, bool) {
+	t.Helper()
+	store := NewMemoryStore()
+	restored, err := store.EnablePersistence(dir)
+	if err != nil {
+		t.Fatalf("EnablePersistence: %v", err)
+	}
+	t.Cleanup(func() { store.journal.Close() })
+	return store, restored
+}
+
+// Everything the first store has should come back in the second one, from
+// the journal alone and from a snapshot plus the journal
+func TestMemoryStoreReplay(t *testing.T) {
+	for _, snapshot := range []bool{false, true} {
+		name := "journal"
+		if snapshot {
+			name = "snapshot"
+		}
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			store, restored := openTestMemoryStore(t, dir)
+			if restored {
+				t.Fatal("a new directory shouldn't restore anything")
+			}
+
+			alice := createTestUser(t, store, "alice")
+			kept := createTestLink(t, store, Link{URL: "https://go.dev/", Title: "Go", UserID: alice.ID}, "lang/go")
+			gone := createTestLink(t, store, Link{URL: "https://example.com/", Title: "Example", UserID: alice.ID}, "misc")
+			if snapshot {
+				if err := store.Snapshot(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			kept.Title = "The Go Programming Language"
+			if err := store.UpdateLink(&kept); err != nil {
+				t.Fatal(err)
+			}
+			if err := store.DeleteLink(gone.ID); err != nil {
+				t.Fatal(err)
+			}
+			if err := store.RenameTag(mustTagID(t, store, alice.ID, "lang"), "code"); err != nil {
+				t.Fatal(err)
+			}
+
+			reopened, restored := openTestMemoryStore(t, dir)
+			if !restored {
+				t.Fatal("nothing was restored")
+			}
+			links, err := reopened.GetUserLinks(alice.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(links) != 1 || links[0].Title != "The Go Programming Language" ||
+				!reflect.DeepEqual(links[0].Tags, []string{"code/go"}) {
+				t.Errorf("links after replay = %+v", links)
+			}
+			if found, _ := reopened.SearchUserLinks(alice.ID, "programming"); len(found) != 1 {
+				t.Errorf("search after replay found %d links, want 1", len(found))
+			}
+
+			// New IDs carry on where the first store left off
+			next := createTestLink(t, reopened, Link{URL: "https://new.example/", Title: "New", UserID: alice.ID})
+			if next.ID <= gone.ID {
+				t.Errorf("new link got ID %d, the deleted one had %d", next.ID, gone.ID)
+			}
+		})
+	}
+}
+
+// Tag moves, merges, deletes and cleanups come back the same from the
+// journal and from a snapshot, search included
+func TestMemoryStoreTagReplay(t *testing.T) {
+	for _, snapshot := range []bool{false, true} {
+		dir := t.TempDir()
+		store, _ := openTestMemoryStore(t, dir)
+		testStoreTagChanges(t, store)
+		if snapshot {
+			if err := store.Snapshot(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		reopened, _ := openTestMemoryStore(t, dir)
+
+		users, err := store.ListUsers()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, user := range users {
+			if got, want := tagSummary(t, reopened, user.ID), tagSummary(t, store, user.ID); !reflect.DeepEqual(got, want) {
+				t.Errorf("snapshot %v: %s's tags after replay = %v, want %v", snapshot, user.Username, got, want)
+			}
+			if got, want := linkTagsSummary(t, reopened, user.ID), linkTagsSummary(t, store, user.ID); !reflect.DeepEqual(got, want) {
+				t.Errorf("snapshot %v: %s's links after replay = %v, want %v", snapshot, user.Username, got, want)
+			}
+			for _, query := range []string{"code", "generics", "lang", "rust", "other", "misc"} {
+				got, _ := reopened.SearchUserLinks(user.ID, query)
+				want, _ := store.SearchUserLinks(user.ID, query)
+				if !reflect.DeepEqual(linkTitles(got), linkTitles(want)) {
+					t.Errorf("snapshot %v: %s searching %q after replay = %v, want %v", snapshot, user.Username, query, linkTitles(got), linkTitles(want))
+				}
+			}
+		}
+	}
+}
+
+// A user's links as "title: tags"
+func linkTagsSummary(t *testing.T, store Store, userID int) []string {
+	t.Helper()
+	links, err := store.GetUserLinks(userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var summary []string
+	for _, link := range links {
+		sort.Strings(link.Tags)
+		summary = append(summary, link.Title+": "+strings.Join(link.Tags, ", "))
+	}
+	sort.Strings(summary)
+	return summary
+}
+
+func mustTagID(t *testing.T, store Store, userID int, name string) int {
+	t.Helper()
+	tags, err := store.GetUserTags(userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, tag := range tags {
+		if tag.Name == name {
+			return tag.ID
+		}
+		names = append(names, tag.Name)
+	}
+	sort.Strings(names)
+	t.Fatalf("no tag %q, only %v", name, names)
+	return 0
+}
+
+// Failed changes don't end up in the journal
+func TestMemoryStoreUnknownLinkNotJournaled(t *testing.T) {
+	store, _ := openTestMemoryStore(t, t.TempDir())
+	before := store.seq
+	store.SetLinkTags(42, []string{"x"})
+	store.AddTagToLinkByName(42, "x")
+	if store.seq != before {
+		t.Errorf("journal went from op %d to %d for a link that doesn't exist", before, store.seq)
+	}
+}
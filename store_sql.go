@@ -0,0 +1,1707 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	_ "github.com/go-sql-driver/mysql"
+	_ "modernc.org/sqlite"
+)
+
+// SQLStore keeps everything in a real database so nothing is lost on restart
+type SQLStore struct {
+	db     *sql.DB
+	driver string
+}
+
+// Open a database connection and make sure it actually works
+func openSQL(driver, dsn string) (*sql.DB, error) {
+	if driver != "mysql" && driver != "sqlite" {
+		return nil, fmt.Errorf("unsupported database driver %q", driver)
+	}
+
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("could not connect to database: %w", err)
+	}
+	if driver == "sqlite" {
+		// SQLite only allows one writer at a time, so don't even try
+		db.SetMaxOpenConns(1)
+	}
+	return db, nil
+}
+
+// NewSQLStore wraps a database that already has the latest schema,
+// see migrations.go
+func NewSQLStore(db *sql.DB, driver string) *SQLStore {
+	return &SQLStore{db: db, driver: driver}
+}
+
+// Close the database connection
+func (s *SQLStore) Close() error {
+	return s.db.Close()
+}
+
+// Escape a string so it can be used inside a LIKE pattern with ESCAPE '!'
+func likePattern(query string) string {
+	replacer := strings.NewReplacer("!", "!!", "%", "!%", "_", "!_")
+	return "%" + replacer.Replace(strings.ToLower(query)) + "%"
+}
+
+// Build "?, ?, ?" for an IN clause
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+}
+
+// Columns selected for a link, in the order scanLinks expects them
+const linkColumns = "l.id, l.url, l.title, l.description, l.favicon, l.user_id, l.created_at, " +
+	"l.status_code, l.final_url, l.checked_at, l.failure_streak, l.check_error, l.visibility, " +
+	"COALESCE(l.workspace_id, 0), l.replaced_by_archive_id"
+
+// Turn an ID that's 0 for "none" into NULL, for optional foreign keys
+func nullID(id int) interface{} {
+	if id == 0 {
+		return nil
+	}
+	return id
+}
+
+// Read links from a query and fill in their tags
+func (s *SQLStore) scanLinks(rows *sql.Rows) ([]Link, error) {
+	defer rows.Close()
+
+	var links []Link
+	for rows.Next() {
+		var link Link
+		var checkedAt sql.NullTime
+		if err := rows.Scan(&link.ID, &link.URL, &link.Title, &link.Description, &link.Favicon, &link.UserID, &link.CreatedAt,
+			&link.Health.StatusCode, &link.Health.FinalURL, &checkedAt, &link.Health.FailureStreak, &link.Health.Error,
+			&link.Visibility, &link.WorkspaceID, &link.ReplacedByArchiveID); err != nil {
+			return nil, err
+		}
+		if checkedAt.Valid {
+			link.Health.CheckedAt = &checkedAt.Time
+		}
+		links = append(links, link)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if err := s.attachTags(links); err != nil {
+		return nil, err
+	}
+	return links, nil
+}
+
+// Load the tag names for a bunch of links with a single query
+func (s *SQLStore) attachTags(links []Link) error {
+	if len(links) == 0 {
+		return nil
+	}
+
+	args := make([]interface{}, len(links))
+	byID := make(map[int]*Link, len(links))
+	for i := range links {
+		args[i] = links[i].ID
+		byID[links[i].ID] = &links[i]
+	}
+
+	rows, err := s.db.Query(`SELECT lt.link_id, t.name FROM link_tags lt
+		JOIN tags t ON t.id = lt.tag_id
+		WHERE lt.link_id IN (`+placeholders(len(links))+`)
+		ORDER BY lt.id`, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var linkID int
+		var name string
+		if err := rows.Scan(&linkID, &name); err != nil {
+			return err
+		}
+		if link, exists := byID[linkID]; exists {
+			link.Tags = append(link.Tags, name)
+		}
+	}
+	return rows.Err()
+}
+
+// Read a single user row
+func scanUser(row *sql.Row) (User, error) {
+	var user User
+	err := row.Scan(&user.ID, &user.Username, &user.Password, &user.Email)
+	if errors.Is(err, sql.ErrNoRows) {
+		return User{}, ErrUserNotFound
+	}
+	return user, err
+}
+
+// Get user by ID
+func (s *SQLStore) GetUserByID(id int) (User, error) {
+	return scanUser(s.db.QueryRow(
+		"SELECT id, username, password, email FROM users WHERE id = ?", id))
+}
+
+// Get user by username
+func (s *SQLStore) GetUserByUsername(username string) (User, error) {
+	return scanUser(s.db.QueryRow(
+		"SELECT id, username, password, email FROM users WHERE username = ?", username))
+}
+
+// List all users
+func (s *SQLStore) ListUsers() ([]User, error) {
+	rows, err := s.db.Query("SELECT id, username, password, email FROM users ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var users []User
+	for rows.Next() {
+		var user User
+		if err := rows.Scan(&user.ID, &user.Username, &user.Password, &user.Email); err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+	return users, rows.Err()
+}
+
+// Create a new user
+func (s *SQLStore) CreateUser(user *User) error {
+	if _, err := s.GetUserByUsername(user.Username); err == nil {
+		return ErrUsernameTaken
+	} else if !errors.Is(err, ErrUserNotFound) {
+		return err
+	}
+
+	res, err := s.db.Exec("INSERT INTO users (username, password, email) VALUES (?, ?, ?)",
+		user.Username, user.Password, user.Email)
+	if err != nil {
+		return err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	user.ID = int(id)
+	return nil
+}
+
+// Replace a user's password hash
+func (s *SQLStore) UpdateUserPassword(userID int, passwordHash string) error {
+	res, err := s.db.Exec("UPDATE users SET password = ? WHERE id = ?", passwordHash, userID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		if _, err := s.GetUserByID(userID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Get all personal links of a user
+func (s *SQLStore) GetUserLinks(userID int) ([]Link, error) {
+	rows, err := s.db.Query("SELECT "+linkColumns+" FROM links l WHERE l.user_id = ? AND l.workspace_id IS NULL ORDER BY l.created_at DESC, l.id DESC", userID)
+	if err != nil {
+		return nil, err
+	}
+	return s.scanLinks(rows)
+}
+
+// Get all links of a workspace
+func (s *SQLStore) GetWorkspaceLinks(workspaceID int) ([]Link, error) {
+	rows, err := s.db.Query("SELECT "+linkColumns+" FROM links l WHERE l.workspace_id = ? ORDER BY l.created_at DESC, l.id DESC", workspaceID)
+	if err != nil {
+		return nil, err
+	}
+	return s.scanLinks(rows)
+}
+
+// Get public links (for non-logged in users)
+func (s *SQLStore) GetPublicLinks(limit int) ([]Link, error) {
+	rows, err := s.db.Query("SELECT "+linkColumns+" FROM links l WHERE l.visibility = ? ORDER BY l.created_at DESC, l.id DESC LIMIT ?",
+		VisibilityPublic, limit)
+	if err != nil {
+		return nil, err
+	}
+	return s.scanLinks(rows)
+}
+
+// Get recent links for a user
+func (s *SQLStore) GetRecentLinks(userID int, limit int) ([]Link, error) {
+	rows, err := s.db.Query("SELECT "+linkColumns+" FROM links l WHERE l.user_id = ? AND l.workspace_id IS NULL ORDER BY l.created_at DESC, l.id DESC LIMIT ?", userID, limit)
+	if err != nil {
+		return nil, err
+	}
+	return s.scanLinks(rows)
+}
+
+// Get a link by ID
+func (s *SQLStore) GetLinkByID(id int) (Link, error) {
+	rows, err := s.db.Query("SELECT "+linkColumns+" FROM links l WHERE l.id = ?", id)
+	if err != nil {
+		return Link{}, err
+	}
+	links, err := s.scanLinks(rows)
+	if err != nil {
+		return Link{}, err
+	}
+	if len(links) == 0 {
+		return Link{}, ErrLinkNotFound
+	}
+	return links[0], nil
+}
+
+// Search for a user's personal links by query in the title, URL,
+// description or tags
+func (s *SQLStore) SearchUserLinks(userID int, query string) ([]Link, error) {
+	return s.searchLinks("l.user_id = ? AND l.workspace_id IS NULL", userID, query)
+}
+
+// Search for a workspace's links by query
+func (s *SQLStore) SearchWorkspaceLinks(workspaceID int, query string) ([]Link, error) {
+	return s.searchLinks("l.workspace_id = ?", workspaceID, query)
+}
+
+// Search the links matching where (with one placeholder for id) by query.
+// Every word of the query has to be somewhere in the title, URL,
+// description or tags, as any part of a word.
+func (s *SQLStore) searchLinks(where string, id int, query string) ([]Link, error) {
+	args := []interface{}{id}
+	for _, word := range strings.Fields(query) {
+		pattern := likePattern(word)
+		where += ` AND (
+			LOWER(l.title) LIKE ? ESCAPE '!' OR
+			LOWER(l.url) LIKE ? ESCAPE '!' OR
+			LOWER(l.description) LIKE ? ESCAPE '!' OR
+			EXISTS (SELECT 1 FROM link_tags lt JOIN tags t ON t.id = lt.tag_id
+				WHERE lt.link_id = l.id AND LOWER(t.name) LIKE ? ESCAPE '!')
+		)`
+		args = append(args, pattern, pattern, pattern, pattern)
+	}
+	rows, err := s.db.Query(`SELECT `+linkColumns+` FROM links l
+		WHERE `+where+`
+		ORDER BY l.created_at DESC, l.id DESC`, args...)
+	if err != nil {
+		return nil, err
+	}
+	return s.scanLinks(rows)
+}
+
+// Create a new link
+func (s *SQLStore) CreateLink(link *Link) error {
+	if link.CreatedAt.IsZero() {
+		link.CreatedAt = time.Now()
+	}
+	// DATETIME columns have no time zone, so always store UTC
+	link.CreatedAt = link.CreatedAt.UTC().Truncate(time.Second)
+	if link.Visibility == "" {
+		link.Visibility = VisibilityPrivate
+	}
+
+	res, err := s.db.Exec("INSERT INTO links (url, title, description, favicon, user_id, created_at, visibility, workspace_id) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		link.URL, link.Title, link.Description, link.Favicon, link.UserID, link.CreatedAt, link.Visibility, nullID(link.WorkspaceID))
+	if err != nil {
+		return err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	link.ID = int(id)
+	link.Tags = []string{}
+	return nil
+}
+
+// Update an existing link
+func (s *SQLStore) UpdateLink(link *Link) error {
+	if link.Visibility == "" {
+		link.Visibility = VisibilityPrivate
+	}
+	res, err := s.db.Exec("UPDATE links SET url = ?, title = ?, description = ?, favicon = ?, visibility = ?, replaced_by_archive_id = ? WHERE id = ?",
+		link.URL, link.Title, link.Description, link.Favicon, link.Visibility, link.ReplacedByArchiveID, link.ID)
+	if err != nil {
+		return err
+	}
+	return s.checkAffected(res, link.ID)
+}
+
+// Get links that haven't been checked since before, least recently
+// checked first. Both databases sort NULLs (never checked) first.
+func (s *SQLStore) GetLinksToCheck(before time.Time, limit int) ([]Link, error) {
+	rows, err := s.db.Query("SELECT "+linkColumns+` FROM links l
+		WHERE l.checked_at IS NULL OR l.checked_at < ?
+		ORDER BY l.checked_at, l.id LIMIT ?`, before.UTC().Truncate(time.Second), limit)
+	if err != nil {
+		return nil, err
+	}
+	return s.scanLinks(rows)
+}
+
+// Record what checking a link found. Nothing changes when the URL was
+// edited while it was being checked.
+func (s *SQLStore) SaveLinkHealth(linkID int, checkedURL string, health LinkHealth) error {
+	res, err := s.db.Exec(`UPDATE links SET status_code = ?, final_url = ?, checked_at = ?, failure_streak = ?, check_error = ?
+		WHERE id = ? AND url = ?`,
+		health.StatusCode, health.FinalURL, nullTime(health.CheckedAt), health.FailureStreak, health.Error, linkID, checkedURL)
+	if err != nil {
+		return err
+	}
+	return s.checkAffected(res, linkID)
+}
+
+// Delete a link and its tags
+func (s *SQLStore) DeleteLink(id int) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM link_tags WHERE link_id = ?", id); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM archived_pages WHERE link_id = ?", id); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM shares WHERE link_id = ?", id); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM collection_links WHERE link_id = ?", id); err != nil {
+		return err
+	}
+	res, err := tx.Exec("DELETE FROM links WHERE id = ?", id)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrLinkNotFound
+	}
+	return tx.Commit()
+}
+
+// MySQL reports 0 affected rows when nothing changed, so only treat
+// it as missing when the link really isn't there
+func (s *SQLStore) checkAffected(res sql.Result, linkID int) error {
+	n, err := res.RowsAffected()
+	if err != nil || n > 0 {
+		return err
+	}
+	var exists int
+	err = s.db.QueryRow("SELECT COUNT(*) FROM links WHERE id = ?", linkID).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if exists == 0 {
+		return ErrLinkNotFound
+	}
+	return nil
+}
+
+// Get all tags for a link
+func (s *SQLStore) GetLinkTags(linkID int) ([]string, error) {
+	return linkTagNames(s.db, linkID)
+}
+
+// The tags of a link in the order they were added, q is the db or a tx
+func linkTagNames(q interface {
+	Query(string, ...interface{}) (*sql.Rows, error)
+}, linkID int) ([]string, error) {
+	rows, err := q.Query(`SELECT t.name FROM link_tags lt
+		JOIN tags t ON t.id = lt.tag_id
+		WHERE lt.link_id = ? ORDER BY lt.id`, linkID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tagNames []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		tagNames = append(tagNames, name)
+	}
+	return tagNames, rows.Err()
+}
+
+// Columns selected for a tag, in the order scanTag expects them
+const tagColumns = "t.id, t.name, COALESCE(t.parent_id, 0), COALESCE(t.user_id, 0), COALESCE(t.workspace_id, 0), " +
+	"(SELECT COUNT(*) FROM link_tags lt WHERE lt.tag_id = t.id)"
+
+// Read a tag from anything with a Scan method
+func scanTag(row interface{ Scan(...interface{}) error }) (Tag, error) {
+	var tag Tag
+	err := row.Scan(&tag.ID, &tag.Name, &tag.ParentID, &tag.UserID, &tag.WorkspaceID, &tag.LinkCount)
+	return tag, err
+}
+
+// Which tags (as t) belong to a library, and the ID for its placeholder.
+// See Tag.inLibrary.
+func tagLibraryWhere(userID, workspaceID int) (string, int) {
+	if workspaceID != 0 {
+		return "t.workspace_id = ?", workspaceID
+	}
+	return "t.user_id = ? AND t.workspace_id IS NULL", userID
+}
+
+// Get a user's personal tags
+func (s *SQLStore) GetUserTags(userID int) ([]Tag, error) {
+	where, id := tagLibraryWhere(userID, 0)
+	return queryTags(s.db, where, id)
+}
+
+// Get a workspace's tags
+func (s *SQLStore) GetWorkspaceTags(workspaceID int) ([]Tag, error) {
+	where, id := tagLibraryWhere(0, workspaceID)
+	return queryTags(s.db, where, id)
+}
+
+// Tags matching where (with one placeholder for id), sorted by name. q is
+// the db or a tx.
+func queryTags(q interface {
+	Query(string, ...interface{}) (*sql.Rows, error)
+}, where string, id int) ([]Tag, error) {
+	rows, err := q.Query("SELECT "+tagColumns+" FROM tags t WHERE "+where, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tags []Tag
+	for rows.Next() {
+		tag, err := scanTag(rows)
+		if err != nil {
+			return nil, err
+		}
+		tags = append(tags, tag)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	// Sorted here so both databases (and the memory store) agree on the
+	// order
+	sort.Slice(tags, func(i, j int) bool {
+		return tags[i].Name < tags[j].Name
+	})
+	return tags, nil
+}
+
+// Get a tag by ID
+func (s *SQLStore) GetTag(id int) (Tag, error) {
+	return getTag(s.db, id)
+}
+
+// Same as GetTag, q is the db or a tx
+func getTag(q interface {
+	QueryRow(string, ...interface{}) *sql.Row
+}, id int) (Tag, error) {
+	tag, err := scanTag(q.QueryRow("SELECT "+tagColumns+" FROM tags t WHERE t.id = ?", id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Tag{}, ErrTagNotFound
+	}
+	return tag, err
+}
+
+// Add a tag to a link (by name)
+func (s *SQLStore) AddTagToLinkByName(linkID int, tagName string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	userID, workspaceID, err := linkLibraryInTx(tx, linkID)
+	if err != nil {
+		return err
+	}
+	if err := addTagInTx(tx, linkID, userID, workspaceID, tagName); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Replace all tags of a link
+func (s *SQLStore) SetLinkTags(linkID int, tagNames []string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	userID, workspaceID, err := linkLibraryInTx(tx, linkID)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM link_tags WHERE link_id = ?", linkID); err != nil {
+		return err
+	}
+	for _, tagName := range tagNames {
+		if err := addTagInTx(tx, linkID, userID, workspaceID, tagName); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Rename a tag and the tags below it
+func (s *SQLStore) RenameTag(id int, name string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	tag, err := getTag(tx, id)
+	if err != nil {
+		return err
+	}
+	if err := renameTagsInTx(tx, tag.UserID, tag.WorkspaceID, tag.Name, name); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Delete a tag, the tags below it move up a level
+func (s *SQLStore) DeleteTag(id int) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	tag, err := getTag(tx, id)
+	if err != nil {
+		return err
+	}
+	if err := deleteTagInTx(tx, tag.ID); err != nil {
+		return err
+	}
+
+	where, libraryID := tagLibraryWhere(tag.UserID, tag.WorkspaceID)
+	library, err := queryTags(tx, where, libraryID)
+	if err != nil {
+		return err
+	}
+	var names []string
+	for _, other := range library {
+		names = append(names, other.Name)
+	}
+	for _, child := range childTagNames(names, tag.Name) {
+		if err := renameTagsInTx(tx, tag.UserID, tag.WorkspaceID, child, movedUpTagName(child, tag.Name)); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Rename the tags of a library that are from or below it, see RenameTag
+func renameTagsInTx(tx *sql.Tx, userID, workspaceID int, from, to string) error {
+	where, libraryID := tagLibraryWhere(userID, workspaceID)
+	library, err := queryTags(tx, where, libraryID)
+	if err != nil {
+		return err
+	}
+	var moving []Tag
+	for _, tag := range library {
+		if tagUnder(tag.Name, from) {
+			moving = append(moving, tag)
+		}
+	}
+	// Tags above first, so the tags below find their new parents
+	sort.Slice(moving, func(i, j int) bool {
+		return tagsAboveFirst(moving[i].Name, moving[j].Name)
+	})
+
+	for _, tag := range moving {
+		name := movedTagName(tag.Name, from, to)
+		var existing int
+		err := tx.QueryRow("SELECT t.id FROM tags t WHERE "+where+" AND t.name = ?", libraryID, name).Scan(&existing)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+		if existing != 0 && existing != tag.ID {
+			if err := mergeTagInTx(tx, tag.ID, existing); err != nil {
+				return err
+			}
+			continue
+		}
+
+		var parentID int64
+		if parent := parentTagName(name); parent != "" {
+			if parentID, err = tagIDInTx(tx, userID, workspaceID, parent); err != nil {
+				return err
+			}
+		}
+		if _, err := tx.Exec("UPDATE tags SET name = ?, parent_id = ? WHERE id = ?", name, nullID(int(parentID)), tag.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Move a tag's links over to another tag and delete it. Links that have
+// both keep the one they had.
+func mergeTagInTx(tx *sql.Tx, tagID, intoID int) error {
+	rows, err := tx.Query(`SELECT link_id FROM link_tags
+		WHERE tag_id = ? AND link_id IN (SELECT link_id FROM link_tags WHERE tag_id = ?)`, tagID, intoID)
+	if err != nil {
+		return err
+	}
+	var both []interface{}
+	for rows.Next() {
+		var linkID int
+		if err := rows.Scan(&linkID); err != nil {
+			rows.Close()
+			return err
+		}
+		both = append(both, linkID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	if len(both) > 0 {
+		args := append([]interface{}{tagID}, both...)
+		if _, err := tx.Exec("DELETE FROM link_tags WHERE tag_id = ? AND link_id IN ("+placeholders(len(both))+")", args...); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec("UPDATE link_tags SET tag_id = ? WHERE tag_id = ?", intoID, tagID); err != nil {
+		return err
+	}
+	return deleteTagInTx(tx, tagID)
+}
+
+// Take a tag off its links and delete it
+func deleteTagInTx(tx *sql.Tx, tagID int) error {
+	for _, statement := range []string{
+		"DELETE FROM link_tags WHERE tag_id = ?",
+		"UPDATE tags SET parent_id = NULL WHERE parent_id = ?",
+		"DELETE FROM tags WHERE id = ?",
+	} {
+		if _, err := tx.Exec(statement, tagID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The library a link's tags come from: its workspace, or the personal tags
+// of the user who saved it
+func linkLibraryInTx(tx *sql.Tx, linkID int) (userID, workspaceID int, err error) {
+	err = tx.QueryRow("SELECT user_id, COALESCE(workspace_id, 0) FROM links WHERE id = ?", linkID).
+		Scan(&userID, &workspaceID)
+	if errors.Is(err, sql.ErrNoRows) {
+		err = ErrLinkNotFound
+	}
+	return userID, workspaceID, err
+}
+
+// Find a tag of a library, or create it and the tags above it, and return
+// its ID
+func tagIDInTx(tx *sql.Tx, userID, workspaceID int, tagName string) (int64, error) {
+	where, libraryID := tagLibraryWhere(userID, workspaceID)
+	var tagID, parentID int64
+	err := tx.QueryRow("SELECT t.id, COALESCE(t.parent_id, 0) FROM tags t WHERE "+where+" AND t.name = ?", libraryID, tagName).
+		Scan(&tagID, &parentID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return 0, err
+	}
+	if parent := parentTagName(tagName); parent != "" && parentID == 0 {
+		if parentID, err = tagIDInTx(tx, userID, workspaceID, parent); err != nil {
+			return 0, err
+		}
+		// Tags from before tags had parents get theirs the next time
+		// they're used
+		if tagID != 0 {
+			if _, err := tx.Exec("UPDATE tags SET parent_id = ? WHERE id = ?", parentID, tagID); err != nil {
+				return 0, err
+			}
+		}
+	}
+	if tagID != 0 {
+		return tagID, nil
+	}
+
+	if workspaceID != 0 {
+		userID = 0
+	}
+	res, err := tx.Exec("INSERT INTO tags (name, parent_id, user_id, workspace_id) VALUES (?, ?, ?, ?)",
+		tagName, nullID(int(parentID)), nullID(userID), nullID(workspaceID))
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+// Find or create the tag in the link's library and attach it to the link
+// if it isn't already
+func addTagInTx(tx *sql.Tx, linkID, userID, workspaceID int, tagName string) error {
+	tagID, err := tagIDInTx(tx, userID, workspaceID, tagName)
+	if err != nil {
+		return err
+	}
+
+	var count int
+	err = tx.QueryRow("SELECT COUNT(*) FROM link_tags WHERE link_id = ? AND tag_id = ?", linkID, tagID).Scan(&count)
+	if err != nil || count > 0 {
+		return err
+	}
+	_, err = tx.Exec("INSERT INTO link_tags (link_id, tag_id) VALUES (?, ?)", linkID, tagID)
+	return err
+}
+
+// Columns selected for an API token, in the order scanAPIToken expects them
+const apiTokenColumns = "id, user_id, name, prefix, hash, scope, created_at, expires_at, last_used_at"
+
+// Read an API token from anything with a Scan method
+func scanAPIToken(row interface{ Scan(...interface{}) error }) (APIToken, error) {
+	var token APIToken
+	var expiresAt, lastUsedAt sql.NullTime
+	err := row.Scan(&token.ID, &token.UserID, &token.Name, &token.Prefix, &token.Hash,
+		&token.Scope, &token.CreatedAt, &expiresAt, &lastUsedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return APIToken{}, ErrTokenNotFound
+	}
+	if expiresAt.Valid {
+		token.ExpiresAt = &expiresAt.Time
+	}
+	if lastUsedAt.Valid {
+		token.LastUsedAt = &lastUsedAt.Time
+	}
+	return token, err
+}
+
+// Turn an optional time into something the driver understands
+func nullTime(t *time.Time) interface{} {
+	if t == nil {
+		return nil
+	}
+	return t.UTC().Truncate(time.Second)
+}
+
+// Create a new API token
+func (s *SQLStore) CreateAPIToken(token *APIToken) error {
+	res, err := s.db.Exec(`INSERT INTO api_tokens (user_id, name, prefix, hash, scope, created_at, expires_at, last_used_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		token.UserID, token.Name, token.Prefix, token.Hash, token.Scope,
+		token.CreatedAt.UTC().Truncate(time.Second), nullTime(token.ExpiresAt), nullTime(token.LastUsedAt))
+	if err != nil {
+		return err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	token.ID = int(id)
+	return nil
+}
+
+// Get an API token by ID
+func (s *SQLStore) GetAPITokenByID(id int) (APIToken, error) {
+	return scanAPIToken(s.db.QueryRow("SELECT "+apiTokenColumns+" FROM api_tokens WHERE id = ?", id))
+}
+
+// Get an API token by the hash of its secret
+func (s *SQLStore) GetAPITokenByHash(hash string) (APIToken, error) {
+	return scanAPIToken(s.db.QueryRow("SELECT "+apiTokenColumns+" FROM api_tokens WHERE hash = ?", hash))
+}
+
+// Get all API tokens of a user, newest first
+func (s *SQLStore) GetUserAPITokens(userID int) ([]APIToken, error) {
+	rows, err := s.db.Query("SELECT "+apiTokenColumns+" FROM api_tokens WHERE user_id = ? ORDER BY id DESC", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tokens []APIToken
+	for rows.Next() {
+		token, err := scanAPIToken(rows)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, token)
+	}
+	return tokens, rows.Err()
+}
+
+// Record when an API token was last used
+func (s *SQLStore) TouchAPIToken(id int, usedAt time.Time) error {
+	_, err := s.db.Exec("UPDATE api_tokens SET last_used_at = ? WHERE id = ?", nullTime(&usedAt), id)
+	return err
+}
+
+// Delete an API token
+func (s *SQLStore) DeleteAPIToken(id int) error {
+	res, err := s.db.Exec("DELETE FROM api_tokens WHERE id = ?", id)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrTokenNotFound
+	}
+	return nil
+}
+
+// Columns selected for an archived page without its contents, in the
+// order scanArchivedPage expects them
+const archivedPageColumns = "id, link_id, url, title, size, created_at"
+
+// Read an archived page from anything with a Scan method, contents go into
+// extra
+func scanArchivedPage(row interface{ Scan(...interface{}) error }, extra ...interface{}) (ArchivedPage, error) {
+	var page ArchivedPage
+	dest := append([]interface{}{&page.ID, &page.LinkID, &page.URL, &page.Title, &page.Size, &page.CreatedAt}, extra...)
+	err := row.Scan(dest...)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ArchivedPage{}, ErrPageNotFound
+	}
+	return page, err
+}
+
+// Save an archived copy of a link's page
+func (s *SQLStore) CreateArchivedPage(page *ArchivedPage) error {
+	res, err := s.db.Exec(`INSERT INTO archived_pages (link_id, url, title, readable, text_content, full_page, size, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		page.LinkID, page.URL, page.Title, page.Readable, page.Text, page.FullPage, page.Size,
+		page.CreatedAt.UTC().Truncate(time.Second))
+	if err != nil {
+		return err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	page.ID = int(id)
+	return nil
+}
+
+// Get an archived page with its contents
+func (s *SQLStore) GetArchivedPage(id int) (ArchivedPage, error) {
+	var readable, text, fullPage string
+	page, err := scanArchivedPage(s.db.QueryRow("SELECT "+archivedPageColumns+", readable, text_content, full_page FROM archived_pages WHERE id = ?", id),
+		&readable, &text, &fullPage)
+	page.Readable, page.Text, page.FullPage = readable, text, fullPage
+	return page, err
+}
+
+// Get the archived copies of a link without their contents, newest first
+func (s *SQLStore) GetLinkArchivedPages(linkID int) ([]ArchivedPage, error) {
+	rows, err := s.db.Query("SELECT "+archivedPageColumns+" FROM archived_pages WHERE link_id = ? ORDER BY id DESC", linkID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var pages []ArchivedPage
+	for rows.Next() {
+		page, err := scanArchivedPage(rows)
+		if err != nil {
+			return nil, err
+		}
+		pages = append(pages, page)
+	}
+	return pages, rows.Err()
+}
+
+// Delete an archived page
+func (s *SQLStore) DeleteArchivedPage(id int) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec("DELETE FROM archived_pages WHERE id = ?", id)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrPageNotFound
+	}
+	// A link shown through this copy goes back to its own URL
+	if _, err := tx.Exec("UPDATE links SET replaced_by_archive_id = 0 WHERE replaced_by_archive_id = ?", id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Columns selected for a share, in the order scanShare expects them
+const shareColumns = "id, owner_id, user_id, link_id, tag, permission, created_at"
+
+// Read a share from anything with a Scan method
+func scanShare(row interface{ Scan(...interface{}) error }) (Share, error) {
+	var share Share
+	var linkID sql.NullInt64
+	err := row.Scan(&share.ID, &share.OwnerID, &share.UserID, &linkID, &share.Tag, &share.Permission, &share.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Share{}, ErrShareNotFound
+	}
+	share.LinkID = int(linkID.Int64)
+	return share, err
+}
+
+// Share a link or tag, or change the permission of an existing share
+func (s *SQLStore) SaveShare(share *Share) error {
+	existing, err := scanShare(s.db.QueryRow("SELECT "+shareColumns+` FROM shares
+		WHERE owner_id = ? AND user_id = ? AND COALESCE(link_id, 0) = ? AND tag = ?`,
+		share.OwnerID, share.UserID, share.LinkID, share.Tag))
+	switch {
+	case err == nil:
+		share.ID, share.CreatedAt = existing.ID, existing.CreatedAt
+		_, err := s.db.Exec("UPDATE shares SET permission = ? WHERE id = ?", share.Permission, share.ID)
+		return err
+	case !errors.Is(err, ErrShareNotFound):
+		return err
+	}
+
+	share.CreatedAt = share.CreatedAt.UTC().Truncate(time.Second)
+	res, err := s.db.Exec(`INSERT INTO shares (owner_id, user_id, link_id, tag, permission, created_at)
+		VALUES (?, ?, ?, ?, ?, ?)`,
+		share.OwnerID, share.UserID, nullID(share.LinkID), share.Tag, share.Permission, share.CreatedAt)
+	if err != nil {
+		return err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	share.ID = int(id)
+	return nil
+}
+
+// Get a share by ID
+func (s *SQLStore) GetShare(id int) (Share, error) {
+	return scanShare(s.db.QueryRow("SELECT "+shareColumns+" FROM shares WHERE id = ?", id))
+}
+
+// Get what a user shared with others, newest first
+func (s *SQLStore) GetSharesByOwner(ownerID int) ([]Share, error) {
+	return s.queryShares("SELECT "+shareColumns+" FROM shares WHERE owner_id = ? ORDER BY id DESC", ownerID)
+}
+
+// Get what others shared with a user, newest first
+func (s *SQLStore) GetSharesWithUser(userID int) ([]Share, error) {
+	return s.queryShares("SELECT "+shareColumns+" FROM shares WHERE user_id = ? ORDER BY id DESC", userID)
+}
+
+func (s *SQLStore) queryShares(query string, args ...interface{}) ([]Share, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var shares []Share
+	for rows.Next() {
+		share, err := scanShare(rows)
+		if err != nil {
+			return nil, err
+		}
+		shares = append(shares, share)
+	}
+	return shares, rows.Err()
+}
+
+// Stop sharing
+func (s *SQLStore) DeleteShare(id int) error {
+	res, err := s.db.Exec("DELETE FROM shares WHERE id = ?", id)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrShareNotFound
+	}
+	return nil
+}
+
+// Columns selected for a workspace, and for members and invitations
+const (
+	workspaceColumns       = "id, name, created_at"
+	workspaceMemberColumns = "workspace_id, user_id, role, created_at"
+	workspaceInviteColumns = "id, workspace_id, user_id, invited_by, role, created_at"
+)
+
+// Create a workspace with its first owner
+func (s *SQLStore) CreateWorkspace(workspace *Workspace, ownerID int) error {
+	if workspace.CreatedAt.IsZero() {
+		workspace.CreatedAt = time.Now()
+	}
+	workspace.CreatedAt = workspace.CreatedAt.UTC().Truncate(time.Second)
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec("INSERT INTO workspaces (name, created_at) VALUES (?, ?)", workspace.Name, workspace.CreatedAt)
+	if err != nil {
+		return err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("INSERT INTO workspace_members ("+workspaceMemberColumns+") VALUES (?, ?, ?, ?)",
+		id, ownerID, RoleOwner, workspace.CreatedAt); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	workspace.ID = int(id)
+	return nil
+}
+
+// Get a workspace by ID
+func (s *SQLStore) GetWorkspace(id int) (Workspace, error) {
+	var workspace Workspace
+	err := s.db.QueryRow("SELECT "+workspaceColumns+" FROM workspaces WHERE id = ?", id).
+		Scan(&workspace.ID, &workspace.Name, &workspace.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Workspace{}, ErrWorkspaceNotFound
+	}
+	return workspace, err
+}
+
+// Give a workspace a new name
+func (s *SQLStore) RenameWorkspace(id int, name string) error {
+	if _, err := s.GetWorkspace(id); err != nil {
+		return err
+	}
+	_, err := s.db.Exec("UPDATE workspaces SET name = ? WHERE id = ?", name, id)
+	return err
+}
+
+// Delete a workspace with its links, members and invitations
+func (s *SQLStore) DeleteWorkspace(id int) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Collections point at their parents, unhook them before deleting
+	links := "SELECT id FROM links WHERE workspace_id = ?"
+	collections := "SELECT id FROM collections WHERE workspace_id = ?"
+	for _, statement := range []string{
+		"DELETE FROM collection_links WHERE collection_id IN (" + collections + ")",
+		"UPDATE collections SET parent_id = NULL WHERE workspace_id = ?",
+		"DELETE FROM collections WHERE workspace_id = ?",
+		"DELETE FROM link_tags WHERE link_id IN (" + links + ")",
+		"UPDATE tags SET parent_id = NULL WHERE workspace_id = ?",
+		"DELETE FROM tags WHERE workspace_id = ?",
+		"DELETE FROM archived_pages WHERE link_id IN (" + links + ")",
+		"DELETE FROM shares WHERE link_id IN (" + links + ")",
+		"DELETE FROM collection_links WHERE link_id IN (" + links + ")",
+		"DELETE FROM links WHERE workspace_id = ?",
+		"DELETE FROM workspace_invites WHERE workspace_id = ?",
+		"DELETE FROM workspace_members WHERE workspace_id = ?",
+	} {
+		if _, err := tx.Exec(statement, id); err != nil {
+			return err
+		}
+	}
+	res, err := tx.Exec("DELETE FROM workspaces WHERE id = ?", id)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrWorkspaceNotFound
+	}
+	return tx.Commit()
+}
+
+// Read a member from anything with a Scan method
+func scanWorkspaceMember(row interface{ Scan(...interface{}) error }) (WorkspaceMember, error) {
+	var member WorkspaceMember
+	err := row.Scan(&member.WorkspaceID, &member.UserID, &member.Role, &member.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return WorkspaceMember{}, ErrNotMember
+	}
+	return member, err
+}
+
+// Get a user's membership of a workspace
+func (s *SQLStore) GetWorkspaceMember(workspaceID, userID int) (WorkspaceMember, error) {
+	return scanWorkspaceMember(s.db.QueryRow("SELECT "+workspaceMemberColumns+
+		" FROM workspace_members WHERE workspace_id = ? AND user_id = ?", workspaceID, userID))
+}
+
+// Get the members of a workspace, oldest first
+func (s *SQLStore) GetWorkspaceMembers(workspaceID int) ([]WorkspaceMember, error) {
+	return s.queryWorkspaceMembers("SELECT "+workspaceMemberColumns+
+		" FROM workspace_members WHERE workspace_id = ? ORDER BY created_at, user_id", workspaceID)
+}
+
+// Get the workspaces a user is in, oldest first
+func (s *SQLStore) GetUserMemberships(userID int) ([]WorkspaceMember, error) {
+	return s.queryWorkspaceMembers("SELECT "+workspaceMemberColumns+
+		" FROM workspace_members WHERE user_id = ? ORDER BY created_at, workspace_id", userID)
+}
+
+func (s *SQLStore) queryWorkspaceMembers(query string, args ...interface{}) ([]WorkspaceMember, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var members []WorkspaceMember
+	for rows.Next() {
+		member, err := scanWorkspaceMember(rows)
+		if err != nil {
+			return nil, err
+		}
+		members = append(members, member)
+	}
+	return members, rows.Err()
+}
+
+// Add a member to a workspace, or change their role
+func (s *SQLStore) SaveWorkspaceMember(member *WorkspaceMember) error {
+	existing, err := s.GetWorkspaceMember(member.WorkspaceID, member.UserID)
+	switch {
+	case err == nil:
+		member.CreatedAt = existing.CreatedAt
+		_, err := s.db.Exec("UPDATE workspace_members SET role = ? WHERE workspace_id = ? AND user_id = ?",
+			member.Role, member.WorkspaceID, member.UserID)
+		return err
+	case !errors.Is(err, ErrNotMember):
+		return err
+	}
+	if _, err := s.GetWorkspace(member.WorkspaceID); err != nil {
+		return err
+	}
+
+	if member.CreatedAt.IsZero() {
+		member.CreatedAt = time.Now()
+	}
+	member.CreatedAt = member.CreatedAt.UTC().Truncate(time.Second)
+	_, err = s.db.Exec("INSERT INTO workspace_members ("+workspaceMemberColumns+") VALUES (?, ?, ?, ?)",
+		member.WorkspaceID, member.UserID, member.Role, member.CreatedAt)
+	return err
+}
+
+// Remove a member from a workspace
+func (s *SQLStore) RemoveWorkspaceMember(workspaceID, userID int) error {
+	res, err := s.db.Exec("DELETE FROM workspace_members WHERE workspace_id = ? AND user_id = ?", workspaceID, userID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrNotMember
+	}
+	return nil
+}
+
+// Read an invitation from anything with a Scan method
+func scanWorkspaceInvite(row interface{ Scan(...interface{}) error }) (WorkspaceInvite, error) {
+	var invite WorkspaceInvite
+	err := row.Scan(&invite.ID, &invite.WorkspaceID, &invite.UserID, &invite.InvitedBy, &invite.Role, &invite.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return WorkspaceInvite{}, ErrInviteNotFound
+	}
+	return invite, err
+}
+
+// Invite a user to a workspace, or change the role they're invited as
+func (s *SQLStore) SaveWorkspaceInvite(invite *WorkspaceInvite) error {
+	if _, err := s.GetWorkspace(invite.WorkspaceID); err != nil {
+		return err
+	}
+	invite.CreatedAt = invite.CreatedAt.UTC().Truncate(time.Second)
+
+	existing, err := scanWorkspaceInvite(s.db.QueryRow("SELECT "+workspaceInviteColumns+
+		" FROM workspace_invites WHERE workspace_id = ? AND user_id = ?", invite.WorkspaceID, invite.UserID))
+	switch {
+	case err == nil:
+		invite.ID = existing.ID
+		_, err := s.db.Exec("UPDATE workspace_invites SET invited_by = ?, role = ?, created_at = ? WHERE id = ?",
+			invite.InvitedBy, invite.Role, invite.CreatedAt, invite.ID)
+		return err
+	case !errors.Is(err, ErrInviteNotFound):
+		return err
+	}
+
+	res, err := s.db.Exec(`INSERT INTO workspace_invites (workspace_id, user_id, invited_by, role, created_at)
+		VALUES (?, ?, ?, ?, ?)`,
+		invite.WorkspaceID, invite.UserID, invite.InvitedBy, invite.Role, invite.CreatedAt)
+	if err != nil {
+		return err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	invite.ID = int(id)
+	return nil
+}
+
+// Get an invitation by ID
+func (s *SQLStore) GetWorkspaceInvite(id int) (WorkspaceInvite, error) {
+	return scanWorkspaceInvite(s.db.QueryRow("SELECT "+workspaceInviteColumns+" FROM workspace_invites WHERE id = ?", id))
+}
+
+// Get the open invitations of a workspace, newest first
+func (s *SQLStore) GetWorkspaceInvites(workspaceID int) ([]WorkspaceInvite, error) {
+	return s.queryWorkspaceInvites("SELECT "+workspaceInviteColumns+
+		" FROM workspace_invites WHERE workspace_id = ? ORDER BY id DESC", workspaceID)
+}
+
+// Get the invitations a user hasn't answered yet, newest first
+func (s *SQLStore) GetUserWorkspaceInvites(userID int) ([]WorkspaceInvite, error) {
+	return s.queryWorkspaceInvites("SELECT "+workspaceInviteColumns+
+		" FROM workspace_invites WHERE user_id = ? ORDER BY id DESC", userID)
+}
+
+func (s *SQLStore) queryWorkspaceInvites(query string, args ...interface{}) ([]WorkspaceInvite, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var invites []WorkspaceInvite
+	for rows.Next() {
+		invite, err := scanWorkspaceInvite(rows)
+		if err != nil {
+			return nil, err
+		}
+		invites = append(invites, invite)
+	}
+	return invites, rows.Err()
+}
+
+// Delete an invitation
+func (s *SQLStore) DeleteWorkspaceInvite(id int) error {
+	res, err := s.db.Exec("DELETE FROM workspace_invites WHERE id = ?", id)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrInviteNotFound
+	}
+	return nil
+}
+
+// Columns selected for a collection, in the order scanCollection expects
+// them
+const collectionColumns = "id, user_id, COALESCE(workspace_id, 0), COALESCE(parent_id, 0), " +
+	"name, description, cover, created_at"
+
+// Read a collection from anything with a Scan method
+func scanCollection(row interface{ Scan(...interface{}) error }) (Collection, error) {
+	var collection Collection
+	err := row.Scan(&collection.ID, &collection.UserID, &collection.WorkspaceID, &collection.ParentID,
+		&collection.Name, &collection.Description, &collection.Cover, &collection.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Collection{}, ErrCollectionNotFound
+	}
+	return collection, err
+}
+
+// Create a new collection
+func (s *SQLStore) CreateCollection(collection *Collection) error {
+	if collection.CreatedAt.IsZero() {
+		collection.CreatedAt = time.Now()
+	}
+	collection.CreatedAt = collection.CreatedAt.UTC().Truncate(time.Second)
+
+	res, err := s.db.Exec(`INSERT INTO collections (user_id, workspace_id, parent_id, name, description, cover, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		collection.UserID, nullID(collection.WorkspaceID), nullID(collection.ParentID),
+		collection.Name, collection.Description, collection.Cover, collection.CreatedAt)
+	if err != nil {
+		return err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	collection.ID = int(id)
+	return nil
+}
+
+// Get a collection by ID
+func (s *SQLStore) GetCollection(id int) (Collection, error) {
+	return scanCollection(s.db.QueryRow("SELECT "+collectionColumns+" FROM collections WHERE id = ?", id))
+}
+
+// Get a user's personal collections, sorted by name
+func (s *SQLStore) GetUserCollections(userID int) ([]Collection, error) {
+	return s.queryCollections("SELECT "+collectionColumns+
+		" FROM collections WHERE user_id = ? AND workspace_id IS NULL", userID)
+}
+
+// Get a workspace's collections, sorted by name
+func (s *SQLStore) GetWorkspaceCollections(workspaceID int) ([]Collection, error) {
+	return s.queryCollections("SELECT "+collectionColumns+
+		" FROM collections WHERE workspace_id = ?", workspaceID)
+}
+
+// Collations differ between MySQL and SQLite, so sorting happens here
+func (s *SQLStore) queryCollections(query string, args ...interface{}) ([]Collection, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var collections []Collection
+	for rows.Next() {
+		collection, err := scanCollection(rows)
+		if err != nil {
+			return nil, err
+		}
+		collections = append(collections, collection)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	sortCollections(collections)
+	return collections, nil
+}
+
+// Update a collection
+func (s *SQLStore) UpdateCollection(collection *Collection) error {
+	if _, err := s.GetCollection(collection.ID); err != nil {
+		return err
+	}
+	// Up the new parents, the tree is only ever a few levels deep
+	for parentID, steps := collection.ParentID, 0; parentID != 0 && steps < 1000; steps++ {
+		if parentID == collection.ID {
+			return ErrCollectionCycle
+		}
+		parent, err := s.GetCollection(parentID)
+		if errors.Is(err, ErrCollectionNotFound) {
+			break
+		} else if err != nil {
+			return err
+		}
+		parentID = parent.ParentID
+	}
+	_, err := s.db.Exec("UPDATE collections SET name = ?, description = ?, cover = ?, parent_id = ? WHERE id = ?",
+		collection.Name, collection.Description, collection.Cover, nullID(collection.ParentID), collection.ID)
+	return err
+}
+
+// Delete a collection, its sub-collections move up to its parent
+func (s *SQLStore) DeleteCollection(id int) error {
+	collection, err := s.GetCollection(id)
+	if err != nil {
+		return err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("UPDATE collections SET parent_id = ? WHERE parent_id = ?", nullID(collection.ParentID), id); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM collection_links WHERE collection_id = ?", id); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM collections WHERE id = ?", id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Get the links in a collection, in their order
+func (s *SQLStore) GetCollectionLinks(collectionID int) ([]Link, error) {
+	if _, err := s.GetCollection(collectionID); err != nil {
+		return nil, err
+	}
+	rows, err := s.db.Query(`SELECT `+linkColumns+` FROM links l
+		JOIN collection_links cl ON cl.link_id = l.id
+		WHERE cl.collection_id = ? ORDER BY cl.position, l.id`, collectionID)
+	if err != nil {
+		return nil, err
+	}
+	return s.scanLinks(rows)
+}
+
+// Get the collections a link is in, sorted by name
+func (s *SQLStore) GetLinkCollections(linkID int) ([]Collection, error) {
+	return s.queryCollections(`SELECT `+collectionColumns+` FROM collections
+		WHERE id IN (SELECT collection_id FROM collection_links WHERE link_id = ?)`, linkID)
+}
+
+// The IDs of the links in a collection, in their order
+func (s *SQLStore) collectionLinkIDs(q interface {
+	Query(string, ...interface{}) (*sql.Rows, error)
+}, collectionID int) ([]int, error) {
+	rows, err := q.Query("SELECT link_id FROM collection_links WHERE collection_id = ? ORDER BY position, link_id", collectionID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var linkIDs []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		linkIDs = append(linkIDs, id)
+	}
+	return linkIDs, rows.Err()
+}
+
+// Put a link at the end of a collection
+func (s *SQLStore) AddLinkToCollection(collectionID, linkID int) error {
+	if _, err := s.GetCollection(collectionID); err != nil {
+		return err
+	}
+	var exists int
+	err := s.db.QueryRow("SELECT 1 FROM links WHERE id = ?", linkID).Scan(&exists)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrLinkNotFound
+	} else if err != nil {
+		return err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	linkIDs, err := s.collectionLinkIDs(tx, collectionID)
+	if err != nil {
+		return err
+	}
+	if indexOf(linkIDs, linkID) >= 0 {
+		return nil
+	}
+	if _, err := tx.Exec(`INSERT INTO collection_links (collection_id, link_id, position)
+		SELECT ?, ?, COALESCE(MAX(position), 0) + 1 FROM collection_links WHERE collection_id = ?`,
+		collectionID, linkID, collectionID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Take a link out of a collection
+func (s *SQLStore) RemoveLinkFromCollection(collectionID, linkID int) error {
+	res, err := s.db.Exec("DELETE FROM collection_links WHERE collection_id = ? AND link_id = ?", collectionID, linkID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrNotInCollection
+	}
+	return nil
+}
+
+// Put the links of a collection in a new order
+func (s *SQLStore) ReorderCollection(collectionID int, linkIDs []int) error {
+	if _, err := s.GetCollection(collectionID); err != nil {
+		return err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	current, err := s.collectionLinkIDs(tx, collectionID)
+	if err != nil {
+		return err
+	}
+	if !sameLinkIDs(current, linkIDs) {
+		return ErrCollectionOrderStale
+	}
+	for i, linkID := range linkIDs {
+		if _, err := tx.Exec("UPDATE collection_links SET position = ? WHERE collection_id = ? AND link_id = ?",
+			i+1, collectionID, linkID); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Columns selected for an auto-tag rule, in the order scanRule expects them
+const ruleColumns = "id, user_id, kind, pattern, tag, created_at"
+
+// Read an auto-tag rule from anything with a Scan method
+func scanRule(row interface{ Scan(...interface{}) error }) (AutoTagRule, error) {
+	var rule AutoTagRule
+	err := row.Scan(&rule.ID, &rule.UserID, &rule.Kind, &rule.Pattern, &rule.Tag, &rule.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return AutoTagRule{}, ErrRuleNotFound
+	}
+	return rule, err
+}
+
+// Create a new auto-tag rule
+func (s *SQLStore) CreateAutoTagRule(rule *AutoTagRule) error {
+	if rule.CreatedAt.IsZero() {
+		rule.CreatedAt = time.Now()
+	}
+	rule.CreatedAt = rule.CreatedAt.UTC().Truncate(time.Second)
+
+	res, err := s.db.Exec("INSERT INTO auto_tag_rules (user_id, kind, pattern, tag, created_at) VALUES (?, ?, ?, ?, ?)",
+		rule.UserID, rule.Kind, rule.Pattern, rule.Tag, rule.CreatedAt)
+	if err != nil {
+		return err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	rule.ID = int(id)
+	return nil
+}
+
+// Get an auto-tag rule by ID
+func (s *SQLStore) GetAutoTagRule(id int) (AutoTagRule, error) {
+	return scanRule(s.db.QueryRow("SELECT "+ruleColumns+" FROM auto_tag_rules WHERE id = ?", id))
+}
+
+// Get a user's auto-tag rules, oldest first
+func (s *SQLStore) GetUserAutoTagRules(userID int) ([]AutoTagRule, error) {
+	rows, err := s.db.Query("SELECT "+ruleColumns+" FROM auto_tag_rules WHERE user_id = ? ORDER BY id", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rules []AutoTagRule
+	for rows.Next() {
+		rule, err := scanRule(rows)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, rows.Err()
+}
+
+// Delete an auto-tag rule, the tags it added stay
+func (s *SQLStore) DeleteAutoTagRule(id int) error {
+	res, err := s.db.Exec("DELETE FROM auto_tag_rules WHERE id = ?", id)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrRuleNotFound
+	}
+	return nil
+}
+
+// Columns selected for a session, in the order scanSession expects them
+const sessionColumns = "id, user_id, data, created_at, last_seen, expires_at, user_agent, ip"
+
+// Read a session from anything with a Scan method
+func scanSession(row interface{ Scan(...interface{}) error }) (SessionRecord, error) {
+	var record SessionRecord
+	err := row.Scan(&record.ID, &record.UserID, &record.Data, &record.CreatedAt,
+		&record.LastSeen, &record.ExpiresAt, &record.UserAgent, &record.IP)
+	if errors.Is(err, sql.ErrNoRows) {
+		return SessionRecord{}, ErrSessionNotFound
+	}
+	return record, err
+}
+
+// Get a session by ID
+func (s *SQLStore) GetSession(id string) (SessionRecord, error) {
+	return scanSession(s.db.QueryRow("SELECT "+sessionColumns+" FROM sessions WHERE id = ?", id))
+}
+
+// Create or update a session
+func (s *SQLStore) SaveSession(record SessionRecord) error {
+	upsert := `INSERT INTO sessions (` + sessionColumns + `) VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET user_id = excluded.user_id, data = excluded.data,
+			last_seen = excluded.last_seen, user_agent = excluded.user_agent, ip = excluded.ip`
+	if s.driver == "mysql" {
+		upsert = `INSERT INTO sessions (` + sessionColumns + `) VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+			ON DUPLICATE KEY UPDATE user_id = VALUES(user_id), data = VALUES(data),
+				last_seen = VALUES(last_seen), user_agent = VALUES(user_agent), ip = VALUES(ip)`
+	}
+	_, err := s.db.Exec(upsert, record.ID, record.UserID, record.Data,
+		record.CreatedAt.UTC(), record.LastSeen.UTC(), record.ExpiresAt.UTC(),
+		record.UserAgent, record.IP)
+	return err
+}
+
+// Delete a session
+func (s *SQLStore) DeleteSession(id string) error {
+	_, err := s.db.Exec("DELETE FROM sessions WHERE id = ?", id)
+	return err
+}
+
+// Get all sessions of a user, most recently used first
+func (s *SQLStore) ListUserSessions(userID int) ([]SessionRecord, error) {
+	rows, err := s.db.Query("SELECT "+sessionColumns+" FROM sessions WHERE user_id = ? ORDER BY last_seen DESC", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var records []SessionRecord
+	for rows.Next() {
+		record, err := scanSession(rows)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	return records, rows.Err()
+}
+
+// Delete all sessions of a user except keepID
+func (s *SQLStore) DeleteUserSessions(userID int, keepID string) error {
+	_, err := s.db.Exec("DELETE FROM sessions WHERE user_id = ? AND id <> ?", userID, keepID)
+	return err
+}
+
+// Delete sessions that have expired or have been idle too long
+func (s *SQLStore) DeleteExpiredSessions(now time.Time, idleTimeout time.Duration) error {
+	_, err := s.db.Exec("DELETE FROM sessions WHERE expires_at <= ? OR last_seen < ?",
+		now.UTC(), now.Add(-idleTimeout).UTC())
+	return err
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"reflect"
+	"sync/atomic"
+	"testing"
+)
+
+var testDatabases atomic.Int64
+
+// A fresh in-memory SQLite database, gone when the test is done
+func openTestSQLite(t *testing.T) *sql.DB {
+	t.Helper()
+	dsn := fmt.Sprintf("file:test%d?mode=memory&cache=shared&_pragma=foreign_keys(1)", testDatabases.Add(1))
+	db, err := openSQL("sqlite", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestSQLStore(t *testing.T) {
+	testStore(t, func(t *testing.T) Store {
+		db := openTestSQLite(t)
+		if _, err := NewMigrator(db, "sqlite").Up(); err != nil {
+			t.Fatalf("migrating: %v", err)
+		}
+		return NewSQLStore(db, "sqlite")
+	})
+}
+
+// What SQL search does differently from the memory store, as documented on
+// SearchUserLinks and in the README. TestMemoryStoreSearch has the other
+// side.
+func TestSQLStoreSearch(t *testing.T) {
+	db := openTestSQLite(t)
+	if _, err := NewMigrator(db, "sqlite").Up(); err != nil {
+		t.Fatalf("migrating: %v", err)
+	}
+	search := searchDifferencesStore(t, NewSQLStore(db, "sqlite"))
+
+	for query, want := range map[string][]string{
+		"programming": {"Programming in Go", "Searches and more"}, // newest first
+		"ogramm":      {"Programming in Go", "Searches and more"}, // any part of a word
+		"gram go":     {"Programming in Go"},                      // for every word
+		"pr":          {"Programming in Go", "Searches and more"}, // however short
+		"searching":   {},                                         // no other endings
+		"kubernetes":  {},                                         // no archived copies
+	} {
+		if got := search(query); !reflect.DeepEqual(got, want) {
+			t.Errorf("search %q = %v, want %v", query, got, want)
+		}
+	}
+}
+
+// Every migration has to roll back cleanly and apply again afterwards
+func TestMigrationsUpDownUp(t *testing.T) {
+	migrator := NewMigrator(openTestSQLite(t), "sqlite")
+	checkVersion := func(want int) {
+		t.Helper()
+		current, err := migrator.CurrentVersion()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if current != want {
+			t.Fatalf("schema version is %d, want %d", current, want)
+		}
+	}
+
+	if _, err := migrator.Up(); err != nil {
+		t.Fatalf("up: %v", err)
+	}
+	checkVersion(latestSchemaVersion())
+
+	done, err := migrator.Down(len(migrations))
+	if err != nil {
+		t.Fatalf("down: %v", err)
+	}
+	if len(done) != len(migrations) {
+		t.Errorf("rolled back %d migrations, want %d", len(done), len(migrations))
+	}
+	checkVersion(0)
+
+	if _, err := migrator.Up(); err != nil {
+		t.Fatalf("up again: %v", err)
+	}
+	checkVersion(latestSchemaVersion())
+}
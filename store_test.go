@@ -0,0 +1,572 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+// What every Store has to do, whatever it keeps things in. The memory and
+// SQL stores both run these, see store_memory_test.go and store_sql_test.go.
+func testStore(t *testing.T, newStore func(t *testing.T) Store) {
+	t.Run("Users", func(t *testing.T) { testStoreUsers(t, newStore(t)) })
+	t.Run("Links", func(t *testing.T) { testStoreLinks(t, newStore(t)) })
+	t.Run("Tags", func(t *testing.T) { testStoreTags(t, newStore(t)) })
+	t.Run("Search", func(t *testing.T) { testStoreSearch(t, newStore(t)) })
+	t.Run("Health", func(t *testing.T) { testStoreHealth(t, newStore(t)) })
+	t.Run("ArchiveReplacement", func(t *testing.T) { testStoreArchiveReplacement(t, newStore(t)) })
+	t.Run("Collections", func(t *testing.T) { testStoreCollections(t, newStore(t)) })
+	t.Run("TagChanges", func(t *testing.T) { testStoreTagChanges(t, newStore(t)) })
+}
+
+func createTestUser(t *testing.T, store Store, username string) User {
+	t.Helper()
+	user := &User{Username: username, Password: "hash", Email: username + "@example.com"}
+	if err := store.CreateUser(user); err != nil {
+		t.Fatalf("CreateUser(%s): %v", username, err)
+	}
+	return *user
+}
+
+func createTestLink(t *testing.T, store Store, link Link, tags ...string) Link {
+	t.Helper()
+	if err := store.CreateLink(&link); err != nil {
+		t.Fatalf("CreateLink(%s): %v", link.URL, err)
+	}
+	if len(tags) > 0 {
+		if err := store.SetLinkTags(link.ID, tags); err != nil {
+			t.Fatalf("SetLinkTags(%d): %v", link.ID, err)
+		}
+	}
+	saved, err := store.GetLinkByID(link.ID)
+	if err != nil {
+		t.Fatalf("GetLinkByID(%d): %v", link.ID, err)
+	}
+	return saved
+}
+
+func linkTitles(links []Link) []string {
+	titles := []string{}
+	for _, link := range links {
+		titles = append(titles, link.Title)
+	}
+	return titles
+}
+
+func testStoreUsers(t *testing.T, store Store) {
+	alice := createTestUser(t, store, "alice")
+	if alice.ID == 0 {
+		t.Fatal("CreateUser didn't fill in the ID")
+	}
+
+	got, err := store.GetUserByUsername("alice")
+	if err != nil || got.ID != alice.ID || got.Email != "alice@example.com" {
+		t.Errorf("GetUserByUsername = %+v, %v", got, err)
+	}
+	if err := store.CreateUser(&User{Username: "alice", Password: "x"}); !errors.Is(err, ErrUsernameTaken) {
+		t.Errorf("second alice: got %v, want ErrUsernameTaken", err)
+	}
+	if _, err := store.GetUserByID(alice.ID + 100); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("unknown user: got %v, want ErrUserNotFound", err)
+	}
+
+	if err := store.UpdateUserPassword(alice.ID, "new hash"); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := store.GetUserByID(alice.ID); got.Password != "new hash" {
+		t.Errorf("password is %q after UpdateUserPassword", got.Password)
+	}
+
+	createTestUser(t, store, "bob")
+	users, err := store.ListUsers()
+	if err != nil || len(users) != 2 || users[0].Username != "alice" {
+		t.Errorf("ListUsers = %+v, %v", users, err)
+	}
+}
+
+func testStoreLinks(t *testing.T, store Store) {
+	alice := createTestUser(t, store, "alice")
+	bob := createTestUser(t, store, "bob")
+	day := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	older := createTestLink(t, store, Link{URL: "https://go.dev/", Title: "Go", UserID: alice.ID, CreatedAt: day})
+	newer := createTestLink(t, store, Link{URL: "https://example.com/", Title: "Example", UserID: alice.ID, CreatedAt: day.Add(time.Hour)})
+	createTestLink(t, store, Link{URL: "https://bob.example/", Title: "Bob's", UserID: bob.ID, CreatedAt: day})
+
+	if older.ID == 0 || older.Visibility != VisibilityPrivate || !older.CreatedAt.Equal(day) {
+		t.Errorf("saved link = %+v", older)
+	}
+
+	links, err := store.GetUserLinks(alice.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := linkTitles(links), []string{"Example", "Go"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("GetUserLinks = %v, want %v (newest first, only alice's)", got, want)
+	}
+	if recent, _ := store.GetRecentLinks(alice.ID, 1); len(recent) != 1 || recent[0].ID != newer.ID {
+		t.Errorf("GetRecentLinks(1) = %v", linkTitles(recent))
+	}
+
+	older.Title = "The Go Programming Language"
+	older.Visibility = VisibilityPublic
+	if err := store.UpdateLink(&older); err != nil {
+		t.Fatal(err)
+	}
+	got, err := store.GetLinkByID(older.ID)
+	if err != nil || got.Title != "The Go Programming Language" || got.Visibility != VisibilityPublic {
+		t.Errorf("after UpdateLink: %+v, %v", got, err)
+	}
+	if public, _ := store.GetPublicLinks(10); len(public) != 1 || public[0].ID != older.ID {
+		t.Errorf("GetPublicLinks = %v", linkTitles(public))
+	}
+
+	if err := store.DeleteLink(older.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.GetLinkByID(older.ID); !errors.Is(err, ErrLinkNotFound) {
+		t.Errorf("deleted link: got %v, want ErrLinkNotFound", err)
+	}
+	if err := store.UpdateLink(&older); !errors.Is(err, ErrLinkNotFound) {
+		t.Errorf("updating a deleted link: got %v, want ErrLinkNotFound", err)
+	}
+	if links, _ := store.GetUserLinks(alice.ID); len(links) != 1 {
+		t.Errorf("alice has %d links after deleting one, want 1", len(links))
+	}
+}
+
+func testStoreTags(t *testing.T, store Store) {
+	alice := createTestUser(t, store, "alice")
+	bob := createTestUser(t, store, "bob")
+	link := createTestLink(t, store, Link{URL: "https://go.dev/", Title: "Go", UserID: alice.ID}, "lang/go", "docs")
+	createTestLink(t, store, Link{URL: "https://bob.example/", Title: "Bob's", UserID: bob.ID}, "bobs")
+
+	sort.Strings(link.Tags)
+	if want := []string{"docs", "lang/go"}; !reflect.DeepEqual(link.Tags, want) {
+		t.Errorf("link tags = %v, want %v", link.Tags, want)
+	}
+
+	// The tag above lang/go is made too, and bob's tags are his own
+	tags, err := store.GetUserTags(alice.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, tag := range tags {
+		names = append(names, tag.Name)
+	}
+	if want := []string{"docs", "lang", "lang/go"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("GetUserTags = %v, want %v", names, want)
+	}
+
+	if err := store.SetLinkTags(link.ID, []string{"reference"}); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := store.GetLinkTags(link.ID); !reflect.DeepEqual(got, []string{"reference"}) {
+		t.Errorf("tags after SetLinkTags = %v", got)
+	}
+
+	if err := store.SetLinkTags(link.ID+100, []string{"x"}); !errors.Is(err, ErrLinkNotFound) {
+		t.Errorf("SetLinkTags on an unknown link: got %v, want ErrLinkNotFound", err)
+	}
+	if err := store.AddTagToLinkByName(link.ID+100, "x"); !errors.Is(err, ErrLinkNotFound) {
+		t.Errorf("AddTagToLinkByName on an unknown link: got %v, want ErrLinkNotFound", err)
+	}
+
+	if err := store.AddTagToLinkByName(link.ID, "golang"); err != nil {
+		t.Fatal(err)
+	}
+	got, _ := store.GetLinkTags(link.ID)
+	sort.Strings(got)
+	if want := []string{"golang", "reference"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("tags after AddTagToLinkByName = %v, want %v", got, want)
+	}
+}
+
+func testStoreSearch(t *testing.T, store Store) {
+	alice := createTestUser(t, store, "alice")
+	bob := createTestUser(t, store, "bob")
+	goLink := createTestLink(t, store, Link{URL: "https://go.dev/", Title: "The Go Programming Language", Description: "Documentation and tutorials", UserID: alice.ID}, "golang")
+	createTestLink(t, store, Link{URL: "https://www.rust-lang.org/", Title: "Rust", Description: "A language empowering everyone", UserID: alice.ID}, "rustlang")
+	createTestLink(t, store, Link{URL: "https://bob.example/", Title: "Bob's programming notes", UserID: bob.ID})
+	createTestLink(t, store, Link{URL: "https://github.com/octocat/hello-world", Title: "Source code", UserID: alice.ID})
+
+	search := func(query string) []string {
+		t.Helper()
+		links, err := store.SearchUserLinks(alice.ID, query)
+		if err != nil {
+			t.Fatalf("SearchUserLinks(%q): %v", query, err)
+		}
+		titles := linkTitles(links)
+		sort.Strings(titles)
+		return titles
+	}
+
+	for query, want := range map[string][]string{
+		"programming":     {"The Go Programming Language"}, // not bob's
+		"PROGRAMMING":     {"The Go Programming Language"},
+		"tutorials":       {"The Go Programming Language"},
+		"rustlang":        {"Rust"}, // a tag
+		"rust-lang.org":   {"Rust"}, // the URL
+		"language":        {"Rust", "The Go Programming Language"},
+		"nothing":         {},
+		"go tutorials":    {"The Go Programming Language"}, // every word, in any field
+		"tutorials go":    {"The Go Programming Language"}, // in any order
+		"programming lan": {"The Go Programming Language"}, // the last word can be the start of one
+		"rust tutorials":  {},
+		"git":             {"Source code"}, // part of a word
+	} {
+		if got := search(query); !reflect.DeepEqual(got, want) {
+			t.Errorf("search %q = %v, want %v", query, got, want)
+		}
+	}
+
+	// Every tag once, even when the tag matches too
+	links, _ := store.SearchUserLinks(alice.ID, "golang")
+	if len(links) != 1 || !reflect.DeepEqual(links[0].Tags, []string{"golang"}) {
+		t.Errorf("search golang = %+v", links)
+	}
+
+	if err := store.DeleteLink(goLink.ID); err != nil {
+		t.Fatal(err)
+	}
+	if got := search("programming"); len(got) != 0 {
+		t.Errorf("deleted link still found: %v", got)
+	}
+}
+
+// Links for the searches the stores do differently (see SearchUserLinks),
+// and a search that returns titles in the order the store gives them
+func searchDifferencesStore(t *testing.T, store Store) func(query string) []string {
+	alice := createTestUser(t, store, "alice")
+	day := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+	older := createTestLink(t, store, Link{URL: "https://a.example/", Title: "Searches and more", Description: "Programming notes", UserID: alice.ID, CreatedAt: day})
+	createTestLink(t, store, Link{URL: "https://b.example/", Title: "Programming in Go", UserID: alice.ID, CreatedAt: day.Add(time.Hour)})
+	if err := store.CreateArchivedPage(&ArchivedPage{LinkID: older.ID, Text: "kubernetes clusters", CreatedAt: day}); err != nil {
+		t.Fatal(err)
+	}
+	return func(query string) []string {
+		t.Helper()
+		links, err := store.SearchUserLinks(alice.ID, query)
+		if err != nil {
+			t.Fatalf("SearchUserLinks(%q): %v", query, err)
+		}
+		return linkTitles(links)
+	}
+}
+
+func testStoreHealth(t *testing.T, store Store) {
+	alice := createTestUser(t, store, "alice")
+	link := createTestLink(t, store, Link{URL: "https://old.example/", Title: "Old", UserID: alice.ID})
+	checked := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	broken := LinkHealth{StatusCode: 404, CheckedAt: &checked, FailureStreak: 1, Error: "404 Not Found"}
+	if err := store.SaveLinkHealth(link.ID, link.URL, broken); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := store.GetLinkByID(link.ID); got.Health.StatusCode != 404 || got.Health.FailureStreak != 1 {
+		t.Errorf("health after saving a check = %+v", got.Health)
+	}
+
+	// The URL is edited while the old one is being checked
+	oldURL := link.URL
+	link.URL = "https://new.example/"
+	if err := store.UpdateLink(&link); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SaveLinkHealth(link.ID, link.URL, LinkHealth{}); err != nil {
+		t.Fatal(err)
+	}
+	broken.FailureStreak = 2
+	if err := store.SaveLinkHealth(link.ID, oldURL, broken); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := store.GetLinkByID(link.ID); got.Health.CheckedAt != nil || got.Health.FailureStreak != 0 {
+		t.Errorf("a check of the old URL was saved for the new one: %+v", got.Health)
+	}
+
+	if err := store.SaveLinkHealth(link.ID+100, link.URL, broken); !errors.Is(err, ErrLinkNotFound) {
+		t.Errorf("unknown link: got %v, want ErrLinkNotFound", err)
+	}
+}
+
+func testStoreArchiveReplacement(t *testing.T, store Store) {
+	alice := createTestUser(t, store, "alice")
+	link := createTestLink(t, store, Link{URL: "https://gone.example/", Title: "Gone", UserID: alice.ID})
+	page := &ArchivedPage{LinkID: link.ID, URL: link.URL, Title: "Gone", Text: "the text", CreatedAt: time.Now()}
+	if err := store.CreateArchivedPage(page); err != nil {
+		t.Fatal(err)
+	}
+
+	link.ReplacedByArchiveID = page.ID
+	if err := store.UpdateLink(&link); err != nil {
+		t.Fatal(err)
+	}
+	got, err := store.GetLinkByID(link.ID)
+	if err != nil || got.ReplacedByArchiveID != page.ID || got.URL != "https://gone.example/" {
+		t.Errorf("replaced link = %+v, %v", got, err)
+	}
+
+	// Without the copy the link goes back to its URL
+	if err := store.DeleteArchivedPage(page.ID); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := store.GetLinkByID(link.ID); got.ReplacedByArchiveID != 0 {
+		t.Errorf("link still points at deleted copy %d", got.ReplacedByArchiveID)
+	}
+}
+
+func testStoreCollections(t *testing.T, store Store) {
+	alice := createTestUser(t, store, "alice")
+	a := createTestLink(t, store, Link{URL: "https://a.example/", Title: "A", UserID: alice.ID})
+	b := createTestLink(t, store, Link{URL: "https://b.example/", Title: "B", UserID: alice.ID})
+	c := createTestLink(t, store, Link{URL: "https://c.example/", Title: "C", UserID: alice.ID})
+
+	reading := &Collection{UserID: alice.ID, Name: "Reading"}
+	if err := store.CreateCollection(reading); err != nil {
+		t.Fatal(err)
+	}
+	for _, link := range []Link{a, b, c, a} {
+		if err := store.AddLinkToCollection(reading.ID, link.ID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expect := func(want ...string) {
+		t.Helper()
+		links, err := store.GetCollectionLinks(reading.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := linkTitles(links); !reflect.DeepEqual(got, want) {
+			t.Errorf("collection links = %v, want %v", got, want)
+		}
+	}
+	expect("A", "B", "C") // adding A again leaves it where it was
+
+	if err := store.ReorderCollection(reading.ID, []int{c.ID, a.ID, b.ID}); err != nil {
+		t.Fatal(err)
+	}
+	expect("C", "A", "B")
+
+	// An order made before someone else changed the collection is refused
+	for _, stale := range [][]int{
+		{c.ID, a.ID},
+		{c.ID, a.ID, a.ID},
+		{c.ID, a.ID, b.ID, b.ID},
+		{c.ID, a.ID, b.ID + 100},
+		nil,
+	} {
+		if err := store.ReorderCollection(reading.ID, stale); !errors.Is(err, ErrCollectionOrderStale) {
+			t.Errorf("ReorderCollection(%v): got %v, want ErrCollectionOrderStale", stale, err)
+		}
+	}
+	expect("C", "A", "B")
+
+	if err := store.RemoveLinkFromCollection(reading.ID, a.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.RemoveLinkFromCollection(reading.ID, a.ID); !errors.Is(err, ErrNotInCollection) {
+		t.Errorf("removing a link twice: got %v, want ErrNotInCollection", err)
+	}
+	if err := store.DeleteLink(c.ID); err != nil {
+		t.Fatal(err)
+	}
+	expect("B")
+	if err := store.ReorderCollection(reading.ID, []int{b.ID}); err != nil {
+		t.Errorf("reordering after a link was deleted: %v", err)
+	}
+
+	// Top > Middle > Bottom
+	top := &Collection{UserID: alice.ID, Name: "Top"}
+	if err := store.CreateCollection(top); err != nil {
+		t.Fatal(err)
+	}
+	middle := &Collection{UserID: alice.ID, Name: "Middle", ParentID: top.ID}
+	if err := store.CreateCollection(middle); err != nil {
+		t.Fatal(err)
+	}
+	bottom := &Collection{UserID: alice.ID, Name: "Bottom", ParentID: middle.ID}
+	if err := store.CreateCollection(bottom); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, parent := range []*Collection{top, middle, bottom} {
+		moved := *top
+		moved.ParentID = parent.ID
+		if err := store.UpdateCollection(&moved); !errors.Is(err, ErrCollectionCycle) {
+			t.Errorf("moving Top into %s: got %v, want ErrCollectionCycle", parent.Name, err)
+		}
+	}
+	if got, _ := store.GetCollection(top.ID); got.ParentID != 0 {
+		t.Errorf("Top is inside collection %d after refused moves", got.ParentID)
+	}
+
+	// Moving up and sideways is fine
+	bottom.ParentID = reading.ID
+	if err := store.UpdateCollection(bottom); err != nil {
+		t.Fatal(err)
+	}
+	top.ParentID = bottom.ID
+	if err := store.UpdateCollection(top); err != nil {
+		t.Errorf("moving Top into Bottom once Bottom is elsewhere: %v", err)
+	}
+
+	// Sub-collections of a deleted collection move up to its parent
+	if err := store.DeleteCollection(top.ID); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := store.GetCollection(middle.ID); err != nil || got.ParentID != bottom.ID {
+		t.Errorf("Middle after deleting Top = %+v, %v, want it inside Bottom", got, err)
+	}
+	if _, err := store.GetCollection(top.ID); !errors.Is(err, ErrCollectionNotFound) {
+		t.Errorf("deleted collection: got %v, want ErrCollectionNotFound", err)
+	}
+	if err := store.UpdateCollection(&Collection{ID: top.ID, Name: "Gone"}); !errors.Is(err, ErrCollectionNotFound) {
+		t.Errorf("updating a deleted collection: got %v, want ErrCollectionNotFound", err)
+	}
+}
+
+// A user's tags as "name:link count", checking every tag sits below the
+// tag its name says it does
+func tagSummary(t *testing.T, store Store, userID int) []string {
+	t.Helper()
+	tags, err := store.GetUserTags(userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	byID := make(map[int]string)
+	for _, tag := range tags {
+		byID[tag.ID] = tag.Name
+	}
+	summary := []string{}
+	for _, tag := range tags {
+		if parent := parentTagName(tag.Name); byID[tag.ParentID] != parent {
+			t.Errorf("tag %s is below %q, want %q", tag.Name, byID[tag.ParentID], parent)
+		}
+		summary = append(summary, fmt.Sprintf("%s:%d", tag.Name, tag.LinkCount))
+	}
+	return summary
+}
+
+// Moving, merging, renaming, deleting and cleaning up tags, the way the
+// tags page does it, and what that does to links and search
+func testStoreTagChanges(t *testing.T, store Store) {
+	app := &App{store: store}
+	alice := createTestUser(t, store, "alice")
+	bob := createTestUser(t, store, "bob")
+	first := createTestLink(t, store, Link{URL: "https://a.example/", Title: "First", UserID: alice.ID}, "lang/go", "lang/go/generics")
+	second := createTestLink(t, store, Link{URL: "https://b.example/", Title: "Second", UserID: alice.ID}, "lang/rust")
+	third := createTestLink(t, store, Link{URL: "https://c.example/", Title: "Third", UserID: alice.ID}, "misc")
+	createTestLink(t, store, Link{URL: "https://d.example/", Title: "Bob's", UserID: bob.ID}, "lang/go")
+	bobsTags := []string{"lang:0", "lang/go:1"}
+
+	tag := func(name string) Tag {
+		t.Helper()
+		tag, err := store.GetTag(mustTagID(t, store, alice.ID, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tag
+	}
+	expectTags := func(step string, want ...string) {
+		t.Helper()
+		if got := tagSummary(t, store, alice.ID); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: tags = %v, want %v", step, got, want)
+		}
+		if got := tagSummary(t, store, bob.ID); !reflect.DeepEqual(got, bobsTags) {
+			t.Errorf("%s: bob's tags changed to %v", step, got)
+		}
+	}
+	expectLinkTags := func(step string, link Link, want ...string) {
+		t.Helper()
+		got, err := store.GetLinkTags(link.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sort.Strings(got)
+		if want == nil {
+			want = []string{}
+		}
+		if got == nil {
+			got = []string{}
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: %s has tags %v, want %v", step, link.Title, got, want)
+		}
+	}
+	expectFound := func(step, query string, want ...string) {
+		t.Helper()
+		links, err := store.SearchUserLinks(alice.ID, query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := linkTitles(links)
+		sort.Strings(got)
+		if want == nil {
+			want = []string{}
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: search %q = %v, want %v", step, query, got, want)
+		}
+	}
+	expectTags("start", "lang:0", "lang/go:1", "lang/go/generics:1", "lang/rust:1", "misc:1")
+
+	// Move lang/go and everything below it under code
+	if problem, err := app.renameTagTo(tag("lang/go"), "code/go", true); problem != "" || err != nil {
+		t.Fatalf("moving lang/go: %q, %v", problem, err)
+	}
+	expectTags("move", "code:0", "code/go:1", "code/go/generics:1", "lang:0", "lang/rust:1", "misc:1")
+	expectLinkTags("move", first, "code/go", "code/go/generics")
+	expectFound("move", "generics", "First")
+	expectFound("move", "code", "First")
+	expectFound("move", "lang", "Second")
+
+	// Merge lang/rust into code/go, not code into a tag below it
+	if problem, err := app.mergeTagInto(tag("code"), tag("code/go")); problem == "" || err != nil {
+		t.Errorf("merging code into code/go: %q, %v", problem, err)
+	}
+	if problem, err := app.mergeTagInto(tag("lang/rust"), tag("code/go")); problem != "" || err != nil {
+		t.Fatalf("merging lang/rust: %q, %v", problem, err)
+	}
+	expectTags("merge", "code:0", "code/go:2", "code/go/generics:1", "lang:0", "misc:1")
+	expectLinkTags("merge", second, "code/go")
+	expectFound("merge", "rust")
+	expectFound("merge", "code", "First", "Second")
+
+	// Rename misc, but not onto a tag that's there or below itself
+	for _, rename := range []struct {
+		name        string
+		wantProblem bool
+	}{{"code/go", true}, {"misc/more", true}, {"other", false}} {
+		if problem, err := app.renameTagTo(tag("misc"), rename.name, false); (problem != "") != rename.wantProblem || err != nil {
+			t.Errorf("renaming misc to %s: %q, %v", rename.name, problem, err)
+		}
+	}
+	expectTags("rename", "code:0", "code/go:2", "code/go/generics:1", "lang:0", "other:1")
+	expectLinkTags("rename", third, "other")
+	expectFound("rename", "misc")
+	expectFound("rename", "other", "Third")
+
+	// Deleting code/go takes it off its links, the tag below moves up
+	if err := app.removeTag(tag("code/go")); err != nil {
+		t.Fatal(err)
+	}
+	expectTags("delete", "code:0", "code/generics:1", "lang:0", "other:1")
+	expectLinkTags("delete", first, "code/generics")
+	expectLinkTags("delete", second)
+	expectFound("delete", "code", "First")
+	if _, err := store.GetTag(mustTagID(t, store, alice.ID, "code") + 100); !errors.Is(err, ErrTagNotFound) {
+		t.Errorf("unknown tag: got %v, want ErrTagNotFound", err)
+	}
+
+	// Cleaning up keeps code, a tag below it is in use
+	removed, err := app.removeUnusedTags(alice.ID, 0)
+	if err != nil || removed != 1 {
+		t.Errorf("removeUnusedTags = %d, %v, want 1 (lang)", removed, err)
+	}
+	expectTags("cleanup", "code:0", "code/generics:1", "other:1")
+	expectFound("cleanup", "generics", "First")
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+)
+
+// Tag suggestions for the tags field of the add and edit forms (and the
+// API). Two kinds: the tags matching what's been typed so far, and the tags
+// of the other links from the same site as the link's URL. Both come from
+// the links of the library the link goes in, and tags used often and lately
+// come first.
+
+// How many suggestions of each kind are sent back
+const tagSuggestionLimit = 10
+
+// A link saved this long ago counts half as much as one saved now, so the
+// tags you use these days beat the ones you used a lot last year
+const tagUseHalfLife = 30 * 24 * time.Hour
+
+// A suggested tag
+type TagSuggestion struct {
+	Name     string    `json:"name"`
+	Count    int       `json:"count"`     // how many links have it
+	LastUsed time.Time `json:"last_used"` // when the newest of those links was saved
+	score    float64   // Count with older links counting for less
+}
+
+// Both kinds of suggestions
+type TagSuggestions struct {
+	Matching []TagSuggestion `json:"matching"`  // tags matching q, best first
+	Site     string          `json:"site"`      // the site of url, "" without one
+	FromSite []TagSuggestion `json:"from_site"` // tags of the other links from that site
+}
+
+// Count how often and how recently each tag is used on links
+func tagUsage(links []Link, now time.Time) map[string]*TagSuggestion {
+	usage := make(map[string]*TagSuggestion)
+	for _, link := range links {
+		age := math.Max(0, now.Sub(link.CreatedAt).Hours())
+		weight := math.Exp2(-age / tagUseHalfLife.Hours())
+		for _, name := range link.Tags {
+			use := usage[name]
+			if use == nil {
+				use = &TagSuggestion{Name: name}
+				usage[name] = use
+			}
+			use.Count++
+			use.score += weight
+			if link.CreatedAt.After(use.LastUsed) {
+				use.LastUsed = link.CreatedAt
+			}
+		}
+	}
+	return usage
+}
+
+// Most used first, with ties in alphabetical order
+func sortByUsage(suggestions []TagSuggestion) {
+	sort.SliceStable(suggestions, func(i, j int) bool {
+		a, b := suggestions[i], suggestions[j]
+		if a.score != b.score {
+			return a.score > b.score
+		}
+		if a.Count != b.Count {
+			return a.Count > b.Count
+		}
+		return a.Name < b.Name
+	})
+}
+
+// How well a tag name matches what was typed, lower is better and -1 is no
+// match at all: 0 is the whole name, 1 the start of the name or of one of
+// its levels (go finds lang/go), 2 somewhere in the name and 3 the letters
+// in the same order (lgo finds lang/go). query has to be lowercase.
+func tagMatch(name, query string) int {
+	name = strings.ToLower(name)
+	switch {
+	case name == query:
+		return 0
+	case strings.HasPrefix(name, query) || strings.Contains(name, tagSeparator+query):
+		return 1
+	case strings.Contains(name, query):
+		return 2
+	case lettersInOrder(name, query):
+		return 3
+	}
+	return -1
+}
+
+// Whether the letters of query show up in name in the same order, with
+// anything in between
+func lettersInOrder(name, query string) bool {
+	for _, r := range query {
+		i := strings.IndexRune(name, r)
+		if i < 0 {
+			return false
+		}
+		name = name[i+utf8.RuneLen(r):]
+	}
+	return true
+}
+
+// The tags matching query, the best matches first and the most used first
+// among equally good ones. An empty query gives the most used tags.
+func matchingTags(usage map[string]*TagSuggestion, query string) []TagSuggestion {
+	query = strings.ToLower(cleanTagName(query))
+	byQuality := make(map[int][]TagSuggestion)
+	for _, use := range usage {
+		if quality := tagMatch(use.Name, query); quality >= 0 {
+			byQuality[quality] = append(byQuality[quality], *use)
+		}
+	}
+
+	matching := []TagSuggestion{}
+	for quality := 0; quality <= 3 && len(matching) < tagSuggestionLimit; quality++ {
+		sortByUsage(byQuality[quality])
+		matching = append(matching, byQuality[quality]...)
+	}
+	if len(matching) > tagSuggestionLimit {
+		matching = matching[:tagSuggestionLimit]
+	}
+	return matching
+}
+
+// The tags of the links from site, most used first
+func siteTags(links []Link, site string, now time.Time) []TagSuggestion {
+	var fromSite []Link
+	for _, link := range links {
+		if SiteOf(link.URL) == site {
+			fromSite = append(fromSite, link)
+		}
+	}
+	suggestions := []TagSuggestion{}
+	for _, use := range tagUsage(fromSite, now) {
+		suggestions = append(suggestions, *use)
+	}
+	sortByUsage(suggestions)
+	if len(suggestions) > tagSuggestionLimit {
+		suggestions = suggestions[:tagSuggestionLimit]
+	}
+	return suggestions
+}
+
+// Suggest tags from the links of a library (see libraryLinks) for a link
+// being added to it or edited. exceptID, the link being edited, is left
+// out so it doesn't suggest its own tags. rawURL can be "" to only get the
+// matching tags.
+func (app *App) suggestTags(userID, workspaceID int, query, rawURL string, exceptID int) (TagSuggestions, error) {
+	links, err := libraryLinks(app.store, userID, workspaceID)
+	if err != nil {
+		return TagSuggestions{}, err
+	}
+	var others []Link
+	for _, link := range links {
+		if link.ID != exceptID {
+			others = append(others, link)
+		}
+	}
+
+	now := time.Now()
+	suggestions := TagSuggestions{
+		Matching: matchingTags(tagUsage(others, now), query),
+		FromSite: []TagSuggestion{},
+	}
+	if rawURL != "" {
+		suggestions.Site = SiteOf(rawURL)
+	}
+	if suggestions.Site != "" {
+		suggestions.FromSite = siteTags(others, suggestions.Site, now)
+	}
+	return suggestions, nil
+}
+
+// The library to suggest tags from (see libraryLinks): the one a new link
+// goes to, or that of the link being edited for linkID != 0. problem says
+// why the user can't have suggestions for either.
+func (app *App) suggestionLibrary(userID, workspaceID, linkID int) (ownerID, libraryID int, problem string, err error) {
+	if linkID == 0 {
+		ok, err := app.canAddLinks(workspaceID, userID)
+		if err != nil || !ok {
+			return 0, 0, "You can't add links to that workspace", err
+		}
+		return userID, workspaceID, "", nil
+	}
+
+	link, err := app.store.GetLinkByID(linkID)
+	if errors.Is(err, ErrLinkNotFound) {
+		return 0, 0, "You can't edit that link", nil
+	} else if err != nil {
+		return 0, 0, "", err
+	}
+	access, err := app.linkAccess(link, userID)
+	if err != nil || access < accessEdit {
+		return 0, 0, "You can't edit that link", err
+	}
+	// Links shared for editing get the tags of their owner
+	return link.UserID, link.WorkspaceID, "", nil
+}
+
+// Suggestions for the tags field, as JSON for script.js. Takes q (what's
+// typed so far), url, and workspace_id (where a new link goes) or link_id
+// (the link being edited), all optional.
+func (app *App) tagSuggestions(c *gin.Context) {
+	userID := sessions.Default(c).Get("user_id").(int)
+	workspaceID, _ := strconv.Atoi(c.Query("workspace_id"))
+	linkID, _ := strconv.Atoi(c.Query("link_id"))
+	ownerID, libraryID, problem, err := app.suggestionLibrary(userID, workspaceID, linkID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not load your tags"})
+		return
+	} else if problem != "" {
+		c.JSON(http.StatusForbidden, gin.H{"error": problem})
+		return
+	}
+
+	suggestions, err := app.suggestTags(ownerID, libraryID, c.Query("q"), strings.TrimSpace(c.Query("url")), linkID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not load your tags"})
+		return
+	}
+	c.JSON(http.StatusOK, suggestions)
+}
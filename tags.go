@@ -0,0 +1,642 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+)
+
+// Tags can be nested by putting a slash in their name: lang/go is a tag
+// below lang. The name is the whole path, so a link tagged lang/go says so
+// everywhere and flat tags work like they always did. Tags also know their
+// parent, the stores create the tags above a new tag when it's first used.
+// Filtering by a tag (on the dashboard, in the API or through a tag share)
+// also finds the links tagged with the tags below it.
+//
+// Tags belong to a library like links and collections do: every user has
+// their own tags for their personal links and every workspace has its own.
+// The tags page (and the API) renames, merges and deletes them, which
+// changes the links of that library only. Renaming a tag to the name of
+// another tag merges the two. Tags no link has anymore stay around until
+// they're cleaned up.
+
+const tagSeparator = "/"
+
+// Clean up a tag name: no spaces around the slashes and no empty levels
+func cleanTagName(name string) string {
+	var parts []string
+	for _, part := range strings.Split(name, tagSeparator) {
+		if part = strings.TrimSpace(part); part != "" {
+			parts = append(parts, part)
+		}
+	}
+	return strings.Join(parts, tagSeparator)
+}
+
+// The name of the tag above, "" for top level tags
+func parentTagName(name string) string {
+	if i := strings.LastIndex(name, tagSeparator); i >= 0 {
+		return name[:i]
+	}
+	return ""
+}
+
+// The last level of a tag's name, go for lang/go
+func tagLabel(name string) string {
+	return name[strings.LastIndex(name, tagSeparator)+1:]
+}
+
+// Put a label below parent, or at the top for parent ""
+func joinTagName(parent, label string) string {
+	if parent == "" {
+		return label
+	}
+	return parent + tagSeparator + label
+}
+
+// Whether tag is filter or one of the tags below it
+func tagUnder(tag, filter string) bool {
+	return tag == filter || strings.HasPrefix(tag, filter+tagSeparator)
+}
+
+// Whether any of the tags is filter or below it
+func taggedWith(tags []string, filter string) bool {
+	for _, tag := range tags {
+		if tagUnder(tag, filter) {
+			return true
+		}
+	}
+	return false
+}
+
+// The links tagged with filter or a tag below it
+func filterTagged(links []Link, filter string) []Link {
+	var tagged []Link
+	for _, link := range links {
+		if taggedWith(link.Tags, filter) {
+			tagged = append(tagged, link)
+		}
+	}
+	return tagged
+}
+
+// What a tag is called after moving from to to, lang/go/generics becomes
+// code/go/generics when lang/go moves to code/go
+func movedTagName(tag, from, to string) string {
+	if !tagUnder(tag, from) {
+		return tag
+	}
+	return to + tag[len(from):]
+}
+
+// What a tag below removed is called once removed is deleted and the tags
+// below it moved up a level, lang/go/generics becomes lang/generics when
+// lang/go is deleted
+func movedUpTagName(tag, removed string) string {
+	return joinTagName(parentTagName(removed), tag[len(removed)+len(tagSeparator):])
+}
+
+// The names one level below name that tags (or the tags below them) have,
+// sorted
+func childTagNames(names []string, name string) []string {
+	seen := make(map[string]bool)
+	var children []string
+	for _, other := range names {
+		if other == name || !tagUnder(other, name) {
+			continue
+		}
+		rest := other[len(name)+len(tagSeparator):]
+		child := joinTagName(name, strings.SplitN(rest, tagSeparator, 2)[0])
+		if !seen[child] {
+			seen[child] = true
+			children = append(children, child)
+		}
+	}
+	sort.Strings(children)
+	return children
+}
+
+// Order to rename tags in: shorter names first, so the tags above come
+// before the tags below them
+func tagsAboveFirst(a, b string) bool {
+	if len(a) != len(b) {
+		return len(a) < len(b)
+	}
+	return a < b
+}
+
+// Whether a tag belongs to a library: a workspace's tags, or userID's
+// personal tags for workspaceID 0
+func (tag Tag) inLibrary(userID, workspaceID int) bool {
+	if workspaceID != 0 {
+		return tag.WorkspaceID == workspaceID
+	}
+	return tag.WorkspaceID == 0 && tag.UserID == userID
+}
+
+// The names of the tags some link has, and of the tags above them
+func tagNamesInUse(tags []Tag) map[string]bool {
+	used := make(map[string]bool)
+	for _, tag := range tags {
+		if tag.LinkCount == 0 {
+			continue
+		}
+		for name := tag.Name; name != "" && !used[name]; name = parentTagName(name) {
+			used[name] = true
+		}
+	}
+	return used
+}
+
+// The tags that are in use, on a link or above a tag that is
+func usedTags(tags []Tag) []Tag {
+	used := tagNamesInUse(tags)
+	var kept []Tag
+	for _, tag := range tags {
+		if used[tag.Name] {
+			kept = append(kept, tag)
+		}
+	}
+	return kept
+}
+
+// The tags that aren't in use, the ones deepest down first so they can be
+// deleted in that order without moving anything up
+func unusedTags(tags []Tag) []Tag {
+	used := tagNamesInUse(tags)
+	var unused []Tag
+	for _, tag := range tags {
+		if !used[tag.Name] {
+			unused = append(unused, tag)
+		}
+	}
+	sort.Slice(unused, func(i, j int) bool {
+		return tagsAboveFirst(unused[j].Name, unused[i].Name)
+	})
+	return unused
+}
+
+// A tag in the tag tree
+type tagNode struct {
+	Tag
+	Label    string // the last level of the name
+	Depth    int    // 0 for top level tags
+	Used     bool   // some link has this tag or a tag below it
+	Active   bool   // the links are filtered by this tag
+	Open     bool   // the filter is this tag or one below it
+	Children []*tagNode
+}
+
+// Non-breaking spaces to indent the name with in a select
+func (node *tagNode) Indent() string {
+	return strings.Repeat("\u00a0\u00a0\u00a0", node.Depth)
+}
+
+// Turn tags sorted by name (like GetUserTags returns them) into a tree.
+// Tags above that are missing from the list are made up, with ID 0.
+func tagTree(tags []Tag, filter string) []*tagNode {
+	used := tagNamesInUse(tags)
+	nodes := make(map[string]*tagNode, len(tags))
+	var roots []*tagNode
+	var add func(name string) *tagNode
+	add = func(name string) *tagNode {
+		if node, ok := nodes[name]; ok {
+			return node
+		}
+		node := &tagNode{
+			Tag:    Tag{Name: name},
+			Label:  tagLabel(name),
+			Used:   used[name],
+			Active: name == filter,
+			Open:   filter != "" && tagUnder(filter, name),
+		}
+		nodes[name] = node
+		if parent := parentTagName(name); parent != "" {
+			above := add(parent)
+			node.Depth = above.Depth + 1
+			above.Children = append(above.Children, node)
+		} else {
+			roots = append(roots, node)
+		}
+		return node
+	}
+	for _, tag := range tags {
+		add(tag.Name).Tag = tag
+	}
+	return roots
+}
+
+// The nodes of a tree in order, every tag right before the tags below it
+func flattenTagTree(nodes []*tagNode) []*tagNode {
+	var flat []*tagNode
+	for _, node := range nodes {
+		flat = append(flat, node)
+		flat = append(flat, flattenTagTree(node.Children)...)
+	}
+	return flat
+}
+
+// Where the tags of a library are managed
+func tagsPath(workspaceID int) string {
+	if workspaceID != 0 {
+		return fmt.Sprintf("/tags?workspace=%d", workspaceID)
+	}
+	return "/tags"
+}
+
+// Rename a tag, or move it by renaming it to a name below another tag, and
+// keep sharing what the owner shared with it. With merge a tag that already
+// has the new name is merged with it, otherwise that's a problem. problem
+// says what's wrong with the name, if anything.
+func (app *App) renameTagTo(tag Tag, name string, merge bool) (problem string, err error) {
+	name = cleanTagName(name)
+	switch {
+	case name == "":
+		return "Give the tag a name", nil
+	case strings.Contains(name, ","):
+		return "Tag names can't have commas in them", nil
+	case name == tag.Name:
+		return "", nil
+	case tagUnder(name, tag.Name):
+		return "A tag can't go below itself", nil
+	}
+	if !merge {
+		library, err := libraryTags(app.store, tag.UserID, tag.WorkspaceID)
+		if err != nil {
+			return "", err
+		}
+		for _, other := range library {
+			if other.Name == name {
+				return fmt.Sprintf("There's already a tag called %s, merge them instead", name), nil
+			}
+		}
+	}
+
+	if err := app.store.RenameTag(tag.ID, name); err != nil {
+		return "", err
+	}
+	if tag.WorkspaceID != 0 {
+		return "", nil
+	}
+	return "", app.updateTagShares(tag.UserID, func(shared string) string {
+		return movedTagName(shared, tag.Name, name)
+	})
+}
+
+// Merge a tag into another tag of the same library: its links get the
+// other tag, and the tags below it go below the other tag
+func (app *App) mergeTagInto(tag, into Tag) (problem string, err error) {
+	switch {
+	case !into.inLibrary(tag.UserID, tag.WorkspaceID):
+		return "Tags can only be merged with tags of the same library", nil
+	case tag.ID == into.ID:
+		return "", nil
+	case tagUnder(into.Name, tag.Name):
+		return "A tag can't be merged into a tag below it", nil
+	}
+	return app.renameTagTo(tag, into.Name, true)
+}
+
+// Delete a tag, the tags below it move up a level. Tag shares follow the
+// tags that moved, shares of the tag itself are revoked.
+func (app *App) removeTag(tag Tag) error {
+	if err := app.store.DeleteTag(tag.ID); err != nil {
+		return err
+	}
+	if tag.WorkspaceID != 0 {
+		return nil
+	}
+	return app.updateTagShares(tag.UserID, func(shared string) string {
+		switch {
+		case shared == tag.Name:
+			return ""
+		case tagUnder(shared, tag.Name):
+			return movedUpTagName(shared, tag.Name)
+		}
+		return shared
+	})
+}
+
+// Delete the tags of a library no link has, and that have no tags below
+// them that a link has. Returns how many were deleted.
+func (app *App) removeUnusedTags(userID, workspaceID int) (int, error) {
+	tags, err := libraryTags(app.store, userID, workspaceID)
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	for _, tag := range unusedTags(tags) {
+		if err := app.store.DeleteTag(tag.ID); err != nil && !errors.Is(err, ErrTagNotFound) {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+// Keep sharing the same links after tags were renamed. rename gives the
+// new name of a shared tag, "" to stop sharing it.
+func (app *App) updateTagShares(ownerID int, rename func(string) string) error {
+	shares, err := app.store.GetSharesByOwner(ownerID)
+	if err != nil {
+		return err
+	}
+	for _, share := range shares {
+		if share.Tag == "" {
+			continue
+		}
+		renamed := rename(share.Tag)
+		if renamed == share.Tag {
+			continue
+		}
+		if renamed != "" {
+			moved := share
+			moved.ID = 0
+			moved.Tag = renamed
+			if err := app.store.SaveShare(&moved); err != nil {
+				return err
+			}
+		}
+		if err := app.store.DeleteShare(share.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Show the tags of a library with how many links have them, the user's
+// own or a workspace's with ?workspace=
+func (app *App) tagsPage(c *gin.Context) {
+	workspaceID, _ := strconv.Atoi(c.Query("workspace"))
+	data := gin.H{}
+	if removed := c.Query("removed"); removed != "" {
+		data["removed"] = removed
+	}
+	app.renderTags(c, http.StatusOK, workspaceID, data)
+}
+
+func (app *App) renderTags(c *gin.Context, code int, workspaceID int, data gin.H) {
+	userID := sessions.Default(c).Get("user_id").(int)
+	canManage := true
+	if workspaceID != 0 {
+		workspace, err := app.store.GetWorkspace(workspaceID)
+		role := ""
+		if err == nil {
+			role, err = app.workspaceRole(workspaceID, userID)
+		}
+		if err != nil || role == "" {
+			render(c, http.StatusNotFound, "error.html", gin.H{
+				"error": "Workspace not found",
+			})
+			return
+		}
+		data["workspace"] = workspace
+		canManage = roleAtLeast(role, RoleEditor)
+	}
+
+	tags, err := libraryTags(app.store, userID, workspaceID)
+	if err != nil {
+		render(c, http.StatusInternalServerError, "error.html", gin.H{
+			"error": "Error loading the tags",
+		})
+		return
+	}
+
+	data["title"] = "Tags"
+	data["canManage"] = canManage
+	data["tags"] = flattenTagTree(tagTree(tags, ""))
+	data["unusedCount"] = len(unusedTags(tags))
+	data["basePath"] = libraryPath(workspaceID)
+	data["listPath"] = tagsPath(workspaceID)
+	render(c, code, "tags.html", data)
+}
+
+// Load the tag named in the URL and check the user may change it, returns
+// false (after sending the error) if not
+func (app *App) loadTag(c *gin.Context) (Tag, bool) {
+	userID := sessions.Default(c).Get("user_id").(int)
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		render(c, http.StatusBadRequest, "error.html", gin.H{
+			"error": "Invalid tag ID",
+		})
+		return Tag{}, false
+	}
+
+	tag, err := app.store.GetTag(id)
+	access := accessNone
+	if err == nil {
+		access, err = app.tagAccess(tag, userID)
+	}
+	if err != nil || access < accessRead {
+		render(c, http.StatusNotFound, "error.html", gin.H{
+			"error": "Tag not found",
+		})
+		return Tag{}, false
+	}
+	if access < accessManage {
+		render(c, http.StatusForbidden, "error.html", gin.H{
+			"error": "You don't have permission to change the tags of this workspace",
+		})
+		return Tag{}, false
+	}
+	return tag, true
+}
+
+// Rename a tag, the tags below it keep their place below it
+func (app *App) renameTag(c *gin.Context) {
+	tag, ok := app.loadTag(c)
+	if !ok {
+		return
+	}
+	problem, err := app.renameTagTo(tag, c.PostForm("name"), false)
+	if err != nil {
+		render(c, http.StatusInternalServerError, "error.html", gin.H{
+			"error": "Error renaming the tag",
+		})
+		return
+	}
+	if problem != "" {
+		app.renderTags(c, http.StatusBadRequest, tag.WorkspaceID, gin.H{"error": problem})
+		return
+	}
+	c.Redirect(http.StatusFound, tagsPath(tag.WorkspaceID))
+}
+
+// Delete a tag, or with reassign_to hand its links to another tag first
+func (app *App) deleteTag(c *gin.Context) {
+	tag, ok := app.loadTag(c)
+	if !ok {
+		return
+	}
+
+	intoID, _ := strconv.Atoi(c.PostForm("reassign_to"))
+	if intoID == 0 {
+		if err := app.removeTag(tag); err != nil {
+			render(c, http.StatusInternalServerError, "error.html", gin.H{
+				"error": "Error deleting the tag",
+			})
+			return
+		}
+		c.Redirect(http.StatusFound, tagsPath(tag.WorkspaceID))
+		return
+	}
+
+	into, err := app.store.GetTag(intoID)
+	if err != nil {
+		app.renderTags(c, http.StatusBadRequest, tag.WorkspaceID, gin.H{"error": "Pick a tag to give the links to"})
+		return
+	}
+	app.finishMerge(c, tag.WorkspaceID, []Tag{tag}, into)
+}
+
+// Merge the tags picked on the tags page (tag_id) into another one (into)
+func (app *App) mergeTags(c *gin.Context) {
+	userID := sessions.Default(c).Get("user_id").(int)
+	workspaceID, _ := strconv.Atoi(c.PostForm("workspace_id"))
+	if ok, err := app.canAddLinks(workspaceID, userID); err != nil || !ok {
+		render(c, http.StatusForbidden, "error.html", gin.H{
+			"error": "You don't have permission to change the tags of this workspace",
+		})
+		return
+	}
+
+	intoID, _ := strconv.Atoi(c.PostForm("into"))
+	into, err := app.store.GetTag(intoID)
+	if err != nil || !into.inLibrary(userID, workspaceID) {
+		app.renderTags(c, http.StatusBadRequest, workspaceID, gin.H{"error": "Pick the tag to merge them into"})
+		return
+	}
+	var tags []Tag
+	for _, value := range c.PostFormArray("tag_id") {
+		id, _ := strconv.Atoi(value)
+		tag, err := app.store.GetTag(id)
+		if err != nil || !tag.inLibrary(userID, workspaceID) {
+			app.renderTags(c, http.StatusBadRequest, workspaceID, gin.H{"error": "Pick the tags to merge"})
+			return
+		}
+		tags = append(tags, tag)
+	}
+	if len(tags) == 0 {
+		app.renderTags(c, http.StatusBadRequest, workspaceID, gin.H{"error": "Pick the tags to merge"})
+		return
+	}
+	app.finishMerge(c, workspaceID, tags, into)
+}
+
+// Merge tags of a library into another one and go back to the tags page
+func (app *App) finishMerge(c *gin.Context, workspaceID int, tags []Tag, into Tag) {
+	for _, tag := range tags {
+		// Merging a tag above this one may have merged it already
+		tag, err := app.store.GetTag(tag.ID)
+		if errors.Is(err, ErrTagNotFound) {
+			continue
+		}
+		problem := ""
+		if err == nil {
+			problem, err = app.mergeTagInto(tag, into)
+		}
+		if err != nil {
+			render(c, http.StatusInternalServerError, "error.html", gin.H{
+				"error": "Error merging the tags",
+			})
+			return
+		}
+		if problem != "" {
+			app.renderTags(c, http.StatusBadRequest, workspaceID, gin.H{"error": problem})
+			return
+		}
+	}
+	c.Redirect(http.StatusFound, tagsPath(workspaceID))
+}
+
+// Delete the tags no link has anymore
+func (app *App) cleanUpTags(c *gin.Context) {
+	userID := sessions.Default(c).Get("user_id").(int)
+	workspaceID, _ := strconv.Atoi(c.PostForm("workspace_id"))
+	if ok, err := app.canAddLinks(workspaceID, userID); err != nil || !ok {
+		render(c, http.StatusForbidden, "error.html", gin.H{
+			"error": "You don't have permission to change the tags of this workspace",
+		})
+		return
+	}
+
+	removed, err := app.removeUnusedTags(userID, workspaceID)
+	if err != nil {
+		render(c, http.StatusInternalServerError, "error.html", gin.H{
+			"error": "Error deleting the unused tags",
+		})
+		return
+	}
+	next := tagsPath(workspaceID) + "?"
+	if workspaceID != 0 {
+		next = tagsPath(workspaceID) + "&"
+	}
+	c.Redirect(http.StatusFound, next+"removed="+strconv.Itoa(removed))
+}
+
+// Move a tag, and the tags below it, under another tag or to the top. This
+// changes the tags of all the links in the user's library or in a
+// workspace, and what the user shared by tag.
+func (app *App) moveTag(c *gin.Context) {
+	userID := sessions.Default(c).Get("user_id").(int)
+	workspaceID, _ := strconv.Atoi(c.PostForm("workspace_id"))
+	if ok, err := app.canAddLinks(workspaceID, userID); err != nil || !ok {
+		render(c, http.StatusForbidden, "error.html", gin.H{
+			"error": "You don't have permission to change the tags of this workspace",
+		})
+		return
+	}
+
+	from := cleanTagName(c.PostForm("tag"))
+	parent := cleanTagName(c.PostForm("parent"))
+	if from == "" {
+		render(c, http.StatusBadRequest, "error.html", gin.H{
+			"error": "Pick a tag to move",
+		})
+		return
+	}
+	to := joinTagName(parent, tagLabel(from))
+
+	tags, err := libraryTags(app.store, userID, workspaceID)
+	if err != nil {
+		render(c, http.StatusInternalServerError, "error.html", gin.H{
+			"error": "Error loading the tags",
+		})
+		return
+	}
+	var tag Tag
+	for _, other := range tags {
+		if other.Name == from {
+			tag = other
+		}
+	}
+	if tag.ID == 0 {
+		render(c, http.StatusNotFound, "error.html", gin.H{
+			"error": "There's no tag called " + from,
+		})
+		return
+	}
+
+	problem, err := app.renameTagTo(tag, to, true)
+	if err != nil {
+		render(c, http.StatusInternalServerError, "error.html", gin.H{
+			"error": "Error moving the tag",
+		})
+		return
+	}
+	if problem != "" {
+		render(c, http.StatusBadRequest, "error.html", gin.H{
+			"error": problem,
+		})
+		return
+	}
+	c.Redirect(http.StatusFound, libraryPath(workspaceID)+"?tag="+url.QueryEscape(to))
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+
+	"golang.org/x/net/idna"
+)
+
+// The same page can be saved under lots of addresses: http or https, with
+// or without www, with utm_* parameters, with or without a trailing slash.
+// NormalizeURL cleans up the address we store, DuplicateKey goes a step
+// further and gives every spelling of the same page the same key, so we can
+// tell when a link was saved before.
+
+// ErrInvalidURL means something isn't an http or https address
+var ErrInvalidURL = errors.New("not a web address")
+
+// Query parameters that only say where a visitor came from. A name ending in
+// "*" matches every parameter starting with it. Rules with a host only apply
+// to that site and its subdomains.
+var trackingParams = []struct {
+	host  string
+	param string
+}{
+	// Campaign tags (Google Analytics, Matomo, Piwik)
+	{"", "utm_*"}, {"", "mtm_*"}, {"", "pk_*"}, {"", "_ga"}, {"", "_gl"},
+	// Ad click IDs
+	{"", "fbclid"}, {"", "gclid"}, {"", "dclid"}, {"", "gbraid"}, {"", "wbraid"},
+	{"", "msclkid"}, {"", "yclid"}, {"", "twclid"}, {"", "ttclid"}, {"", "li_fat_id"},
+	// Newsletters and marketing automation
+	{"", "mc_cid"}, {"", "mc_eid"}, {"", "_hsenc"}, {"", "_hsmi"}, {"", "mkt_tok"},
+	{"", "oly_anon_id"}, {"", "oly_enc_id"}, {"", "vero_id"}, {"", "igshid"},
+	// Share buttons of a few big sites
+	{"youtube.com", "si"}, {"youtube.com", "feature"}, {"youtu.be", "si"},
+	{"twitter.com", "s"}, {"twitter.com", "t"}, {"x.com", "s"}, {"x.com", "t"},
+	{"instagram.com", "igsh"}, {"linkedin.com", "trk"}, {"medium.com", "source"},
+}
+
+// NormalizeURL cleans up an address before it's saved. It lowercases the
+// scheme and host, turns international domain names into punycode, drops
+// default ports, tracking parameters and empty or text-highlight fragments,
+// and resolves "." and ".." in the path. Addresses without a scheme get
+// https://.
+func NormalizeURL(raw string) (string, error) {
+	raw = strings.TrimSpace(raw)
+	if !strings.Contains(raw, "://") && !hasScheme(raw) {
+		raw = "https://" + raw
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", ErrInvalidURL
+	}
+	u.Scheme = strings.ToLower(u.Scheme)
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return "", ErrInvalidURL
+	}
+
+	host := strings.TrimSuffix(strings.ToLower(u.Hostname()), ".")
+	if host == "" {
+		return "", ErrInvalidURL
+	}
+	if net.ParseIP(host) == nil {
+		// Leave names that aren't valid domain names (underscores and
+		// such) alone rather than refusing them
+		if ascii, err := idna.Lookup.ToASCII(host); err == nil {
+			host = ascii
+		}
+	} else if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	port := u.Port()
+	if (u.Scheme == "http" && port == "80") || (u.Scheme == "https" && port == "443") {
+		port = ""
+	}
+	u.Host = host
+	if port != "" {
+		u.Host += ":" + port
+	}
+
+	if cleaned := cleanPath(u.Path); cleaned != u.Path {
+		u.Path = cleaned
+		u.RawPath = ""
+	}
+	u.RawQuery = stripTrackingParams(host, u.RawQuery)
+	u.ForceQuery = false
+
+	// "#:~:text=..." only highlights a bit of the page
+	fragment := u.Fragment
+	if i := strings.Index(fragment, ":~:"); i >= 0 {
+		fragment = fragment[:i]
+	}
+	u.Fragment = fragment
+	u.RawFragment = ""
+
+	return u.String(), nil
+}
+
+// DuplicateKey returns the same string for addresses that are most likely
+// the same page: on top of NormalizeURL it ignores http vs https, a leading
+// "www.", a trailing slash, the order of query parameters and fragments
+// (except "#!" and "#/" routes of single page apps). Addresses that aren't
+// web addresses, like links replaced with an archived copy, are their own
+// key.
+func DuplicateKey(raw string) string {
+	normalized, err := NormalizeURL(raw)
+	if err != nil {
+		return strings.TrimSpace(raw)
+	}
+	u, err := url.Parse(normalized)
+	if err != nil {
+		return normalized
+	}
+
+	key := strings.TrimPrefix(u.Host, "www.") + strings.TrimSuffix(u.EscapedPath(), "/")
+	if u.RawQuery != "" {
+		params := strings.Split(u.RawQuery, "&")
+		sort.Strings(params)
+		key += "?" + strings.Join(params, "&")
+	}
+	if strings.HasPrefix(u.Fragment, "!") || strings.HasPrefix(u.Fragment, "/") {
+		key += "#" + u.Fragment
+	}
+	return key
+}
+
+// SiteOf returns the site an address is on: its host without a leading
+// "www." or a port, so www.github.com and github.com:443 are both
+// github.com. Addresses that aren't web addresses have no site ("").
+func SiteOf(raw string) string {
+	normalized, err := NormalizeURL(raw)
+	if err != nil {
+		return ""
+	}
+	u, err := url.Parse(normalized)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimPrefix(u.Hostname(), "www.")
+}
+
+// Whether raw starts with a scheme like "mailto:", as opposed to a host
+// name with a port like "example.com:8080"
+func hasScheme(raw string) bool {
+	scheme, rest, found := strings.Cut(raw, ":")
+	if !found || scheme == "" || strings.ContainsAny(scheme, "/?#") {
+		return false
+	}
+	return rest == "" || rest[0] < '0' || rest[0] > '9'
+}
+
+// Resolve "." and ".." segments, keeping a trailing slash. Paths without
+// them are left as they are, path.Clean would also squash double slashes.
+func cleanPath(p string) string {
+	if p == "" {
+		return "/"
+	}
+	dots := false
+	for _, segment := range strings.Split(p, "/") {
+		if segment == "." || segment == ".." {
+			dots = true
+			break
+		}
+	}
+	if !dots {
+		return p
+	}
+	cleaned := path.Clean(p)
+	if strings.HasSuffix(p, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+	return cleaned
+}
+
+// Drop tracking parameters from a raw query, keeping the rest as they were
+func stripTrackingParams(host, rawQuery string) string {
+	var kept []string
+	for _, param := range strings.Split(rawQuery, "&") {
+		if param == "" {
+			continue
+		}
+		name, _, _ := strings.Cut(param, "=")
+		if unescaped, err := url.QueryUnescape(name); err == nil {
+			name = unescaped
+		}
+		if !trackingParam(host, strings.ToLower(name)) {
+			kept = append(kept, param)
+		}
+	}
+	return strings.Join(kept, "&")
+}
+
+// Whether a query parameter on host is one of trackingParams
+func trackingParam(host, name string) bool {
+	for _, rule := range trackingParams {
+		if rule.host != "" && host != rule.host && !strings.HasSuffix(host, "."+rule.host) {
+			continue
+		}
+		if prefix, ok := strings.CutSuffix(rule.param, "*"); ok {
+			if strings.HasPrefix(name, prefix) {
+				return true
+			}
+		} else if name == rule.param {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestNormalizeURL(t *testing.T) {
+	for raw, want := range map[string]string{
+		// No scheme, or one we don't save
+		"example.com/page":              "https://example.com/page",
+		"  HTTP://Example.COM/Path  ":   "http://example.com/Path",
+		"example.com:8080/x":            "https://example.com:8080/x",
+		"localhost:3000":                "https://localhost:3000/",
+		"mailto:alice@example.com":      "",
+		"javascript:alert(1)":           "",
+		"ftp://example.com/file":        "",
+		"https://":                      "",
+		"":                              "",
+		"data:text/html,<b>hi</b>":      "",
+		"tel:+15551234":                 "",
+		"news:comp.lang.go":             "",
+		"example.com:https":             "",
+		"https://example.com:443/":      "https://example.com/",
+		"http://example.com:80/a":       "http://example.com/a",
+		"http://example.com:443/":       "http://example.com:443/",
+		"https://example.com:80/":       "https://example.com:80/",
+		"https://example.com.":          "https://example.com/",
+		"https://Bücher.example/Straße": "https://xn--bcher-kva.example/Stra%C3%9Fe",
+		"https://my_host.example/":      "https://my_host.example/",
+		"https://[::1]:8080/x":          "https://[::1]:8080/x",
+		"https://[2001:DB8::1]:443/":    "https://[2001:db8::1]/",
+		"http://192.168.0.1:80":         "http://192.168.0.1/",
+
+		// Tracking parameters, some only on the site they belong to
+		"https://example.com/?utm_source=news&id=3&UTM_Medium=mail&fbclid=x": "https://example.com/?id=3",
+		"https://example.com/?utm_campaign":                                  "https://example.com/",
+		"https://example.com/?q=a%26b&gclid=1":                               "https://example.com/?q=a%26b",
+		"https://www.youtube.com/watch?v=abc&si=xyz&feature=share":           "https://www.youtube.com/watch?v=abc",
+		"https://music.youtube.com/watch?v=abc&si=xyz":                       "https://music.youtube.com/watch?v=abc",
+		"https://youtu.be/abc?si=xyz&t=30":                                   "https://youtu.be/abc?t=30",
+		"https://example.com/units?si=metric":                                "https://example.com/units?si=metric",
+		"https://notyoutube.com/?si=1":                                       "https://notyoutube.com/?si=1",
+		"https://x.com/gopher/status/1?s=20&t=abc":                           "https://x.com/gopher/status/1",
+		"https://example.com/?s=search&t=5":                                  "https://example.com/?s=search&t=5",
+
+		// Fragments
+		"https://example.com/page#":                 "https://example.com/page",
+		"https://example.com/page#:~:text=gophers":  "https://example.com/page",
+		"https://example.com/page#intro:~:text=dig": "https://example.com/page#intro",
+		"https://example.com/page#intro":            "https://example.com/page#intro",
+		"https://example.com/app#!/users/1":         "https://example.com/app#!/users/1",
+
+		// Paths
+		"https://example.com":             "https://example.com/",
+		"https://example.com/a/./b/../c/": "https://example.com/a/c/",
+		"https://example.com/a/b/..":      "https://example.com/a",
+		"https://example.com/../../x":     "https://example.com/x",
+		"https://example.com/a//b":        "https://example.com/a//b",
+		"https://example.com/page?":       "https://example.com/page",
+	} {
+		got, err := NormalizeURL(raw)
+		if want == "" {
+			if !errors.Is(err, ErrInvalidURL) {
+				t.Errorf("NormalizeURL(%q) = %q, %v, want ErrInvalidURL", raw, got, err)
+			}
+			continue
+		}
+		if err != nil || got != want {
+			t.Errorf("NormalizeURL(%q) = %q, %v, want %q", raw, got, err, want)
+		}
+	}
+}
+
+func TestHasScheme(t *testing.T) {
+	for raw, want := range map[string]bool{
+		"mailto:alice@example.com": true,
+		"javascript:alert(1)":      true,
+		"about:":                   true,
+		"example.com:8080":         false,
+		"localhost:3000/path":      false,
+		"example.com/a:b":          false,
+		"example.com?x=a:b":        false,
+		"example.com":              false,
+		":8080":                    false,
+	} {
+		if got := hasScheme(raw); got != want {
+			t.Errorf("hasScheme(%q) = %v, want %v", raw, got, want)
+		}
+	}
+}
+
+func TestDuplicateKey(t *testing.T) {
+	for _, test := range []struct {
+		a, b string
+		same bool
+	}{
+		{"http://www.example.com/page/", "https://example.com/page", true},
+		{"example.com", "https://example.com/?utm_source=news", true},
+		{"https://example.com/?b=2&a=1", "https://example.com/?a=1&b=2", true},
+		{"https://example.com/page#intro", "https://example.com/page", true},
+		{"https://example.com/page#:~:text=dig", "https://example.com/page", true},
+		{"https://Bücher.example/", "https://xn--bcher-kva.example", true},
+		{"https://example.com:443/a", "http://example.com:80/a", true},
+		{"https://www.youtube.com/watch?v=abc&si=1", "https://youtube.com/watch?v=abc", true},
+		{"https://example.com/app#!/users/1", "https://example.com/app#!/users/2", false},
+		{"https://example.com/app#/settings", "https://example.com/app", false},
+		{"https://example.com/a", "https://example.com/b", false},
+		{"https://example.com/a", "https://example.com/A", false},
+		{"https://example.com:8080/", "https://example.com/", false},
+		{"https://example.com/?a=1", "https://example.com/?a=2", false},
+		{"https://blog.example.com/", "https://example.com/", false},
+		{"https://[::1]/", "https://[::1]:443", true},
+		{"mailto:alice@example.com", "mailto:alice@example.com", true},
+		{"mailto:alice@example.com", "mailto:bob@example.com", false},
+	} {
+		if got := DuplicateKey(test.a) == DuplicateKey(test.b); got != test.same {
+			t.Errorf("DuplicateKey(%q) == DuplicateKey(%q): %v, want %v (%q, %q)",
+				test.a, test.b, got, test.same, DuplicateKey(test.a), DuplicateKey(test.b))
+		}
+	}
+}
+
+func TestMergeLinks(t *testing.T) {
+	store := NewMemoryStore()
+	alice := createTestUser(t, store, "alice")
+	into := createTestLink(t, store, Link{URL: "https://go.dev/", Title: "Go", UserID: alice.ID}, "go", "languages")
+	from := createTestLink(t, store, Link{URL: "http://www.go.dev", Title: "The Go site", Description: "Gophers", Favicon: "https://go.dev/favicon.ico", UserID: alice.ID}, "go", "google")
+	if err := store.CreateArchivedPage(&ArchivedPage{LinkID: from.ID, Text: "old copy"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mergeLinks(store, &into, from); err != nil {
+		t.Fatal(err)
+	}
+	got, err := store.GetLinkByID(into.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(got.Tags)
+	want := Link{ID: into.ID, URL: "https://go.dev/", Title: "Go", Description: "Gophers", Favicon: "https://go.dev/favicon.ico", Tags: []string{"go", "google", "languages"}}
+	if got.URL != want.URL || got.Title != want.Title || got.Description != want.Description || got.Favicon != want.Favicon || !reflect.DeepEqual(got.Tags, want.Tags) {
+		t.Errorf("merged link = %+v\nwant %+v", got, want)
+	}
+	if _, err := store.GetLinkByID(from.ID); !errors.Is(err, ErrLinkNotFound) {
+		t.Errorf("the merged away link is still there: %v", err)
+	}
+	if pages, _ := store.GetLinkArchivedPages(from.ID); len(pages) != 0 {
+		t.Errorf("the merged away link's archived copies are still there: %d", len(pages))
+	}
+
+	// Its own description wins, and a link that was never saved isn't
+	// deleted
+	if err := mergeLinks(store, &into, Link{URL: "https://go.dev", Description: "Other", Tags: []string{"new"}}); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := store.GetLinkByID(into.ID); got.Description != "Gophers" || len(got.Tags) != 4 {
+		t.Errorf("after merging an unsaved link = %+v", got)
+	}
+}
+
+func TestDedupeCommand(t *testing.T) {
+	config := LoadConfig()
+	config.DBDriver = "sqlite"
+	config.DBPath = filepath.Join(t.TempDir(), "links.db")
+	store, err := openStore(config, NewPasswordHasher(config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice := createTestUser(t, store, "alice")
+	bob := createTestUser(t, store, "bob")
+	day := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+	oldest := createTestLink(t, store, Link{URL: "http://www.go.dev/?utm_source=x", Title: "Go", UserID: alice.ID, CreatedAt: day}, "go")
+	createTestLink(t, store, Link{URL: "https://go.dev", Title: "Go again", UserID: alice.ID, CreatedAt: day.Add(time.Hour)}, "gophers")
+	createTestLink(t, store, Link{URL: "https://go.dev/#:~:text=go", Title: "And again", UserID: alice.ID, CreatedAt: day.Add(2 * time.Hour)})
+	createTestLink(t, store, Link{URL: "https://example.com/", Title: "Other", UserID: alice.ID, CreatedAt: day})
+	createTestLink(t, store, Link{URL: "https://go.dev/", Title: "Bob's", UserID: bob.ID, CreatedAt: day})
+
+	// Duplicates in a workspace are merged once, whoever saved them, and
+	// never with someone's personal links
+	team := createTestWorkspace(t, store, "Team", alice, map[int]string{bob.ID: RoleEditor})
+	teamLink := createTestLink(t, store, Link{URL: "https://go.dev/", Title: "Team Go", UserID: bob.ID, WorkspaceID: team.ID, CreatedAt: day}, "team")
+	createTestLink(t, store, Link{URL: "https://www.go.dev/", Title: "Team Go again", UserID: alice.ID, WorkspaceID: team.ID, CreatedAt: day.Add(time.Hour)}, "go")
+	teamLinks := func() []Link {
+		t.Helper()
+		links, err := store.GetWorkspaceLinks(team.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return links
+	}
+
+	links := func(user User) []Link {
+		t.Helper()
+		links, err := store.GetUserLinks(user.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return links
+	}
+
+	if err := runDedupeCommand(config, []string{"--dry-run"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := links(alice); len(got) != 4 {
+		t.Errorf("--dry-run changed alice's links to %v", linkTitles(got))
+	}
+	if got := teamLinks(); len(got) != 2 {
+		t.Errorf("--dry-run changed the workspace's links to %v", linkTitles(got))
+	}
+	if got, _ := store.GetLinkByID(oldest.ID); got.URL != oldest.URL {
+		t.Errorf("--dry-run cleaned up the URL to %s", got.URL)
+	}
+
+	if err := runDedupeCommand(config, nil); err != nil {
+		t.Fatal(err)
+	}
+	got := links(alice)
+	sort.Slice(got, func(i, j int) bool { return got[i].ID < got[j].ID })
+	if titles := linkTitles(got); !reflect.DeepEqual(titles, []string{"Go", "Other"}) {
+		t.Fatalf("alice's links after dedupe = %v, want the oldest Go link and the other one", titles)
+	}
+	sort.Strings(got[0].Tags)
+	if got[0].URL != "http://www.go.dev/" || !reflect.DeepEqual(got[0].Tags, []string{"go", "gophers"}) {
+		t.Errorf("kept link = %+v, want a cleaned up URL and the tags of both", got[0])
+	}
+	if got := links(bob); len(got) != 1 {
+		t.Errorf("bob's copy of the same page was merged too: %v", linkTitles(got))
+	}
+	got = teamLinks()
+	if len(got) != 1 || got[0].ID != teamLink.ID {
+		t.Fatalf("the workspace's links after dedupe = %v, want only the oldest", linkTitles(got))
+	}
+	sort.Strings(got[0].Tags)
+	if !reflect.DeepEqual(got[0].Tags, []string{"go", "team"}) {
+		t.Errorf("kept workspace link = %+v, want the tags of both", got[0])
+	}
+
+	if err := runDedupeCommand(config, []string{"--force"}); err == nil {
+		t.Error("an unknown option was accepted")
+	}
+}
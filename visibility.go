@@ -0,0 +1,33 @@
+package main
+
+// Who gets to see a link. Private links are only for their owner, unlisted
+// ones for anyone who has the address of the link's page, and public ones
+// are also listed on the home page.
+const (
+	VisibilityPrivate  = "private"
+	VisibilityUnlisted = "unlisted"
+	VisibilityPublic   = "public"
+)
+
+// Visibilities in the order the forms list them
+var visibilities = []string{VisibilityPrivate, VisibilityUnlisted, VisibilityPublic}
+
+// Whether v is one of the visibilities
+func validVisibility(v string) bool {
+	for _, known := range visibilities {
+		if v == known {
+			return true
+		}
+	}
+	return false
+}
+
+// VisibleTo tells whether a user may look at the link. userID is 0 for
+// visitors who aren't logged in. Who's in a workspace is up to
+// linkAccess, saving a link there doesn't keep it visible after leaving.
+func (l Link) VisibleTo(userID int) bool {
+	if userID != 0 && l.WorkspaceID == 0 && l.UserID == userID {
+		return true
+	}
+	return l.Visibility == VisibilityPublic || l.Visibility == VisibilityUnlisted
+}
@@ -0,0 +1,610 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+)
+
+// Workspaces are link libraries a team keeps together. Links saved to a
+// workspace belong to it instead of the person who saved them. Members are
+// owners (they also run the workspace: members, invitations, its name),
+// editors (add, edit and delete links) or viewers. People join by accepting
+// an invitation from an owner. What that means for single links is worked
+// out in policy.go.
+
+// Workspace is a shared library of links
+type Workspace struct {
+	ID        int       `json:"id"`
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// WorkspaceMember is a user's membership of a workspace
+type WorkspaceMember struct {
+	WorkspaceID int       `json:"workspace_id"`
+	UserID      int       `json:"user_id"`
+	Role        string    `json:"role"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// WorkspaceInvite asks a user to join a workspace
+type WorkspaceInvite struct {
+	ID          int       `json:"id"`
+	WorkspaceID int       `json:"workspace_id"`
+	UserID      int       `json:"user_id"`    // who's invited
+	InvitedBy   int       `json:"invited_by"` // the owner who invited them
+	Role        string    `json:"role"`       // what they'll be once they join
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+const (
+	RoleViewer = "viewer"
+	RoleEditor = "editor"
+	RoleOwner  = "owner"
+)
+
+// Roles from least to most rights
+var workspaceRoles = []string{RoleViewer, RoleEditor, RoleOwner}
+
+// Longest workspace name we accept
+const maxWorkspaceNameLength = 100
+
+// Whether role has at least the rights of min. Not being a member ("")
+// never does.
+func roleAtLeast(role, min string) bool {
+	rank := func(role string) int {
+		for i, r := range workspaceRoles {
+			if r == role {
+				return i + 1
+			}
+		}
+		return 0
+	}
+	return rank(role) > 0 && rank(role) >= rank(min)
+}
+
+func validRole(role string) bool {
+	return roleAtLeast(role, RoleViewer)
+}
+
+// Where the links of a library are listed: the dashboard for personal
+// links, the workspace's page for a workspace
+func libraryPath(workspaceID int) string {
+	if workspaceID != 0 {
+		return fmt.Sprintf("/workspaces/%d", workspaceID)
+	}
+	return "/dashboard"
+}
+
+// Load the workspace named in the URL and check the user has at least the
+// given role in it, returns false (after sending the error) if not
+func (app *App) memberWorkspace(c *gin.Context, min string) (Workspace, string, bool) {
+	userID := sessions.Default(c).Get("user_id").(int)
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		render(c, http.StatusBadRequest, "error.html", gin.H{
+			"error": "Invalid workspace ID",
+		})
+		return Workspace{}, "", false
+	}
+
+	// Workspaces someone isn't in don't exist as far as they know
+	workspace, err := app.store.GetWorkspace(id)
+	role := ""
+	if err == nil {
+		role, err = app.workspaceRole(id, userID)
+	}
+	if err != nil || role == "" {
+		render(c, http.StatusNotFound, "error.html", gin.H{
+			"error": "Workspace not found",
+		})
+		return Workspace{}, "", false
+	}
+	if !roleAtLeast(role, min) {
+		render(c, http.StatusForbidden, "error.html", gin.H{
+			"error": "Only " + min + "s of the workspace can do that",
+		})
+		return Workspace{}, "", false
+	}
+	return workspace, role, true
+}
+
+// A workspace with the user's role in it, for the workspaces page and the
+// add link form
+type membershipView struct {
+	Workspace
+	Role string
+}
+
+// Load the workspaces a user is in, in the order they joined
+func (app *App) userWorkspaces(userID int) ([]membershipView, error) {
+	memberships, err := app.store.GetUserMemberships(userID)
+	if err != nil {
+		return nil, err
+	}
+	views := make([]membershipView, 0, len(memberships))
+	for _, membership := range memberships {
+		workspace, err := app.store.GetWorkspace(membership.WorkspaceID)
+		if err != nil {
+			return nil, err
+		}
+		views = append(views, membershipView{Workspace: workspace, Role: membership.Role})
+	}
+	return views, nil
+}
+
+// An invitation with the names that go with it
+type inviteView struct {
+	WorkspaceInvite
+	WorkspaceName string
+	Username      string
+	InvitedByName string
+}
+
+func (app *App) describeInvites(invites []WorkspaceInvite) []inviteView {
+	views := make([]inviteView, 0, len(invites))
+	for _, invite := range invites {
+		view := inviteView{WorkspaceInvite: invite}
+		if workspace, err := app.store.GetWorkspace(invite.WorkspaceID); err == nil {
+			view.WorkspaceName = workspace.Name
+		}
+		if user, err := app.store.GetUserByID(invite.UserID); err == nil {
+			view.Username = user.Username
+		}
+		if user, err := app.store.GetUserByID(invite.InvitedBy); err == nil {
+			view.InvitedByName = user.Username
+		}
+		views = append(views, view)
+	}
+	return views
+}
+
+// Show the user's workspaces and invitations, with a form for a new one
+func (app *App) workspacesPage(c *gin.Context) {
+	app.renderWorkspaces(c, http.StatusOK, gin.H{})
+}
+
+func (app *App) renderWorkspaces(c *gin.Context, code int, data gin.H) {
+	userID := sessions.Default(c).Get("user_id").(int)
+	workspaces, err := app.userWorkspaces(userID)
+	if err != nil {
+		render(c, http.StatusInternalServerError, "error.html", gin.H{
+			"error": "Error loading your workspaces",
+		})
+		return
+	}
+	invites, err := app.store.GetUserWorkspaceInvites(userID)
+	if err != nil {
+		render(c, http.StatusInternalServerError, "error.html", gin.H{
+			"error": "Error loading your invitations",
+		})
+		return
+	}
+
+	data["title"] = "Workspaces"
+	data["workspaces"] = workspaces
+	data["invites"] = app.describeInvites(invites)
+	render(c, code, "workspaces.html", data)
+}
+
+// Check a workspace name from a form, problem says what's wrong with it
+func workspaceName(c *gin.Context) (name string, problem string) {
+	name = strings.TrimSpace(c.PostForm("name"))
+	switch {
+	case name == "":
+		return "", "Give the workspace a name"
+	case len(name) > maxWorkspaceNameLength:
+		return "", fmt.Sprintf("Keep the name under %d characters", maxWorkspaceNameLength)
+	}
+	return name, ""
+}
+
+// Start a new workspace, with the user as its owner
+func (app *App) createWorkspace(c *gin.Context) {
+	userID := sessions.Default(c).Get("user_id").(int)
+	name, problem := workspaceName(c)
+	if problem != "" {
+		app.renderWorkspaces(c, http.StatusBadRequest, gin.H{"error": problem})
+		return
+	}
+
+	workspace := &Workspace{Name: name}
+	if err := app.store.CreateWorkspace(workspace, userID); err != nil {
+		render(c, http.StatusInternalServerError, "error.html", gin.H{
+			"error": "Error creating the workspace",
+		})
+		return
+	}
+	c.Redirect(http.StatusFound, fmt.Sprintf("/workspaces/%d", workspace.ID))
+}
+
+// The workspace's dashboard
+func (app *App) workspacePage(c *gin.Context) {
+	workspace, role, ok := app.memberWorkspace(c, RoleViewer)
+	if !ok {
+		return
+	}
+	links, err := app.store.GetWorkspaceLinks(workspace.ID)
+	if err != nil {
+		render(c, http.StatusInternalServerError, "error.html", gin.H{
+			"error": "Error loading the workspace's links",
+		})
+		return
+	}
+	tags, err := app.store.GetWorkspaceTags(workspace.ID)
+	if err != nil {
+		render(c, http.StatusInternalServerError, "error.html", gin.H{
+			"error": "Error loading the workspace's tags",
+		})
+		return
+	}
+
+	app.renderDashboard(c, links, gin.H{
+		"title":      workspace.Name,
+		"workspace":  workspace,
+		"role":       role,
+		"canManage":  roleAtLeast(role, RoleEditor),
+		"basePath":   libraryPath(workspace.ID),
+		"tags":       tags,
+		"searchPath": fmt.Sprintf("/workspaces/%d/search", workspace.ID),
+	})
+}
+
+// Search the workspace's links
+func (app *App) searchWorkspace(c *gin.Context) {
+	workspace, role, ok := app.memberWorkspace(c, RoleViewer)
+	if !ok {
+		return
+	}
+	data := gin.H{
+		"title":      "Search " + workspace.Name,
+		"workspace":  workspace,
+		"canManage":  roleAtLeast(role, RoleEditor),
+		"searchPath": fmt.Sprintf("/workspaces/%d/search", workspace.ID),
+	}
+
+	query := c.Query("q")
+	if query != "" {
+		links, err := app.store.SearchWorkspaceLinks(workspace.ID, query)
+		if err != nil {
+			render(c, http.StatusInternalServerError, "error.html", gin.H{
+				"error": "Error searching links",
+			})
+			return
+		}
+		data["title"] = "Search Results"
+		data["query"] = query
+		data["links"] = links
+	}
+	render(c, http.StatusOK, "search.html", data)
+}
+
+// A member with their name, for the members page
+type memberView struct {
+	WorkspaceMember
+	Username string
+}
+
+// Show the members and invitations of a workspace. Everyone in it can see
+// who else is, owners also get to change things.
+func (app *App) workspaceMembersPage(c *gin.Context) {
+	workspace, role, ok := app.memberWorkspace(c, RoleViewer)
+	if !ok {
+		return
+	}
+	app.renderWorkspaceMembers(c, http.StatusOK, workspace, role, gin.H{})
+}
+
+func (app *App) renderWorkspaceMembers(c *gin.Context, code int, workspace Workspace, role string, data gin.H) {
+	userID := sessions.Default(c).Get("user_id").(int)
+	members, err := app.store.GetWorkspaceMembers(workspace.ID)
+	if err != nil {
+		render(c, http.StatusInternalServerError, "error.html", gin.H{
+			"error": "Error loading the members",
+		})
+		return
+	}
+	views := make([]memberView, 0, len(members))
+	for _, member := range members {
+		view := memberView{WorkspaceMember: member}
+		if user, err := app.store.GetUserByID(member.UserID); err == nil {
+			view.Username = user.Username
+		}
+		views = append(views, view)
+	}
+
+	var invites []inviteView
+	if role == RoleOwner {
+		pending, err := app.store.GetWorkspaceInvites(workspace.ID)
+		if err != nil {
+			render(c, http.StatusInternalServerError, "error.html", gin.H{
+				"error": "Error loading the invitations",
+			})
+			return
+		}
+		invites = app.describeInvites(pending)
+	}
+
+	data["title"] = workspace.Name + " Members"
+	data["workspace"] = workspace
+	data["role"] = role
+	data["isOwner"] = role == RoleOwner
+	data["userID"] = userID
+	data["members"] = views
+	data["invites"] = invites
+	data["roles"] = workspaceRoles
+	render(c, code, "workspace_members.html", data)
+}
+
+// Invite someone to the workspace
+func (app *App) inviteToWorkspace(c *gin.Context) {
+	workspace, role, ok := app.memberWorkspace(c, RoleOwner)
+	if !ok {
+		return
+	}
+	userID := sessions.Default(c).Get("user_id").(int)
+
+	problem := ""
+	newRole := c.PostForm("role")
+	user, err := app.store.GetUserByUsername(strings.TrimSpace(c.PostForm("username")))
+	switch {
+	case !validRole(newRole):
+		problem = "Pick a role for them"
+	case err != nil:
+		problem = "There's no user with that name"
+	}
+	if problem == "" {
+		existing, err := app.workspaceRole(workspace.ID, user.ID)
+		if err != nil {
+			render(c, http.StatusInternalServerError, "error.html", gin.H{
+				"error": "Error loading the members",
+			})
+			return
+		}
+		if existing != "" {
+			problem = user.Username + " is already a member"
+		}
+	}
+	if problem != "" {
+		app.renderWorkspaceMembers(c, http.StatusBadRequest, workspace, role, gin.H{"error": problem})
+		return
+	}
+
+	invite := &WorkspaceInvite{
+		WorkspaceID: workspace.ID,
+		UserID:      user.ID,
+		InvitedBy:   userID,
+		Role:        newRole,
+		CreatedAt:   time.Now(),
+	}
+	if err := app.store.SaveWorkspaceInvite(invite); err != nil {
+		render(c, http.StatusInternalServerError, "error.html", gin.H{
+			"error": "Error sending the invitation",
+		})
+		return
+	}
+	c.Redirect(http.StatusFound, fmt.Sprintf("/workspaces/%d/members", workspace.ID))
+}
+
+// Load the invitation named in the URL
+func (app *App) loadInvite(c *gin.Context) (WorkspaceInvite, bool) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		render(c, http.StatusBadRequest, "error.html", gin.H{
+			"error": "Invalid invitation ID",
+		})
+		return WorkspaceInvite{}, false
+	}
+	invite, err := app.store.GetWorkspaceInvite(id)
+	if err != nil {
+		render(c, http.StatusNotFound, "error.html", gin.H{
+			"error": "Invitation not found",
+		})
+		return WorkspaceInvite{}, false
+	}
+	return invite, true
+}
+
+// Join a workspace the user was invited to
+func (app *App) acceptInvite(c *gin.Context) {
+	userID := sessions.Default(c).Get("user_id").(int)
+	invite, ok := app.loadInvite(c)
+	if !ok {
+		return
+	}
+	if invite.UserID != userID {
+		render(c, http.StatusNotFound, "error.html", gin.H{
+			"error": "Invitation not found",
+		})
+		return
+	}
+
+	member := &WorkspaceMember{
+		WorkspaceID: invite.WorkspaceID,
+		UserID:      userID,
+		Role:        invite.Role,
+		CreatedAt:   time.Now(),
+	}
+	if err := app.store.SaveWorkspaceMember(member); err != nil {
+		render(c, http.StatusInternalServerError, "error.html", gin.H{
+			"error": "Error joining the workspace",
+		})
+		return
+	}
+	if err := app.store.DeleteWorkspaceInvite(invite.ID); err != nil && !errors.Is(err, ErrInviteNotFound) {
+		fmt.Printf("Could not delete invitation %d: %v\n", invite.ID, err)
+	}
+	c.Redirect(http.StatusFound, fmt.Sprintf("/workspaces/%d", invite.WorkspaceID))
+}
+
+// Turn down an invitation, or take it back if the user is an owner of the
+// workspace
+func (app *App) declineInvite(c *gin.Context) {
+	userID := sessions.Default(c).Get("user_id").(int)
+	invite, ok := app.loadInvite(c)
+	if !ok {
+		return
+	}
+	role, err := app.workspaceRole(invite.WorkspaceID, userID)
+	if err != nil || (invite.UserID != userID && role != RoleOwner) {
+		render(c, http.StatusNotFound, "error.html", gin.H{
+			"error": "Invitation not found",
+		})
+		return
+	}
+
+	if err := app.store.DeleteWorkspaceInvite(invite.ID); err != nil {
+		render(c, http.StatusInternalServerError, "error.html", gin.H{
+			"error": "Error removing the invitation",
+		})
+		return
+	}
+	if invite.UserID == userID {
+		c.Redirect(http.StatusFound, "/workspaces")
+		return
+	}
+	c.Redirect(http.StatusFound, fmt.Sprintf("/workspaces/%d/members", invite.WorkspaceID))
+}
+
+// Load the member named in the URL, and make sure the workspace keeps an
+// owner if they stop being one
+func (app *App) changeableMember(c *gin.Context, workspace Workspace, newRole string) (WorkspaceMember, bool) {
+	userID, err := strconv.Atoi(c.Param("user_id"))
+	if err != nil {
+		render(c, http.StatusBadRequest, "error.html", gin.H{
+			"error": "Invalid user ID",
+		})
+		return WorkspaceMember{}, false
+	}
+	member, err := app.store.GetWorkspaceMember(workspace.ID, userID)
+	if err != nil {
+		render(c, http.StatusNotFound, "error.html", gin.H{
+			"error": "Member not found",
+		})
+		return WorkspaceMember{}, false
+	}
+
+	if member.Role == RoleOwner && newRole != RoleOwner {
+		members, err := app.store.GetWorkspaceMembers(workspace.ID)
+		if err != nil {
+			render(c, http.StatusInternalServerError, "error.html", gin.H{
+				"error": "Error loading the members",
+			})
+			return WorkspaceMember{}, false
+		}
+		owners := 0
+		for _, m := range members {
+			if m.Role == RoleOwner {
+				owners++
+			}
+		}
+		if owners < 2 {
+			render(c, http.StatusBadRequest, "error.html", gin.H{
+				"error": "A workspace needs an owner, make someone else owner first",
+			})
+			return WorkspaceMember{}, false
+		}
+	}
+	return member, true
+}
+
+// Give a member another role
+func (app *App) changeMemberRole(c *gin.Context) {
+	workspace, role, ok := app.memberWorkspace(c, RoleOwner)
+	if !ok {
+		return
+	}
+	newRole := c.PostForm("role")
+	if !validRole(newRole) {
+		app.renderWorkspaceMembers(c, http.StatusBadRequest, workspace, role, gin.H{"error": "Pick a role"})
+		return
+	}
+	member, ok := app.changeableMember(c, workspace, newRole)
+	if !ok {
+		return
+	}
+
+	member.Role = newRole
+	if err := app.store.SaveWorkspaceMember(&member); err != nil {
+		render(c, http.StatusInternalServerError, "error.html", gin.H{
+			"error": "Error changing the role",
+		})
+		return
+	}
+	c.Redirect(http.StatusFound, fmt.Sprintf("/workspaces/%d/members", workspace.ID))
+}
+
+// Remove someone from the workspace. Owners can remove anyone, everyone
+// can remove themselves. The links they saved stay in the workspace.
+func (app *App) removeMember(c *gin.Context) {
+	workspace, role, ok := app.memberWorkspace(c, RoleViewer)
+	if !ok {
+		return
+	}
+	userID := sessions.Default(c).Get("user_id").(int)
+	if c.Param("user_id") != strconv.Itoa(userID) && role != RoleOwner {
+		render(c, http.StatusForbidden, "error.html", gin.H{
+			"error": "Only owners of the workspace can do that",
+		})
+		return
+	}
+	member, ok := app.changeableMember(c, workspace, "")
+	if !ok {
+		return
+	}
+
+	if err := app.store.RemoveWorkspaceMember(workspace.ID, member.UserID); err != nil {
+		render(c, http.StatusInternalServerError, "error.html", gin.H{
+			"error": "Error removing the member",
+		})
+		return
+	}
+	if member.UserID == userID {
+		c.Redirect(http.StatusFound, "/workspaces")
+		return
+	}
+	c.Redirect(http.StatusFound, fmt.Sprintf("/workspaces/%d/members", workspace.ID))
+}
+
+// Rename the workspace
+func (app *App) renameWorkspace(c *gin.Context) {
+	workspace, role, ok := app.memberWorkspace(c, RoleOwner)
+	if !ok {
+		return
+	}
+	name, problem := workspaceName(c)
+	if problem != "" {
+		app.renderWorkspaceMembers(c, http.StatusBadRequest, workspace, role, gin.H{"error": problem})
+		return
+	}
+
+	if err := app.store.RenameWorkspace(workspace.ID, name); err != nil {
+		render(c, http.StatusInternalServerError, "error.html", gin.H{
+			"error": "Error renaming the workspace",
+		})
+		return
+	}
+	c.Redirect(http.StatusFound, fmt.Sprintf("/workspaces/%d/members", workspace.ID))
+}
+
+// Delete the workspace and all of its links
+func (app *App) deleteWorkspace(c *gin.Context) {
+	workspace, _, ok := app.memberWorkspace(c, RoleOwner)
+	if !ok {
+		return
+	}
+	if err := app.store.DeleteWorkspace(workspace.ID); err != nil {
+		render(c, http.StatusInternalServerError, "error.html", gin.H{
+			"error": "Error deleting the workspace",
+		})
+		return
+	}
+	c.Redirect(http.StatusFound, "/workspaces")
+}